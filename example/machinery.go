@@ -8,6 +8,7 @@ import (
 
 	"github.com/Guazi-inc/machinery/example/tasks"
 	"github.com/Guazi-inc/machinery/v1"
+	"github.com/Guazi-inc/machinery/v1/admin"
 	"github.com/Guazi-inc/machinery/v1/config"
 	"github.com/Guazi-inc/machinery/v1/log"
 	"github.com/Guazi-inc/machinery/v1/tasks"
@@ -23,7 +24,7 @@ func init() {
 	// Initialise a CLI app
 	app = cli.NewApp()
 	app.Name = "machinery"
-	app.Usage = "machinery worker and send example tasks with machinery send"
+	app.Usage = "machinery worker, send example tasks with machinery send and manage queues with machinery admin"
 	app.Author = "Richard Knop"
 	app.Email = "risoknop@gmail.com"
 	app.Version = "0.0.0"
@@ -60,6 +61,7 @@ func main() {
 				return nil
 			},
 		},
+		admin.Command(loadConfig),
 	}
 
 	// Run the CLI app
@@ -0,0 +1,474 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+)
+
+// ErrNotSupported is returned when the broker cannot carry out the operation
+var ErrNotSupported = brokers.ErrNotSupported
+
+// Admin inspects and manipulates tasks in a queue of the server, the default
+// queue unless another one is set, results are written to out either as
+// tables or as JSON
+type Admin struct {
+	server *machinery.Server
+	out    io.Writer
+	json   bool
+	// Queue to work with, empty for the default queue
+	queueName string
+}
+
+// QueueCount is the number of tasks in a queue, pending and delayed tasks are
+// left out if the broker cannot count them
+type QueueCount struct {
+	Queue       string `json:"queue"`
+	Pending     *int   `json:"pending,omitempty"`
+	Delayed     *int   `json:"delayed,omitempty"`
+	DeadLetters int    `json:"dead_letters"`
+}
+
+// Result is the outcome of an operation on a task or a queue
+type Result struct {
+	UUID  string `json:"uuid,omitempty"`
+	Queue string `json:"queue,omitempty"`
+	// Count is the number of tasks the operation has affected
+	Count int    `json:"count"`
+	Error string `json:"error,omitempty"`
+}
+
+// New creates Admin instance, JSON is written instead of tables if
+// jsonOutput is true
+func New(server *machinery.Server, out io.Writer, jsonOutput bool) *Admin {
+	return &Admin{server: server, out: out, json: jsonOutput}
+}
+
+// SetQueue sets the queue to work with, the default queue is used if queue
+// is empty
+func (admin *Admin) SetQueue(queue string) {
+	admin.queueName = queue
+}
+
+// queue returns the queue the admin works with
+func (admin *Admin) queue() string {
+	if admin.queueName != "" {
+		return admin.queueName
+	}
+	return admin.server.GetConfig().DefaultQueue
+}
+
+// inspector returns the broker if it can inspect a single queue
+func (admin *Admin) inspector() (brokers.QueueInspector, error) {
+	inspector, ok := admin.server.GetBroker().(brokers.QueueInspector)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return inspector, nil
+}
+
+// manager returns the broker if it can manipulate tasks in a queue
+func (admin *Admin) manager() (brokers.QueueManager, error) {
+	manager, ok := admin.server.GetBroker().(brokers.QueueManager)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return manager, nil
+}
+
+// Count writes the number of pending and delayed tasks and dead letters,
+// tasks the broker cannot count are left out
+func (admin *Admin) Count() error {
+	count := &QueueCount{Queue: admin.queue()}
+
+	if inspector, err := admin.inspector(); err == nil {
+		if count.Pending, err = countTasks(inspector.CountQueuePendingTasks, count.Queue); err != nil {
+			return fmt.Errorf("Count pending tasks error: %s", err)
+		}
+		if count.Delayed, err = countTasks(inspector.CountQueueDelayedTasks, count.Queue); err != nil {
+			return fmt.Errorf("Count delayed tasks error: %s", err)
+		}
+	}
+
+	deadLetters, err := admin.server.CountDeadLetters(admin.queueName)
+	if err != nil {
+		return wrapError("Count dead letters error", err)
+	}
+	count.DeadLetters = deadLetters
+
+	if admin.json {
+		return admin.writeJSON(count)
+	}
+	return admin.writeTable(
+		[]string{"QUEUE", "PENDING", "DELAYED", "DEAD LETTERS"},
+		[]string{count.Queue, formatCount(count.Pending), formatCount(count.Delayed), fmt.Sprint(count.DeadLetters)},
+	)
+}
+
+// ListPending writes pending tasks between the indexes, in the order they
+// are consumed
+func (admin *Admin) ListPending(indexStart, indexEnd int) error {
+	inspector, err := admin.inspector()
+	if err != nil {
+		return err
+	}
+	signatures, err := inspector.GetQueuePendingTasks(admin.queue(), indexStart, indexEnd)
+	if err != nil {
+		return wrapError("Get pending tasks error", err)
+	}
+	return admin.writeSignatures(signatures)
+}
+
+// ListDelayed writes delayed tasks between the indexes, due first
+func (admin *Admin) ListDelayed(indexStart, indexEnd int) error {
+	inspector, err := admin.inspector()
+	if err != nil {
+		return err
+	}
+	signatures, err := inspector.GetQueueDelayedTasks(admin.queue(), indexStart, indexEnd)
+	if err != nil {
+		return wrapError("Get delayed tasks error", err)
+	}
+	return admin.writeSignatures(signatures)
+}
+
+// ListDeadLetters writes dead letters between the indexes, oldest first
+func (admin *Admin) ListDeadLetters(indexStart, indexEnd int) error {
+	deadLetters, err := admin.server.GetDeadLetters(admin.queueName, indexStart, indexEnd)
+	if err != nil {
+		return fmt.Errorf("Get dead letters error: %s", err)
+	}
+	if deadLetters == nil {
+		deadLetters = []*tasks.DeadLetter{}
+	}
+
+	if admin.json {
+		return admin.writeJSON(deadLetters)
+	}
+	rows := make([][]string, 0, len(deadLetters))
+	for _, deadLetter := range deadLetters {
+		rows = append(rows, []string{
+			deadLetter.Signature.UUID,
+			deadLetter.Signature.Name,
+			fmt.Sprint(deadLetter.Attempts),
+			formatTime(&deadLetter.FailedAt),
+			deadLetter.Error,
+		})
+	}
+	return admin.writeTable([]string{"UUID", "NAME", "ATTEMPTS", "FAILED AT", "ERROR"}, rows...)
+}
+
+// Peek writes the next count pending tasks, or delayed tasks due first, with
+// their arguments and headers
+func (admin *Admin) Peek(count int, delayed bool) error {
+	if count <= 0 {
+		count = 1
+	}
+
+	inspector, err := admin.inspector()
+	if err != nil {
+		return err
+	}
+
+	var signatures []*tasks.Signature
+	if delayed {
+		signatures, err = inspector.GetQueueDelayedTasks(admin.queue(), 0, count-1)
+	} else {
+		signatures, err = inspector.GetQueuePendingTasks(admin.queue(), 0, count-1)
+	}
+	if err != nil {
+		return wrapError("Get tasks error", err)
+	}
+	if signatures == nil {
+		signatures = []*tasks.Signature{}
+	}
+
+	if admin.json {
+		return admin.writeJSON(signatures)
+	}
+	for i, signature := range signatures {
+		if i > 0 {
+			fmt.Fprintln(admin.out)
+		}
+		args, _ := json.Marshal(signature.Args)
+		headers, _ := json.Marshal(signature.Headers)
+		err := admin.writeTable(nil,
+			[]string{"UUID", signature.UUID},
+			[]string{"NAME", signature.Name},
+			[]string{"QUEUE", signature.RoutingKey},
+			[]string{"ETA", formatTime(signature.ETA)},
+			[]string{"PRIORITY", fmt.Sprint(signature.Priority)},
+			[]string{"RETRIES", fmt.Sprintf("%d left, %d attempted", signature.RetryCount, signature.RetryAttempt)},
+			[]string{"ARGS", string(args)},
+			[]string{"HEADERS", string(headers)},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgePending removes all pending tasks
+func (admin *Admin) PurgePending() error {
+	manager, err := admin.manager()
+	if err != nil {
+		return err
+	}
+	count, err := manager.PurgePendingTasks(admin.queue())
+	if err != nil {
+		return fmt.Errorf("Purge pending tasks error: %s", err)
+	}
+	return admin.writeResults(&Result{Queue: admin.queue(), Count: count})
+}
+
+// PurgeDelayed removes all delayed tasks
+func (admin *Admin) PurgeDelayed() error {
+	manager, err := admin.manager()
+	if err != nil {
+		return err
+	}
+	count, err := manager.PurgeDelayedTasks(admin.queue())
+	if err != nil {
+		return fmt.Errorf("Purge delayed tasks error: %s", err)
+	}
+	return admin.writeResults(&Result{Queue: admin.queue(), Count: count})
+}
+
+// PurgeDeadLetters removes all dead letters
+func (admin *Admin) PurgeDeadLetters() error {
+	count, err := admin.server.CountDeadLetters(admin.queueName)
+	if err != nil {
+		return wrapError("Count dead letters error", err)
+	}
+	if err := admin.server.PurgeDeadLetters(admin.queueName); err != nil {
+		return fmt.Errorf("Purge dead letters error: %s", err)
+	}
+	return admin.writeResults(&Result{Queue: admin.queue(), Count: count})
+}
+
+// Move moves up to count pending tasks, or delayed tasks due first, to
+// another queue. All tasks are moved if count is not positive.
+func (admin *Admin) Move(newQueue string, count int, delayed bool) error {
+	manager, err := admin.manager()
+	if err != nil {
+		return err
+	}
+
+	var moved int
+	if delayed {
+		moved, err = manager.MoveDelayedTasks(admin.queue(), newQueue, count)
+	} else {
+		moved, err = manager.MovePendingTasks(admin.queue(), newQueue, count)
+	}
+	if err != nil {
+		return fmt.Errorf("Move tasks error: %s", err)
+	}
+	return admin.writeResults(&Result{Queue: newQueue, Count: moved})
+}
+
+// Requeue sends dead letters again, each task keeps its UUID
+func (admin *Admin) Requeue(uuids ...string) error {
+	results := make([]*Result, 0, len(uuids))
+	for _, uuid := range uuids {
+		result := &Result{UUID: uuid, Queue: admin.queue()}
+		if _, err := admin.server.RequeueDeadLetter(admin.queueName, uuid); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Count = 1
+		}
+		results = append(results, result)
+	}
+	return admin.writeResults(results...)
+}
+
+// Cancel removes delayed tasks
+func (admin *Admin) Cancel(uuids ...string) error {
+	results := make([]*Result, 0, len(uuids))
+	for _, uuid := range uuids {
+		result := &Result{UUID: uuid}
+		signature, err := admin.server.GetDelayTask(uuid)
+		switch {
+		case err != nil:
+			result.Error = err.Error()
+		case signature == nil:
+			result.Error = "Delayed task not found"
+		default:
+			result.Queue = signature.RoutingKey
+			if err := admin.server.CancelDelayTask(uuid); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Count = 1
+			}
+		}
+		results = append(results, result)
+	}
+	return admin.writeResults(results...)
+}
+
+// State writes states of tasks kept by the result backend
+func (admin *Admin) State(uuids ...string) error {
+	backend := admin.server.GetBackend()
+	if backend == nil {
+		return errors.New("Result backend required")
+	}
+
+	states := make([]*tasks.TaskState, 0, len(uuids))
+	for _, uuid := range uuids {
+		state, err := backend.GetState(uuid)
+		if err != nil {
+			return fmt.Errorf("Get state of task %s error: %s", uuid, err)
+		}
+		states = append(states, state)
+	}
+
+	if admin.json {
+		return admin.writeJSON(states)
+	}
+	rows := make([][]string, 0, len(states))
+	for _, state := range states {
+		progress := ""
+		if state.Progress != nil {
+			progress = fmt.Sprintf("%g%%", state.Progress.Percent)
+		}
+		rows = append(rows, []string{
+			state.TaskUUID,
+			state.State,
+			progress,
+			readableResults(state.Results),
+			state.Error,
+		})
+	}
+	return admin.writeTable([]string{"UUID", "STATE", "PROGRESS", "RESULTS", "ERROR"}, rows...)
+}
+
+// writeSignatures writes a row for each task
+func (admin *Admin) writeSignatures(signatures []*tasks.Signature) error {
+	if signatures == nil {
+		signatures = []*tasks.Signature{}
+	}
+	if admin.json {
+		return admin.writeJSON(signatures)
+	}
+
+	rows := make([][]string, 0, len(signatures))
+	for _, signature := range signatures {
+		rows = append(rows, []string{
+			signature.UUID,
+			signature.Name,
+			signature.RoutingKey,
+			formatTime(signature.ETA),
+			fmt.Sprint(signature.Priority),
+			fmt.Sprint(signature.RetryCount),
+		})
+	}
+	return admin.writeTable([]string{"UUID", "NAME", "QUEUE", "ETA", "PRIORITY", "RETRIES"}, rows...)
+}
+
+// writeResults writes results of an operation, it returns an error if any
+// of them has failed
+func (admin *Admin) writeResults(results ...*Result) error {
+	var err error
+	if admin.json {
+		if len(results) == 1 {
+			err = admin.writeJSON(results[0])
+		} else {
+			err = admin.writeJSON(results)
+		}
+	} else {
+		rows := make([][]string, 0, len(results))
+		for _, result := range results {
+			rows = append(rows, []string{result.UUID, result.Queue, fmt.Sprint(result.Count), result.Error})
+		}
+		err = admin.writeTable([]string{"UUID", "QUEUE", "COUNT", "ERROR"}, rows...)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		if result.Error != "" {
+			return errors.New("Some operations have failed")
+		}
+	}
+	return nil
+}
+
+func (admin *Admin) writeJSON(v interface{}) error {
+	encoder := json.NewEncoder(admin.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// writeTable writes rows aligned in columns, the header is left out if nil
+func (admin *Admin) writeTable(header []string, rows ...[]string) error {
+	w := tabwriter.NewWriter(admin.out, 0, 8, 2, ' ', 0)
+	if header != nil {
+		fmt.Fprintln(w, strings.Join(header, "\t"))
+	}
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// readableResults formats task results, raw values are used if the results
+// cannot be reflected
+func readableResults(results []*tasks.TaskResult) string {
+	if len(results) == 0 {
+		return ""
+	}
+	values, err := tasks.ReflectTaskResults(results)
+	if err != nil {
+		raw := make([]interface{}, 0, len(results))
+		for _, result := range results {
+			raw = append(raw, result.Value)
+		}
+		return fmt.Sprint(raw)
+	}
+	return tasks.HumanReadableResults(values)
+}
+
+// wrapError adds context to the error, ErrNotSupported is returned as is so
+// callers can tell it apart
+func wrapError(context string, err error) error {
+	if err == brokers.ErrNotSupported {
+		return ErrNotSupported
+	}
+	return fmt.Errorf("%s: %s", context, err)
+}
+
+// countTasks counts tasks in the queue, nil if the broker cannot count them
+func countTasks(count func(queue string) (int, error), queue string) (*int, error) {
+	n, err := count(queue)
+	if err == brokers.ErrNotSupported {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+// formatCount formats a number of tasks, a dash if they are not counted
+func formatCount(count *int) string {
+	if count == nil {
+		return "-"
+	}
+	return fmt.Sprint(*count)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
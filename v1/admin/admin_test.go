@@ -0,0 +1,181 @@
+package admin_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/Guazi-inc/machinery/v1"
+	"github.com/Guazi-inc/machinery/v1/admin"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func getEagerServer(t *testing.T) *machinery.Server {
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "eager",
+		DefaultQueue:  "machinery_tasks",
+		ResultBackend: "eager",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestAdminDeadLetters(t *testing.T) {
+	server := getEagerServer(t)
+
+	fail := true
+	err := server.RegisterTask("flaky_task", func() error {
+		if fail {
+			return errors.New("still broken")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	var uuids []string
+	for i := 0; i < 2; i++ {
+		asyncResult, err := server.SendTask(&tasks.Signature{Name: "flaky_task"})
+		assert.NoError(t, err)
+		uuids = append(uuids, asyncResult.Signature.UUID)
+	}
+
+	out := new(bytes.Buffer)
+	adm := admin.New(server, out, true)
+
+	assert.NoError(t, adm.Count())
+	count := new(admin.QueueCount)
+	assert.NoError(t, json.Unmarshal(out.Bytes(), count))
+	assert.Equal(t, admin.QueueCount{Queue: "machinery_tasks", DeadLetters: 2}, *count)
+
+	out.Reset()
+	assert.NoError(t, adm.ListDeadLetters(0, -1))
+	var deadLetters []*tasks.DeadLetter
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &deadLetters))
+	if assert.Len(t, deadLetters, 2) {
+		assert.Equal(t, uuids[0], deadLetters[0].Signature.UUID)
+		assert.Equal(t, "still broken", deadLetters[0].Error)
+	}
+
+	// Requeueing fails for the task which is not a dead letter
+	fail = false
+	out.Reset()
+	assert.Error(t, adm.Requeue(uuids[0], "unknown"))
+	var results []*admin.Result
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &results))
+	if assert.Len(t, results, 2) {
+		assert.Equal(t, 1, results[0].Count)
+		assert.Empty(t, results[0].Error)
+		assert.Equal(t, 0, results[1].Count)
+		assert.NotEmpty(t, results[1].Error)
+	}
+
+	out.Reset()
+	assert.NoError(t, adm.State(uuids...))
+	var states []*tasks.TaskState
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &states))
+	if assert.Len(t, states, 2) {
+		assert.Equal(t, tasks.StateSuccess, states[0].State)
+		assert.Equal(t, tasks.StateFailure, states[1].State)
+		assert.Equal(t, "still broken", states[1].Error)
+	}
+
+	out.Reset()
+	assert.NoError(t, adm.PurgeDeadLetters())
+	result := new(admin.Result)
+	assert.NoError(t, json.Unmarshal(out.Bytes(), result))
+	assert.Equal(t, 1, result.Count)
+
+	deadLetters, err = server.GetDeadLetters("", 0, -1)
+	assert.NoError(t, err)
+	assert.Empty(t, deadLetters)
+}
+
+func TestAdminTable(t *testing.T) {
+	server := getEagerServer(t)
+
+	err := server.RegisterTask("broken_task", func() error {
+		return errors.New("broken")
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "broken_task"})
+	assert.NoError(t, err)
+
+	out := new(bytes.Buffer)
+	adm := admin.New(server, out, false)
+
+	assert.NoError(t, adm.ListDeadLetters(0, -1))
+	assert.Contains(t, out.String(), "UUID")
+	assert.Contains(t, out.String(), asyncResult.Signature.UUID)
+	assert.Contains(t, out.String(), "broken")
+
+	out.Reset()
+	assert.NoError(t, adm.State(asyncResult.Signature.UUID))
+	assert.Contains(t, out.String(), tasks.StateFailure)
+}
+
+func TestAdminNotSupported(t *testing.T) {
+	out := new(bytes.Buffer)
+	adm := admin.New(getEagerServer(t), out, false)
+
+	assert.Equal(t, admin.ErrNotSupported, adm.ListPending(0, -1))
+	assert.Equal(t, admin.ErrNotSupported, adm.Peek(1, false))
+	assert.Equal(t, admin.ErrNotSupported, adm.PurgePending())
+	assert.Equal(t, admin.ErrNotSupported, adm.PurgeDelayed())
+	assert.Equal(t, admin.ErrNotSupported, adm.Move("other_queue", 0, false))
+	assert.Empty(t, out.String())
+}
+
+// countingBroker counts pending tasks of a single queue but cannot list
+// them or count delayed tasks, like the AMQP broker
+type countingBroker struct {
+	brokers.Interface
+	queues []string
+}
+
+func (b *countingBroker) Queues() ([]string, error) {
+	return []string{"machinery_tasks"}, nil
+}
+
+func (b *countingBroker) CountQueuePendingTasks(queue string) (int, error) {
+	b.queues = append(b.queues, queue)
+	return 3, nil
+}
+
+func (b *countingBroker) CountQueueDelayedTasks(queue string) (int, error) {
+	return 0, brokers.ErrNotSupported
+}
+
+func (b *countingBroker) GetQueuePendingTasks(queue string, indexStart, indexEnd int) ([]*tasks.Signature, error) {
+	return nil, brokers.ErrNotSupported
+}
+
+func (b *countingBroker) GetQueueDelayedTasks(queue string, indexStart, indexEnd int) ([]*tasks.Signature, error) {
+	return nil, brokers.ErrNotSupported
+}
+
+func TestAdminQueue(t *testing.T) {
+	server := getEagerServer(t)
+	broker := &countingBroker{Interface: server.GetBroker()}
+	server.SetBroker(broker)
+
+	out := new(bytes.Buffer)
+	adm := admin.New(server, out, true)
+	adm.SetQueue("other_queue")
+
+	// Delayed tasks the broker cannot count are left out
+	assert.NoError(t, adm.Count())
+	assert.JSONEq(t, `{"queue": "other_queue", "pending": 3, "dead_letters": 0}`, out.String())
+	assert.Equal(t, []string{"other_queue"}, broker.queues)
+
+	out.Reset()
+	assert.Equal(t, admin.ErrNotSupported, adm.ListPending(0, -1))
+	assert.Equal(t, admin.ErrNotSupported, adm.Peek(1, true))
+	assert.Empty(t, out.String())
+}
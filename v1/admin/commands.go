@@ -0,0 +1,180 @@
+package admin
+
+import (
+	"errors"
+	"os"
+
+	"github.com/Guazi-inc/machinery/v1"
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/urfave/cli"
+)
+
+// Command returns the admin command with a subcommand for each operation of
+// Admin. The configuration is loaded by loadConfig, every subcommand works
+// with the queue set by the queue flag, the default queue if it is not set.
+func Command(loadConfig func() (*config.Config, error)) cli.Command {
+	commonFlags := []cli.Flag{
+		cli.StringFlag{
+			Name:  "queue",
+			Usage: "Queue to work with instead of the default queue",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Write JSON instead of tables",
+		},
+	}
+	flags := func(flags ...cli.Flag) []cli.Flag {
+		return append(flags, commonFlags...)
+	}
+	action := func(run func(admin *Admin, c *cli.Context) error) cli.ActionFunc {
+		return func(c *cli.Context) error {
+			admin, err := newAdmin(loadConfig, c)
+			if err == nil {
+				err = run(admin, c)
+			}
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			return nil
+		}
+	}
+
+	return cli.Command{
+		Name:  "admin",
+		Usage: "inspect and manipulate tasks in a queue",
+		Subcommands: []cli.Command{
+			{
+				Name:  "count",
+				Usage: "count pending and delayed tasks and dead letters",
+				Flags: flags(),
+				Action: action(func(admin *Admin, c *cli.Context) error {
+					return admin.Count()
+				}),
+			},
+			{
+				Name:  "list",
+				Usage: "list pending tasks, delayed tasks or dead letters",
+				Flags: flags(
+					cli.BoolFlag{Name: "delayed", Usage: "List delayed tasks"},
+					cli.BoolFlag{Name: "dead", Usage: "List dead letters"},
+					cli.IntFlag{Name: "start", Value: 0, Usage: "Index of the first task"},
+					cli.IntFlag{Name: "end", Value: 9, Usage: "Index of the last task, inclusive"},
+				),
+				Action: action(func(admin *Admin, c *cli.Context) error {
+					start, end := c.Int("start"), c.Int("end")
+					switch {
+					case c.Bool("delayed") && c.Bool("dead"):
+						return errors.New("Only one of --delayed and --dead can be set")
+					case c.Bool("delayed"):
+						return admin.ListDelayed(start, end)
+					case c.Bool("dead"):
+						return admin.ListDeadLetters(start, end)
+					}
+					return admin.ListPending(start, end)
+				}),
+			},
+			{
+				Name:  "peek",
+				Usage: "show the next tasks with their arguments",
+				Flags: flags(
+					cli.BoolFlag{Name: "delayed", Usage: "Show delayed tasks due first"},
+					cli.IntFlag{Name: "count", Value: 1, Usage: "Number of tasks"},
+				),
+				Action: action(func(admin *Admin, c *cli.Context) error {
+					return admin.Peek(c.Int("count"), c.Bool("delayed"))
+				}),
+			},
+			{
+				Name:  "purge",
+				Usage: "remove all pending tasks, delayed tasks or dead letters",
+				Flags: flags(
+					cli.BoolFlag{Name: "delayed", Usage: "Remove delayed tasks"},
+					cli.BoolFlag{Name: "dead", Usage: "Remove dead letters"},
+					cli.BoolFlag{Name: "force", Usage: "Confirm the tasks are to be removed"},
+				),
+				Action: action(func(admin *Admin, c *cli.Context) error {
+					if !c.Bool("force") {
+						return errors.New("Purging cannot be undone, set --force to confirm")
+					}
+					switch {
+					case c.Bool("delayed") && c.Bool("dead"):
+						return errors.New("Only one of --delayed and --dead can be set")
+					case c.Bool("delayed"):
+						return admin.PurgeDelayed()
+					case c.Bool("dead"):
+						return admin.PurgeDeadLetters()
+					}
+					return admin.PurgePending()
+				}),
+			},
+			{
+				Name:  "move",
+				Usage: "move pending or delayed tasks to another queue",
+				Flags: flags(
+					cli.StringFlag{Name: "to", Usage: "Queue the tasks are moved to"},
+					cli.BoolFlag{Name: "delayed", Usage: "Move delayed tasks due first"},
+					cli.IntFlag{Name: "count", Value: 0, Usage: "Number of tasks, all of them if 0"},
+				),
+				Action: action(func(admin *Admin, c *cli.Context) error {
+					if c.String("to") == "" {
+						return errors.New("Queue to move the tasks to is required, set --to")
+					}
+					return admin.Move(c.String("to"), c.Int("count"), c.Bool("delayed"))
+				}),
+			},
+			{
+				Name:      "requeue",
+				Usage:     "send dead letters again",
+				ArgsUsage: "UUID...",
+				Flags:     flags(),
+				Action: action(func(admin *Admin, c *cli.Context) error {
+					if c.NArg() == 0 {
+						return errors.New("At least one task UUID is required")
+					}
+					return admin.Requeue(c.Args()...)
+				}),
+			},
+			{
+				Name:      "cancel",
+				Usage:     "remove delayed tasks",
+				ArgsUsage: "UUID...",
+				Flags:     flags(),
+				Action: action(func(admin *Admin, c *cli.Context) error {
+					if c.NArg() == 0 {
+						return errors.New("At least one task UUID is required")
+					}
+					return admin.Cancel(c.Args()...)
+				}),
+			},
+			{
+				Name:      "state",
+				Usage:     "show states of tasks kept by the result backend",
+				ArgsUsage: "UUID...",
+				Flags:     flags(),
+				Action: action(func(admin *Admin, c *cli.Context) error {
+					if c.NArg() == 0 {
+						return errors.New("At least one task UUID is required")
+					}
+					return admin.State(c.Args()...)
+				}),
+			},
+		},
+	}
+}
+
+// newAdmin creates Admin instance writing to the standard output
+func newAdmin(loadConfig func() (*config.Config, error), c *cli.Context) (*Admin, error) {
+	cnf, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := machinery.NewServer(cnf)
+	if err != nil {
+		return nil, err
+	}
+
+	admin := New(server, os.Stdout, c.Bool("json"))
+	admin.SetQueue(c.String("queue"))
+	return admin, nil
+}
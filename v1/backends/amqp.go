@@ -15,9 +15,11 @@ package backends
 // It is important to consume the queue exclusively to avoid race conditions.
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/Guazi-inc/machinery/v1/common"
 	"github.com/Guazi-inc/machinery/v1/config"
@@ -30,6 +32,11 @@ import (
 type AMQPBackend struct {
 	Backend
 	common.AMQPConnector
+	// Connection checking whether tasks have been revoked, opened on first
+	// use and again once it has been closed
+	revokedConn       *amqp.Connection
+	revokedConnClosed chan *amqp.Error
+	revokedConnMu     sync.Mutex
 }
 
 // NewAMQPBackend creates AMQPBackend instance
@@ -146,6 +153,12 @@ func (b *AMQPBackend) SetStateStarted(signature *tasks.Signature) error {
 	return b.updateState(taskState)
 }
 
+// SetStateProgress updates task state to PROGRESS
+func (b *AMQPBackend) SetStateProgress(signature *tasks.Signature, progress *tasks.Progress) error {
+	taskState := tasks.NewProgressTaskState(signature, progress)
+	return b.updateState(taskState)
+}
+
 // SetStateRetry updates task state to RETRY
 func (b *AMQPBackend) SetStateRetry(signature *tasks.Signature) error {
 	state := tasks.NewRetryTaskState(signature)
@@ -182,6 +195,115 @@ func (b *AMQPBackend) SetStateFailure(signature *tasks.Signature, err string) er
 	return b.markTaskCompleted(signature, taskState)
 }
 
+// SetStateRevoked updates task state to REVOKED and flags the task as revoked.
+// As reading the task state consumes it, the flag is kept as an empty queue.
+func (b *AMQPBackend) SetStateRevoked(signature *tasks.Signature) error {
+	conn, channel, err := b.Open(b.cnf.Broker, b.cnf.TLSConfig)
+	if err != nil {
+		return err
+	}
+	defer b.Close(channel, conn)
+
+	declareQueueArgs := amqp.Table{
+		// Time after that the queue will be deleted.
+		"x-expires": int32(b.getExpiresIn()),
+	}
+	if _, err := channel.QueueDeclare(
+		amqpRevokedQueue(signature.UUID), // name
+		false,                            // durable
+		false,                            // delete when unused
+		false,                            // exclusive
+		false,                            // no-wait
+		declareQueueArgs,                 // arguments
+	); err != nil {
+		return fmt.Errorf("Queue declare error: %s", err)
+	}
+
+	taskState := tasks.NewRevokedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// IsRevoked returns true if the task has been revoked
+func (b *AMQPBackend) IsRevoked(taskUUID string) (bool, error) {
+	conn, err := b.revokedConnection()
+	if err != nil {
+		return false, err
+	}
+	return b.inspectRevoked(conn, taskUUID)
+}
+
+// RevokedTasks returns UUIDs of the tasks which have been revoked, a single
+// connection is used to check all of them
+func (b *AMQPBackend) RevokedTasks(taskUUIDs []string) ([]string, error) {
+	conn, err := b.revokedConnection()
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := make([]string, 0, len(taskUUIDs))
+	for _, taskUUID := range taskUUIDs {
+		exists, err := b.inspectRevoked(conn, taskUUID)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			revoked = append(revoked, taskUUID)
+		}
+	}
+	return revoked, nil
+}
+
+// revokedConnection returns the connection checking whether tasks have been
+// revoked, workers check every task they receive so it is kept open
+func (b *AMQPBackend) revokedConnection() (*amqp.Connection, error) {
+	b.revokedConnMu.Lock()
+	defer b.revokedConnMu.Unlock()
+
+	if b.revokedConn != nil {
+		select {
+		case <-b.revokedConnClosed:
+		default:
+			return b.revokedConn, nil
+		}
+	}
+
+	conn, err := amqp.DialTLS(b.cnf.Broker, b.cnf.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Dial error: %s", err)
+	}
+	b.revokedConn = conn
+	b.revokedConnClosed = conn.NotifyClose(make(chan *amqp.Error, 1))
+	return conn, nil
+}
+
+// inspectRevoked checks the revoked flag of the task on a channel of its own,
+// inspecting a queue which does not exist closes the channel
+func (b *AMQPBackend) inspectRevoked(conn *amqp.Connection, taskUUID string) (bool, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return false, fmt.Errorf("Open channel error: %s", err)
+	}
+	exists, err := b.revokedQueueExists(channel, taskUUID)
+	if exists {
+		channel.Close()
+	}
+	return exists, err
+}
+
+// revokedQueueExists checks whether the revoked flag of the task is set. Only
+// a missing queue means it is not, other errors are returned. Inspecting a
+// queue which does not exist closes the channel.
+func (b *AMQPBackend) revokedQueueExists(channel *amqp.Channel, taskUUID string) (bool, error) {
+	_, err := channel.QueueInspect(amqpRevokedQueue(taskUUID))
+	if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.NotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Queue inspect error: %s", err)
+	}
+	return true, nil
+}
+
 // GetState returns the latest task state. It will only return the status once
 // as the message will get consumed and removed from the queue.
 func (b *AMQPBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
@@ -233,6 +355,135 @@ func (b *AMQPBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
 	return state, nil
 }
 
+// WaitCompleted blocks until the task completes. State changes are copied to
+// a reply queue bound to the routing key of the task, so the queue keeping
+// the task states is left for GetState.
+func (b *AMQPBackend) WaitCompleted(ctx context.Context, taskUUID string) (*tasks.TaskState, error) {
+	declareQueueArgs := amqp.Table{
+		// Time in milliseconds
+		// after that message will expire
+		"x-message-ttl": int32(b.getExpiresIn()),
+		// Time after that the queue will be deleted.
+		"x-expires": int32(b.getExpiresIn()),
+	}
+	conn, channel, _, _, _, err := b.Connect(
+		b.cnf.Broker,
+		b.cnf.TLSConfig,
+		b.cnf.AMQP.Exchange,     // exchange name
+		b.cnf.AMQP.ExchangeType, // exchange type
+		taskUUID,                // queue name
+		false,                   // queue durable
+		true,                    // queue delete when unused
+		taskUUID,                // queue binding key
+		nil,                     // exchange declare args
+		declareQueueArgs,        // queue declare args
+		nil,                     // queue binding args
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close(channel, conn)
+
+	// The reply queue is deleted once the connection is closed
+	replyQueue, err := channel.QueueDeclare(
+		"",    // name, generated by the server
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Queue declare error: %s", err)
+	}
+	if err := channel.QueueBind(
+		replyQueue.Name,     // name of the queue
+		taskUUID,            // binding key
+		b.cnf.AMQP.Exchange, // source exchange
+		false,               // no-wait
+		nil,                 // arguments
+	); err != nil {
+		return nil, fmt.Errorf("Queue bind error: %s", err)
+	}
+
+	deliveries, err := channel.Consume(
+		replyQueue.Name, // queue
+		"",              // consumer tag
+		true,            // auto-ack
+		true,            // exclusive
+		false,           // no-local
+		false,           // no-wait
+		nil,             // arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Queue consume error: %s", err)
+	}
+
+	// The task may have completed before the reply queue was bound
+	state, err := b.peekCompleted(conn, taskUUID)
+	if err != nil || state != nil {
+		return state, err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case d, ok := <-deliveries:
+			if !ok {
+				return nil, errors.New("Reply queue closed")
+			}
+
+			state := new(tasks.TaskState)
+			if err := json.Unmarshal(d.Body, state); err != nil {
+				return nil, err
+			}
+			if state.IsCompleted() {
+				return state, nil
+			}
+		}
+	}
+}
+
+// peekCompleted returns the completed state kept in the queue of the task, or
+// nil if the task has not completed yet. The states are read without being
+// acknowledged and returned to the queue afterwards.
+func (b *AMQPBackend) peekCompleted(conn *amqp.Connection, taskUUID string) (*tasks.TaskState, error) {
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Open channel error: %s", err)
+	}
+	defer channel.Close()
+
+	var completed *tasks.TaskState
+	var last *amqp.Delivery
+	for {
+		d, ok, err := channel.Get(
+			taskUUID, // queue name
+			false,    // auto-ack
+		)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		last = &d
+
+		state := new(tasks.TaskState)
+		if err := json.Unmarshal(d.Body, state); err == nil && state.IsCompleted() {
+			completed = state
+		}
+	}
+
+	if last != nil {
+		if err := last.Nack(true, true); err != nil {
+			return nil, err
+		}
+	}
+	return completed, nil
+}
+
 // PurgeState deletes stored task state
 func (b *AMQPBackend) PurgeState(taskUUID string) error {
 	conn, channel, err := b.Open(b.cnf.Broker, b.cnf.TLSConfig)
@@ -386,3 +637,16 @@ func (b *AMQPBackend) markTaskCompleted(signature *tasks.Signature, taskState *t
 func amqmChordTriggeredQueue(groupUUID string) string {
 	return fmt.Sprintf("%s_chord_triggered", groupUUID)
 }
+
+func amqpRevokedQueue(taskUUID string) string {
+	return fmt.Sprintf("%s_revoked", taskUUID)
+}
+
+// Ping checks a connection to the AMQP server can be opened
+func (b *AMQPBackend) Ping() error {
+	conn, channel, err := b.Open(b.cnf.Broker, b.cnf.TLSConfig)
+	if err != nil {
+		return err
+	}
+	return b.Close(channel, conn)
+}
@@ -158,3 +158,32 @@ func TestPurgeStateAMQP(t *testing.T) {
 	assert.Nil(t, taskState)
 	assert.Error(t, err)
 }
+
+func TestRevokedAMQP(t *testing.T) {
+	if os.Getenv("AMQP_URL") == "" {
+		return
+	}
+
+	// The revoked flag outlives the task state, so every run revokes a new task
+	signature := tasks.NewSignature("test_task", nil)
+	backend := backends.NewAMQPBackend(amqpConfig)
+
+	// Checks share a connection which survives channels closed by
+	// inspecting missing flags
+	for i := 0; i < 3; i++ {
+		revoked, err := backend.IsRevoked(signature.UUID)
+		assert.NoError(t, err)
+		assert.False(t, revoked)
+	}
+
+	assert.NoError(t, backend.SetStateRevoked(signature))
+	revoked, err := backend.IsRevoked(signature.UUID)
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+
+	revokedUUIDs, err := backend.(backends.RevokedChecker).RevokedTasks([]string{"testOtherTaskUUID", signature.UUID})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{signature.UUID}, revokedUUIDs)
+
+	backend.PurgeState(signature.UUID)
+}
@@ -1,10 +1,12 @@
 package backends
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"time"
 
+	"github.com/Guazi-inc/machinery/v1/log"
 	"github.com/Guazi-inc/machinery/v1/tasks"
 )
 
@@ -86,6 +88,10 @@ func (asyncResult *AsyncResult) Touch() ([]reflect.Value, error) {
 		return nil, errors.New(asyncResult.taskState.Error)
 	}
 
+	if asyncResult.taskState.IsRevoked() {
+		return nil, tasks.ErrTaskRevoked
+	}
+
 	if asyncResult.taskState.IsSuccess() {
 		return tasks.ReflectTaskResults(asyncResult.taskState.Results)
 	}
@@ -95,37 +101,65 @@ func (asyncResult *AsyncResult) Touch() ([]reflect.Value, error) {
 
 // Get returns task results (synchronous blocking call)
 func (asyncResult *AsyncResult) Get(sleepDuration time.Duration) ([]reflect.Value, error) {
-	for {
-		results, err := asyncResult.Touch()
-
-		if results == nil && err == nil {
-			<-time.After(sleepDuration)
-		} else {
-			return results, err
-		}
-	}
+	return asyncResult.GetWithContext(context.Background(), sleepDuration)
 }
 
 // GetWithTimeout returns task results with a timeout (synchronous blocking call)
 func (asyncResult *AsyncResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([]reflect.Value, error) {
-	timeout := time.NewTimer(timeoutDuration)
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutDuration)
+	defer cancel()
+
+	results, err := asyncResult.GetWithContext(ctx, sleepDuration)
+	if err == context.DeadlineExceeded {
+		return nil, ErrTimeoutReached
+	}
+	return results, err
+}
+
+// GetWithContext returns task results once the task completes or the context
+// is done (synchronous blocking call). Backends pushing state changes wake
+// the caller up right away, others are polled every sleepDuration.
+func (asyncResult *AsyncResult) GetWithContext(ctx context.Context, sleepDuration time.Duration) ([]reflect.Value, error) {
+	if asyncResult.backend == nil {
+		return nil, ErrBackendNotConfigured
+	}
+
+	if notifier, ok := asyncResult.backend.(Notifier); ok && !asyncResult.taskState.IsCompleted() {
+		taskState, err := notifier.WaitCompleted(ctx, asyncResult.Signature.UUID)
+		if err == nil {
+			asyncResult.taskState = taskState
+			return asyncResult.Touch()
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		log.WARNING.Printf("Failed to wait for state change of task %s, polling instead: %s", asyncResult.Signature.UUID, err)
+	}
 
 	for {
+		results, err := asyncResult.Touch()
+		if results != nil || err != nil {
+			return results, err
+		}
+
 		select {
-		case <-timeout.C:
-			return nil, ErrTimeoutReached
-		default:
-			results, err := asyncResult.Touch()
-
-			if results == nil && err == nil {
-				<-time.After(sleepDuration)
-			} else {
-				return results, err
-			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(sleepDuration):
 		}
 	}
 }
 
+// GetProgress returns progress last reported by the task, nil if the task is
+// not in the PROGRESS state
+func (asyncResult *AsyncResult) GetProgress() *tasks.Progress {
+	taskState := asyncResult.GetState()
+	if !taskState.IsProgress() {
+		return nil
+	}
+	return taskState.Progress
+}
+
 // GetState returns latest task state
 func (asyncResult *AsyncResult) GetState() *tasks.TaskState {
 	if asyncResult.taskState.IsCompleted() {
@@ -142,6 +176,24 @@ func (asyncResult *AsyncResult) GetState() *tasks.TaskState {
 
 // Get returns results of a chain of tasks (synchronous blocking call)
 func (chainAsyncResult *ChainAsyncResult) Get(sleepDuration time.Duration) ([]reflect.Value, error) {
+	return chainAsyncResult.GetWithContext(context.Background(), sleepDuration)
+}
+
+// GetWithTimeout returns results of a chain of tasks with timeout (synchronous blocking call)
+func (chainAsyncResult *ChainAsyncResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([]reflect.Value, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutDuration)
+	defer cancel()
+
+	results, err := chainAsyncResult.GetWithContext(ctx, sleepDuration)
+	if err == context.DeadlineExceeded {
+		return nil, ErrTimeoutReached
+	}
+	return results, err
+}
+
+// GetWithContext returns results of a chain of tasks once the last task
+// completes or the context is done (synchronous blocking call)
+func (chainAsyncResult *ChainAsyncResult) GetWithContext(ctx context.Context, sleepDuration time.Duration) ([]reflect.Value, error) {
 	if chainAsyncResult.backend == nil {
 		return nil, ErrBackendNotConfigured
 	}
@@ -152,7 +204,7 @@ func (chainAsyncResult *ChainAsyncResult) Get(sleepDuration time.Duration) ([]re
 	)
 
 	for _, asyncResult := range chainAsyncResult.asyncResults {
-		results, err = asyncResult.Get(sleepDuration)
+		results, err = asyncResult.GetWithContext(ctx, sleepDuration)
 		if err != nil {
 			return nil, err
 		}
@@ -163,93 +215,33 @@ func (chainAsyncResult *ChainAsyncResult) Get(sleepDuration time.Duration) ([]re
 
 // Get returns result of a chord (synchronous blocking call)
 func (chordAsyncResult *ChordAsyncResult) Get(sleepDuration time.Duration) ([]reflect.Value, error) {
-	if chordAsyncResult.backend == nil {
-		return nil, ErrBackendNotConfigured
-	}
-
-	var err error
-	for _, asyncResult := range chordAsyncResult.groupAsyncResults {
-		_, err = asyncResult.Get(sleepDuration)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return chordAsyncResult.chordAsyncResult.Get(sleepDuration)
+	return chordAsyncResult.GetWithContext(context.Background(), sleepDuration)
 }
 
-// GetWithTimeout returns results of a chain of tasks with timeout (synchronous blocking call)
-func (chainAsyncResult *ChainAsyncResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([]reflect.Value, error) {
-	if chainAsyncResult.backend == nil {
-		return nil, ErrBackendNotConfigured
-	}
-
-	var (
-		results []reflect.Value
-		err     error
-	)
-
-	timeout := time.NewTimer(timeoutDuration)
-	ln := len(chainAsyncResult.asyncResults)
-	lastResult := chainAsyncResult.asyncResults[ln-1]
+// GetWithTimeout returns result of a chord with a timeout (synchronous blocking call)
+func (chordAsyncResult *ChordAsyncResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([]reflect.Value, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutDuration)
+	defer cancel()
 
-	for {
-		select {
-		case <-timeout.C:
-			return nil, ErrTimeoutReached
-		default:
-
-			for _, asyncResult := range chainAsyncResult.asyncResults {
-				_, errcur := asyncResult.Touch()
-				if errcur != nil {
-					return nil, err
-				}
-			}
-
-			results, err = lastResult.Touch()
-			if err != nil {
-				return nil, err
-			}
-			if results != nil {
-				return results, err
-			}
-			<-time.After(sleepDuration)
-		}
+	results, err := chordAsyncResult.GetWithContext(ctx, sleepDuration)
+	if err == context.DeadlineExceeded {
+		return nil, ErrTimeoutReached
 	}
+	return results, err
 }
 
-// GetWithTimeout returns result of a chord with a timeout (synchronous blocking call)
-func (chordAsyncResult *ChordAsyncResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([]reflect.Value, error) {
+// GetWithContext returns result of a chord once the callback completes or
+// the context is done (synchronous blocking call)
+func (chordAsyncResult *ChordAsyncResult) GetWithContext(ctx context.Context, sleepDuration time.Duration) ([]reflect.Value, error) {
 	if chordAsyncResult.backend == nil {
 		return nil, ErrBackendNotConfigured
 	}
 
-	var (
-		results []reflect.Value
-		err     error
-	)
-
-	timeout := time.NewTimer(timeoutDuration)
-	for {
-		select {
-		case <-timeout.C:
-			return nil, ErrTimeoutReached
-		default:
-			for _, asyncResult := range chordAsyncResult.groupAsyncResults {
-				_, errcur := asyncResult.Touch()
-				if errcur != nil {
-					return nil, err
-				}
-			}
-
-			results, err = chordAsyncResult.chordAsyncResult.Touch()
-			if err != nil {
-				return nil, nil
-			}
-			if results != nil {
-				return results, err
-			}
-			<-time.After(sleepDuration)
+	for _, asyncResult := range chordAsyncResult.groupAsyncResults {
+		if _, err := asyncResult.GetWithContext(ctx, sleepDuration); err != nil {
+			return nil, err
 		}
 	}
+
+	return chordAsyncResult.chordAsyncResult.GetWithContext(ctx, sleepDuration)
 }
@@ -0,0 +1,79 @@
+package backends_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/backends"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+// notifyingBackend pushes state changes of tasks through a channel
+type notifyingBackend struct {
+	backends.Interface
+	completed chan *tasks.TaskState
+}
+
+func (b *notifyingBackend) WaitCompleted(ctx context.Context, taskUUID string) (*tasks.TaskState, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case taskState := <-b.completed:
+		if taskState == nil {
+			return nil, errors.New("notifications are broken")
+		}
+		return taskState, nil
+	}
+}
+
+func TestAsyncResultGetWithContextPolling(t *testing.T) {
+	backend := backends.NewEagerBackend()
+	signature := &tasks.Signature{UUID: "testTaskUUID"}
+	assert.NoError(t, backend.SetStatePending(signature))
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		backend.SetStateSuccess(signature, []*tasks.TaskResult{{Type: "int", Value: 2}})
+	}()
+
+	results, err := backends.NewAsyncResult(signature, backend).GetWithContext(context.Background(), time.Millisecond)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 1) {
+		assert.Equal(t, int64(2), results[0].Int())
+	}
+
+	// Context done before the task completes
+	pending := &tasks.Signature{UUID: "testPendingTaskUUID"}
+	assert.NoError(t, backend.SetStatePending(pending))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = backends.NewAsyncResult(pending, backend).GetWithContext(ctx, time.Millisecond)
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = backends.NewAsyncResult(pending, backend).GetWithTimeout(10*time.Millisecond, time.Millisecond)
+	assert.Equal(t, backends.ErrTimeoutReached, err)
+}
+
+func TestAsyncResultGetWithContextNotified(t *testing.T) {
+	backend := &notifyingBackend{Interface: backends.NewEagerBackend(), completed: make(chan *tasks.TaskState, 1)}
+	signature := &tasks.Signature{UUID: "testTaskUUID"}
+	assert.NoError(t, backend.SetStatePending(signature))
+
+	// Polling would not see the state pushed by the backend
+	backend.completed <- tasks.NewFailureTaskState(signature, "boom")
+	_, err := backends.NewAsyncResult(signature, backend).GetWithContext(context.Background(), time.Hour)
+	assert.EqualError(t, err, "boom")
+
+	// Broken notifications fall back to polling
+	assert.NoError(t, backend.SetStateSuccess(signature, []*tasks.TaskResult{}))
+	backend.completed <- nil
+	_, err = backends.NewAsyncResult(signature, backend).GetWithContext(context.Background(), time.Millisecond)
+	assert.NoError(t, err)
+
+	_, err = backends.NewAsyncResult(&tasks.Signature{UUID: "testPendingTaskUUID"}, backend).GetWithTimeout(10*time.Millisecond, time.Hour)
+	assert.Equal(t, backends.ErrTimeoutReached, err)
+}
@@ -3,6 +3,8 @@ package backends
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/Guazi-inc/machinery/v1/tasks"
 )
@@ -39,15 +41,21 @@ func (e ErrTasknotFound) Error() string {
 
 // EagerBackend represents an "eager" in-memory result backend
 type EagerBackend struct {
-	groups map[string][]string
-	tasks  map[string][]byte
+	groups  map[string][]string
+	tasks   map[string][]byte
+	revoked map[string]bool
+	keys    map[string]eagerKey
+	// Tasks may be revoked from other goroutines while they are processed
+	mu sync.RWMutex
 }
 
 // NewEagerBackend creates EagerBackend instance
 func NewEagerBackend() Interface {
 	return &EagerBackend{
-		groups: make(map[string][]string),
-		tasks:  make(map[string][]byte),
+		groups:  make(map[string][]string),
+		tasks:   make(map[string][]byte),
+		revoked: make(map[string]bool),
+		keys:    make(map[string]eagerKey),
 	}
 }
 
@@ -131,6 +139,12 @@ func (b *EagerBackend) SetStateStarted(signature *tasks.Signature) error {
 	return b.updateState(state)
 }
 
+// SetStateProgress updates task state to PROGRESS
+func (b *EagerBackend) SetStateProgress(signature *tasks.Signature, progress *tasks.Progress) error {
+	state := tasks.NewProgressTaskState(signature, progress)
+	return b.updateState(state)
+}
+
 // SetStateRetry updates task state to RETRY
 func (b *EagerBackend) SetStateRetry(signature *tasks.Signature) error {
 	state := tasks.NewRetryTaskState(signature)
@@ -149,9 +163,81 @@ func (b *EagerBackend) SetStateFailure(signature *tasks.Signature, err string) e
 	return b.updateState(state)
 }
 
+// SetStateRevoked updates task state to REVOKED and flags the task as revoked
+func (b *EagerBackend) SetStateRevoked(signature *tasks.Signature) error {
+	b.mu.Lock()
+	b.revoked[signature.UUID] = true
+	b.mu.Unlock()
+
+	state := tasks.NewRevokedTaskState(signature)
+	return b.updateState(state)
+}
+
+// IsRevoked returns true if the task has been revoked
+func (b *EagerBackend) IsRevoked(taskUUID string) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.revoked[taskUUID], nil
+}
+
+// RevokedTasks returns UUIDs of the tasks which have been revoked
+func (b *EagerBackend) RevokedTasks(taskUUIDs []string) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	revoked := make([]string, 0, len(taskUUIDs))
+	for _, taskUUID := range taskUUIDs {
+		if b.revoked[taskUUID] {
+			revoked = append(revoked, taskUUID)
+		}
+	}
+	return revoked, nil
+}
+
+// eagerKey is a value of a key claimed in memory
+type eagerKey struct {
+	value     string
+	expiresAt time.Time
+}
+
+// ClaimKey sets the key to value for the expiry unless it is set already
+func (b *EagerBackend) ClaimKey(key, value string, expiry time.Duration) (string, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := b.keys[key]; ok && existing.expiresAt.After(now) {
+		return existing.value, false, nil
+	}
+
+	// Drop expired keys so the map does not grow forever
+	for k, existing := range b.keys {
+		if !existing.expiresAt.After(now) {
+			delete(b.keys, k)
+		}
+	}
+
+	b.keys[key] = eagerKey{value: value, expiresAt: now.Add(expiry)}
+	return value, true, nil
+}
+
+// ReleaseKey deletes the key if it is still set to value
+func (b *EagerBackend) ReleaseKey(key, value string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if existing, ok := b.keys[key]; ok && existing.value == value {
+		delete(b.keys, key)
+	}
+	return nil
+}
+
 // GetState returns the latest task state
 func (b *EagerBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
+	b.mu.RLock()
 	tasktStateBytes, ok := b.tasks[taskUUID]
+	b.mu.RUnlock()
 	if !ok {
 		return nil, NewErrTasknotFound(taskUUID)
 	}
@@ -166,6 +252,9 @@ func (b *EagerBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
 
 // PurgeState deletes stored task state
 func (b *EagerBackend) PurgeState(taskUUID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	_, ok := b.tasks[taskUUID]
 	if !ok {
 		return NewErrTasknotFound(taskUUID)
@@ -193,6 +282,8 @@ func (b *EagerBackend) updateState(s *tasks.TaskState) error {
 		return fmt.Errorf("Marshal task state error: %v", err)
 	}
 
+	b.mu.Lock()
 	b.tasks[s.TaskUUID] = msg
+	b.mu.Unlock()
 	return nil
 }
@@ -2,6 +2,7 @@ package backends_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/Guazi-inc/machinery/v1/backends"
 	"github.com/Guazi-inc/machinery/v1/tasks"
@@ -271,6 +272,61 @@ func (s *EagerBackendTestSuite) TestSetStateRetry() {
 	}
 }
 
+func (s *EagerBackendTestSuite) TestSetStateRevoked() {
+	t := &tasks.Signature{UUID: "revoked"}
+	s.Nil(s.backend.SetStatePending(t))
+
+	revoked, err := s.backend.IsRevoked(t.UUID)
+	s.Nil(err)
+	s.False(revoked)
+
+	s.Nil(s.backend.SetStateRevoked(t))
+	revoked, err = s.backend.IsRevoked(t.UUID)
+	s.Nil(err)
+	s.True(revoked)
+
+	// the revoked flag survives later state updates
+	s.Nil(s.backend.SetStateStarted(t))
+	revoked, err = s.backend.IsRevoked(t.UUID)
+	s.Nil(err)
+	s.True(revoked)
+
+	// all revoked tasks are returned at once
+	revokedUUIDs, err := s.backend.(backends.RevokedChecker).RevokedTasks([]string{"unknown", t.UUID})
+	s.Nil(err)
+	s.Equal([]string{t.UUID}, revokedUUIDs)
+}
+
+func (s *EagerBackendTestSuite) TestClaimKey() {
+	claimer := s.backend.(backends.KeyClaimer)
+
+	value, claimed, err := claimer.ClaimKey("order-1", "task-1", time.Minute)
+	s.Nil(err)
+	s.True(claimed)
+	s.Equal("task-1", value)
+
+	// The key is held by the task which claimed it first
+	value, claimed, err = claimer.ClaimKey("order-1", "task-2", time.Minute)
+	s.Nil(err)
+	s.False(claimed)
+	s.Equal("task-1", value)
+
+	// Released only by the task holding it
+	s.Nil(claimer.ReleaseKey("order-1", "task-2"))
+	_, claimed, _ = claimer.ClaimKey("order-1", "task-2", time.Minute)
+	s.False(claimed)
+	s.Nil(claimer.ReleaseKey("order-1", "task-1"))
+	_, claimed, _ = claimer.ClaimKey("order-1", "task-2", time.Minute)
+	s.True(claimed)
+
+	// Expired keys can be claimed again
+	_, claimed, _ = claimer.ClaimKey("order-2", "task-1", time.Millisecond)
+	s.True(claimed)
+	time.Sleep(5 * time.Millisecond)
+	_, claimed, _ = claimer.ClaimKey("order-2", "task-2", time.Minute)
+	s.True(claimed)
+}
+
 func (s *EagerBackendTestSuite) TestGetState() {
 	// get something not existed -- empty string
 	st, err := s.backend.GetState("")
@@ -1,6 +1,9 @@
 package backends
 
 import (
+	"context"
+	"time"
+
 	"github.com/Guazi-inc/machinery/v1/tasks"
 )
 
@@ -16,12 +19,50 @@ type Interface interface {
 	SetStatePending(signature *tasks.Signature) error
 	SetStateReceived(signature *tasks.Signature) error
 	SetStateStarted(signature *tasks.Signature) error
+	SetStateProgress(signature *tasks.Signature, progress *tasks.Progress) error
 	SetStateRetry(signature *tasks.Signature) error
 	SetStateSuccess(signature *tasks.Signature, results []*tasks.TaskResult) error
 	SetStateFailure(signature *tasks.Signature, err string) error
 	GetState(taskUUID string) (*tasks.TaskState, error)
 
+	// Revoking tasks, the revoked flag is kept apart from the task state
+	// so it survives state updates of a task which is already running
+	SetStateRevoked(signature *tasks.Signature) error
+	IsRevoked(taskUUID string) (bool, error)
+
 	// Purging stored stored tasks states and group meta data
 	PurgeState(taskUUID string) error
 	PurgeGroupMeta(groupUUID string) error
 }
+
+// Notifier is implemented by result backends which push state changes of
+// tasks, so waiting for a result does not have to poll the backend
+type Notifier interface {
+	// WaitCompleted blocks until the task completes or the context is done
+	WaitCompleted(ctx context.Context, taskUUID string) (*tasks.TaskState, error)
+}
+
+// RevokedChecker is implemented by result backends which can check whether
+// many tasks have been revoked at once
+type RevokedChecker interface {
+	// RevokedTasks returns UUIDs of the tasks which have been revoked
+	RevokedTasks(taskUUIDs []string) ([]string, error)
+}
+
+// KeyClaimer is implemented by result backends which can keep keys shared by
+// all workers and publishers, e.g. idempotency keys of tasks. Redis backend
+// does not implement it as keys are kept in its Redis server directly.
+type KeyClaimer interface {
+	// ClaimKey sets the key to value for the expiry unless it is set already.
+	// It returns the value the key is set to and false if it has been set
+	// already.
+	ClaimKey(key, value string, expiry time.Duration) (string, bool, error)
+	// ReleaseKey deletes the key if it is still set to value
+	ReleaseKey(key, value string) error
+}
+
+// Pinger is implemented by result backends which can check they are reachable
+type Pinger interface {
+	// Ping returns an error if the backend cannot be reached
+	Ping() error
+}
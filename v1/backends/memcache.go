@@ -139,6 +139,12 @@ func (b *MemcacheBackend) SetStateStarted(signature *tasks.Signature) error {
 	return b.updateState(taskState)
 }
 
+// SetStateProgress updates task state to PROGRESS
+func (b *MemcacheBackend) SetStateProgress(signature *tasks.Signature, progress *tasks.Progress) error {
+	taskState := tasks.NewProgressTaskState(signature, progress)
+	return b.updateState(taskState)
+}
+
 // SetStateRetry updates task state to RETRY
 func (b *MemcacheBackend) SetStateRetry(signature *tasks.Signature) error {
 	state := tasks.NewRetryTaskState(signature)
@@ -157,6 +163,53 @@ func (b *MemcacheBackend) SetStateFailure(signature *tasks.Signature, err string
 	return b.updateState(taskState)
 }
 
+// SetStateRevoked updates task state to REVOKED and flags the task as revoked
+func (b *MemcacheBackend) SetStateRevoked(signature *tasks.Signature) error {
+	err := b.getClient().Set(&memcache.Item{
+		Key:        withRevokedSuffix(signature.UUID),
+		Value:      []byte("1"),
+		Expiration: b.getExpirationTimestamp(),
+	})
+	if err != nil {
+		return err
+	}
+
+	taskState := tasks.NewRevokedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// IsRevoked returns true if the task has been revoked
+func (b *MemcacheBackend) IsRevoked(taskUUID string) (bool, error) {
+	_, err := b.getClient().Get(withRevokedSuffix(taskUUID))
+	if err == memcache.ErrCacheMiss {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// RevokedTasks returns UUIDs of the tasks which have been revoked
+func (b *MemcacheBackend) RevokedTasks(taskUUIDs []string) ([]string, error) {
+	keys := make([]string, 0, len(taskUUIDs))
+	for _, taskUUID := range taskUUIDs {
+		keys = append(keys, withRevokedSuffix(taskUUID))
+	}
+	items, err := b.getClient().GetMulti(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := make([]string, 0, len(items))
+	for _, taskUUID := range taskUUIDs {
+		if _, ok := items[withRevokedSuffix(taskUUID)]; ok {
+			revoked = append(revoked, taskUUID)
+		}
+	}
+	return revoked, nil
+}
+
 // GetState returns the latest task state
 func (b *MemcacheBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
 	item, err := b.getClient().Get(taskUUID)
@@ -262,6 +315,53 @@ func (b *MemcacheBackend) getStates(taskUUIDs ...string) ([]*tasks.TaskState, er
 	return states, nil
 }
 
+// ClaimKey sets the key to value for the expiry unless it is set already
+func (b *MemcacheBackend) ClaimKey(key, value string, expiry time.Duration) (string, bool, error) {
+	for {
+		err := b.getClient().Add(&memcache.Item{
+			Key:        key,
+			Value:      []byte(value),
+			Expiration: int32(time.Now().Add(expiry).Unix()),
+		})
+		if err == nil {
+			return value, true, nil
+		}
+		if err != memcache.ErrNotStored {
+			return "", false, err
+		}
+
+		item, err := b.getClient().Get(key)
+		// The key has expired in the meantime, try to claim it again
+		if err == memcache.ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return string(item.Value), false, nil
+	}
+}
+
+// ReleaseKey deletes the key if it is still set to value
+func (b *MemcacheBackend) ReleaseKey(key, value string) error {
+	item, err := b.getClient().Get(key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if string(item.Value) != value {
+		return nil
+	}
+
+	err = b.getClient().Delete(key)
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
 // getExpirationTimestamp returns expiration timestamp
 func (b *MemcacheBackend) getExpirationTimestamp() int32 {
 	expiresIn := b.cnf.ResultsExpireIn
@@ -279,3 +379,13 @@ func (b *MemcacheBackend) getClient() *memcache.Client {
 	}
 	return b.client
 }
+
+// Ping checks the Memcache servers are reachable, a missing key means the
+// server has answered
+func (b *MemcacheBackend) Ping() error {
+	_, err := b.getClient().Get("machinery_ping")
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
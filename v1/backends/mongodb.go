@@ -17,6 +17,7 @@ type MongodbBackend struct {
 	session              *mgo.Session
 	tasksCollection      *mgo.Collection
 	groupMetasCollection *mgo.Collection
+	keysCollection       *mgo.Collection
 }
 
 // NewMongodbBackend creates MongodbBackend instance
@@ -130,6 +131,12 @@ func (b *MongodbBackend) SetStateStarted(signature *tasks.Signature) error {
 	return b.updateState(signature, update)
 }
 
+// SetStateProgress updates task state to PROGRESS
+func (b *MongodbBackend) SetStateProgress(signature *tasks.Signature, progress *tasks.Progress) error {
+	update := bson.M{"state": tasks.StateProgress, "progress": progress}
+	return b.updateState(signature, update)
+}
+
 // SetStateRetry updates task state to RETRY
 func (b *MongodbBackend) SetStateRetry(signature *tasks.Signature) error {
 	update := bson.M{"state": tasks.StateRetry}
@@ -179,6 +186,46 @@ func (b *MongodbBackend) SetStateFailure(signature *tasks.Signature, err string)
 	return b.updateState(signature, update)
 }
 
+// SetStateRevoked updates task state to REVOKED and flags the task as revoked
+func (b *MongodbBackend) SetStateRevoked(signature *tasks.Signature) error {
+	update := bson.M{"state": tasks.StateRevoked, "revoked": true}
+	return b.updateState(signature, update)
+}
+
+// IsRevoked returns true if the task has been revoked
+func (b *MongodbBackend) IsRevoked(taskUUID string) (bool, error) {
+	if err := b.connect(); err != nil {
+		return false, err
+	}
+
+	count, err := b.tasksCollection.Find(bson.M{"_id": taskUUID, "revoked": true}).Count()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// RevokedTasks returns UUIDs of the tasks which have been revoked
+func (b *MongodbBackend) RevokedTasks(taskUUIDs []string) ([]string, error) {
+	if err := b.connect(); err != nil {
+		return nil, err
+	}
+
+	var states []struct {
+		TaskUUID string `bson:"_id"`
+	}
+	query := bson.M{"_id": bson.M{"$in": taskUUIDs}, "revoked": true}
+	if err := b.tasksCollection.Find(query).Select(bson.M{"_id": 1}).All(&states); err != nil {
+		return nil, err
+	}
+
+	revoked := make([]string, 0, len(states))
+	for _, state := range states {
+		revoked = append(revoked, state.TaskUUID)
+	}
+	return revoked, nil
+}
+
 // GetState returns the latest task state
 func (b *MongodbBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
 	if err := b.connect(); err != nil {
@@ -266,8 +313,12 @@ func (b *MongodbBackend) updateState(signature *tasks.Signature, update bson.M)
 		return err
 	}
 
-	update = bson.M{"$set": update}
-	_, err := b.tasksCollection.UpsertId(signature.UUID, update)
+	change := bson.M{"$set": update}
+	// Progress is kept only while the task reports it
+	if _, ok := update["progress"]; !ok {
+		change["$unset"] = bson.M{"progress": ""}
+	}
+	_, err := b.tasksCollection.UpsertId(signature.UUID, change)
 	if err != nil {
 		return err
 	}
@@ -290,6 +341,16 @@ func (b *MongodbBackend) connect() error {
 
 	b.tasksCollection = b.session.DB("").C("tasks")
 	b.groupMetasCollection = b.session.DB("").C("group_metas")
+	b.keysCollection = b.session.DB("").C("keys")
+
+	// Claimed keys are removed once they have expired
+	if err := b.keysCollection.EnsureIndex(mgo.Index{
+		Key:         []string{"expires_at"},
+		Background:  true,
+		ExpireAfter: time.Second,
+	}); err != nil {
+		return err
+	}
 
 	return b.createMongoIndexes()
 }
@@ -328,3 +389,73 @@ func (b *MongodbBackend) createMongoIndexes() error {
 
 	return nil
 }
+
+// claimedKey is a key claimed by ClaimKey
+type claimedKey struct {
+	Key       string    `bson:"_id"`
+	Value     string    `bson:"value"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// ClaimKey sets the key to value for the expiry unless it is set already
+func (b *MongodbBackend) ClaimKey(key, value string, expiry time.Duration) (string, bool, error) {
+	if err := b.connect(); err != nil {
+		return "", false, err
+	}
+
+	for {
+		now := time.Now().UTC()
+		claimed := &claimedKey{Key: key, Value: value, ExpiresAt: now.Add(expiry)}
+		err := b.keysCollection.Insert(claimed)
+		if err == nil {
+			return value, true, nil
+		}
+		if !mgo.IsDup(err) {
+			return "", false, err
+		}
+
+		// Expired keys are only removed every now and then, take it over
+		err = b.keysCollection.Update(
+			bson.M{"_id": key, "expires_at": bson.M{"$lte": now}},
+			bson.M{"$set": bson.M{"value": value, "expires_at": claimed.ExpiresAt}},
+		)
+		if err == nil {
+			return value, true, nil
+		}
+		if err != mgo.ErrNotFound {
+			return "", false, err
+		}
+
+		existing := new(claimedKey)
+		err = b.keysCollection.FindId(key).One(existing)
+		// The key has been released in the meantime, try to claim it again
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		return existing.Value, false, nil
+	}
+}
+
+// ReleaseKey deletes the key if it is still set to value
+func (b *MongodbBackend) ReleaseKey(key, value string) error {
+	if err := b.connect(); err != nil {
+		return err
+	}
+
+	err := b.keysCollection.Remove(bson.M{"_id": key, "value": value})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// Ping checks the MongoDB server is reachable
+func (b *MongodbBackend) Ping() error {
+	if err := b.connect(); err != nil {
+		return err
+	}
+	return b.session.Ping()
+}
@@ -3,6 +3,7 @@ package backends
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/Guazi-inc/machinery/v1/common"
@@ -17,6 +18,10 @@ func withResultSuffix(queue string) string {
 	return queue + "_result"
 }
 
+func withRevokedSuffix(taskUUID string) string {
+	return taskUUID + "_revoked"
+}
+
 // RedisBackend represents a Memcache result backend
 type RedisBackend struct {
 	Backend
@@ -27,6 +32,9 @@ type RedisBackend struct {
 	// If set, path to a socket file overrides hostname
 	socketPath string
 	redsync    *redsync.Redsync
+	// Subscriber to state changes of tasks, created on first use
+	notifier   *redisNotifier
+	notifierMu sync.Mutex
 	common.RedisConnector
 }
 
@@ -155,6 +163,12 @@ func (b *RedisBackend) SetStateStarted(signature *tasks.Signature) error {
 	return b.updateState(taskState)
 }
 
+// SetStateProgress updates task state to PROGRESS
+func (b *RedisBackend) SetStateProgress(signature *tasks.Signature, progress *tasks.Progress) error {
+	taskState := tasks.NewProgressTaskState(signature, progress)
+	return b.updateState(taskState)
+}
+
 // SetStateRetry updates task state to RETRY
 func (b *RedisBackend) SetStateRetry(signature *tasks.Signature) error {
 	state := tasks.NewRetryTaskState(signature)
@@ -173,6 +187,54 @@ func (b *RedisBackend) SetStateFailure(signature *tasks.Signature, err string) e
 	return b.updateState(taskState)
 }
 
+// SetStateRevoked updates task state to REVOKED and flags the task as revoked
+func (b *RedisBackend) SetStateRevoked(signature *tasks.Signature) error {
+	conn := b.open()
+	defer conn.Close()
+
+	_, err := conn.Do("SET", withRevokedSuffix(signature.UUID), 1)
+	if err != nil {
+		return err
+	}
+
+	if err := b.setExpirationTime(withRevokedSuffix(signature.UUID)); err != nil {
+		return err
+	}
+
+	taskState := tasks.NewRevokedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// IsRevoked returns true if the task has been revoked
+func (b *RedisBackend) IsRevoked(taskUUID string) (bool, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("EXISTS", withRevokedSuffix(taskUUID)))
+}
+
+// RevokedTasks returns UUIDs of the tasks which have been revoked
+func (b *RedisBackend) RevokedTasks(taskUUIDs []string) ([]string, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	for _, taskUUID := range taskUUIDs {
+		conn.Send("EXISTS", withRevokedSuffix(taskUUID))
+	}
+	exist, err := redis.Ints(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+
+	revoked := make([]string, 0, len(taskUUIDs))
+	for i, taskUUID := range taskUUIDs {
+		if exist[i] > 0 {
+			revoked = append(revoked, taskUUID)
+		}
+	}
+	return revoked, nil
+}
+
 // GetState returns the latest task state
 func (b *RedisBackend) GetState(taskUUID string) (*tasks.TaskState, error) {
 	conn := b.open()
@@ -286,7 +348,17 @@ func (b *RedisBackend) updateState(taskState *tasks.TaskState) error {
 		return err
 	}
 
-	return b.setExpirationTime(taskState.TaskUUID)
+	if err := b.setExpirationTime(taskState.TaskUUID); err != nil {
+		return err
+	}
+
+	// Wake up callers waiting for the result, they fall back to checking
+	// the state periodically if the notification is lost
+	if _, err := conn.Do("PUBLISH", withStateChannelSuffix(taskState.TaskUUID), taskState.State); err != nil {
+		log.WARNING.Printf("Failed to notify state change of task %s: %s", taskState.TaskUUID, err)
+	}
+
+	return nil
 }
 
 // setExpirationTime sets expiration timestamp on a stored task state
@@ -320,3 +392,18 @@ func (b *RedisBackend) open() redis.Conn {
 	}
 	return b.pool.Get()
 }
+
+// GetConn returns a connection from the pool of the backend, it lets other
+// components keep state in the same Redis server
+func (b *RedisBackend) GetConn() redis.Conn {
+	return b.open()
+}
+
+// Ping checks the Redis server is reachable
+func (b *RedisBackend) Ping() error {
+	conn := b.open()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return err
+}
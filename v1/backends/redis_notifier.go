@@ -0,0 +1,174 @@
+package backends
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/common"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	redisStateChannelSuffix = "_state"
+	// Subscriber connection is pinged so it does not hit the read timeout
+	redisNotifierPingInterval = 5 * time.Second
+	// Task state is checked again now and then in case a notification
+	// has been lost
+	redisNotifierRecheckInterval = 5 * time.Second
+)
+
+// withStateChannelSuffix returns the channel notified about state changes of
+// the task
+func withStateChannelSuffix(taskUUID string) string {
+	return taskUUID + redisStateChannelSuffix
+}
+
+// redisNotifier shares a single subscriber connection among all callers
+// waiting for state changes of tasks
+type redisNotifier struct {
+	open    func() redis.Conn
+	pubsub  *common.RedisPubSub
+	waiters map[string]map[chan struct{}]bool
+	mu      sync.Mutex
+}
+
+// subscribe returns a channel receiving a value whenever the channel is
+// notified and a channel closed once the connection fails, the caller has to
+// subscribe again then. Cancel has to be called once the caller stops
+// waiting.
+func (n *redisNotifier) subscribe(channel string) (events <-chan struct{}, failed <-chan struct{}, cancel func(), err error) {
+	n.mu.Lock()
+	if n.pubsub == nil {
+		n.pubsub = common.NewRedisPubSub(n.open(), redisNotifierPingInterval, n.receive)
+		n.waiters = make(map[string]map[chan struct{}]bool)
+		go n.watch(n.pubsub)
+	}
+	pubsub := n.pubsub
+
+	subscribe := len(n.waiters[channel]) == 0
+	if subscribe {
+		n.waiters[channel] = make(map[chan struct{}]bool)
+	}
+	waiter := make(chan struct{}, 1)
+	n.waiters[channel][waiter] = true
+	n.mu.Unlock()
+
+	cancel = func() { n.unsubscribe(pubsub, channel, waiter) }
+
+	// Subscribing waits for the reading goroutine, which notifies waiters
+	// under the lock
+	if subscribe {
+		if err := pubsub.Subscribe(channel); err != nil {
+			cancel()
+			return nil, nil, nil, err
+		}
+	}
+	return waiter, pubsub.Done(), cancel, nil
+}
+
+// unsubscribe stops notifying the caller, the connection is closed once
+// nobody is waiting
+func (n *redisNotifier) unsubscribe(pubsub *common.RedisPubSub, channel string, events chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// The connection has been replaced after an error
+	if n.pubsub != pubsub {
+		return
+	}
+
+	delete(n.waiters[channel], events)
+	if len(n.waiters[channel]) > 0 {
+		return
+	}
+	delete(n.waiters, channel)
+
+	if len(n.waiters) == 0 {
+		n.pubsub = nil
+		pubsub.Close()
+		return
+	}
+	pubsub.Unsubscribe(channel)
+}
+
+// receive passes a notification to waiters of its channel
+func (n *redisNotifier) receive(message redis.Message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for events := range n.waiters[message.Channel] {
+		notify(events)
+	}
+}
+
+// watch drops the connection once it fails, so it is opened again by the
+// next subscriber
+func (n *redisNotifier) watch(pubsub *common.RedisPubSub) {
+	<-pubsub.Done()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.pubsub != pubsub {
+		return
+	}
+	n.pubsub = nil
+	n.waiters = nil
+}
+
+// notify wakes up the waiter unless it has a notification pending already
+func notify(events chan struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+// WaitCompleted blocks until the task completes, it is notified about state
+// changes of the task through Redis pub/sub
+func (b *RedisBackend) WaitCompleted(ctx context.Context, taskUUID string) (*tasks.TaskState, error) {
+	b.notifierMu.Lock()
+	if b.notifier == nil {
+		b.notifier = &redisNotifier{open: b.open}
+	}
+	notifier := b.notifier
+	b.notifierMu.Unlock()
+
+	// Subscribe before checking the state so no change is missed
+	channel := withStateChannelSuffix(taskUUID)
+	events, failed, cancel, err := notifier.subscribe(channel)
+	if err != nil {
+		return nil, err
+	}
+	// Subscribing again replaces cancel, it is nil if that has failed
+	defer func() {
+		if cancel != nil {
+			cancel()
+		}
+	}()
+
+	recheck := time.NewTicker(redisNotifierRecheckInterval)
+	defer recheck.Stop()
+
+	for {
+		taskState, err := b.GetState(taskUUID)
+		if err == nil && taskState.IsCompleted() {
+			return taskState, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-events:
+		case <-recheck.C:
+		case <-failed:
+			cancel()
+			events, failed, cancel, err = notifier.subscribe(channel)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package backends_test
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"testing"
 	"time"
@@ -143,3 +145,67 @@ func TestPurgeStateRedis(t *testing.T) {
 	assert.Nil(t, taskState)
 	assert.Error(t, err)
 }
+
+func TestRevokedRedis(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+	if redisURL == "" {
+		return
+	}
+
+	// Revoked flags are not purged with task states, use a fresh UUID
+	signature := &tasks.Signature{
+		UUID: fmt.Sprintf("testRevokedTaskUUID_%d", time.Now().UnixNano()),
+	}
+
+	backend := backends.NewRedisBackend(new(config.Config), redisURL, redisPassword, "", 0)
+
+	revoked, err := backend.IsRevoked(signature.UUID)
+	if assert.NoError(t, err) {
+		assert.False(t, revoked)
+	}
+
+	assert.NoError(t, backend.SetStateRevoked(signature))
+	backend.SetStateStarted(signature)
+
+	revoked, err = backend.IsRevoked(signature.UUID)
+	if assert.NoError(t, err) {
+		assert.True(t, revoked)
+	}
+
+	revokedUUIDs, err := backend.(backends.RevokedChecker).RevokedTasks([]string{"testRevokedTaskUUID_unknown", signature.UUID})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{signature.UUID}, revokedUUIDs)
+	}
+}
+
+func TestWaitCompletedRedis(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+	if redisURL == "" {
+		return
+	}
+
+	signature := &tasks.Signature{
+		UUID: fmt.Sprintf("testWaitTaskUUID_%d", time.Now().UnixNano()),
+	}
+
+	backend := backends.NewRedisBackend(new(config.Config), redisURL, redisPassword, "", 0)
+	backend.SetStatePending(signature)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		backend.SetStateStarted(signature)
+		backend.SetStateSuccess(signature, []*tasks.TaskResult{})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	taskState, err := backend.(backends.Notifier).WaitCompleted(ctx, signature.UUID)
+	if assert.NoError(t, err) {
+		assert.True(t, taskState.IsSuccess())
+	}
+
+	backend.PurgeState(signature.UUID)
+}
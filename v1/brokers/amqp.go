@@ -1,6 +1,7 @@
 package brokers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -41,7 +42,7 @@ func (b *AMQPBroker) StartConsuming(consumerTag string, concurrency int, taskPro
 		false,                   // queue delete when unused
 		b.cnf.AMQP.BindingKey, // queue binding key
 		nil, // exchange declare args
-		nil, // queue declare args
+		b.queueDeclareArgs(), // queue declare args
 		amqp.Table(b.cnf.AMQP.QueueBindingArgs), // queue binding args
 	)
 	if err != nil {
@@ -71,6 +72,11 @@ func (b *AMQPBroker) StartConsuming(consumerTag string, concurrency int, taskPro
 		return b.retry, fmt.Errorf("Queue consume error: %s", err)
 	}
 
+	// The consumer is disconnected once consume returns, either because the
+	// connection has been closed or because consuming has been stopped
+	b.setConsumerConnected(true)
+	defer b.setConsumerConnected(false)
+
 	log.INFO.Print("[*] Waiting for messages. To exit press CTRL+C")
 
 	if err := b.consume(deliveries, concurrency, taskProcessor, amqpCloseChan); err != nil {
@@ -83,6 +89,12 @@ func (b *AMQPBroker) StartConsuming(consumerTag string, concurrency int, taskPro
 	return b.retry, nil
 }
 
+// IsConsumerConnected returns true while the consumer is connected to the
+// AMQP server
+func (b *AMQPBroker) IsConsumerConnected() bool {
+	return b.isConsumerConnected()
+}
+
 // StopConsuming quits the loop
 func (b *AMQPBroker) StopConsuming() {
 	b.stopConsuming()
@@ -93,6 +105,17 @@ func (b *AMQPBroker) StopConsuming() {
 
 // Publish places a new message on the default queue
 func (b *AMQPBroker) Publish(signature *tasks.Signature) error {
+	return b.PublishWithContext(context.Background(), signature)
+}
+
+// PublishWithContext places a new message on the default queue. Once the
+// context is done it stops waiting for the broker to confirm the message,
+// which may still be delivered then.
+func (b *AMQPBroker) PublishWithContext(ctx context.Context, signature *tasks.Signature) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	b.AdjustRoutingKey(signature)
 
 	// Check the ETA signature field, if it is set and it is in the future,
@@ -122,7 +145,7 @@ func (b *AMQPBroker) Publish(signature *tasks.Signature) error {
 		false,                   // queue delete when unused
 		b.cnf.AMQP.BindingKey, // queue binding key
 		nil, // exchange declare args
-		nil, // queue declare args
+		b.queueDeclareArgs(), // queue declare args
 		amqp.Table(b.cnf.AMQP.QueueBindingArgs), // queue binding args
 	)
 	if err != nil {
@@ -140,18 +163,30 @@ func (b *AMQPBroker) Publish(signature *tasks.Signature) error {
 			ContentType:  "application/json",
 			Body:         message,
 			DeliveryMode: amqp.Persistent,
+			Priority:     signature.Priority,
 		},
 	); err != nil {
 		return err
 	}
 
-	confirmed := <-confirmsChan
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case confirmed := <-confirmsChan:
+		if confirmed.Ack {
+			return nil
+		}
+		return fmt.Errorf("Failed delivery of delivery tag: %v", confirmed.DeliveryTag)
+	}
+}
 
-	if confirmed.Ack {
+// queueDeclareArgs returns arguments the queue is declared with, the queue
+// supports priorities if max priority is configured
+func (b *AMQPBroker) queueDeclareArgs() amqp.Table {
+	if b.cnf.AMQP.MaxPriority <= 0 {
 		return nil
 	}
-
-	return fmt.Errorf("Failed delivery of delivery tag: %v", confirmed.DeliveryTag)
+	return amqp.Table{"x-max-priority": int32(b.cnf.AMQP.MaxPriority)}
 }
 
 // consume takes delivered messages from the channel and manages a worker pool
@@ -175,13 +210,24 @@ func (b *AMQPBroker) consume(deliveries <-chan amqp.Delivery, concurrency int, t
 		case err := <-errorsChan:
 			return err
 		case d := <-deliveries:
+			b.processingWG.Add(1)
+
+			release, signature, ok := acquireTask(d.Body, taskProcessor)
+			if !ok {
+				// A task over its concurrency limits is sent back without
+				// taking a slot of the worker pool
+				go func() {
+					b.delayOne(d, signature, taskProcessor)
+					b.processingWG.Done()
+				}()
+				continue
+			}
+
 			if concurrency > 0 {
 				// get worker from pool (blocks until one is available)
 				<-pool
 			}
 
-			b.processingWG.Add(1)
-
 			// Consume the task inside a gotourine so multiple tasks
 			// can be processed concurrently
 			go func() {
@@ -189,6 +235,7 @@ func (b *AMQPBroker) consume(deliveries <-chan amqp.Delivery, concurrency int, t
 					errorsChan <- err
 				}
 
+				release()
 				b.processingWG.Done()
 
 				if concurrency > 0 {
@@ -235,6 +282,18 @@ func (b *AMQPBroker) consumeOne(d amqp.Delivery, taskProcessor TaskProcessor) er
 	return taskProcessor.Process(signature)
 }
 
+// delayOne hands a task over its concurrency limits to the task processor to
+// be published again for later, the message is acknowledged once that is done
+// and requeued otherwise
+func (b *AMQPBroker) delayOne(d amqp.Delivery, signature *tasks.Signature, taskProcessor TaskProcessor) {
+	if err := taskProcessor.(TaskLimiter).DelayTask(signature); err != nil {
+		log.ERROR.Printf("Delay task over its concurrency limits error: %s", err)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
 // delay a task by delayDuration miliseconds, the way it works is a new queue
 // is created without any consumers, the message is then published to this queue
 // with appropriate ttl expiration headers, after the expiration, it is sent to
@@ -295,6 +354,7 @@ func (b *AMQPBroker) delay(signature *tasks.Signature, delayMs int64) error {
 			ContentType:  "application/json",
 			Body:         message,
 			DeliveryMode: amqp.Persistent,
+			Priority:     signature.Priority,
 		},
 	); err != nil {
 		return err
@@ -311,28 +371,272 @@ func (b *AMQPBroker) GetConn() redis.Conn {
 	return nil
 }
 
+// CountDelayedTasks is not supported, delayed tasks wait in a queue per
+// delay which cannot be listed
 func (b *AMQPBroker) CountDelayedTasks() (int, error) {
-	return 0, nil
+	return 0, ErrNotSupported
 }
 
+// CountPendingTasks returns the number of tasks waiting in the queues of the
+// broker
 func (b *AMQPBroker) CountPendingTasks() (int, error) {
-	return 0, nil
+	queues, err := b.Queues()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, queue := range queues {
+		count, err := b.CountQueuePendingTasks(queue)
+		if err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// Queues returns the name of the queue tasks are consumed from
+func (b *AMQPBroker) Queues() ([]string, error) {
+	return []string{b.cnf.DefaultQueue}, nil
+}
+
+// CountQueuePendingTasks returns the number of tasks ready to be consumed from
+// the queue, tasks delivered to workers and not acknowledged yet are not
+// counted
+func (b *AMQPBroker) CountQueuePendingTasks(queue string) (int, error) {
+	conn, channel, err := b.Open(b.cnf.Broker, b.cnf.TLSConfig)
+	if err != nil {
+		return 0, err
+	}
+	defer b.Close(channel, conn)
+
+	inspected, err := b.InspectQueue(channel, queue)
+	if err != nil {
+		return 0, err
+	}
+	return inspected.Messages, nil
+}
+
+// CountQueueDelayedTasks is not supported, see CountDelayedTasks
+func (b *AMQPBroker) CountQueueDelayedTasks(queue string) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// GetQueuePendingTasks is not supported, tasks cannot be read without
+// consuming them
+func (b *AMQPBroker) GetQueuePendingTasks(queue string, indexStart, indexEnd int) ([]*tasks.Signature, error) {
+	return nil, ErrNotSupported
+}
+
+// GetQueueDelayedTasks is not supported, see CountDelayedTasks
+func (b *AMQPBroker) GetQueueDelayedTasks(queue string, indexStart, indexEnd int) ([]*tasks.Signature, error) {
+	return nil, ErrNotSupported
 }
 
+// GetDelayedTasks is not supported, see CountDelayedTasks
 func (b *AMQPBroker) GetDelayedTasks(_ int, _ int) ([]*tasks.Signature, error) {
-	return nil, nil
+	return nil, ErrNotSupported
 }
 
+// GetPendingTasks is not supported, see GetQueuePendingTasks
 func (b *AMQPBroker) GetPendingTasks(_ int, _ int) ([]*tasks.Signature, error) {
-	return nil, nil
+	return nil, ErrNotSupported
 }
 
-//CancelDelayTask _
+// CancelDelayTask does nothing, delayed tasks cannot be removed from the queue
+// they wait in and revoked ones are skipped by workers once they are due
 func (b *AMQPBroker) CancelDelayTask(uuid string) error {
 	return nil
 }
 
-//GetDelayTask _
+// GetDelayTask is not supported, see CountDelayedTasks
 func (b *AMQPBroker) GetDelayTask(uuid string) (*tasks.Signature, error) {
-	return nil, nil
+	return nil, ErrNotSupported
+}
+
+// openDeadLetterQueue declares the durable queue keeping dead letters of the
+// queue, it returns the number of dead letters in it
+func (b *AMQPBroker) openDeadLetterQueue(queue string) (*amqp.Connection, *amqp.Channel, string, int, error) {
+	conn, channel, err := b.Open(b.cnf.Broker, b.cnf.TLSConfig)
+	if err != nil {
+		return nil, nil, "", 0, err
+	}
+
+	queueName := b.deadLetterQueue(queue) + deadLetterSuffix
+	deadQueue, err := channel.QueueDeclare(
+		queueName, // name
+		true,      // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		nil,       // arguments
+	)
+	if err != nil {
+		b.Close(channel, conn)
+		return nil, nil, "", 0, fmt.Errorf("Queue declare error: %s", err)
+	}
+
+	return conn, channel, queueName, deadQueue.Messages, nil
+}
+
+// getDeadLetters reads up to limit dead letters of the queue without
+// acknowledging them, they return to the queue once the channel is closed.
+// Reading stops early once stop returns true. Messages which are not dead
+// letters are skipped.
+func (b *AMQPBroker) getDeadLetters(channel *amqp.Channel, queueName string, limit int, stop func(*tasks.DeadLetter, amqp.Delivery) bool) ([]*tasks.DeadLetter, error) {
+	deadLetters := make([]*tasks.DeadLetter, 0, limit)
+	for i := 0; i < limit; i++ {
+		d, ok, err := channel.Get(queueName, false)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+
+		deadLetter := new(tasks.DeadLetter)
+		if err := json.Unmarshal(d.Body, deadLetter); err != nil || deadLetter.Signature == nil {
+			log.WARNING.Printf("Skipping invalid dead letter in %s: %s", queueName, d.Body)
+			continue
+		}
+		deadLetters = append(deadLetters, deadLetter)
+
+		if stop != nil && stop(deadLetter, d) {
+			break
+		}
+	}
+	return deadLetters, nil
+}
+
+// taskQueue returns the queue the task has been routed to, the routing key of
+// the default queue is its binding key
+func (b *AMQPBroker) taskQueue(signature *tasks.Signature) string {
+	if b.cnf.AMQP != nil && signature.RoutingKey == b.cnf.AMQP.BindingKey {
+		return b.cnf.DefaultQueue
+	}
+	return b.deadLetterQueue(signature.RoutingKey)
+}
+
+// PublishDeadLetter keeps the failed task in the dead letter queue of its queue
+func (b *AMQPBroker) PublishDeadLetter(deadLetter *tasks.DeadLetter) error {
+	message, err := json.Marshal(deadLetter)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	conn, channel, queueName, _, err := b.openDeadLetterQueue(b.taskQueue(deadLetter.Signature))
+	if err != nil {
+		return err
+	}
+	defer b.Close(channel, conn)
+
+	return channel.Publish(
+		"",        // default exchange
+		queueName, // routing key
+		false,     // mandatory
+		false,     // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Body:         message,
+			DeliveryMode: amqp.Persistent,
+		},
+	)
+}
+
+// GetDeadLetters returns dead letters of the queue, oldest first. AMQP has no
+// random access to messages, so all of them up to indexEnd are read.
+func (b *AMQPBroker) GetDeadLetters(queue string, indexStart, indexEnd int) ([]*tasks.DeadLetter, error) {
+	conn, channel, queueName, count, err := b.openDeadLetterQueue(queue)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close(channel, conn)
+
+	// Negative indexes count from the end, so the whole queue is needed
+	limit := count
+	if indexStart >= 0 && indexEnd >= 0 && indexEnd < count {
+		limit = indexEnd + 1
+	}
+
+	deadLetters, err := b.getDeadLetters(channel, queueName, limit, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	start, end := indexRange(len(deadLetters), indexStart, indexEnd)
+	return deadLetters[start:end], nil
+}
+
+// GetDeadLetter returns a dead letter of the queue, nil if there is none
+func (b *AMQPBroker) GetDeadLetter(queue, uuid string) (*tasks.DeadLetter, error) {
+	conn, channel, queueName, count, err := b.openDeadLetterQueue(queue)
+	if err != nil {
+		return nil, err
+	}
+	defer b.Close(channel, conn)
+
+	var found *tasks.DeadLetter
+	_, err = b.getDeadLetters(channel, queueName, count, func(deadLetter *tasks.DeadLetter, d amqp.Delivery) bool {
+		if deadLetter.Signature.UUID == uuid {
+			found = deadLetter
+		}
+		return found != nil
+	})
+	return found, err
+}
+
+// DeleteDeadLetter removes a dead letter of the queue
+func (b *AMQPBroker) DeleteDeadLetter(queue, uuid string) error {
+	conn, channel, queueName, count, err := b.openDeadLetterQueue(queue)
+	if err != nil {
+		return err
+	}
+	defer b.Close(channel, conn)
+
+	var ackErr error
+	found := false
+	_, err = b.getDeadLetters(channel, queueName, count, func(deadLetter *tasks.DeadLetter, d amqp.Delivery) bool {
+		if deadLetter.Signature.UUID == uuid {
+			found = true
+			ackErr = d.Ack(false)
+		}
+		return found
+	})
+	if err != nil {
+		return err
+	}
+	return ackErr
+}
+
+// CountDeadLetters returns the number of dead letters of the queue
+func (b *AMQPBroker) CountDeadLetters(queue string) (int, error) {
+	conn, channel, _, count, err := b.openDeadLetterQueue(queue)
+	if err != nil {
+		return 0, err
+	}
+	defer b.Close(channel, conn)
+
+	return count, nil
+}
+
+// PurgeDeadLetters removes all dead letters of the queue
+func (b *AMQPBroker) PurgeDeadLetters(queue string) error {
+	conn, channel, queueName, _, err := b.openDeadLetterQueue(queue)
+	if err != nil {
+		return err
+	}
+	defer b.Close(channel, conn)
+
+	_, err = channel.QueuePurge(queueName, false)
+	return err
+}
+
+// Ping checks a connection to the AMQP server can be opened
+func (b *AMQPBroker) Ping() error {
+	conn, channel, err := b.Open(b.cnf.Broker, b.cnf.TLSConfig)
+	if err != nil {
+		return err
+	}
+	return b.Close(channel, conn)
 }
@@ -1,7 +1,9 @@
 package brokers
 
 import (
+	"encoding/json"
 	"errors"
+	"sync/atomic"
 
 	"github.com/Guazi-inc/machinery/v1/config"
 	"github.com/Guazi-inc/machinery/v1/log"
@@ -17,6 +19,8 @@ type Broker struct {
 	retryFunc           func(chan int)
 	retryStopChan       chan int
 	stopChan            chan int
+	// consumerConnected is 1 while the consumer is connected to the broker
+	consumerConnected int32
 }
 
 // New creates new Broker instance
@@ -44,6 +48,39 @@ func (b *Broker) GetPendingTasks(queue string) ([]*tasks.Signature, error) {
 	return nil, errors.New("Not implemented")
 }
 
+// deadLetterSuffix is appended to a queue name to get where its dead letters
+// are kept
+const deadLetterSuffix = "_dead"
+
+// deadLetterQueue returns the queue dead letters are kept for
+func (b *Broker) deadLetterQueue(queue string) string {
+	if queue == "" && b.cnf != nil {
+		return b.cnf.DefaultQueue
+	}
+	return queue
+}
+
+// indexRange converts inclusive start and end indexes, which may be negative
+// to count from the end like in Redis ZRANGE, to slice bounds
+func indexRange(length, indexStart, indexEnd int) (int, int) {
+	if indexStart < 0 {
+		indexStart += length
+	}
+	if indexEnd < 0 {
+		indexEnd += length
+	}
+	if indexStart < 0 {
+		indexStart = 0
+	}
+	if indexEnd >= length {
+		indexEnd = length - 1
+	}
+	if indexStart > indexEnd {
+		return 0, 0
+	}
+	return indexStart, indexEnd + 1
+}
+
 // AdjustRoutingKey makes sure the routing key is correct.
 // If the routing key is an empty string:
 // a) set it to binding key for direct exchange type
@@ -69,10 +106,27 @@ func (b *Broker) startConsuming(consumerTag string, taskProcessor TaskProcessor)
 		b.retryFunc = retry.Closure()
 	}
 
+	// Consuming may be started again after it has been stopped, e.g. when
+	// the worker is paused and resumed
+	b.retry = true
 	b.stopChan = make(chan int)
 	b.retryStopChan = make(chan int)
 }
 
+// setConsumerConnected records whether the consumer is connected to the
+// broker, see ConsumerMonitor
+func (b *Broker) setConsumerConnected(connected bool) {
+	var value int32
+	if connected {
+		value = 1
+	}
+	atomic.StoreInt32(&b.consumerConnected, value)
+}
+
+func (b *Broker) isConsumerConnected() bool {
+	return atomic.LoadInt32(&b.consumerConnected) == 1
+}
+
 // startConsuming is a common part of StopConsuming
 func (b *Broker) stopConsuming() {
 	// Do not retry from now on
@@ -86,3 +140,26 @@ func (b *Broker) stopConsuming() {
 	// Notifying the stop channel stops consuming of messages
 	b.stopChan <- 1
 }
+
+// acquireTask takes the slots the task in the message needs to run, if the
+// task processor limits how many instances of a task run at once. It returns
+// false with the task if it has reached its limits, such a task is handed to
+// the task processor to be delayed rather than waiting for a slot, so the
+// consume loop goes on with other tasks. Malformed messages are let through
+// to be reported once they are processed.
+func acquireTask(body []byte, taskProcessor TaskProcessor) (func(), *tasks.Signature, bool) {
+	limiter, ok := taskProcessor.(TaskLimiter)
+	if !ok {
+		return func() {}, nil, true
+	}
+
+	signature := new(tasks.Signature)
+	if err := json.Unmarshal(body, signature); err != nil {
+		return func() {}, nil, true
+	}
+
+	if release, ok := limiter.TryAcquireTask(signature.Name); ok {
+		return release, nil, true
+	}
+	return nil, signature, false
+}
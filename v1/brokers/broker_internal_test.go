@@ -0,0 +1,61 @@
+package brokers
+
+import (
+	"testing"
+
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+// testLimiter lets a single instance of every task run at once
+type testLimiter struct {
+	slots map[string]chan struct{}
+}
+
+func (limiter *testLimiter) Process(signature *tasks.Signature) error {
+	return nil
+}
+
+func (limiter *testLimiter) TryAcquireTask(name string) (func(), bool) {
+	select {
+	case limiter.slots[name] <- struct{}{}:
+		return func() { <-limiter.slots[name] }, true
+	default:
+		return nil, false
+	}
+}
+
+func (limiter *testLimiter) DelayTask(signature *tasks.Signature) error {
+	return nil
+}
+
+func TestAcquireTask(t *testing.T) {
+	limiter := &testLimiter{slots: map[string]chan struct{}{
+		"slow_task":  make(chan struct{}, 1),
+		"other_task": make(chan struct{}, 1),
+	}}
+
+	releaseSlow, _, ok := acquireTask([]byte(`{"UUID":"a","Name":"slow_task"}`), limiter)
+	assert.True(t, ok)
+
+	// Task over its limit is returned to be delayed, other tasks run meanwhile
+	_, signature, ok := acquireTask([]byte(`{"UUID":"b","Name":"slow_task"}`), limiter)
+	assert.False(t, ok)
+	if assert.NotNil(t, signature) {
+		assert.Equal(t, "b", signature.UUID)
+	}
+	releaseOther, _, ok := acquireTask([]byte(`{"UUID":"c","Name":"other_task"}`), limiter)
+	assert.True(t, ok)
+	releaseOther()
+
+	// Task runs once the slot is freed
+	releaseSlow()
+	releaseSlow, _, ok = acquireTask([]byte(`{"UUID":"b","Name":"slow_task"}`), limiter)
+	assert.True(t, ok)
+	releaseSlow()
+
+	// Malformed messages are let through to be reported
+	release, _, ok := acquireTask([]byte(`not json`), limiter)
+	assert.True(t, ok)
+	release()
+}
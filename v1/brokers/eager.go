@@ -1,9 +1,11 @@
 package brokers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
 
 	"github.com/Guazi-inc/machinery/v1/tasks"
 	"github.com/garyburd/redigo/redis"
@@ -13,6 +15,8 @@ import (
 type EagerBroker struct {
 	worker TaskProcessor
 	Broker
+	deadLetters   map[string][]*tasks.DeadLetter
+	deadLettersMu sync.Mutex
 }
 
 // NewEagerBroker creates new EagerBroker instance
@@ -37,6 +41,15 @@ func (eagerBroker *EagerBroker) StopConsuming() {
 
 // Publish places a new message on the default queue
 func (eagerBroker *EagerBroker) Publish(task *tasks.Signature) error {
+	return eagerBroker.PublishWithContext(context.Background(), task)
+}
+
+// PublishWithContext processes the task unless the context is done
+func (eagerBroker *EagerBroker) PublishWithContext(ctx context.Context, task *tasks.Signature) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
 	if eagerBroker.worker == nil {
 		return errors.New("worker is not assigned in eager-mode")
 	}
@@ -98,3 +111,72 @@ func (b *EagerBroker) CancelDelayTask(uuid string) error {
 func (b *EagerBroker) GetDelayTask(uuid string) (*tasks.Signature, error) {
 	return nil, nil
 }
+
+// PublishDeadLetter keeps the failed task in memory
+func (b *EagerBroker) PublishDeadLetter(deadLetter *tasks.DeadLetter) error {
+	b.deadLettersMu.Lock()
+	defer b.deadLettersMu.Unlock()
+
+	if b.deadLetters == nil {
+		b.deadLetters = make(map[string][]*tasks.DeadLetter)
+	}
+	queue := b.deadLetterQueue(deadLetter.Signature.RoutingKey)
+	b.deadLetters[queue] = append(b.deadLetters[queue], deadLetter)
+	return nil
+}
+
+// GetDeadLetters returns dead letters of the queue, oldest first
+func (b *EagerBroker) GetDeadLetters(queue string, indexStart, indexEnd int) ([]*tasks.DeadLetter, error) {
+	b.deadLettersMu.Lock()
+	defer b.deadLettersMu.Unlock()
+
+	deadLetters := b.deadLetters[b.deadLetterQueue(queue)]
+	start, end := indexRange(len(deadLetters), indexStart, indexEnd)
+	return append([]*tasks.DeadLetter{}, deadLetters[start:end]...), nil
+}
+
+// GetDeadLetter returns a dead letter of the queue, nil if there is none
+func (b *EagerBroker) GetDeadLetter(queue, uuid string) (*tasks.DeadLetter, error) {
+	b.deadLettersMu.Lock()
+	defer b.deadLettersMu.Unlock()
+
+	for _, deadLetter := range b.deadLetters[b.deadLetterQueue(queue)] {
+		if deadLetter.Signature.UUID == uuid {
+			return deadLetter, nil
+		}
+	}
+	return nil, nil
+}
+
+// DeleteDeadLetter removes a dead letter of the queue
+func (b *EagerBroker) DeleteDeadLetter(queue, uuid string) error {
+	b.deadLettersMu.Lock()
+	defer b.deadLettersMu.Unlock()
+
+	queue = b.deadLetterQueue(queue)
+	deadLetters := b.deadLetters[queue]
+	for i, deadLetter := range deadLetters {
+		if deadLetter.Signature.UUID == uuid {
+			b.deadLetters[queue] = append(deadLetters[:i:i], deadLetters[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// CountDeadLetters returns the number of dead letters of the queue
+func (b *EagerBroker) CountDeadLetters(queue string) (int, error) {
+	b.deadLettersMu.Lock()
+	defer b.deadLettersMu.Unlock()
+
+	return len(b.deadLetters[b.deadLetterQueue(queue)]), nil
+}
+
+// PurgeDeadLetters removes all dead letters of the queue
+func (b *EagerBroker) PurgeDeadLetters(queue string) error {
+	b.deadLettersMu.Lock()
+	defer b.deadLettersMu.Unlock()
+
+	delete(b.deadLetters, b.deadLetterQueue(queue))
+	return nil
+}
@@ -0,0 +1,50 @@
+package brokers_test
+
+import (
+	"testing"
+
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEagerDeadLetters(t *testing.T) {
+	broker := brokers.NewEagerBroker()
+
+	for _, uuid := range []string{"a", "b", "c"} {
+		deadLetter := tasks.NewDeadLetter(&tasks.Signature{UUID: uuid}, "error")
+		assert.NoError(t, broker.PublishDeadLetter(deadLetter))
+	}
+
+	uuids := func(start, end int) []string {
+		deadLetters, err := broker.GetDeadLetters("", start, end)
+		assert.NoError(t, err)
+		result := []string{}
+		for _, deadLetter := range deadLetters {
+			result = append(result, deadLetter.Signature.UUID)
+		}
+		return result
+	}
+
+	assert.Equal(t, []string{"a", "b", "c"}, uuids(0, -1))
+	assert.Equal(t, []string{"b"}, uuids(1, 1))
+	assert.Equal(t, []string{"b", "c"}, uuids(-2, 10))
+	assert.Equal(t, []string{}, uuids(2, 1))
+
+	deadLetter, err := broker.GetDeadLetter("", "b")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deadLetter.Attempts)
+
+	assert.NoError(t, broker.DeleteDeadLetter("", "b"))
+	assert.Equal(t, []string{"a", "c"}, uuids(0, -1))
+
+	deadLetter, err = broker.GetDeadLetter("", "b")
+	assert.NoError(t, err)
+	assert.Nil(t, deadLetter)
+	count, err := broker.CountDeadLetters("")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	assert.NoError(t, broker.PurgeDeadLetters(""))
+	assert.Equal(t, []string{}, uuids(0, -1))
+}
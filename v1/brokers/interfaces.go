@@ -1,6 +1,10 @@
 package brokers
 
 import (
+	"context"
+	"errors"
+
+	"github.com/Guazi-inc/machinery/v1/config"
 	"github.com/Guazi-inc/machinery/v1/tasks"
 	"github.com/garyburd/redigo/redis"
 )
@@ -13,6 +17,9 @@ const (
 
 var taskLoggers []taskLogger
 
+// ErrNotSupported is returned by brokers which cannot carry out an operation
+var ErrNotSupported = errors.New("Not supported by the broker")
+
 type RecordType int32
 
 type taskLogger func(queueName string, recordType RecordType, signare *tasks.Signature)
@@ -28,14 +35,26 @@ type Interface interface {
 	StartConsuming(consumerTag string, concurrency int, p TaskProcessor) (bool, error)
 	StopConsuming()
 	Publish(task *tasks.Signature) error
+	// PublishWithContext gives up publishing once the context is done
+	PublishWithContext(ctx context.Context, task *tasks.Signature) error
 	GetConn() (conn redis.Conn)
 	CancelDelayTask(uuid string) error
 	GetDelayTask(uuid string) (*tasks.Signature, error)
 
+	// Tasks waiting in all queues known to the broker
 	CountPendingTasks() (task_number int, err error)
 	CountDelayedTasks() (task_number int, err error)
 	GetPendingTasks(indexStart, indexEnd int) ([]*tasks.Signature, error)
 	GetDelayedTasks(indexStart, indexEnd int) ([]*tasks.Signature, error)
+
+	// Dead letters of tasks which failed after exhausting retry attempts,
+	// the default queue is used if queue is empty
+	PublishDeadLetter(deadLetter *tasks.DeadLetter) error
+	GetDeadLetters(queue string, indexStart, indexEnd int) ([]*tasks.DeadLetter, error)
+	GetDeadLetter(queue, uuid string) (*tasks.DeadLetter, error)
+	CountDeadLetters(queue string) (int, error)
+	DeleteDeadLetter(queue, uuid string) error
+	PurgeDeadLetters(queue string) error
 }
 
 // TaskProcessor - can process a delivered task
@@ -43,3 +62,59 @@ type Interface interface {
 type TaskProcessor interface {
 	Process(signature *tasks.Signature) error
 }
+
+// QueueConsumer is implemented by task processors which consume from other
+// queues than the default queue
+type QueueConsumer interface {
+	// ConsumingQueues returns queues to consume from, empty for the default queue
+	ConsumingQueues() []config.QueueConfig
+}
+
+// TaskLimiter is implemented by task processors which limit how many instances
+// of a task run at once. Brokers take the slots a task needs before handing it
+// over to the task processor and hand a task over its limits to DelayTask.
+// The eager broker does not, the task processor takes the slots itself.
+type TaskLimiter interface {
+	// TryAcquireTask takes the slots the task needs to run, it returns false
+	// if the task has reached its limits
+	TryAcquireTask(name string) (release func(), ok bool)
+	// DelayTask publishes the task over its limits again to be processed
+	// later, the message it has been delivered in can be acknowledged once
+	// DelayTask succeeds
+	DelayTask(signature *tasks.Signature) error
+}
+
+// QueueInspector is implemented by brokers which can inspect tasks waiting
+// in a single queue
+type QueueInspector interface {
+	// Queues returns names of the default queue, configured queues and
+	// queues tasks have been routed to
+	Queues() ([]string, error)
+	CountQueuePendingTasks(queue string) (int, error)
+	CountQueueDelayedTasks(queue string) (int, error)
+	GetQueuePendingTasks(queue string, indexStart, indexEnd int) ([]*tasks.Signature, error)
+	GetQueueDelayedTasks(queue string, indexStart, indexEnd int) ([]*tasks.Signature, error)
+}
+
+// ConsumerMonitor is implemented by brokers which tell whether their consumer
+// is connected, so health checks need not open connections of their own
+type ConsumerMonitor interface {
+	// IsConsumerConnected returns true while StartConsuming is connected to
+	// the broker and waiting for tasks
+	IsConsumerConnected() bool
+}
+
+// Pinger is implemented by brokers which can check they are reachable
+type Pinger interface {
+	// Ping returns an error if the broker cannot be reached
+	Ping() error
+}
+
+// QueueManager is implemented by brokers which can remove tasks waiting in a
+// queue or move them to another queue
+type QueueManager interface {
+	PurgePendingTasks(queue string) (int, error)
+	PurgeDelayedTasks(queue string) (int, error)
+	MovePendingTasks(queue, newQueue string, count int) (int, error)
+	MoveDelayedTasks(queue, newQueue string, count int) (int, error)
+}
@@ -1,9 +1,13 @@
 package brokers
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
@@ -12,12 +16,147 @@ import (
 	"github.com/Guazi-inc/machinery/v1/log"
 	"github.com/Guazi-inc/machinery/v1/tasks"
 	"github.com/garyburd/redigo/redis"
+	uuid "github.com/satori/go.uuid"
 	redsync "gopkg.in/redsync.v1"
 )
 
 const (
 	redisDelayedQueueSuffix      = "_delayed"
 	redisDelayedTaskDetailSuffix = "_detail"
+	redisProcessingSuffix        = "_processing"
+	redisConsumersSuffix         = "_consumers"
+	redisPrioritySuffix          = "_priority"
+	redisQueuesSuffix            = "_queues"
+
+	// default number of seconds after which messages of a dead consumer are requeued
+	defaultRedisVisibilityTimeout = 60
+	// how often the reliable consumer polls the queue when it is empty
+	redisReliablePollInterval = 100 * time.Millisecond
+)
+
+var (
+	// redisPriorityKeySource defines a Lua function returning the list of the
+	// queue the message belongs to according to its priority
+	redisPriorityKeySource = `
+local function priorityKey(queue, msg, maxPriority)
+	if maxPriority <= 0 then
+		return queue
+	end
+	local ok, signature = pcall(cjson.decode, msg)
+	if not ok or type(signature) ~= 'table' or type(signature['Priority']) ~= 'number' then
+		return queue
+	end
+	local priority = math.min(math.floor(signature['Priority']), maxPriority)
+	if priority <= 0 then
+		return queue
+	end
+	return queue .. '` + redisPrioritySuffix + `:' .. priority
+end
+`
+
+	// reliablePopScript moves the first message of the first non empty queue
+	// (first half of KEYS) to the tail of the consumer's processing list of
+	// that queue (second half of KEYS), the number of keys is passed first
+	reliablePopScript = redis.NewScript(-1, `
+local count = #KEYS / 2
+for i = 1, count do
+	local msg = redis.call('LPOP', KEYS[i])
+	if msg then
+		redis.call('RPUSH', KEYS[count + i], msg)
+		return {KEYS[i], msg}
+	end
+end
+return false
+`)
+
+	// requeueProcessingScript returns all messages from a processing list
+	// (KEYS[2]) to the head of the queue (KEYS[3]) and unregisters the
+	// consumer (ARGV[1]) from the consumers set (KEYS[1]), but only if its
+	// last heartbeat is not newer than ARGV[2]. Messages keep their priority
+	// if priorities up to ARGV[3] are enabled.
+	requeueProcessingScript = redis.NewScript(3, redisPriorityKeySource+`
+local heartbeat = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if heartbeat and tonumber(heartbeat) > tonumber(ARGV[2]) then
+	return 0
+end
+local count = 0
+local msg = redis.call('RPOP', KEYS[2])
+while msg do
+	redis.call('LPUSH', priorityKey(KEYS[3], msg, tonumber(ARGV[3])), msg)
+	count = count + 1
+	msg = redis.call('RPOP', KEYS[2])
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+return count
+`)
+
+	// reliableDelayedScript moves the next due delayed task from the ZSET
+	// (KEYS[1]) and its detail hash (KEYS[2]) to the tail of the queue (KEYS[3]),
+	// the task keeps its priority if priorities up to ARGV[2] are enabled
+	reliableDelayedScript = redis.NewScript(3, redisPriorityKeySource+`
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], 0, ARGV[1], 'LIMIT', 0, 1)
+if #items == 0 then
+	return false
+end
+redis.call('ZREM', KEYS[1], items[1])
+local msg = redis.call('HGET', KEYS[2], items[1])
+redis.call('HDEL', KEYS[2], items[1])
+if msg then
+	redis.call('RPUSH', priorityKey(KEYS[3], msg, tonumber(ARGV[2])), msg)
+end
+return items[1]
+`)
+)
+
+var (
+	// movePendingScript moves up to ARGV[2] messages (all if not positive)
+	// from the lists of a queue (all KEYS but the last, highest priority
+	// first) to the tail of the queue ARGV[1], messages keep their priority if
+	// priorities up to ARGV[3] are enabled. The queue is added to the set of
+	// routed queues (the last of KEYS) if ARGV[4] is 1 and any message has
+	// been moved. The number of keys is passed first.
+	movePendingScript = redis.NewScript(-1, redisPriorityKeySource+`
+local limit = tonumber(ARGV[2])
+local count = 0
+for i = 1, #KEYS - 1 do
+	while limit <= 0 or count < limit do
+		local msg = redis.call('LPOP', KEYS[i])
+		if not msg then
+			break
+		end
+		redis.call('RPUSH', priorityKey(ARGV[1], msg, tonumber(ARGV[3])), msg)
+		count = count + 1
+	end
+end
+if count > 0 and ARGV[4] == '1' then
+	redis.call('SADD', KEYS[#KEYS], ARGV[1])
+end
+return count
+`)
+
+	// moveDelayedScript moves up to ARGV[2] delayed tasks due first (all if
+	// not positive) from the ZSET (KEYS[1]) and the detail hash (KEYS[2]) of
+	// a queue to the ZSET (KEYS[3]) and the detail hash (KEYS[4]) of the queue
+	// ARGV[1], tasks keep their ETA. The queue is added to the set of routed
+	// queues (KEYS[5]) if ARGV[3] is 1 and any task has been moved.
+	moveDelayedScript = redis.NewScript(5, `
+local items = redis.call('ZRANGE', KEYS[1], 0, tonumber(ARGV[2]) - 1, 'WITHSCORES')
+local count = 0
+for i = 1, #items, 2 do
+	local msg = redis.call('HGET', KEYS[2], items[i])
+	redis.call('ZREM', KEYS[1], items[i])
+	redis.call('HDEL', KEYS[2], items[i])
+	if msg then
+		redis.call('ZADD', KEYS[3], items[i + 1], items[i])
+		redis.call('HSET', KEYS[4], items[i], msg)
+		count = count + 1
+	end
+end
+if count > 0 and ARGV[3] == '1' then
+	redis.call('SADD', KEYS[5], ARGV[1])
+end
+return count
+`)
 )
 
 func WithDelaySuffix(queue string) string {
@@ -28,17 +167,59 @@ func WithDetailSuffix(queue string) string {
 	return queue + redisDelayedTaskDetailSuffix
 }
 
+// withProcessingSuffix returns the key of the list holding messages which
+// are being processed by the consumer
+func withProcessingSuffix(queue, consumerID string) string {
+	return queue + redisProcessingSuffix + ":" + consumerID
+}
+
+// withConsumersSuffix returns the key of the sorted set holding heartbeats
+// of reliable consumers of the queue
+func withConsumersSuffix(queue string) string {
+	return queue + redisConsumersSuffix
+}
+
+// withQueuesSuffix returns the key of the set holding names of queues tasks
+// have been routed to, other than the default queue and configured queues
+func withQueuesSuffix(queue string) string {
+	return queue + redisQueuesSuffix
+}
+
+// withPrioritySuffix returns the key of the list holding messages of the
+// queue with the given priority, messages without priority stay in the queue
+func withPrioritySuffix(queue string, priority int) string {
+	if priority <= 0 {
+		return queue
+	}
+	return fmt.Sprintf("%s%s:%d", queue, redisPrioritySuffix, priority)
+}
+
+// withDeadSuffix returns the key of the sorted set holding UUIDs of dead
+// letters of the queue, ordered by the time they failed
+func withDeadSuffix(queue string) string {
+	return queue + deadLetterSuffix
+}
+
 // RedisBroker represents a Redis broker
 type RedisBroker struct {
 	host              string
 	password          string
 	db                int
 	pool              *redis.Pool
+	poolMu            sync.Mutex
 	stopReceivingChan chan int
 	stopDelayedChan   chan int
+	stopReaperChan    chan int
 	processingWG      sync.WaitGroup // use wait group to make sure task processing completes on interrupt signal
 	receivingWG       sync.WaitGroup
 	delayedWG         sync.WaitGroup
+	reaperWG          sync.WaitGroup
+	// Closes the stop channels once per StartConsuming, see stopGoroutines
+	stopOnce *sync.Once
+	// Unique ID of this consumer, used to name its processing lists in reliable mode
+	consumerID string
+	// Queues consumed by the running StartConsuming loop
+	queues []config.QueueConfig
 	// If set, path to a socket file overrides hostname
 	socketPath string
 	redsync    *redsync.Redsync
@@ -46,6 +227,12 @@ type RedisBroker struct {
 	common.RedisConnector
 }
 
+// redisDelivery is a message popped from one of the consumed queues
+type redisDelivery struct {
+	queue string
+	body  []byte
+}
+
 // NewRedisBroker creates new RedisBroker instance
 func NewRedisBroker(cnf *config.Config, host, password, socketPath string, db int) Interface {
 	b := &RedisBroker{Broker: New(cnf)}
@@ -61,10 +248,12 @@ func NewRedisBroker(cnf *config.Config, host, password, socketPath string, db in
 func (b *RedisBroker) StartConsuming(consumerTag string, concurrency int, taskProcessor TaskProcessor) (bool, error) {
 	b.startConsuming(consumerTag, taskProcessor)
 
-	b.pool = nil
+	// Connections are released once consuming stops, whatever uses the
+	// broker next opens a new pool, e.g. consuming resumed after the worker
+	// has been paused or a worker removing its heartbeat when quitting
 	conn := b.open()
 	defer conn.Close()
-	defer b.pool.Close()
+	defer b.closePool()
 
 	// Ping the server to make sure connection is live
 	_, err := conn.Do("PING")
@@ -72,19 +261,65 @@ func (b *RedisBroker) StartConsuming(consumerTag string, concurrency int, taskPr
 		b.retryFunc(b.retryStopChan)
 		return b.retry, err
 	}
+	b.setConsumerConnected(true)
+	defer b.setConsumerConnected(false)
+
+	queues := b.consumingQueues(taskProcessor)
 
 	// Channels and wait groups used to properly close down goroutines
 	b.stopReceivingChan = make(chan int)
 	b.stopDelayedChan = make(chan int)
-	b.receivingWG.Add(1)
-	b.delayedWG.Add(1)
+	b.stopReaperChan = make(chan int)
+	b.stopOnce = new(sync.Once)
+
+	if b.isReliable() {
+		if b.consumerID == "" {
+			b.consumerID = fmt.Sprintf("%s:%v", consumerTag, uuid.NewV4())
+		}
+
+		// Register the consumer before taking any messages so the reaper
+		// does not mistake its processing lists for abandoned ones
+		if err := b.heartbeat(queues); err != nil {
+			b.retryFunc(b.retryStopChan)
+			return b.retry, err
+		}
+
+		// A goroutine to keep sending heartbeats and to return messages
+		// held by dead consumers back to the queues
+		b.reaperWG.Add(1)
+		go func() {
+			defer b.reaperWG.Done()
+
+			ticker := time.NewTicker(b.heartbeatInterval())
+			defer ticker.Stop()
+
+			for {
+				select {
+				// A way to stop this goroutine from b.StopConsuming
+				case <-b.stopReaperChan:
+					return
+				case <-ticker.C:
+					if err := b.heartbeat(queues); err != nil {
+						log.ERROR.Printf("Consumer heartbeat error: %s", err)
+					}
+					for _, queue := range queues {
+						if err := b.reapDeadConsumers(queue.Name); err != nil {
+							log.ERROR.Printf("Requeue messages of dead consumers error: %s", err)
+						}
+					}
+				}
+			}
+		}()
+	}
 
 	// Channel to which we will push tasks ready for processing by worker
-	deliveries := make(chan []byte)
+	deliveries := make(chan redisDelivery)
 
-	// A receivig goroutine keeps popping messages from the queue by BLPOP
+	// A receivig goroutine keeps popping messages from the queues by BLPOP
+	// (or by moving them to the processing list in reliable mode)
 	// If the message is valid and can be unmarshaled into a proper structure
 	// we send it to the deliveries channel
+	b.receivingWG.Add(1)
 	go func() {
 		defer b.receivingWG.Done()
 
@@ -96,18 +331,34 @@ func (b *RedisBroker) StartConsuming(consumerTag string, concurrency int, taskPr
 			case <-b.stopReceivingChan:
 				return
 			default:
-				task, err := b.nextTask(b.cnf.DefaultQueue)
+				var (
+					delivery redisDelivery
+					err      error
+				)
+				if b.isReliable() {
+					delivery, err = b.nextReliableTask(queueOrder(queues)...)
+				} else {
+					delivery, err = b.nextTask(queueOrder(queues)...)
+				}
+				// Empty queues are no sign of a broken connection
+				b.setConsumerConnected(err == nil || err == redis.ErrNil)
 				if err != nil {
 					continue
 				}
 
-				deliveries <- task
+				select {
+				case deliveries <- delivery:
+				case <-b.stopReceivingChan:
+					b.putBack(delivery)
+					return
+				}
 			}
 		}
 	}()
 
 	// A goroutine to watch for delayed tasks and push them to deliveries
 	// channel for consumption by the worker
+	b.delayedWG.Add(1)
 	go func() {
 		defer b.delayedWG.Done()
 
@@ -117,56 +368,133 @@ func (b *RedisBroker) StartConsuming(consumerTag string, concurrency int, taskPr
 			case <-b.stopDelayedChan:
 				return
 			default:
-				delayedTask, err := b.nextDelayedTask(WithDelaySuffix(b.cnf.DefaultQueue))
-				if err != nil {
-					continue
+				for _, queue := range queues {
+					// In reliable mode due tasks are moved to the queue so they
+					// are consumed through the processing list like any other
+					if b.isReliable() {
+						if err := b.moveDelayedTask(queue.Name); err != nil {
+							log.ERROR.Printf("Move delayed task error: %s", err)
+						}
+						continue
+					}
+
+					delayedTask, err := b.nextDelayedTask(queue.Name)
+					if err != nil {
+						continue
+					}
+
+					delivery := redisDelivery{queue: queue.Name, body: delayedTask}
+					select {
+					case deliveries <- delivery:
+					case <-b.stopDelayedChan:
+						b.putBack(delivery)
+						return
+					}
 				}
-
-				deliveries <- delayedTask
 			}
 		}
 	}()
 
 	if err := b.consume(deliveries, concurrency, taskProcessor); err != nil {
+		// Messages which failed to be processed stay in the processing lists,
+		// the next run is another consumer so the reaper of any consumer
+		// returns them to the queues once this one stops sending heartbeats
+		b.stopGoroutines()
+		if b.isReliable() {
+			b.consumerID = ""
+		}
 		return b.retry, err
 	}
 
-	// Waiting for any tasks being processed to finish
-	b.processingWG.Wait()
+	// Waiting for the goroutines and any tasks being processed to finish
+	b.stopGoroutines()
 
 	return b.retry, nil
 }
 
-// StopConsuming quits the loop
-func (b *RedisBroker) StopConsuming() {
-	b.stopConsuming()
+// stopGoroutines stops the receiving, delayed tasks and heartbeat goroutines
+// started by StartConsuming and waits for them and for any tasks being
+// processed to finish. It is called both when consuming stops and when it
+// fails, the goroutines are stopped only once.
+func (b *RedisBroker) stopGoroutines() {
+	if b.stopOnce == nil {
+		return
+	}
+	b.stopOnce.Do(func() {
+		close(b.stopReceivingChan)
+		close(b.stopDelayedChan)
+		close(b.stopReaperChan)
+	})
 
-	// Stop the receiving goroutine
-	b.stopReceivingChan <- 1
 	// Waiting for the receiving goroutine to have stopped
 	b.receivingWG.Wait()
+	b.setConsumerConnected(false)
 
-	// Stop the delayed tasks goroutine
-	b.stopDelayedChan <- 1
 	// Waiting for the delayed tasks goroutine to have stopped
 	b.delayedWG.Wait()
 
 	// Waiting for any tasks being processed to finish
 	b.processingWG.Wait()
+
+	// Waiting for the heartbeat goroutine to have stopped
+	b.reaperWG.Wait()
+}
+
+// IsConsumerConnected returns true while the consumer is connected to the
+// Redis server, it turns false once popping tasks fails
+func (b *RedisBroker) IsConsumerConnected() bool {
+	return b.isConsumerConnected()
 }
 
-// Publish places a new message on the default queue
+// StopConsuming quits the loop
+func (b *RedisBroker) StopConsuming() {
+	b.stopConsuming()
+	b.stopGoroutines()
+
+	if b.isReliable() {
+		// Nothing is being processed anymore, anything left in the processing
+		// lists was never delivered so put it back for other consumers
+		for _, queue := range b.queues {
+			if err := b.requeueProcessing(queue.Name, b.consumerID, time.Now().UTC().UnixNano()); err != nil {
+				log.ERROR.Printf("Requeue processing list error: %s", err)
+			}
+		}
+	}
+}
+
+// Publish places a new message on the queue named by the routing key
 func (b *RedisBroker) Publish(signature *tasks.Signature) error {
+	return b.PublishWithContext(context.Background(), signature)
+}
+
+// PublishWithContext places a new message on the queue named by the routing
+// key unless the context is done. The message is placed by a single command
+// which is not interrupted once sent.
+func (b *RedisBroker) PublishWithContext(ctx context.Context, signature *tasks.Signature) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// There are no exchanges and binding keys in Redis, the routing key
+	// is simply the name of the queue
+	if signature.RoutingKey == "" {
+		signature.RoutingKey = b.cnf.DefaultQueue
+	}
+
 	msg, err := json.Marshal(signature)
 	if err != nil {
 		return fmt.Errorf("JSON marshal error: %s", err)
 	}
 
-	b.AdjustRoutingKey(signature)
-
 	conn := b.open()
 	defer conn.Close()
 
+	// Remember the queue so tasks routed to it can be found later, the reply
+	// is read together with the reply of pushing the task
+	if !b.isConfiguredQueue(signature.RoutingKey) {
+		conn.Send("SADD", withQueuesSuffix(b.cnf.DefaultQueue), signature.RoutingKey)
+	}
+
 	// Check the ETA signature field, if it is set and it is in the future,
 	// delay the task
 	if signature.ETA != nil && signature.ETA.After(time.Now().UTC()) {
@@ -175,14 +503,12 @@ func (b *RedisBroker) Publish(signature *tasks.Signature) error {
 
 		//conn.Send("SET", WithDetailSuffix(signature.UUID), msg)
 
-		conn.Send("HSET", WithDetailSuffix(b.cnf.DefaultQueue), signature.UUID, msg)
-		conn.Send("ZADD", WithDelaySuffix(b.cnf.DefaultQueue), score, signature.UUID)
-		conn.Flush()
-		if _, err = conn.Receive(); err != nil {
+		conn.Send("HSET", WithDetailSuffix(signature.RoutingKey), signature.UUID, msg)
+		if _, err = conn.Do("ZADD", WithDelaySuffix(signature.RoutingKey), score, signature.UUID); err != nil {
 			return err
 		}
 	} else {
-		if _, err = conn.Do("RPUSH", signature.RoutingKey, msg); err != nil {
+		if _, err = conn.Do("RPUSH", b.priorityQueue(signature.RoutingKey, signature.Priority), msg); err != nil {
 			return err
 		}
 
@@ -200,22 +526,59 @@ func (b *RedisBroker) SaveRecord(recordType RecordType, signare *tasks.Signature
 	}()
 }
 
-// GetPendingTasks returns a slice of task signatures waiting in the queue
+// GetPendingTasks returns a slice of task signatures waiting in all known
+// queues, see Queues
 func (b *RedisBroker) GetPendingTasks(indexStart, indexEnd int) ([]*tasks.Signature, error) {
 	conn := b.open()
 	defer conn.Close()
 
+	queues, err := b.knownQueues(conn)
+	if err != nil {
+		return nil, err
+	}
+	return b.getPendingTasks(conn, queues, indexStart, indexEnd)
+}
+
+// GetQueuePendingTasks returns a slice of task signatures waiting in the queue
+func (b *RedisBroker) GetQueuePendingTasks(queue string, indexStart, indexEnd int) ([]*tasks.Signature, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	return b.getPendingTasks(conn, []string{queue}, indexStart, indexEnd)
+}
+
+// getPendingTasks returns tasks waiting in the queues in the order they are
+// consumed, queue by queue and highest priority first
+func (b *RedisBroker) getPendingTasks(conn redis.Conn, queues []string, indexStart, indexEnd int) ([]*tasks.Signature, error) {
 	if indexStart < 0 || indexEnd < indexStart {
 		indexStart = 0
 		indexEnd = 10
 	}
-	bytes, err := conn.Do("LRANGE", b.cnf.DefaultQueue, indexStart, indexEnd)
-	if err != nil {
-		return nil, err
-	}
-	results, err := redis.ByteSlices(bytes, err)
-	if err != nil {
-		return nil, err
+
+	var results [][]byte
+	offset, remaining := indexStart, indexEnd-indexStart+1
+	keys, _ := b.priorityKeys(queues)
+	for _, key := range keys {
+		if remaining <= 0 {
+			break
+		}
+
+		length, err := redis.Int(conn.Do("LLEN", key))
+		if err != nil {
+			return nil, err
+		}
+		if offset >= length {
+			offset -= length
+			continue
+		}
+
+		items, err := redis.ByteSlices(conn.Do("LRANGE", key, offset, offset+remaining-1))
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, items...)
+		remaining -= len(items)
+		offset = 0
 	}
 
 	taskSignatures := make([]*tasks.Signature, len(results))
@@ -229,46 +592,83 @@ func (b *RedisBroker) GetPendingTasks(indexStart, indexEnd int) ([]*tasks.Signat
 	return taskSignatures, nil
 }
 
+// GetDelayedTasks returns a slice of task signatures delayed in all known
+// queues, due first
 func (b *RedisBroker) GetDelayedTasks(indexStart, indexEnd int) ([]*tasks.Signature, error) {
 	conn := b.open()
 	defer conn.Close()
 
-	if indexStart < 0 || indexEnd < indexStart {
-		indexStart = 0
-		indexEnd = 10
-	}
-	bytes, err := conn.Do("ZRANGE", WithDelaySuffix(b.cnf.DefaultQueue), indexStart, indexEnd)
+	queues, err := b.knownQueues(conn)
 	if err != nil {
 		return nil, err
 	}
-	results, err := redis.ByteSlices(bytes, err)
-	if err != nil {
-		return nil, err
+	return b.getDelayedTasks(conn, queues, indexStart, indexEnd)
+}
+
+// GetQueueDelayedTasks returns a slice of task signatures delayed in the
+// queue, due first
+func (b *RedisBroker) GetQueueDelayedTasks(queue string, indexStart, indexEnd int) ([]*tasks.Signature, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	return b.getDelayedTasks(conn, []string{queue}, indexStart, indexEnd)
+}
+
+// getDelayedTasks returns tasks delayed in the queues, due first
+func (b *RedisBroker) getDelayedTasks(conn redis.Conn, queues []string, indexStart, indexEnd int) ([]*tasks.Signature, error) {
+	if indexStart < 0 || indexEnd < indexStart {
+		indexStart = 0
+		indexEnd = 10
 	}
 
-	taskSignatures := make([]*tasks.Signature, len(results))
-	for i, result := range results {
-		sig := new(tasks.Signature)
-		//bytes, err = conn.Do("GET", WithDetailSuffix(string(result)))
-		bytes, err = conn.Do("HGET", WithDetailSuffix(b.cnf.DefaultQueue), string(result))
+	// Tasks due first in every queue are merged by their ETA
+	type delayedTask struct {
+		queue string
+		uuid  string
+		eta   int64
+	}
+	var delayed []delayedTask
+	for _, queue := range queues {
+		items, err := redis.Strings(conn.Do("ZRANGE", WithDelaySuffix(queue), 0, indexEnd, "WITHSCORES"))
 		if err != nil {
 			return nil, err
 		}
-		detail, err := redis.Bytes(bytes, err)
+		for i := 0; i+1 < len(items); i += 2 {
+			eta, err := strconv.ParseInt(items[i+1], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			delayed = append(delayed, delayedTask{queue: queue, uuid: items[i], eta: eta})
+		}
+	}
+	sort.SliceStable(delayed, func(i, j int) bool {
+		return delayed[i].eta < delayed[j].eta
+	})
+	start, end := indexRange(len(delayed), indexStart, indexEnd)
+	delayed = delayed[start:end]
+
+	taskSignatures := make([]*tasks.Signature, 0, len(delayed))
+	for _, task := range delayed {
+		detail, err := redis.Bytes(conn.Do("HGET", WithDetailSuffix(task.queue), task.uuid))
+		if err == redis.ErrNil {
+			// The task has become due in the meantime
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
+		sig := new(tasks.Signature)
 		if err := json.Unmarshal(detail, sig); err != nil {
 			return nil, err
 		}
-		taskSignatures[i] = sig
+		taskSignatures = append(taskSignatures, sig)
 	}
 	return taskSignatures, nil
 }
 
 // consume takes delivered messages from the channel and manages a worker pool
 // to process tasks concurrently
-func (b *RedisBroker) consume(deliveries <-chan []byte, concurrency int, taskProcessor TaskProcessor) error {
+func (b *RedisBroker) consume(deliveries <-chan redisDelivery, concurrency int, taskProcessor TaskProcessor) error {
 	pool := make(chan struct{}, concurrency)
 
 	// initialize worker pool with maxWorkers workers
@@ -285,13 +685,24 @@ func (b *RedisBroker) consume(deliveries <-chan []byte, concurrency int, taskPro
 		case err := <-errorsChan:
 			return err
 		case d := <-deliveries:
+			b.processingWG.Add(1)
+
+			release, signature, ok := acquireTask(d.body, taskProcessor)
+			if !ok {
+				// A task over its concurrency limits is sent back without
+				// taking a slot of the worker pool
+				go func() {
+					b.delayOne(d, signature, taskProcessor)
+					b.processingWG.Done()
+				}()
+				continue
+			}
+
 			if concurrency > 0 {
 				// get worker from pool (blocks until one is available)
 				<-pool
 			}
 
-			b.processingWG.Add(1)
-
 			// Consume the task inside a gotourine so multiple tasks
 			// can be processed concurrently
 			go func() {
@@ -299,6 +710,7 @@ func (b *RedisBroker) consume(deliveries <-chan []byte, concurrency int, taskPro
 					errorsChan <- err
 				}
 
+				release()
 				b.processingWG.Done()
 
 				if concurrency > 0 {
@@ -313,55 +725,432 @@ func (b *RedisBroker) consume(deliveries <-chan []byte, concurrency int, taskPro
 }
 
 // consumeOne processes a single message using TaskProcessor
-func (b *RedisBroker) consumeOne(delivery []byte, taskProcessor TaskProcessor) error {
+func (b *RedisBroker) consumeOne(delivery redisDelivery, taskProcessor TaskProcessor) error {
 	sig := new(tasks.Signature)
-	if err := json.Unmarshal(delivery, sig); err != nil {
+	if err := json.Unmarshal(delivery.body, sig); err != nil {
+		if b.isReliable() {
+			// A malformed message would never be processed, drop it
+			b.ack(delivery)
+		}
 		return err
 	}
 
 	// If the task is not registered, we requeue it,
 	// there might be different workers for processing specific tasks
 	if !b.IsTaskRegistered(sig.Name) {
-		conn := b.open()
-		defer conn.Close()
-
-		conn.Do("RPUSH", b.cnf.DefaultQueue, delivery)
+		b.requeue(delivery, sig.Priority)
 		return nil
 	}
 
-	log.INFO.Printf("Received new message: %s", log.Truncate(string(delivery)))
+	log.INFO.Printf("Received new message: %s", log.Truncate(string(delivery.body)))
 
+	// Acknowledge the message once the task has been processed, the task
+	// state and any retries are handled by the task processor from then on.
+	// A message whose task failed to be processed, e.g. because the result
+	// backend is unreachable, stays in the processing list for the reaper,
+	// unless the task has failed for good.
 	if err := taskProcessor.Process(sig); err != nil {
+		if _, ok := tasks.AsNonRetryable(err); ok && b.isReliable() {
+			b.ack(delivery)
+		}
 		return err
 	}
+	if b.isReliable() {
+		b.ack(delivery)
+	}
 	b.SaveRecord(RecordTypeProcess, sig)
 	return nil
 }
 
-// nextTask pops next available task from the default queue
-func (b *RedisBroker) nextTask(queue string) (result []byte, err error) {
+// delayOne hands a task over its concurrency limits to the task processor to
+// be published again for later. The message is acknowledged once that is done,
+// otherwise it is pushed back to the queue so the task is not lost.
+func (b *RedisBroker) delayOne(delivery redisDelivery, signature *tasks.Signature, taskProcessor TaskProcessor) {
+	if err := taskProcessor.(TaskLimiter).DelayTask(signature); err != nil {
+		log.ERROR.Printf("Delay task over its concurrency limits error: %s", err)
+		b.requeue(delivery, signature.Priority)
+		return
+	}
+	if b.isReliable() {
+		b.ack(delivery)
+	}
+}
+
+// requeue pushes the message back to the tail of its queue, in reliable mode
+// it is removed from the processing list at the same time
+func (b *RedisBroker) requeue(delivery redisDelivery, priority uint8) {
 	conn := b.open()
 	defer conn.Close()
 
-	items, err := redis.ByteSlices(conn.Do("BLPOP", queue, 1))
+	queue := b.priorityQueue(delivery.queue, priority)
+	if !b.isReliable() {
+		conn.Do("RPUSH", queue, delivery.body)
+		return
+	}
+
+	conn.Send("MULTI")
+	conn.Send("RPUSH", queue, delivery.body)
+	conn.Send("LREM", withProcessingSuffix(delivery.queue, b.consumerID), 1, delivery.body)
+	conn.Do("EXEC")
+}
+
+// nextTask pops next available task from the first non empty queue
+func (b *RedisBroker) nextTask(queues ...string) (result redisDelivery, err error) {
+	conn := b.open()
+	defer conn.Close()
+
+	keys, keyQueues := b.priorityKeys(queues)
+	args := make([]interface{}, 0, len(keys)+1)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	args = append(args, 1)
+
+	items, err := redis.ByteSlices(conn.Do("BLPOP", args...))
 	if err != nil {
-		return []byte{}, err
+		return result, err
 	}
 
 	// items[0] - the name of the key where an element was popped
 	// items[1] - the value of the popped element
 	if len(items) != 2 {
-		return []byte{}, redis.ErrNil
+		return result, redis.ErrNil
 	}
 
-	result = items[1]
+	result.queue = keyQueues[string(items[0])]
+	result.body = items[1]
 
 	return result, nil
 }
 
-// nextDelayedTask pops a value from the ZSET key using WATCH/MULTI/EXEC commands.
+// nextReliableTask moves next available task from the first non empty queue
+// to the processing list of this consumer, the message stays there until it
+// is acknowledged
+func (b *RedisBroker) nextReliableTask(queues ...string) (result redisDelivery, err error) {
+	conn := b.open()
+	defer conn.Close()
+
+	// All priority lists of a queue share its processing list
+	keys, keyQueues := b.priorityKeys(queues)
+	keysAndArgs := make([]interface{}, 0, len(keys)*2)
+	for _, key := range keys {
+		keysAndArgs = append(keysAndArgs, key)
+	}
+	for _, key := range keys {
+		keysAndArgs = append(keysAndArgs, withProcessingSuffix(keyQueues[key], b.consumerID))
+	}
+
+	keysAndArgs = append([]interface{}{len(keysAndArgs)}, keysAndArgs...)
+	items, err := redis.ByteSlices(reliablePopScript.Do(conn, keysAndArgs...))
+	if err == redis.ErrNil {
+		// Space out polling of empty queues so we don't bombard redis server
+		<-time.After(redisReliablePollInterval)
+	}
+	if err != nil {
+		return result, err
+	}
+
+	// items[0] - the name of the list where an element was popped
+	// items[1] - the value of the popped element
+	if len(items) != 2 {
+		return result, redis.ErrNil
+	}
+
+	result.queue = keyQueues[string(items[0])]
+	result.body = items[1]
+
+	return result, nil
+}
+
+// putBack returns a message popped from the queue but never delivered to the
+// head of its queue, in reliable mode it stays in the processing list instead
+// and is requeued with the list
+func (b *RedisBroker) putBack(delivery redisDelivery) {
+	if b.isReliable() {
+		return
+	}
+
+	// A malformed message goes back without priority
+	sig := new(tasks.Signature)
+	json.Unmarshal(delivery.body, sig)
+
+	conn := b.open()
+	defer conn.Close()
+
+	if _, err := conn.Do("LPUSH", b.priorityQueue(delivery.queue, sig.Priority), delivery.body); err != nil {
+		log.ERROR.Printf("Put back message error: %s", err)
+	}
+}
+
+// ack removes a processed message from the processing list of this consumer
+func (b *RedisBroker) ack(delivery redisDelivery) {
+	conn := b.open()
+	defer conn.Close()
+
+	if _, err := conn.Do("LREM", withProcessingSuffix(delivery.queue, b.consumerID), 1, delivery.body); err != nil {
+		log.ERROR.Printf("Acknowledge message error: %s", err)
+	}
+}
+
+// heartbeat records that this consumer of the queues is alive
+func (b *RedisBroker) heartbeat(queues []config.QueueConfig) error {
+	conn := b.open()
+	defer conn.Close()
+
+	now := time.Now().UTC().UnixNano()
+	for _, queue := range queues {
+		conn.Send("ZADD", withConsumersSuffix(queue.Name), now, b.consumerID)
+	}
+	_, err := conn.Do("")
+	return err
+}
+
+// consumingQueues returns queues the task processor wants to consume from,
+// by default only the default queue is consumed
+func (b *RedisBroker) consumingQueues(taskProcessor TaskProcessor) []config.QueueConfig {
+	var queues []config.QueueConfig
+	if queueConsumer, ok := taskProcessor.(QueueConsumer); ok {
+		queues = queueConsumer.ConsumingQueues()
+	}
+	if len(queues) == 0 {
+		queues = []config.QueueConfig{{Name: b.cnf.DefaultQueue}}
+	}
+	b.queues = queues
+	return queues
+}
+
+// knownQueues returns names of the default queue, configured queues and
+// queues tasks have been routed to
+func (b *RedisBroker) knownQueues(conn redis.Conn) ([]string, error) {
+	queues := []string{b.cnf.DefaultQueue}
+	for _, queue := range b.cnf.Queues {
+		if queue.Name != b.cnf.DefaultQueue {
+			queues = append(queues, queue.Name)
+		}
+	}
+
+	routed, err := redis.Strings(conn.Do("SMEMBERS", withQueuesSuffix(b.cnf.DefaultQueue)))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(routed)
+	for _, queue := range routed {
+		if !b.isConfiguredQueue(queue) {
+			queues = append(queues, queue)
+		}
+	}
+	return queues, nil
+}
+
+// isConfiguredQueue returns true for the default queue and configured queues
+func (b *RedisBroker) isConfiguredQueue(queue string) bool {
+	if queue == b.cnf.DefaultQueue {
+		return true
+	}
+	for _, configured := range b.cnf.Queues {
+		if configured.Name == queue {
+			return true
+		}
+	}
+	return false
+}
+
+// isRoutedQueue returns 1 if the queue has to be remembered in the set of
+// routed queues to be found later, 0 for the default and configured queues
+func (b *RedisBroker) isRoutedQueue(queue string) int {
+	if b.isConfiguredQueue(queue) {
+		return 0
+	}
+	return 1
+}
+
+// queueOrder returns names of queues in the order they should be checked for
+// messages. Without weights the order is strict, otherwise queues are
+// shuffled so that each queue comes first proportionally to its weight
+func queueOrder(queues []config.QueueConfig) []string {
+	weighted := false
+	for _, queue := range queues {
+		if queue.Weight > 0 {
+			weighted = true
+			break
+		}
+	}
+
+	names := make([]string, 0, len(queues))
+	if !weighted {
+		for _, queue := range queues {
+			names = append(names, queue.Name)
+		}
+		return names
+	}
+
+	// Weighted random order without replacement
+	remaining := make([]config.QueueConfig, len(queues))
+	copy(remaining, queues)
+	for len(remaining) > 0 {
+		total := 0
+		for _, queue := range remaining {
+			total += queueWeight(queue)
+		}
+		pick := rand.Intn(total)
+		for i, queue := range remaining {
+			pick -= queueWeight(queue)
+			if pick < 0 {
+				names = append(names, queue.Name)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// queueWeight returns weight of a queue, queues without one weigh 1
+func queueWeight(queue config.QueueConfig) int {
+	if queue.Weight > 0 {
+		return queue.Weight
+	}
+	return 1
+}
+
+// reapDeadConsumers returns messages held by consumers which have not sent
+// a heartbeat within the visibility timeout back to the queue
+func (b *RedisBroker) reapDeadConsumers(queue string) error {
+	conn := b.open()
+	defer conn.Close()
+
+	deadline := time.Now().UTC().Add(-b.visibilityTimeout()).UnixNano()
+	consumers, err := redis.Strings(conn.Do("ZRANGEBYSCORE", withConsumersSuffix(queue), "-inf", deadline))
+	if err != nil {
+		return err
+	}
+
+	for _, consumerID := range consumers {
+		if err := b.requeueProcessing(queue, consumerID, deadline); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// requeueProcessing moves messages from the consumer's processing list back
+// to the queue unless the consumer sent a heartbeat after the deadline
+func (b *RedisBroker) requeueProcessing(queue, consumerID string, deadline int64) error {
+	conn := b.open()
+	defer conn.Close()
+
+	count, err := redis.Int(requeueProcessingScript.Do(
+		conn,
+		withConsumersSuffix(queue),
+		withProcessingSuffix(queue, consumerID),
+		queue,
+		consumerID,
+		deadline,
+		b.maxPriority(),
+	))
+	if err != nil {
+		return err
+	}
+
+	if count > 0 {
+		log.WARNING.Printf("Requeued %d messages of consumer %s", count, consumerID)
+	}
+
+	return nil
+}
+
+// moveDelayedTask moves the next due delayed task to the queue
+func (b *RedisBroker) moveDelayedTask(queue string) error {
+	// Space out queries to ZSET to 20ms intervals so we don't bombard redis
+	// server with relentless ZRANGEBYSCOREs
+	<-time.After(20 * time.Millisecond)
+
+	conn := b.open()
+	defer conn.Close()
+
+	_, err := reliableDelayedScript.Do(
+		conn,
+		WithDelaySuffix(queue),
+		WithDetailSuffix(queue),
+		queue,
+		time.Now().UTC().UnixNano(),
+		b.maxPriority(),
+	)
+	return err
+}
+
+// maxPriority returns the highest priority of tasks, 0 if priorities are
+// disabled
+func (b *RedisBroker) maxPriority() int {
+	if b.cnf.Redis == nil || b.cnf.Redis.MaxPriority < 0 {
+		return 0
+	}
+	return b.cnf.Redis.MaxPriority
+}
+
+// priorityQueue returns the list the task of the given priority is pushed to,
+// priorities above the max priority are capped
+func (b *RedisBroker) priorityQueue(queue string, priority uint8) string {
+	maxPriority := b.maxPriority()
+	if int(priority) > maxPriority {
+		return withPrioritySuffix(queue, maxPriority)
+	}
+	return withPrioritySuffix(queue, int(priority))
+}
+
+// priorityQueues returns lists of the queue, highest priority first
+func (b *RedisBroker) priorityQueues(queue string) []string {
+	lists := make([]string, 0, b.maxPriority()+1)
+	for priority := b.maxPriority(); priority >= 0; priority-- {
+		lists = append(lists, withPrioritySuffix(queue, priority))
+	}
+	return lists
+}
+
+// priorityKeys returns lists of the queues in the order they should be
+// checked for messages and the queue each list belongs to
+func (b *RedisBroker) priorityKeys(queues []string) ([]string, map[string]string) {
+	keys := make([]string, 0, len(queues)*(b.maxPriority()+1))
+	keyQueues := make(map[string]string, cap(keys))
+	for _, queue := range queues {
+		for _, key := range b.priorityQueues(queue) {
+			keys = append(keys, key)
+			keyQueues[key] = queue
+		}
+	}
+	return keys, keyQueues
+}
+
+// isReliable returns true if messages should be acknowledged after processing
+func (b *RedisBroker) isReliable() bool {
+	return b.cnf.Redis != nil && b.cnf.Redis.ReliableConsume
+}
+
+// visibilityTimeout returns how long a consumer may stay silent before its
+// messages are returned to the queue
+func (b *RedisBroker) visibilityTimeout() time.Duration {
+	visibilityTimeout := defaultRedisVisibilityTimeout
+	if b.cnf.Redis != nil && b.cnf.Redis.VisibilityTimeout > 0 {
+		visibilityTimeout = b.cnf.Redis.VisibilityTimeout
+	}
+	return time.Duration(visibilityTimeout) * time.Second
+}
+
+// heartbeatInterval returns how often a reliable consumer sends heartbeats,
+// several heartbeats fit into the visibility timeout
+func (b *RedisBroker) heartbeatInterval() time.Duration {
+	interval := b.visibilityTimeout() / 3
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// nextDelayedTask pops a value from the delayed ZSET of the queue using WATCH/MULTI/EXEC commands.
 // https://github.com/garyburd/redigo/blob/master/redis/zpop_example_test.go
-func (b *RedisBroker) nextDelayedTask(key string) (result []byte, err error) {
+func (b *RedisBroker) nextDelayedTask(queue string) (result []byte, err error) {
+	key := WithDelaySuffix(queue)
 
 	conn := b.open()
 	defer conn.Close()
@@ -398,11 +1187,11 @@ func (b *RedisBroker) nextDelayedTask(key string) (result []byte, err error) {
 		}
 
 		//if msg_delay, err = conn.Do("GET", WithDetailSuffix(string(items[0]))); err != nil {
-		if msg_delay, err = conn.Do("HGET", WithDetailSuffix(b.cnf.DefaultQueue), string(items[0])); err != nil {
+		if msg_delay, err = conn.Do("HGET", WithDetailSuffix(queue), string(items[0])); err != nil {
 			return
 		}
 		if msg_delay == nil {
-			err = fmt.Errorf("signature message for %s is nil: %s", string(items[0]))
+			err = fmt.Errorf("signature message for %s is nil", string(items[0]))
 			return
 		}
 
@@ -416,7 +1205,7 @@ func (b *RedisBroker) nextDelayedTask(key string) (result []byte, err error) {
 		conn.Send("MULTI")
 		conn.Send("ZREM", key, items[0])
 		//conn.Send("DEL", WithDetailSuffix(string(items[0])))
-		conn.Send("HDEL", WithDetailSuffix(b.cnf.DefaultQueue), string(items[0]))
+		conn.Send("HDEL", WithDetailSuffix(queue), string(items[0]))
 		if reply, err = conn.Do("EXEC"); err != nil {
 			return
 		}
@@ -439,6 +1228,9 @@ func (b *RedisBroker) nextDelayedTask(key string) (result []byte, err error) {
 
 // open returns or creates instance of Redis connection
 func (b *RedisBroker) open() redis.Conn {
+	b.poolMu.Lock()
+	defer b.poolMu.Unlock()
+
 	if b.pool == nil {
 		b.pool = b.NewPool(b.socketPath, b.host, b.password, b.db)
 	}
@@ -449,6 +1241,19 @@ func (b *RedisBroker) open() redis.Conn {
 	return b.pool.Get()
 }
 
+// closePool closes the pool, connections taken from it before stay usable
+// until they are closed and the next connection opens a new pool
+func (b *RedisBroker) closePool() {
+	b.poolMu.Lock()
+	defer b.poolMu.Unlock()
+
+	if b.pool != nil {
+		b.pool.Close()
+		b.pool = nil
+		b.redsync = nil
+	}
+}
+
 //transfer delay tasks to suit updated code in which ETA of tasks can be modified
 func (b *RedisBroker) TransferDelayTask(queue, newQueue string, start, end int) (errRet error) {
 	if start == 0 && end == 0 {
@@ -556,28 +1361,82 @@ func (b *RedisBroker) GetConn() (conn redis.Conn) {
 	return
 }
 
+// CountDelayedTasks returns the number of tasks delayed in all known queues
 func (b *RedisBroker) CountDelayedTasks() (int, error) {
 	conn := b.open()
 	defer conn.Close()
 
-	reply, err := conn.Do("ZCARD", WithDelaySuffix(b.cnf.DefaultQueue))
+	queues, err := b.knownQueues(conn)
 	if err != nil {
 		return 0, err
 	}
+	return b.countDelayedTasks(conn, queues)
+}
 
-	return redis.Int(reply, err)
+// CountQueueDelayedTasks returns the number of tasks delayed in the queue
+func (b *RedisBroker) CountQueueDelayedTasks(queue string) (int, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	return b.countDelayedTasks(conn, []string{queue})
 }
 
+func (b *RedisBroker) countDelayedTasks(conn redis.Conn, queues []string) (int, error) {
+	for _, queue := range queues {
+		conn.Send("ZCARD", WithDelaySuffix(queue))
+	}
+	return sumReplies(conn)
+}
+
+// CountPendingTasks returns the number of tasks waiting in all known queues
 func (b *RedisBroker) CountPendingTasks() (int, error) {
 	conn := b.open()
 	defer conn.Close()
 
-	reply, err := conn.Do("LLEN", b.cnf.DefaultQueue)
+	queues, err := b.knownQueues(conn)
+	if err != nil {
+		return 0, err
+	}
+	return b.countPendingTasks(conn, queues)
+}
+
+// CountQueuePendingTasks returns the number of tasks waiting in the queue
+func (b *RedisBroker) CountQueuePendingTasks(queue string) (int, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	return b.countPendingTasks(conn, []string{queue})
+}
+
+func (b *RedisBroker) countPendingTasks(conn redis.Conn, queues []string) (int, error) {
+	keys, _ := b.priorityKeys(queues)
+	for _, key := range keys {
+		conn.Send("LLEN", key)
+	}
+	return sumReplies(conn)
+}
+
+// sumReplies returns the sum of integer replies to the commands sent
+func sumReplies(conn redis.Conn) (int, error) {
+	counts, err := redis.Ints(conn.Do(""))
 	if err != nil {
 		return 0, err
 	}
 
-	return redis.Int(reply, err)
+	sum := 0
+	for _, count := range counts {
+		sum += count
+	}
+	return sum, nil
+}
+
+// Queues returns names of the default queue, configured queues and queues
+// tasks have been routed to
+func (b *RedisBroker) Queues() ([]string, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	return b.knownQueues(conn)
 }
 
 //CancelDelayTask 取消延时任务
@@ -585,10 +1444,17 @@ func (b *RedisBroker) CancelDelayTask(uuid string) error {
 	conn := b.open()
 	defer conn.Close()
 
+	// The task might have been routed to any of the known queues
+	queues, err := b.knownQueues(conn)
+	if err != nil {
+		return err
+	}
 	conn.Send("MULTI")
-	conn.Send("ZREM", WithDelaySuffix(b.cnf.DefaultQueue), uuid)
-	conn.Send("HDEL", WithDetailSuffix(b.cnf.DefaultQueue), uuid)
-	_, err := conn.Do("EXEC")
+	for _, queue := range queues {
+		conn.Send("ZREM", WithDelaySuffix(queue), uuid)
+		conn.Send("HDEL", WithDetailSuffix(queue), uuid)
+	}
+	_, err = conn.Do("EXEC")
 	if err == nil {
 		log.INFO.Printf("Cancel Task: uuid = %s", uuid)
 		b.SaveRecord(RecordTypeCancel, &tasks.Signature{
@@ -603,14 +1469,29 @@ func (b *RedisBroker) GetDelayTask(uuid string) (*tasks.Signature, error) {
 	conn := b.open()
 	defer conn.Close()
 
-	reply, err := conn.Do("ZSCORE", WithDelaySuffix(b.cnf.DefaultQueue), uuid)
+	// Find the queue the task has been delayed in
+	queues, err := b.knownQueues(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		queue string
+		reply interface{}
+	)
+	for _, queue = range queues {
+		reply, err = conn.Do("ZSCORE", WithDelaySuffix(queue), uuid)
+		if err != nil || reply != nil {
+			break
+		}
+	}
 	if err == redis.ErrNil || reply == nil {
 		return nil, nil
 	} else if err != nil {
 		log.ERROR.Printf("get delay task score error: %v, uuid: %s", err, uuid)
 		return nil, err
 	}
-	reply, err = conn.Do("HGET", WithDetailSuffix(b.cnf.DefaultQueue), uuid)
+	reply, err = conn.Do("HGET", WithDetailSuffix(queue), uuid)
 	if err == redis.ErrNil || reply == nil {
 		return nil, nil
 	} else if err != nil {
@@ -625,3 +1506,228 @@ func (b *RedisBroker) GetDelayTask(uuid string) (*tasks.Signature, error) {
 	var task tasks.Signature
 	return &task, json.Unmarshal(bytes, &task)
 }
+
+// PurgePendingTasks removes all tasks waiting in the queue, it returns the
+// number of removed tasks
+func (b *RedisBroker) PurgePendingTasks(queue string) (int, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	lists := b.priorityQueues(queue)
+	keys := make([]interface{}, 0, len(lists))
+	conn.Send("MULTI")
+	for _, list := range lists {
+		conn.Send("LLEN", list)
+		keys = append(keys, list)
+	}
+	conn.Send("DEL", keys...)
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+
+	lengths, err := redis.Ints(replies[:len(lists)], nil)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, length := range lengths {
+		count += length
+	}
+	return count, nil
+}
+
+// PurgeDelayedTasks removes all delayed tasks of the queue, it returns the
+// number of removed tasks
+func (b *RedisBroker) PurgeDelayedTasks(queue string) (int, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("ZCARD", WithDelaySuffix(queue))
+	conn.Send("DEL", WithDelaySuffix(queue), WithDetailSuffix(queue))
+	replies, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return 0, err
+	}
+	return redis.Int(replies[0], nil)
+}
+
+// MovePendingTasks moves up to count tasks (all if count is not positive)
+// waiting in the queue to the tail of another queue, tasks are moved in the
+// order they would be consumed and keep their priority. Unlike TransferTask,
+// which copies a list when migrating data, tasks are removed from the queue.
+// It returns the number of moved tasks.
+func (b *RedisBroker) MovePendingTasks(queue, newQueue string, count int) (int, error) {
+	if newQueue == "" || newQueue == queue {
+		return 0, errors.New("Tasks have to be moved to another queue")
+	}
+
+	conn := b.open()
+	defer conn.Close()
+
+	lists := b.priorityQueues(queue)
+	keysAndArgs := make([]interface{}, 0, len(lists)+6)
+	keysAndArgs = append(keysAndArgs, len(lists)+1)
+	for _, list := range lists {
+		keysAndArgs = append(keysAndArgs, list)
+	}
+	keysAndArgs = append(keysAndArgs, withQueuesSuffix(b.cnf.DefaultQueue))
+	keysAndArgs = append(keysAndArgs, newQueue, count, b.maxPriority(), b.isRoutedQueue(newQueue))
+
+	return redis.Int(movePendingScript.Do(conn, keysAndArgs...))
+}
+
+// MoveDelayedTasks moves up to count delayed tasks due first (all if count is
+// not positive) from the queue to another queue, tasks keep their ETA. It
+// returns the number of moved tasks.
+func (b *RedisBroker) MoveDelayedTasks(queue, newQueue string, count int) (int, error) {
+	if newQueue == "" || newQueue == queue {
+		return 0, errors.New("Tasks have to be moved to another queue")
+	}
+
+	conn := b.open()
+	defer conn.Close()
+
+	if count < 0 {
+		count = 0
+	}
+
+	return redis.Int(moveDelayedScript.Do(
+		conn,
+		WithDelaySuffix(queue),
+		WithDetailSuffix(queue),
+		WithDelaySuffix(newQueue),
+		WithDetailSuffix(newQueue),
+		withQueuesSuffix(b.cnf.DefaultQueue),
+		newQueue,
+		count,
+		b.isRoutedQueue(newQueue),
+	))
+}
+
+// PublishDeadLetter keeps the failed task in the dead letters of its queue
+func (b *RedisBroker) PublishDeadLetter(deadLetter *tasks.DeadLetter) error {
+	encoded, err := json.Marshal(deadLetter)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	queue := b.deadLetterQueue(deadLetter.Signature.RoutingKey)
+	uuid := deadLetter.Signature.UUID
+
+	conn := b.open()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("ZADD", withDeadSuffix(queue), deadLetter.FailedAt.UnixNano()/int64(time.Millisecond), uuid)
+	conn.Send("HSET", WithDetailSuffix(withDeadSuffix(queue)), uuid, encoded)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+// GetDeadLetters returns dead letters of the queue, oldest first
+func (b *RedisBroker) GetDeadLetters(queue string, indexStart, indexEnd int) ([]*tasks.DeadLetter, error) {
+	queue = b.deadLetterQueue(queue)
+
+	conn := b.open()
+	defer conn.Close()
+
+	uuids, err := redis.Strings(conn.Do("ZRANGE", withDeadSuffix(queue), indexStart, indexEnd))
+	if err != nil {
+		return nil, err
+	}
+	if len(uuids) == 0 {
+		return []*tasks.DeadLetter{}, nil
+	}
+
+	args := make([]interface{}, 0, len(uuids)+1)
+	args = append(args, WithDetailSuffix(withDeadSuffix(queue)))
+	for _, uuid := range uuids {
+		args = append(args, uuid)
+	}
+	items, err := redis.ByteSlices(conn.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters := make([]*tasks.DeadLetter, 0, len(items))
+	for _, item := range items {
+		// Dead letter deleted in the meantime
+		if item == nil {
+			continue
+		}
+		deadLetter := new(tasks.DeadLetter)
+		if err := json.Unmarshal(item, deadLetter); err != nil {
+			return nil, err
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	return deadLetters, nil
+}
+
+// GetDeadLetter returns a dead letter of the queue, nil if there is none
+func (b *RedisBroker) GetDeadLetter(queue, uuid string) (*tasks.DeadLetter, error) {
+	queue = b.deadLetterQueue(queue)
+
+	conn := b.open()
+	defer conn.Close()
+
+	item, err := redis.Bytes(conn.Do("HGET", WithDetailSuffix(withDeadSuffix(queue)), uuid))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetter := new(tasks.DeadLetter)
+	if err := json.Unmarshal(item, deadLetter); err != nil {
+		return nil, err
+	}
+	return deadLetter, nil
+}
+
+// DeleteDeadLetter removes a dead letter of the queue
+func (b *RedisBroker) DeleteDeadLetter(queue, uuid string) error {
+	queue = b.deadLetterQueue(queue)
+
+	conn := b.open()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("ZREM", withDeadSuffix(queue), uuid)
+	conn.Send("HDEL", WithDetailSuffix(withDeadSuffix(queue)), uuid)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+// CountDeadLetters returns the number of dead letters of the queue
+func (b *RedisBroker) CountDeadLetters(queue string) (int, error) {
+	queue = b.deadLetterQueue(queue)
+
+	conn := b.open()
+	defer conn.Close()
+
+	return redis.Int(conn.Do("ZCARD", withDeadSuffix(queue)))
+}
+
+// PurgeDeadLetters removes all dead letters of the queue
+func (b *RedisBroker) PurgeDeadLetters(queue string) error {
+	queue = b.deadLetterQueue(queue)
+
+	conn := b.open()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", withDeadSuffix(queue), WithDetailSuffix(withDeadSuffix(queue)))
+	return err
+}
+
+// Ping checks the Redis server is reachable
+func (b *RedisBroker) Ping() error {
+	conn := b.open()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+	return err
+}
@@ -0,0 +1,455 @@
+package brokers
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueOrder(t *testing.T) {
+	// Without weights queues are checked in strict order
+	queues := []config.QueueConfig{{Name: "critical"}, {Name: "default"}, {Name: "low"}}
+	assert.Equal(t, []string{"critical", "default", "low"}, queueOrder(queues))
+
+	// With weights every queue is checked exactly once
+	queues = []config.QueueConfig{{Name: "critical", Weight: 6}, {Name: "default", Weight: 3}, {Name: "low"}}
+	firsts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		order := queueOrder(queues)
+		firsts[order[0]]++
+		sort.Strings(order)
+		assert.Equal(t, []string{"critical", "default", "low"}, order)
+	}
+
+	// and heavier queues come first more often
+	assert.True(t, firsts["critical"] > firsts["default"])
+	assert.True(t, firsts["default"] > firsts["low"])
+}
+
+func TestDeadLettersRedis(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+	if redisURL == "" {
+		return
+	}
+
+	broker := NewRedisBroker(&config.Config{DefaultQueue: "test_queue"}, redisURL, redisPassword, "", 0)
+
+	// Cleanup before the test
+	assert.NoError(t, broker.PurgeDeadLetters(""))
+
+	for _, uuid := range []string{"testTaskUUID1", "testTaskUUID2"} {
+		deadLetter := tasks.NewDeadLetter(&tasks.Signature{UUID: uuid}, "error")
+		assert.NoError(t, broker.PublishDeadLetter(deadLetter))
+	}
+
+	deadLetters, err := broker.GetDeadLetters("test_queue", 0, -1)
+	assert.NoError(t, err)
+	assert.Len(t, deadLetters, 2)
+
+	deadLetter, err := broker.GetDeadLetter("", "testTaskUUID2")
+	assert.NoError(t, err)
+	if assert.NotNil(t, deadLetter) {
+		assert.Equal(t, "error", deadLetter.Error)
+	}
+
+	assert.NoError(t, broker.DeleteDeadLetter("", "testTaskUUID2"))
+	deadLetter, err = broker.GetDeadLetter("", "testTaskUUID2")
+	assert.NoError(t, err)
+	assert.Nil(t, deadLetter)
+	count, err := broker.CountDeadLetters("")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	assert.NoError(t, broker.PurgeDeadLetters(""))
+	deadLetters, err = broker.GetDeadLetters("", 0, -1)
+	assert.NoError(t, err)
+	assert.Len(t, deadLetters, 0)
+}
+
+func TestPriorityKeys(t *testing.T) {
+	// Without max priority every queue has a single list
+	broker := NewRedisBroker(&config.Config{}, "", "", "", 0).(*RedisBroker)
+	keys, keyQueues := broker.priorityKeys([]string{"a", "b"})
+	assert.Equal(t, []string{"a", "b"}, keys)
+	assert.Equal(t, "b", keyQueues["b"])
+	assert.Equal(t, "a", broker.priorityQueue("a", 5))
+
+	broker = NewRedisBroker(&config.Config{Redis: &config.RedisConfig{MaxPriority: 2}}, "", "", "", 0).(*RedisBroker)
+	keys, keyQueues = broker.priorityKeys([]string{"a", "b"})
+	assert.Equal(t, []string{"a_priority:2", "a_priority:1", "a", "b_priority:2", "b_priority:1", "b"}, keys)
+	assert.Equal(t, "a", keyQueues["a_priority:1"])
+	assert.Equal(t, "b", keyQueues["b_priority:2"])
+
+	// Priorities above the max priority are capped
+	assert.Equal(t, "a", broker.priorityQueue("a", 0))
+	assert.Equal(t, "a_priority:1", broker.priorityQueue("a", 1))
+	assert.Equal(t, "a_priority:2", broker.priorityQueue("a", 9))
+}
+
+func TestPriorityRedis(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+	if redisURL == "" {
+		return
+	}
+
+	cnf := &config.Config{DefaultQueue: "test_priority_queue", Redis: &config.RedisConfig{MaxPriority: 3}}
+	broker := NewRedisBroker(cnf, redisURL, redisPassword, "", 0).(*RedisBroker)
+
+	// Cleanup before the test
+	conn := broker.GetConn()
+	for _, queue := range broker.priorityQueues(cnf.DefaultQueue) {
+		conn.Do("DEL", queue)
+	}
+	conn.Close()
+
+	for i, priority := range []uint8{0, 3, 1, 3} {
+		signature := &tasks.Signature{UUID: []string{"a", "b", "c", "d"}[i], Priority: priority}
+		assert.NoError(t, broker.Publish(signature))
+	}
+
+	count, err := broker.CountPendingTasks()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+
+	pendingTasks, err := broker.GetPendingTasks(1, 2)
+	assert.NoError(t, err)
+	if assert.Len(t, pendingTasks, 2) {
+		assert.Equal(t, "d", pendingTasks[0].UUID)
+		assert.Equal(t, "c", pendingTasks[1].UUID)
+	}
+
+	delivery, err := broker.nextTask(cnf.DefaultQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, cnf.DefaultQueue, delivery.queue)
+	assert.Contains(t, string(delivery.body), `"UUID":"b"`)
+}
+
+func TestMoveAndPurgeTasksRedis(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+	if redisURL == "" {
+		return
+	}
+
+	cnf := &config.Config{DefaultQueue: "test_move_queue", Redis: &config.RedisConfig{MaxPriority: 1}}
+	broker := NewRedisBroker(cnf, redisURL, redisPassword, "", 0).(*RedisBroker)
+	queue, newQueue := cnf.DefaultQueue, "test_move_new_queue"
+
+	// Cleanup before the test
+	for _, q := range []string{queue, newQueue} {
+		_, err := broker.PurgePendingTasks(q)
+		assert.NoError(t, err)
+		_, err = broker.PurgeDelayedTasks(q)
+		assert.NoError(t, err)
+	}
+	conn := broker.open()
+	_, err := conn.Do("DEL", withQueuesSuffix(queue))
+	conn.Close()
+	assert.NoError(t, err)
+
+	// Tasks are laid out by publishing them, delayed ones are kept in the
+	// ZSET of the queue by UUID and in its detail hash
+	eta := time.Now().UTC().Add(time.Hour)
+	for i, priority := range []uint8{0, 1, 0} {
+		signature := &tasks.Signature{UUID: []string{"a", "b", "c"}[i], Priority: priority}
+		assert.NoError(t, broker.Publish(signature))
+		delayed := &tasks.Signature{UUID: []string{"d", "e", "f"}[i], ETA: &eta}
+		assert.NoError(t, broker.Publish(delayed))
+	}
+
+	_, err = broker.MovePendingTasks(queue, queue, 0)
+	assert.Error(t, err)
+
+	// Tasks are moved in the order they would be consumed, the highest
+	// priority first, and keep their priority
+	moved, err := broker.MovePendingTasks(queue, newQueue, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, moved)
+	pendingTasks, err := broker.GetQueuePendingTasks(newQueue, 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, pendingTasks, 2) {
+		assert.Equal(t, "b", pendingTasks[0].UUID)
+		assert.Equal(t, "a", pendingTasks[1].UUID)
+	}
+	pendingTasks, err = broker.GetQueuePendingTasks(queue, 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, pendingTasks, 1) {
+		assert.Equal(t, "c", pendingTasks[0].UUID)
+	}
+
+	// The new queue is remembered so moved tasks can be found
+	queues, err := broker.Queues()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{queue, newQueue}, queues)
+
+	moved, err = broker.MoveDelayedTasks(queue, newQueue, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, moved)
+	count, err := broker.CountQueueDelayedTasks(queue)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+	delayedTask, err := broker.GetDelayTask("e")
+	assert.NoError(t, err)
+	if assert.NotNil(t, delayedTask) {
+		assert.Equal(t, eta.Unix(), delayedTask.ETA.Unix())
+	}
+	delayedTasks, err := broker.GetQueueDelayedTasks(newQueue, 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, delayedTasks, 3)
+
+	purged, err := broker.PurgePendingTasks(queue)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	purged, err = broker.PurgePendingTasks(newQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, purged)
+	purged, err = broker.PurgeDelayedTasks(newQueue)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, purged)
+
+	count, err = broker.CountDelayedTasks()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func newReliableRedisBroker(queue, consumerID string) *RedisBroker {
+	redisURL := os.Getenv("REDIS_URL")
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+
+	cnf := &config.Config{
+		DefaultQueue: queue,
+		Redis:        &config.RedisConfig{ReliableConsume: true, VisibilityTimeout: 1},
+	}
+	broker := NewRedisBroker(cnf, redisURL, redisPassword, "", 0).(*RedisBroker)
+	broker.consumerID = consumerID
+	return broker
+}
+
+func TestReliableAckRedis(t *testing.T) {
+	if os.Getenv("REDIS_URL") == "" {
+		return
+	}
+
+	queue := "test_reliable_ack_queue"
+	broker := newReliableRedisBroker(queue, "consumer")
+
+	// Cleanup before the test
+	conn := broker.GetConn()
+	defer conn.Close()
+	conn.Do("DEL", queue, withProcessingSuffix(queue, "consumer"), withConsumersSuffix(queue))
+
+	assert.NoError(t, broker.Publish(&tasks.Signature{UUID: "a"}))
+
+	// Popped message is kept in the processing list until it is acknowledged
+	delivery, err := broker.nextReliableTask(queue)
+	assert.NoError(t, err)
+	assert.Equal(t, queue, delivery.queue)
+	assert.Contains(t, string(delivery.body), `"UUID":"a"`)
+
+	length, err := redis.Int(conn.Do("LLEN", queue))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, length)
+	length, err = redis.Int(conn.Do("LLEN", withProcessingSuffix(queue, "consumer")))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, length)
+
+	broker.ack(delivery)
+	length, err = redis.Int(conn.Do("LLEN", withProcessingSuffix(queue, "consumer")))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, length)
+
+	_, err = broker.nextReliableTask(queue)
+	assert.Equal(t, redis.ErrNil, err)
+}
+
+// errorProcessor fails to process every task with its error
+type errorProcessor struct {
+	err error
+}
+
+func (p *errorProcessor) Process(signature *tasks.Signature) error {
+	return p.err
+}
+
+func TestReliableProcessErrorRedis(t *testing.T) {
+	if os.Getenv("REDIS_URL") == "" {
+		return
+	}
+
+	queue := "test_reliable_error_queue"
+	broker := newReliableRedisBroker(queue, "consumer")
+	broker.SetRegisteredTaskNames([]string{"test_task"})
+
+	// Cleanup before the test
+	conn := broker.GetConn()
+	defer conn.Close()
+	conn.Do("DEL", queue, withProcessingSuffix(queue, "consumer"), withConsumersSuffix(queue))
+
+	assert.NoError(t, broker.Publish(&tasks.Signature{UUID: "a", Name: "test_task"}))
+	delivery, err := broker.nextReliableTask(queue)
+	assert.NoError(t, err)
+
+	// Message is left for the reaper if processing fails, e.g. when the
+	// result backend is unreachable
+	err = broker.consumeOne(delivery, &errorProcessor{err: errors.New("backend down")})
+	assert.Error(t, err)
+	length, err := redis.Int(conn.Do("LLEN", withProcessingSuffix(queue, "consumer")))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, length)
+
+	// Message of a task which has failed for good is acknowledged
+	err = broker.consumeOne(delivery, &errorProcessor{err: tasks.NewErrNonRetryable(errors.New("malformed"))})
+	assert.Error(t, err)
+	length, err = redis.Int(conn.Do("LLEN", withProcessingSuffix(queue, "consumer")))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, length)
+}
+
+func TestReliableReapRedis(t *testing.T) {
+	if os.Getenv("REDIS_URL") == "" {
+		return
+	}
+
+	queue := "test_reliable_reap_queue"
+	dead := newReliableRedisBroker(queue, "dead")
+	live := newReliableRedisBroker(queue, "live")
+	queues := []config.QueueConfig{{Name: queue}}
+
+	// Cleanup before the test
+	conn := live.GetConn()
+	defer conn.Close()
+	conn.Do("DEL", queue, withProcessingSuffix(queue, "dead"), withProcessingSuffix(queue, "live"), withConsumersSuffix(queue))
+
+	assert.NoError(t, live.Publish(&tasks.Signature{UUID: "a"}))
+	assert.NoError(t, live.Publish(&tasks.Signature{UUID: "b"}))
+
+	// Both consumers take a message, the dead one crashes without
+	// acknowledging it and stops sending heartbeats
+	assert.NoError(t, dead.heartbeat(queues))
+	delivery, err := dead.nextReliableTask(queue)
+	assert.NoError(t, err)
+	assert.Contains(t, string(delivery.body), `"UUID":"a"`)
+
+	assert.NoError(t, live.heartbeat(queues))
+	delivery, err = live.nextReliableTask(queue)
+	assert.NoError(t, err)
+	assert.Contains(t, string(delivery.body), `"UUID":"b"`)
+
+	// Nothing is reaped within the visibility timeout
+	assert.NoError(t, live.reapDeadConsumers(queue))
+	length, err := redis.Int(conn.Do("LLEN", withProcessingSuffix(queue, "dead")))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, length)
+
+	time.Sleep(live.visibilityTimeout() + 100*time.Millisecond)
+	assert.NoError(t, live.heartbeat(queues))
+
+	// Message of the dead consumer is redelivered, the live consumer keeps
+	// the message it is processing
+	assert.NoError(t, live.reapDeadConsumers(queue))
+	length, err = redis.Int(conn.Do("LLEN", withProcessingSuffix(queue, "dead")))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, length)
+	length, err = redis.Int(conn.Do("LLEN", withProcessingSuffix(queue, "live")))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, length)
+	consumers, err := redis.Strings(conn.Do("ZRANGE", withConsumersSuffix(queue), 0, -1))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"live"}, consumers)
+
+	delivery, err = live.nextReliableTask(queue)
+	assert.NoError(t, err)
+	assert.Contains(t, string(delivery.body), `"UUID":"a"`)
+
+	// Consumer which has sent a heartbeat after the deadline is not reaped
+	// even if it was listed as dead before
+	deadline := time.Now().UTC().Add(-time.Minute).UnixNano()
+	assert.NoError(t, live.requeueProcessing(queue, "live", deadline))
+	length, err = redis.Int(conn.Do("LLEN", withProcessingSuffix(queue, "live")))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, length)
+}
+
+func TestRoutedQueuesRedis(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	redisPassword := os.Getenv("REDIS_PASSWORD")
+	if redisURL == "" {
+		return
+	}
+
+	cnf := &config.Config{DefaultQueue: "test_routed_default", Queues: []config.QueueConfig{{Name: "test_routed_configured"}}}
+	broker := NewRedisBroker(cnf, redisURL, redisPassword, "", 0).(*RedisBroker)
+
+	// Cleanup before the test
+	conn := broker.GetConn()
+	for _, queue := range []string{"test_routed_default", "test_routed_configured", "test_routed_other"} {
+		conn.Do("DEL", queue, WithDelaySuffix(queue), WithDetailSuffix(queue), withQueuesSuffix(queue))
+	}
+	conn.Close()
+
+	eta := time.Now().UTC().Add(time.Hour)
+	laterETA := eta.Add(time.Hour)
+	signatures := []*tasks.Signature{
+		{UUID: "a"},
+		{UUID: "b", RoutingKey: "test_routed_other"},
+		{UUID: "c", RoutingKey: "test_routed_configured", ETA: &laterETA},
+		{UUID: "d", RoutingKey: "test_routed_other", ETA: &eta},
+	}
+	for _, signature := range signatures {
+		assert.NoError(t, broker.Publish(signature))
+	}
+
+	queues, err := broker.Queues()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"test_routed_default", "test_routed_configured", "test_routed_other"}, queues)
+
+	count, err := broker.CountPendingTasks()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	count, err = broker.CountQueuePendingTasks("test_routed_other")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+	count, err = broker.CountDelayedTasks()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	pendingTasks, err := broker.GetPendingTasks(0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, pendingTasks, 2) {
+		assert.Equal(t, "a", pendingTasks[0].UUID)
+		assert.Equal(t, "b", pendingTasks[1].UUID)
+	}
+
+	// Delayed tasks of all queues are listed due first
+	delayedTasks, err := broker.GetDelayedTasks(0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, delayedTasks, 2) {
+		assert.Equal(t, "d", delayedTasks[0].UUID)
+		assert.Equal(t, "c", delayedTasks[1].UUID)
+	}
+	delayedTasks, err = broker.GetQueueDelayedTasks("test_routed_configured", 0, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, delayedTasks, 1) {
+		assert.Equal(t, "c", delayedTasks[0].UUID)
+	}
+
+	// Delayed task routed to a queue which is not configured is found
+	delayedTask, err := broker.GetDelayTask("d")
+	assert.NoError(t, err)
+	if assert.NotNil(t, delayedTask) {
+		assert.Equal(t, "test_routed_other", delayedTask.RoutingKey)
+	}
+	assert.NoError(t, broker.CancelDelayTask("d"))
+	delayedTask, err = broker.GetDelayTask("d")
+	assert.NoError(t, err)
+	assert.Nil(t, delayedTask)
+}
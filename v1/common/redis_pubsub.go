@@ -0,0 +1,165 @@
+package common
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrRedisPubSubClosed is why reading from a closed RedisPubSub has stopped
+var ErrRedisPubSubClosed = errors.New("Redis pub/sub closed")
+
+// RedisPubSub receives messages of Redis channels subscribed on a single
+// connection. A single goroutine reads from the connection, so replies to
+// unsubscribing are not read concurrently, and another one pings it so it
+// does not hit the read timeout. Writing to the connection is serialized.
+type RedisPubSub struct {
+	psc    redis.PubSubConn
+	handle func(message redis.Message)
+	// Subscribers waiting for their subscriptions to be confirmed
+	pending map[string][]chan struct{}
+	closing bool
+	// err is why reading has stopped, it is set before done is closed
+	err  error
+	done chan struct{}
+	mu   sync.Mutex
+}
+
+// NewRedisPubSub starts reading from the connection, handle is called with
+// every message by the reading goroutine
+func NewRedisPubSub(conn redis.Conn, pingInterval time.Duration, handle func(message redis.Message)) *RedisPubSub {
+	ps := &RedisPubSub{
+		psc:     redis.PubSubConn{Conn: conn},
+		handle:  handle,
+		pending: make(map[string][]chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go ps.read()
+	go ps.ping(pingInterval)
+	return ps
+}
+
+// Subscribe subscribes to the channel and waits until the subscription is
+// confirmed, so messages published afterwards are received
+func (ps *RedisPubSub) Subscribe(channel string) error {
+	confirmed := make(chan struct{})
+
+	ps.mu.Lock()
+	if ps.closing {
+		ps.mu.Unlock()
+		return ErrRedisPubSubClosed
+	}
+	ps.pending[channel] = append(ps.pending[channel], confirmed)
+	if err := ps.psc.Subscribe(channel); err != nil {
+		ps.psc.Close()
+		ps.mu.Unlock()
+		return err
+	}
+	ps.mu.Unlock()
+
+	select {
+	case <-confirmed:
+		return nil
+	case <-ps.done:
+		return ps.err
+	}
+}
+
+// Unsubscribe unsubscribes from the channel
+func (ps *RedisPubSub) Unsubscribe(channel string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.closing {
+		return nil
+	}
+	if err := ps.psc.Unsubscribe(channel); err != nil {
+		ps.psc.Close()
+		return err
+	}
+	return nil
+}
+
+// Close unsubscribes from all channels, the reading goroutine closes the
+// connection afterwards. It may be called more than once.
+func (ps *RedisPubSub) Close() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.closing {
+		return
+	}
+	ps.closing = true
+	// Reading has stopped already if the connection has failed
+	if err := ps.psc.Unsubscribe(); err != nil {
+		ps.psc.Close()
+	}
+}
+
+// Done returns a channel closed once reading has stopped, because the
+// connection has failed or the pub/sub has been closed
+func (ps *RedisPubSub) Done() <-chan struct{} {
+	return ps.done
+}
+
+// Err returns why reading has stopped once Done is closed
+func (ps *RedisPubSub) Err() error {
+	return ps.err
+}
+
+// read passes messages to handle until the connection fails or all channels
+// have been unsubscribed after closing, the connection is closed then
+func (ps *RedisPubSub) read() {
+	defer close(ps.done)
+
+	for {
+		switch v := ps.psc.Receive().(type) {
+		case redis.Message:
+			ps.handle(v)
+		case redis.Subscription:
+			ps.mu.Lock()
+			if v.Kind == "subscribe" {
+				for _, confirmed := range ps.pending[v.Channel] {
+					close(confirmed)
+				}
+				delete(ps.pending, v.Channel)
+			}
+			closed := v.Count == 0 && ps.closing
+			if closed {
+				ps.err = ErrRedisPubSubClosed
+				ps.psc.Close()
+			}
+			ps.mu.Unlock()
+			if closed {
+				return
+			}
+		case error:
+			ps.mu.Lock()
+			ps.err = v
+			ps.psc.Close()
+			ps.mu.Unlock()
+			return
+		}
+	}
+}
+
+// ping keeps the connection alive until reading from it stops
+func (ps *RedisPubSub) ping(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ps.done:
+			return
+		case <-ticker.C:
+			ps.mu.Lock()
+			if !ps.closing {
+				ps.psc.Ping("")
+			}
+			ps.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package machinery
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/backends"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/Guazi-inc/machinery/v1/semaphore"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+)
+
+const (
+	concurrencySuffix = "_concurrency:"
+	// Task over its concurrency limits is sent back to the queue with this
+	// delay
+	concurrencyLimitDelay = time.Second
+	// How often a task waiting in place for its global concurrency limit
+	// checks for a free slot, slots are freed by other workers so they are
+	// polled
+	concurrencyLimitPollInterval = 100 * time.Millisecond
+)
+
+// errGlobalConcurrencyNotSupported is returned when registering a task with a
+// global concurrency limit if there is nowhere to keep slots shared by all
+// workers
+var errGlobalConcurrencyNotSupported = errors.New("Global concurrency limits require Redis broker or Redis result backend")
+
+// newSemaphore creates the semaphore enforcing global concurrency limits of
+// registered tasks. Slots are kept in Redis when using Redis broker or Redis
+// result backend so the limits apply to the whole worker fleet, eager broker
+// keeps them in memory. Nil is returned with other brokers and backends.
+func newSemaphore(cnf *config.Config, broker brokers.Interface, backend backends.Interface) semaphore.Semaphore {
+	if pool, ok := sharedRedisPool(broker, backend); ok {
+		return semaphore.NewRedisSemaphore(pool, cnf.DefaultQueue+concurrencySuffix)
+	}
+	if isEagerBroker(broker) {
+		return semaphore.NewLocalSemaphore()
+	}
+	return nil
+}
+
+// taskSlots counts running instances of tasks with concurrency limits in a
+// worker, the zero value is ready to use
+type taskSlots struct {
+	mu      sync.Mutex
+	running map[string]int
+	// freed is closed and replaced whenever a slot is freed
+	freed chan struct{}
+}
+
+// tryAcquire takes a slot of the task unless limit instances of it are
+// running already, the returned channel is closed once a slot is freed
+func (slots *taskSlots) tryAcquire(name string, limit int) (func(), <-chan struct{}, bool) {
+	slots.mu.Lock()
+	defer slots.mu.Unlock()
+
+	if slots.running == nil {
+		slots.running = make(map[string]int)
+		slots.freed = make(chan struct{})
+	}
+	if slots.running[name] >= limit {
+		return nil, slots.freed, false
+	}
+	slots.running[name]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			slots.mu.Lock()
+			defer slots.mu.Unlock()
+
+			slots.running[name]--
+			if slots.running[name] == 0 {
+				delete(slots.running, name)
+			}
+			close(slots.freed)
+			slots.freed = make(chan struct{})
+		})
+	}, nil, true
+}
+
+// TryAcquireTask takes a slot of the worker and a global slot for the task if
+// it has concurrency limits, it returns false if any of them is not free.
+// Global limit is not enforced if the semaphore fails.
+func (worker *Worker) TryAcquireTask(name string) (func(), bool) {
+	release, _, ok := worker.tryAcquireTask(name)
+	return release, ok
+}
+
+// acquireTask blocks until the task gets the slots it needs to run, eager
+// broker processes tasks in place so a task over its limits waits there
+func (worker *Worker) acquireTask(name string) func() {
+	for {
+		release, freed, ok := worker.tryAcquireTask(name)
+		if ok {
+			return release
+		}
+
+		select {
+		case <-freed:
+		case <-time.After(concurrencyLimitPollInterval):
+		}
+	}
+}
+
+// DelayTask sends a task over its concurrency limits back to the queue to be
+// processed after a delay, brokers do so rather than waiting for a slot, so
+// other tasks keep running meanwhile
+func (worker *Worker) DelayTask(signature *tasks.Signature) error {
+	log.INFO.Printf("Task %s has reached its concurrency limit", signature.UUID)
+	return worker.delayTask(signature, concurrencyLimitDelay)
+}
+
+// tryAcquireTask is TryAcquireTask also returning a channel which is closed
+// once a slot of the worker is freed, if that is what the task is waiting for
+func (worker *Worker) tryAcquireTask(name string) (func(), <-chan struct{}, bool) {
+	options := worker.server.GetRegisteredTaskOptions(name)
+	release := func() {}
+
+	if options.Concurrency > 0 {
+		releaseLocal, freed, ok := worker.slots.tryAcquire(name, options.Concurrency)
+		if !ok {
+			return nil, freed, false
+		}
+		release = releaseLocal
+	}
+
+	if options.GlobalConcurrency > 0 && worker.server.semaphore == nil {
+		log.ERROR.Printf("Failed to acquire concurrency slot for %s: %s", name, errGlobalConcurrencyNotSupported)
+	} else if options.GlobalConcurrency > 0 {
+		releaseGlobal, ok, err := worker.server.semaphore.Acquire(name, options.GlobalConcurrency)
+		if err != nil {
+			log.ERROR.Printf("Failed to acquire concurrency slot for %s: %s", name, err)
+			return release, nil, true
+		}
+		if !ok {
+			release()
+			return nil, nil, false
+		}
+		releaseLocal := release
+		release = func() {
+			releaseGlobal()
+			releaseLocal()
+		}
+	}
+
+	return release, nil, true
+}
@@ -3,6 +3,7 @@ package config
 import (
 	"crypto/tls"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -27,14 +28,33 @@ var (
 
 // Config holds all configuration for our program
 type Config struct {
-	Broker          string      `yaml:"broker" envconfig:"BROKER"`
-	DefaultQueue    string      `yaml:"default_queue" envconfig:"DEFAULT_QUEUE"`
-	ResultBackend   string      `yaml:"result_backend" envconfig:"RESULT_BACKEND"`
-	ResultsExpireIn int         `yaml:"results_expire_in" envconfig:"RESULTS_EXPIRE_IN"`
-	AMQP            *AMQPConfig `yaml:"amqp"`
+	Broker          string       `yaml:"broker" envconfig:"BROKER"`
+	DefaultQueue    string       `yaml:"default_queue" envconfig:"DEFAULT_QUEUE"`
+	ResultBackend   string       `yaml:"result_backend" envconfig:"RESULT_BACKEND"`
+	ResultsExpireIn int          `yaml:"results_expire_in" envconfig:"RESULTS_EXPIRE_IN"`
+	Queues          Queues       `yaml:"queues" envconfig:"QUEUES"`
+	AMQP            *AMQPConfig  `yaml:"amqp"`
+	Redis           *RedisConfig `yaml:"redis"`
 	TLSConfig       *tls.Config
+	// IdempotencyWindow is the number of seconds a task sent with an
+	// idempotency key prevents duplicates, defaults to ResultsExpireIn
+	IdempotencyWindow int `yaml:"idempotency_window" envconfig:"IDEMPOTENCY_WINDOW"`
+	// HealthAddr is the address workers serve health checks on, e.g.
+	// ":8080", no health check server is started if empty
+	HealthAddr string `yaml:"health_addr" envconfig:"HEALTH_ADDR"`
 }
 
+// QueueConfig describes a single queue consumed by workers
+type QueueConfig struct {
+	Name string `yaml:"name"`
+	// Weight sets how often the queue is checked relative to other queues,
+	// if no queue has a weight, queues are checked in strict order
+	Weight int `yaml:"weight"`
+}
+
+// Queues is a list of queues consumed by workers
+type Queues []QueueConfig
+
 // QueueBindingArgs arguments which are used when binding to the exchange
 type QueueBindingArgs map[string]interface{}
 
@@ -45,6 +65,23 @@ type AMQPConfig struct {
 	QueueBindingArgs QueueBindingArgs `yaml:"queue_binding_args" envconfig:"AMQP_QUEUE_BINDING_ARGS"`
 	BindingKey       string           `yaml:"binding_key" envconfig:"AMQP_BINDING_KEY"`
 	PrefetchCount    int              `yaml:"prefetch_count" envconfig:"AMQP_PREFETCH_COUNT"`
+	// MaxPriority enables task priorities up to the given value by declaring
+	// the queue with x-max-priority, the queue has to be recreated if it
+	// already exists without it
+	MaxPriority int `yaml:"max_priority" envconfig:"AMQP_MAX_PRIORITY"`
+}
+
+// RedisConfig wraps Redis broker related configuration
+type RedisConfig struct {
+	// ReliableConsume enables at-least-once delivery, consumed messages are
+	// kept in a per-consumer processing list until they are acknowledged
+	ReliableConsume bool `yaml:"reliable_consume" envconfig:"REDIS_RELIABLE_CONSUME"`
+	// VisibilityTimeout is the number of seconds after which messages held by
+	// a consumer which stopped sending heartbeats are returned to the queue
+	VisibilityTimeout int `yaml:"visibility_timeout" envconfig:"REDIS_VISIBILITY_TIMEOUT"`
+	// MaxPriority enables task priorities up to the given value, tasks of
+	// each priority are kept in a separate list consumed highest first
+	MaxPriority int `yaml:"max_priority" envconfig:"REDIS_MAX_PRIORITY"`
 }
 
 // Decode from yaml to map (any field whose type or pointer-to-type implements
@@ -62,3 +99,27 @@ func (args *QueueBindingArgs) Decode(value string) error {
 	*args = QueueBindingArgs(mp)
 	return nil
 }
+
+// Decode from a comma separated list of queue names with optional weights,
+// e.g. "critical:3,default:1"
+func (queues *Queues) Decode(value string) error {
+	items := strings.Split(value, ",")
+	decoded := make(Queues, 0, len(items))
+	for _, item := range items {
+		parts := strings.Split(item, ":")
+		if len(parts) > 2 || parts[0] == "" {
+			return fmt.Errorf("invalid queue: %q", item)
+		}
+		queue := QueueConfig{Name: parts[0]}
+		if len(parts) == 2 {
+			weight, err := strconv.Atoi(parts[1])
+			if err != nil {
+				return fmt.Errorf("invalid queue weight: %q", item)
+			}
+			queue.Weight = weight
+		}
+		decoded = append(decoded, queue)
+	}
+	*queues = decoded
+	return nil
+}
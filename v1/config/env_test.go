@@ -35,6 +35,7 @@ func TestNewFromEnvironment(t *testing.T) {
 	assert.Equal(t, "default_queue", cnf.DefaultQueue)
 	assert.Equal(t, "result_backend", cnf.ResultBackend)
 	assert.Equal(t, 123456, cnf.ResultsExpireIn)
+	assert.Equal(t, config.Queues{{Name: "critical", Weight: 3}, {Name: "default_queue"}}, cnf.Queues)
 	assert.Equal(t, "exchange", cnf.AMQP.Exchange)
 	assert.Equal(t, "exchange_type", cnf.AMQP.ExchangeType)
 	assert.Equal(t, "binding_key", cnf.AMQP.BindingKey)
@@ -14,6 +14,10 @@ broker: broker
 default_queue: default_queue
 result_backend: result_backend
 results_expire_in: 123456
+queues:
+  - name: critical
+    weight: 3
+  - name: default_queue
 amqp:
   binding_key: binding_key
   exchange: exchange
@@ -52,6 +56,7 @@ func TestNewFromYaml(t *testing.T) {
 	assert.Equal(t, "default_queue", cnf.DefaultQueue)
 	assert.Equal(t, "result_backend", cnf.ResultBackend)
 	assert.Equal(t, 123456, cnf.ResultsExpireIn)
+	assert.Equal(t, config.Queues{{Name: "critical", Weight: 3}, {Name: "default_queue"}}, cnf.Queues)
 	assert.Equal(t, "exchange", cnf.AMQP.Exchange)
 	assert.Equal(t, "exchange_type", cnf.AMQP.ExchangeType)
 	assert.Equal(t, "binding_key", cnf.AMQP.BindingKey)
@@ -0,0 +1,910 @@
+package machinery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/common"
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/garyburd/redigo/redis"
+	uuid "github.com/satori/go.uuid"
+	"github.com/streadway/amqp"
+)
+
+// Control commands understood by workers
+const (
+	// ControlPing only makes workers reply
+	ControlPing = "ping"
+	// ControlPause stops consuming tasks, running tasks are finished first
+	ControlPause = "pause"
+	// ControlResume starts consuming tasks again
+	ControlResume = "resume"
+	// ControlSetConcurrency changes concurrency of workers
+	ControlSetConcurrency = "set_concurrency"
+	// ControlShutdown quits workers gracefully
+	ControlShutdown = "shutdown"
+)
+
+const (
+	controlSuffix      = "_control"
+	controlReplySuffix = "_control_reply:"
+	// DefaultControlTimeout is how long replies of workers to a control
+	// command are collected unless a timeout is given
+	DefaultControlTimeout = 5 * time.Second
+	// Subscriber connection is pinged so it does not hit the read timeout
+	controlPingInterval = 5 * time.Second
+	// Worker subscribes to control commands again after this delay when its
+	// subscription fails
+	controlResubscribeDelay = time.Second
+)
+
+// errControlNotSupported is returned when sending control commands if the
+// broker cannot pass them to workers
+var errControlNotSupported = errors.New("Control commands require Redis or AMQP broker")
+
+// ControlCommand is broadcast to launched workers, see Server.Control
+type ControlCommand struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// IDs of workers the command is for, see Worker.ID. The command is for
+	// all workers if empty.
+	Destination []string `json:"destination,omitempty"`
+	// Concurrency set by the set_concurrency command
+	Concurrency int `json:"concurrency,omitempty"`
+}
+
+// ControlReply is the reply of a worker to a control command
+type ControlReply struct {
+	CommandID string `json:"command_id"`
+	WorkerID  string `json:"worker_id"`
+	// Error is empty if the worker has carried out the command
+	Error string `json:"error,omitempty"`
+}
+
+// isFor returns true if the command is for the worker
+func (command *ControlCommand) isFor(workerID string) bool {
+	if len(command.Destination) == 0 {
+		return true
+	}
+	for _, id := range command.Destination {
+		if id == workerID {
+			return true
+		}
+	}
+	return false
+}
+
+// controlChannel passes control commands to workers and their replies back
+type controlChannel interface {
+	// Subscribe passes every command to handle in a new goroutine until
+	// unsubscribe is called
+	Subscribe(handle func(command *ControlCommand)) (unsubscribe func())
+	// Broadcast sends the command to all subscribed workers, their replies
+	// are passed to the returned channel until stop is called
+	Broadcast(command *ControlCommand) (replies <-chan *ControlReply, stop func(), err error)
+	// Reply sends the reply of a worker to the command
+	Reply(reply *ControlReply) error
+}
+
+// newControlChannel creates the control channel. Commands are broadcast by
+// Redis pub/sub when using Redis broker and by a fanout exchange when using
+// AMQP broker, so they reach the whole worker fleet. Eager broker passes them
+// in memory. Nil is returned with other brokers.
+func newControlChannel(cnf *config.Config, broker brokers.Interface) controlChannel {
+	if redisBroker, ok := broker.(*brokers.RedisBroker); ok {
+		return &redisControlChannel{broker: redisBroker, channel: cnf.DefaultQueue + controlSuffix}
+	}
+	if _, ok := broker.(*brokers.AMQPBroker); ok {
+		return &amqpControlChannel{cnf: cnf, exchange: cnf.DefaultQueue + controlSuffix}
+	}
+	if isEagerBroker(broker) {
+		return &localControlChannel{
+			handlers: make(map[int]func(*ControlCommand)),
+			waiters:  make(map[string]*localControlWaiter),
+		}
+	}
+	return nil
+}
+
+// Control broadcasts the command to launched workers and collects their
+// replies until every worker the command is for has replied or the timeout
+// expires. Workers listed by ListWorkers are waited for if the command has
+// no destination.
+func (server *Server) Control(command *ControlCommand, timeout time.Duration) ([]*ControlReply, error) {
+	if server.controlChannel == nil {
+		return nil, errControlNotSupported
+	}
+
+	if command.ID == "" {
+		command.ID = fmt.Sprintf("control_%v", uuid.NewV4())
+	}
+	if timeout <= 0 {
+		timeout = DefaultControlTimeout
+	}
+
+	waitingFor := make(map[string]bool)
+	if len(command.Destination) > 0 {
+		for _, id := range command.Destination {
+			waitingFor[id] = true
+		}
+	} else if workers, err := server.ListWorkers(); err == nil {
+		for _, worker := range workers {
+			waitingFor[worker.ID] = true
+		}
+	}
+
+	replies, stop, err := server.controlChannel.Broadcast(command)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	collected := make([]*ControlReply, 0, len(waitingFor))
+	for {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				return collected, nil
+			}
+			collected = append(collected, reply)
+
+			if waitingFor[reply.WorkerID] {
+				delete(waitingFor, reply.WorkerID)
+				if len(waitingFor) == 0 {
+					return collected, nil
+				}
+			}
+		case <-timer.C:
+			return collected, nil
+		}
+	}
+}
+
+// PingWorkers collects replies of workers, all workers if no worker IDs
+// are given
+func (server *Server) PingWorkers(timeout time.Duration, workerIDs ...string) ([]*ControlReply, error) {
+	return server.Control(&ControlCommand{Name: ControlPing, Destination: workerIDs}, timeout)
+}
+
+// PauseWorkers makes workers stop consuming tasks, all workers if no worker
+// IDs are given. Workers reply once their running tasks have finished.
+func (server *Server) PauseWorkers(timeout time.Duration, workerIDs ...string) ([]*ControlReply, error) {
+	return server.Control(&ControlCommand{Name: ControlPause, Destination: workerIDs}, timeout)
+}
+
+// ResumeWorkers makes paused workers consume tasks again, all workers if no
+// worker IDs are given
+func (server *Server) ResumeWorkers(timeout time.Duration, workerIDs ...string) ([]*ControlReply, error) {
+	return server.Control(&ControlCommand{Name: ControlResume, Destination: workerIDs}, timeout)
+}
+
+// SetWorkersConcurrency changes concurrency of workers, all workers if no
+// worker IDs are given
+func (server *Server) SetWorkersConcurrency(concurrency int, timeout time.Duration, workerIDs ...string) ([]*ControlReply, error) {
+	return server.Control(&ControlCommand{Name: ControlSetConcurrency, Destination: workerIDs, Concurrency: concurrency}, timeout)
+}
+
+// ShutdownWorkers makes workers quit gracefully, all workers if no worker IDs
+// are given. Workers reply before they quit.
+func (server *Server) ShutdownWorkers(timeout time.Duration, workerIDs ...string) ([]*ControlReply, error) {
+	return server.Control(&ControlCommand{Name: ControlShutdown, Destination: workerIDs}, timeout)
+}
+
+// workerControl is the state of the worker changed by control commands
+type workerControl struct {
+	// actionMu serializes pausing, resuming and quitting of the worker
+	actionMu    sync.Mutex
+	mu          sync.Mutex
+	launched    bool
+	paused      bool
+	quitting    bool
+	restart     bool
+	resumed     chan struct{}
+	unsubscribe func()
+}
+
+// Pause stops consuming tasks until Resume is called, it waits for running
+// tasks to finish
+func (worker *Worker) Pause() error {
+	worker.control.actionMu.Lock()
+	defer worker.control.actionMu.Unlock()
+
+	worker.control.mu.Lock()
+	if !worker.control.launched || worker.control.quitting {
+		worker.control.mu.Unlock()
+		return errors.New("Worker is not running")
+	}
+	if worker.control.paused {
+		worker.control.mu.Unlock()
+		return nil
+	}
+	worker.control.paused = true
+	worker.control.restart = true
+	worker.control.resumed = make(chan struct{})
+	worker.control.mu.Unlock()
+
+	log.WARNING.Print("Pausing the worker, waiting for running tasks to finish")
+	worker.server.GetBroker().StopConsuming()
+	return nil
+}
+
+// Resume starts consuming tasks again after Pause
+func (worker *Worker) Resume() error {
+	worker.control.actionMu.Lock()
+	defer worker.control.actionMu.Unlock()
+
+	worker.control.mu.Lock()
+	defer worker.control.mu.Unlock()
+
+	if worker.control.paused {
+		log.WARNING.Print("Resuming the worker")
+		worker.control.paused = false
+		close(worker.control.resumed)
+	}
+	return nil
+}
+
+// IsPaused returns true if the worker has been paused
+func (worker *Worker) IsPaused() bool {
+	worker.control.mu.Lock()
+	defer worker.control.mu.Unlock()
+
+	return worker.control.paused
+}
+
+// SetConcurrency changes concurrency of the worker, consuming is restarted
+// with the new concurrency once running tasks have finished
+func (worker *Worker) SetConcurrency(concurrency int) error {
+	if concurrency < 0 {
+		return errors.New("Concurrency must not be negative")
+	}
+
+	worker.control.actionMu.Lock()
+	defer worker.control.actionMu.Unlock()
+
+	worker.control.mu.Lock()
+	worker.Concurrency = concurrency
+	restart := worker.control.launched && !worker.control.paused && !worker.control.quitting
+	if restart {
+		worker.control.restart = true
+	}
+	worker.control.mu.Unlock()
+
+	if restart {
+		log.WARNING.Printf("Restarting the worker with concurrency %d", concurrency)
+		worker.server.GetBroker().StopConsuming()
+	}
+	return nil
+}
+
+// concurrency returns concurrency of the worker
+func (worker *Worker) concurrency() int {
+	worker.control.mu.Lock()
+	defer worker.control.mu.Unlock()
+
+	return worker.Concurrency
+}
+
+// consume keeps consuming tasks from the broker until the worker quits or
+// the broker gives up
+func (worker *Worker) consume(errorsChan chan<- error) {
+	broker := worker.server.GetBroker()
+
+	var err error
+	for worker.waitResumed() {
+		var retry bool
+		retry, err = broker.StartConsuming(worker.ConsumerTag, worker.concurrency(), worker)
+
+		// Consuming has been stopped to pause the worker or to change its
+		// concurrency
+		if worker.restarting() {
+			worker.consumeStopped()
+			continue
+		}
+
+		if !retry {
+			break
+		}
+		log.WARNING.Printf("Start consuming error: %s", err)
+		if err != nil {
+			worker.consumeErrored(err)
+		}
+	}
+
+	worker.setConsuming(false)
+	worker.stopHeartbeat()
+	worker.stopControl()
+	errorsChan <- err
+}
+
+// waitResumed blocks while the worker is paused, it returns false if the
+// worker is quitting
+func (worker *Worker) waitResumed() bool {
+	worker.control.mu.Lock()
+	resumed := worker.control.resumed
+	paused := worker.control.paused
+	worker.control.mu.Unlock()
+
+	if paused {
+		<-resumed
+	}
+
+	worker.control.mu.Lock()
+	defer worker.control.mu.Unlock()
+
+	return !worker.control.quitting
+}
+
+// restarting returns true once after consuming has been stopped on purpose
+func (worker *Worker) restarting() bool {
+	worker.control.mu.Lock()
+	defer worker.control.mu.Unlock()
+
+	restart := worker.control.restart && !worker.control.quitting
+	worker.control.restart = false
+	return restart
+}
+
+// quitting marks the worker as quitting, it returns false if the broker is
+// not consuming because the worker has been paused
+func (worker *Worker) quitting() bool {
+	worker.control.actionMu.Lock()
+	defer worker.control.actionMu.Unlock()
+
+	worker.control.mu.Lock()
+	defer worker.control.mu.Unlock()
+
+	worker.control.quitting = true
+	if worker.control.paused {
+		worker.control.paused = false
+		close(worker.control.resumed)
+		return false
+	}
+	return true
+}
+
+// startControl subscribes the worker to control commands
+func (worker *Worker) startControl() {
+	var unsubscribe func()
+	if worker.server.controlChannel != nil {
+		unsubscribe = worker.server.controlChannel.Subscribe(worker.handleControl)
+	} else {
+		log.WARNING.Printf("Worker %s will not receive control commands: %s", worker.ID(), errControlNotSupported)
+	}
+
+	worker.control.mu.Lock()
+	worker.control.launched = true
+	worker.control.unsubscribe = unsubscribe
+	worker.control.mu.Unlock()
+}
+
+// stopControl unsubscribes the worker from control commands
+func (worker *Worker) stopControl() {
+	worker.control.mu.Lock()
+	unsubscribe := worker.control.unsubscribe
+	worker.control.unsubscribe = nil
+	worker.control.mu.Unlock()
+
+	if unsubscribe != nil {
+		unsubscribe()
+	}
+}
+
+// handleControl carries out the command and replies to it
+func (worker *Worker) handleControl(command *ControlCommand) {
+	if !command.isFor(worker.ID()) {
+		return
+	}
+
+	log.INFO.Printf("Received control command %s: %s", command.Name, command.ID)
+
+	var err error
+	switch command.Name {
+	case ControlPing:
+	case ControlPause:
+		err = worker.Pause()
+	case ControlResume:
+		err = worker.Resume()
+	case ControlSetConcurrency:
+		err = worker.SetConcurrency(command.Concurrency)
+	case ControlShutdown:
+		// Reply first as quitting waits for running tasks to finish
+		defer worker.Quit()
+	default:
+		err = fmt.Errorf("Unknown control command %s", command.Name)
+	}
+
+	reply := &ControlReply{CommandID: command.ID, WorkerID: worker.ID()}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	if err := worker.server.controlChannel.Reply(reply); err != nil {
+		log.ERROR.Printf("Failed to reply to control command %s: %s", command.ID, err)
+	}
+}
+
+// redisControlChannel broadcasts commands and replies by Redis pub/sub
+type redisControlChannel struct {
+	broker  *brokers.RedisBroker
+	channel string
+}
+
+func (c *redisControlChannel) Subscribe(handle func(command *ControlCommand)) func() {
+	return subscribeControl(func(quit <-chan struct{}) error {
+		return c.receive(handle, quit)
+	})
+}
+
+// subscribeControl keeps calling receive until the returned unsubscribe
+// function is called, receive returns once quit is closed or once its
+// subscription fails
+func subscribeControl(receive func(quit <-chan struct{}) error) func() {
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for {
+			err := receive(quit)
+			select {
+			case <-quit:
+				return
+			default:
+			}
+
+			log.WARNING.Printf("Control channel error: %s", err)
+			select {
+			case <-quit:
+				return
+			case <-time.After(controlResubscribeDelay):
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// receive passes commands to handle until the subscription fails or quit is
+// closed
+func (c *redisControlChannel) receive(handle func(command *ControlCommand), quit <-chan struct{}) error {
+	subscription, err := subscribeRedis(c.broker.GetConn(), c.channel)
+	if err != nil {
+		return err
+	}
+	defer subscription.close()
+
+	// Closing the subscription makes receiving from it fail
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-quit:
+			subscription.close()
+		case <-done:
+		}
+	}()
+
+	for {
+		data, err := subscription.receive()
+		if err != nil {
+			return err
+		}
+
+		command := new(ControlCommand)
+		if err := json.Unmarshal(data, command); err != nil {
+			log.ERROR.Printf("Failed to decode control command: %s", err)
+			continue
+		}
+		go handle(command)
+	}
+}
+
+func (c *redisControlChannel) Broadcast(command *ControlCommand) (<-chan *ControlReply, func(), error) {
+	encoded, err := json.Marshal(command)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Subscribe to replies before sending the command so none is missed
+	subscription, err := subscribeRedis(c.broker.GetConn(), c.channel+controlReplySuffix+command.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn := c.broker.GetConn()
+	defer conn.Close()
+
+	if _, err := conn.Do("PUBLISH", c.channel, encoded); err != nil {
+		subscription.close()
+		return nil, nil, err
+	}
+
+	replies := make(chan *ControlReply)
+	stop := make(chan struct{})
+	go func() {
+		defer close(replies)
+
+		for {
+			data, err := subscription.receive()
+			if err != nil {
+				return
+			}
+
+			reply := new(ControlReply)
+			if err := json.Unmarshal(data, reply); err != nil {
+				log.ERROR.Printf("Failed to decode control reply: %s", err)
+				continue
+			}
+
+			select {
+			case replies <- reply:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return replies, func() {
+		close(stop)
+		subscription.close()
+	}, nil
+}
+
+func (c *redisControlChannel) Reply(reply *ControlReply) error {
+	encoded, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	conn := c.broker.GetConn()
+	defer conn.Close()
+
+	_, err = conn.Do("PUBLISH", c.channel+controlReplySuffix+reply.CommandID, encoded)
+	return err
+}
+
+// redisSubscription receives messages of a Redis channel
+type redisSubscription struct {
+	pubsub   *common.RedisPubSub
+	messages chan []byte
+	// stop is closed with the subscription, so reading does not wait for
+	// messages to be received any more
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// subscribeRedis subscribes to the channel and waits until the subscription
+// is confirmed, so messages published afterwards are received
+func subscribeRedis(conn redis.Conn, channel string) (*redisSubscription, error) {
+	subscription := &redisSubscription{
+		messages: make(chan []byte),
+		stop:     make(chan struct{}),
+	}
+	subscription.pubsub = common.NewRedisPubSub(conn, controlPingInterval, func(message redis.Message) {
+		select {
+		case subscription.messages <- message.Data:
+		case <-subscription.stop:
+		}
+	})
+	if err := subscription.pubsub.Subscribe(channel); err != nil {
+		subscription.close()
+		return nil, err
+	}
+	return subscription, nil
+}
+
+// receive returns data of the next message
+func (subscription *redisSubscription) receive() ([]byte, error) {
+	select {
+	case data := <-subscription.messages:
+		return data, nil
+	case <-subscription.pubsub.Done():
+		return nil, subscription.pubsub.Err()
+	}
+}
+
+// close unsubscribes from the channel, the connection is closed afterwards.
+// It may be called more than once.
+func (subscription *redisSubscription) close() {
+	subscription.stopOnce.Do(func() {
+		close(subscription.stop)
+	})
+	subscription.pubsub.Close()
+}
+
+// amqpControlChannel broadcasts commands by a fanout exchange, every
+// subscribed worker consumes them from an exclusive queue of its own. Replies
+// are sent to a queue declared for the command by the default exchange.
+type amqpControlChannel struct {
+	common.AMQPConnector
+	cnf      *config.Config
+	exchange string
+}
+
+func (c *amqpControlChannel) Subscribe(handle func(command *ControlCommand)) func() {
+	return subscribeControl(func(quit <-chan struct{}) error {
+		return c.receive(handle, quit)
+	})
+}
+
+// receive passes commands to handle until the connection fails or quit is
+// closed
+func (c *amqpControlChannel) receive(handle func(command *ControlCommand), quit <-chan struct{}) error {
+	conn, channel, err := c.Open(c.cnf.Broker, c.cnf.TLSConfig)
+	if err != nil {
+		return err
+	}
+	defer c.Close(channel, conn)
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+	if err := c.declareExchange(channel); err != nil {
+		return err
+	}
+
+	// The queue is deleted once the connection is closed
+	queue, err := channel.QueueDeclare(
+		"",    // name, generated by the server
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("Queue declare error: %s", err)
+	}
+	if err := channel.QueueBind(
+		queue.Name, // name of the queue
+		"",         // binding key, ignored by fanout exchange
+		c.exchange, // source exchange
+		false,      // no-wait
+		nil,        // arguments
+	); err != nil {
+		return fmt.Errorf("Queue bind error: %s", err)
+	}
+
+	deliveries, err := c.consume(channel, queue.Name)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-quit:
+			return nil
+		case amqpErr := <-closed:
+			if amqpErr != nil {
+				return amqpErr
+			}
+			return errors.New("Connection closed")
+		case d, ok := <-deliveries:
+			if !ok {
+				return errors.New("Control queue closed")
+			}
+
+			command := new(ControlCommand)
+			if err := json.Unmarshal(d.Body, command); err != nil {
+				log.ERROR.Printf("Failed to decode control command: %s", err)
+				continue
+			}
+			go handle(command)
+		}
+	}
+}
+
+func (c *amqpControlChannel) Broadcast(command *ControlCommand) (<-chan *ControlReply, func(), error) {
+	encoded, err := json.Marshal(command)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn, channel, err := c.Open(c.cnf.Broker, c.cnf.TLSConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Declare the reply queue before sending the command so no reply is
+	// missed, the queue is deleted once the connection is closed
+	deliveries, err := c.declareReplyQueue(channel, command.ID)
+	if err == nil {
+		err = c.declareExchange(channel)
+	}
+	if err == nil {
+		err = channel.Publish(
+			c.exchange, // exchange name
+			"",         // routing key, ignored by fanout exchange
+			false,      // mandatory
+			false,      // immediate
+			amqp.Publishing{ContentType: "application/json", Body: encoded},
+		)
+	}
+	if err != nil {
+		c.Close(channel, conn)
+		return nil, nil, err
+	}
+
+	replies := make(chan *ControlReply)
+	stop := make(chan struct{})
+	go func() {
+		defer close(replies)
+
+		// Deliveries are closed once the connection is closed by stop
+		for d := range deliveries {
+			reply := new(ControlReply)
+			if err := json.Unmarshal(d.Body, reply); err != nil {
+				log.ERROR.Printf("Failed to decode control reply: %s", err)
+				continue
+			}
+
+			select {
+			case replies <- reply:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return replies, func() {
+		close(stop)
+		c.Close(channel, conn)
+	}, nil
+}
+
+func (c *amqpControlChannel) Reply(reply *ControlReply) error {
+	encoded, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	conn, channel, err := c.Open(c.cnf.Broker, c.cnf.TLSConfig)
+	if err != nil {
+		return err
+	}
+	defer c.Close(channel, conn)
+
+	// The default exchange routes the reply to the queue named by the routing
+	// key, it is dropped if nobody waits for replies anymore
+	return channel.Publish(
+		"",                            // exchange name
+		c.replyQueue(reply.CommandID), // routing key
+		false,                         // mandatory
+		false,                         // immediate
+		amqp.Publishing{ContentType: "application/json", Body: encoded},
+	)
+}
+
+// declareExchange declares the fanout exchange commands are broadcast by
+func (c *amqpControlChannel) declareExchange(channel *amqp.Channel) error {
+	if err := channel.ExchangeDeclare(
+		c.exchange, // name of the exchange
+		"fanout",   // type
+		false,      // durable
+		false,      // delete when complete
+		false,      // internal
+		false,      // no-wait
+		nil,        // arguments
+	); err != nil {
+		return fmt.Errorf("Exchange declare error: %s", err)
+	}
+	return nil
+}
+
+// declareReplyQueue declares the queue replies to the command are sent to
+// and consumes it
+func (c *amqpControlChannel) declareReplyQueue(channel *amqp.Channel, commandID string) (<-chan amqp.Delivery, error) {
+	queue, err := channel.QueueDeclare(
+		c.replyQueue(commandID), // name
+		false,                   // durable
+		true,                    // delete when unused
+		true,                    // exclusive
+		false,                   // no-wait
+		nil,                     // arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Queue declare error: %s", err)
+	}
+	return c.consume(channel, queue.Name)
+}
+
+func (c *amqpControlChannel) consume(channel *amqp.Channel, queue string) (<-chan amqp.Delivery, error) {
+	deliveries, err := channel.Consume(
+		queue, // queue
+		"",    // consumer tag
+		true,  // auto-ack
+		true,  // exclusive
+		false, // no-local
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Queue consume error: %s", err)
+	}
+	return deliveries, nil
+}
+
+// replyQueue returns the name of the queue replies to the command are sent to
+func (c *amqpControlChannel) replyQueue(commandID string) string {
+	return c.exchange + controlReplySuffix + commandID
+}
+
+// localControlWaiter receives replies to a command broadcast in memory
+type localControlWaiter struct {
+	replies chan *ControlReply
+	stop    chan struct{}
+}
+
+// localControlChannel passes commands and replies in memory
+type localControlChannel struct {
+	handlers      map[int]func(*ControlCommand)
+	nextHandlerID int
+	waiters       map[string]*localControlWaiter
+	mu            sync.Mutex
+}
+
+func (c *localControlChannel) Subscribe(handle func(command *ControlCommand)) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id := c.nextHandlerID
+	c.nextHandlerID++
+	c.handlers[id] = handle
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		delete(c.handlers, id)
+	}
+}
+
+func (c *localControlChannel) Broadcast(command *ControlCommand) (<-chan *ControlReply, func(), error) {
+	waiter := &localControlWaiter{
+		replies: make(chan *ControlReply),
+		stop:    make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.waiters[command.ID] = waiter
+	for _, handle := range c.handlers {
+		commandCopy := *command
+		go handle(&commandCopy)
+	}
+
+	return waiter.replies, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		delete(c.waiters, command.ID)
+		close(waiter.stop)
+	}, nil
+}
+
+func (c *localControlChannel) Reply(reply *ControlReply) error {
+	c.mu.Lock()
+	waiter, ok := c.waiters[reply.CommandID]
+	c.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	select {
+	case waiter.replies <- reply:
+	case <-waiter.stop:
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule describes when a periodic task runs
+type Schedule interface {
+	// Next returns the next activation time, later than the given time
+	Next(time.Time) time.Time
+}
+
+// SpecSchedule is a schedule parsed from a cron expression, each field is a
+// bit set of the values it matches
+type SpecSchedule struct {
+	Minute, Hour, Dom, Month, Dow uint64
+	// Day of month and day of week fields set to * or ?, if either is
+	// unrestricted a day has to match both, otherwise it has to match one
+	domStar, dowStar bool
+}
+
+// IntervalSchedule runs at fixed intervals
+type IntervalSchedule struct {
+	Interval time.Duration
+}
+
+// bounds holds valid range of a cron expression field
+type bounds struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minutes = bounds{0, 59, nil}
+	hours   = bounds{0, 23, nil}
+	doms    = bounds{1, 31, nil}
+	months  = bounds{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// Both 0 and 7 stand for Sunday
+	dows = bounds{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+
+	descriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// Parse parses a standard cron expression with five fields (minute, hour,
+// day of month, month and day of week), e.g. "*/15 9-17 * * mon-fri".
+// Descriptors like @hourly or @daily and "@every <duration>" are accepted too.
+func Parse(spec string) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+
+	if strings.HasPrefix(spec, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(spec, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse interval of %s: %s", spec, err)
+		}
+		return Every(interval)
+	}
+
+	if descriptor, ok := descriptors[spec]; ok {
+		spec = descriptor
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("Expected 5 fields, found %d: %s", len(fields), spec)
+	}
+
+	schedule := new(SpecSchedule)
+	var err error
+	if schedule.Minute, err = parseField(fields[0], minutes); err != nil {
+		return nil, err
+	}
+	if schedule.Hour, err = parseField(fields[1], hours); err != nil {
+		return nil, err
+	}
+	if schedule.Dom, err = parseField(fields[2], doms); err != nil {
+		return nil, err
+	}
+	if schedule.Month, err = parseField(fields[3], months); err != nil {
+		return nil, err
+	}
+	if schedule.Dow, err = parseField(fields[4], dows); err != nil {
+		return nil, err
+	}
+
+	// Fold Sunday written as 7 into 0
+	if schedule.Dow&(1<<7) > 0 {
+		schedule.Dow = schedule.Dow&^(1<<7) | 1
+	}
+
+	schedule.domStar = isStar(fields[2])
+	schedule.dowStar = isStar(fields[4])
+
+	return schedule, nil
+}
+
+// Every returns a schedule running at fixed intervals
+func Every(interval time.Duration) (Schedule, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("Interval must be positive: %s", interval)
+	}
+	return &IntervalSchedule{Interval: interval}, nil
+}
+
+// Next returns the next activation time, later than the given time
+func (schedule *IntervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(schedule.Interval)
+}
+
+// Next returns the next activation time, later than the given time. Zero
+// time is returned if the schedule never matches (e.g. 30th of February).
+func (schedule *SpecSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+
+	// Start at the next whole minute
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+
+	// Give up if nothing matches within a few years
+	yearLimit := t.Year() + 5
+
+wrap:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+
+	for 1<<uint(t.Month())&schedule.Month == 0 {
+		t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		if t.Month() == time.January {
+			goto wrap
+		}
+	}
+
+	for !schedule.dayMatches(t) {
+		t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		if t.Day() == 1 {
+			goto wrap
+		}
+	}
+
+	for 1<<uint(t.Hour())&schedule.Hour == 0 {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		if t.Hour() == 0 {
+			goto wrap
+		}
+	}
+
+	for 1<<uint(t.Minute())&schedule.Minute == 0 {
+		t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+		if t.Minute() == 0 {
+			goto wrap
+		}
+	}
+
+	return t
+}
+
+// dayMatches returns true if day of month and day of week fields match t
+func (schedule *SpecSchedule) dayMatches(t time.Time) bool {
+	domMatch := 1<<uint(t.Day())&schedule.Dom > 0
+	dowMatch := 1<<uint(t.Weekday())&schedule.Dow > 0
+
+	if schedule.domStar || schedule.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// parseField parses a comma separated list of ranges into a bit set
+func parseField(field string, b bounds) (uint64, error) {
+	var bits uint64
+	for _, expr := range strings.Split(field, ",") {
+		rangeBits, err := parseRange(expr, b)
+		if err != nil {
+			return 0, err
+		}
+		bits |= rangeBits
+	}
+	return bits, nil
+}
+
+// parseRange parses a single range like *, 5, 1-5, */2 or 10-40/5
+func parseRange(expr string, b bounds) (uint64, error) {
+	var (
+		start, end int
+		step       = 1
+		err        error
+	)
+
+	rangeAndStep := strings.Split(expr, "/")
+	if len(rangeAndStep) > 2 {
+		return 0, fmt.Errorf("Too many slashes: %s", expr)
+	}
+
+	lowAndHigh := strings.Split(rangeAndStep[0], "-")
+	switch {
+	case len(lowAndHigh) > 2:
+		return 0, fmt.Errorf("Too many hyphens: %s", expr)
+	case isStar(lowAndHigh[0]):
+		if len(lowAndHigh) > 1 {
+			return 0, fmt.Errorf("Invalid range: %s", expr)
+		}
+		start, end = b.min, b.max
+	default:
+		if start, err = parseValue(lowAndHigh[0], b); err != nil {
+			return 0, err
+		}
+		end = start
+		if len(lowAndHigh) == 2 {
+			if end, err = parseValue(lowAndHigh[1], b); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if len(rangeAndStep) == 2 {
+		if step, err = strconv.Atoi(rangeAndStep[1]); err != nil || step <= 0 {
+			return 0, fmt.Errorf("Invalid step: %s", expr)
+		}
+		// A single value with a step, e.g. 5/10, runs till the end of the range
+		if len(lowAndHigh) == 1 {
+			end = b.max
+		}
+	}
+
+	if start < b.min || end > b.max || start > end {
+		return 0, fmt.Errorf("Out of range [%d, %d]: %s", b.min, b.max, expr)
+	}
+
+	var bits uint64
+	for i := start; i <= end; i += step {
+		bits |= 1 << uint(i)
+	}
+	return bits, nil
+}
+
+// parseValue parses a number or a name of a month or a day of week
+func parseValue(value string, b bounds) (int, error) {
+	if n, ok := b.names[strings.ToLower(value)]; ok {
+		return n, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse %s: %s", value, err)
+	}
+	return n, nil
+}
+
+func isStar(field string) bool {
+	return field == "*" || field == "?"
+}
@@ -0,0 +1,84 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/cron"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"1-2-3 * * * *",
+		"*-5 * * * *",
+		"* * * foo *",
+		"@every",
+		"@every -5m",
+	} {
+		_, err := cron.Parse(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestSpecScheduleNext(t *testing.T) {
+	testCases := []struct {
+		spec     string
+		from     string
+		expected string
+	}{
+		{"* * * * *", "2018-01-01T10:00:30Z", "2018-01-01T10:01:00Z"},
+		{"*/15 * * * *", "2018-01-01T10:00:00Z", "2018-01-01T10:15:00Z"},
+		{"0 * * * *", "2018-01-01T10:59:59Z", "2018-01-01T11:00:00Z"},
+		{"30 9-17 * * *", "2018-01-01T17:30:00Z", "2018-01-02T09:30:00Z"},
+		{"0 0 1 1 *", "2018-06-01T00:00:00Z", "2019-01-01T00:00:00Z"},
+		{"@monthly", "2018-01-31T12:00:00Z", "2018-02-01T00:00:00Z"},
+		{"0 0 29 2 *", "2018-01-01T00:00:00Z", "2020-02-29T00:00:00Z"},
+		// 2018-01-01 is Monday
+		{"0 12 * * mon-fri", "2018-01-05T13:00:00Z", "2018-01-08T12:00:00Z"},
+		{"0 12 * * 7", "2018-01-01T00:00:00Z", "2018-01-07T12:00:00Z"},
+		{"0 12 * * SUN", "2018-01-01T00:00:00Z", "2018-01-07T12:00:00Z"},
+		// Either day of month or day of week has to match
+		{"0 0 15 * sun", "2018-01-01T00:00:00Z", "2018-01-07T00:00:00Z"},
+		{"0 0 15 * *", "2018-01-01T00:00:00Z", "2018-01-15T00:00:00Z"},
+		{"5/20 * * * *", "2018-01-01T10:30:00Z", "2018-01-01T10:45:00Z"},
+		{"0,30 * * dec *", "2018-01-01T00:00:00Z", "2018-12-01T00:00:00Z"},
+	}
+
+	for _, testCase := range testCases {
+		schedule, err := cron.Parse(testCase.spec)
+		if !assert.NoError(t, err, testCase.spec) {
+			continue
+		}
+
+		from, _ := time.Parse(time.RFC3339, testCase.from)
+		expected, _ := time.Parse(time.RFC3339, testCase.expected)
+		assert.Equal(t, expected, schedule.Next(from), testCase.spec)
+	}
+}
+
+func TestSpecScheduleNeverMatches(t *testing.T) {
+	schedule, err := cron.Parse("0 0 30 2 *")
+	assert.NoError(t, err)
+	assert.True(t, schedule.Next(time.Now()).IsZero())
+}
+
+func TestEvery(t *testing.T) {
+	schedule, err := cron.Parse("@every 1h30m")
+	assert.NoError(t, err)
+
+	from := time.Date(2018, 1, 1, 10, 0, 0, 0, time.UTC)
+	assert.Equal(t, from.Add(90*time.Minute), schedule.Next(from))
+
+	_, err = cron.Every(0)
+	assert.Error(t, err)
+}
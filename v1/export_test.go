@@ -0,0 +1,7 @@
+package machinery
+
+// SetClock replaces the clock of the scheduler, it has to be called before
+// the scheduler is launched
+func (scheduler *Scheduler) SetClock(clock schedulerClock) {
+	scheduler.clock = clock
+}
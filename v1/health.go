@@ -0,0 +1,283 @@
+package machinery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/backends"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+)
+
+// healthShutdownTimeout bounds how long quitting the worker waits for health
+// check requests being served
+const healthShutdownTimeout = 5 * time.Second
+
+// errConsumerNotConnected is reported as the broker error of a worker whose
+// consumer is not connected to the broker
+var errConsumerNotConnected = errors.New("Consumer is not connected to the broker")
+
+// WorkerStatus describes the state of a worker, it is served as JSON by the
+// status page of the worker
+type WorkerStatus struct {
+	ConsumerTag string   `json:"consumer_tag"`
+	Concurrency int      `json:"concurrency"`
+	Queues      []string `json:"queues"`
+	// Alive is true while the worker is consuming from the broker, it is
+	// false while the worker reconnects after consuming has failed
+	Alive bool `json:"alive"`
+	// Ready is true if the worker is alive, its consumer is connected to the
+	// broker and the result backend is reachable
+	Ready bool `json:"ready"`
+	// Paused is true if the worker has been paused by a control command
+	Paused       bool   `json:"paused"`
+	BrokerError  string `json:"broker_error,omitempty"`
+	BackendError string `json:"backend_error,omitempty"`
+	// Last error which made the worker reconnect to the broker
+	LastConsumeError   string          `json:"last_consume_error,omitempty"`
+	LastConsumeErrorAt *time.Time      `json:"last_consume_error_at,omitempty"`
+	InFlightTasks      []*InFlightTask `json:"in_flight_tasks"`
+	RegisteredTasks    []string        `json:"registered_tasks"`
+}
+
+// InFlightTask is a task being processed by a worker
+type InFlightTask struct {
+	UUID       string    `json:"uuid"`
+	Name       string    `json:"name"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// workerHealth keeps track of the worker for its health checks
+type workerHealth struct {
+	mu                 sync.Mutex
+	consuming          bool
+	reconnecting       bool
+	lastConsumeError   error
+	lastConsumeErrorAt time.Time
+	inFlight           map[string]*InFlightTask
+	server             *http.Server
+}
+
+// HealthHandler returns a handler serving health checks of the worker:
+//
+//	/healthz - liveness, fails once the worker has stopped consuming and
+//	           while it reconnects to the broker
+//	/readyz  - readiness, fails unless the consumer is connected to the
+//	           broker and the backend is reachable
+//	/status  - JSON encoded WorkerStatus
+func (worker *Worker) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, worker.isAlive())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, worker.Status().Ready)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status := worker.Status()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !status.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(status)
+	})
+	return mux
+}
+
+// Status checks the broker and the result backend and returns the state of
+// the worker
+func (worker *Worker) Status() *WorkerStatus {
+	status := &WorkerStatus{
+		ConsumerTag:     worker.ConsumerTag,
+		Concurrency:     worker.concurrency(),
+		Paused:          worker.IsPaused(),
+		Queues:          worker.queueNames(),
+		Alive:           worker.isAlive(),
+		InFlightTasks:   worker.inFlightTasks(),
+		RegisteredTasks: worker.server.GetRegisteredTaskNames(),
+	}
+	sort.Strings(status.RegisteredTasks)
+
+	// Brokers which do not tell whether their consumer is connected are
+	// checked by a connection of their own
+	if connected, ok := worker.consumerConnected(); ok {
+		if !connected {
+			status.BrokerError = errConsumerNotConnected.Error()
+		}
+	} else if pinger, ok := worker.server.GetBroker().(brokers.Pinger); ok {
+		if err := pinger.Ping(); err != nil {
+			status.BrokerError = err.Error()
+		}
+	}
+	if pinger, ok := worker.server.GetBackend().(backends.Pinger); ok {
+		if err := pinger.Ping(); err != nil {
+			status.BackendError = err.Error()
+		}
+	}
+	status.Ready = status.Alive && status.BrokerError == "" && status.BackendError == ""
+
+	worker.health.mu.Lock()
+	if worker.health.lastConsumeError != nil {
+		lastConsumeErrorAt := worker.health.lastConsumeErrorAt
+		status.LastConsumeError = worker.health.lastConsumeError.Error()
+		status.LastConsumeErrorAt = &lastConsumeErrorAt
+	}
+	worker.health.mu.Unlock()
+
+	return status
+}
+
+// serveHealth starts the embedded HTTP server serving health checks, the
+// worker keeps running without it if it cannot listen on the address
+func (worker *Worker) serveHealth(addr string) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.ERROR.Printf("Health check server error: %s", err)
+		return
+	}
+
+	server := &http.Server{Handler: worker.HealthHandler()}
+
+	worker.health.mu.Lock()
+	worker.health.server = server
+	worker.health.mu.Unlock()
+
+	log.INFO.Printf("Serving health checks on %s", listener.Addr())
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.ERROR.Printf("Health check server error: %s", err)
+		}
+	}()
+}
+
+// stopHealth shuts down the embedded HTTP server if there is one
+func (worker *Worker) stopHealth() {
+	worker.health.mu.Lock()
+	server := worker.health.server
+	worker.health.server = nil
+	worker.health.mu.Unlock()
+
+	if server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.WARNING.Printf("Health check server shutdown error: %s", err)
+	}
+}
+
+func (worker *Worker) setConsuming(consuming bool) {
+	worker.health.mu.Lock()
+	defer worker.health.mu.Unlock()
+
+	worker.health.consuming = consuming
+}
+
+// isAlive returns true while the worker is consuming. A worker reconnecting
+// to the broker is alive again once its consumer has connected, the broker
+// has to implement brokers.ConsumerMonitor to tell.
+func (worker *Worker) isAlive() bool {
+	worker.health.mu.Lock()
+	consuming := worker.health.consuming
+	reconnecting := worker.health.reconnecting
+	worker.health.mu.Unlock()
+
+	if !consuming {
+		return false
+	}
+	if !reconnecting {
+		return true
+	}
+	connected, ok := worker.consumerConnected()
+	return ok && connected
+}
+
+// consumerConnected returns whether the consumer is connected to the broker,
+// ok is false if the broker cannot tell
+func (worker *Worker) consumerConnected() (connected bool, ok bool) {
+	monitor, ok := worker.server.GetBroker().(brokers.ConsumerMonitor)
+	if !ok {
+		return false, false
+	}
+	return monitor.IsConsumerConnected(), true
+}
+
+// consumeErrored records the error which made the worker reconnect, the
+// worker is not alive until its consumer connects again
+func (worker *Worker) consumeErrored(err error) {
+	worker.health.mu.Lock()
+	defer worker.health.mu.Unlock()
+
+	worker.health.reconnecting = true
+	worker.health.lastConsumeError = err
+	worker.health.lastConsumeErrorAt = time.Now().UTC()
+}
+
+// consumeStopped records that consuming has been stopped on purpose, e.g. to
+// pause the worker, so the worker is not reconnecting anymore
+func (worker *Worker) consumeStopped() {
+	worker.health.mu.Lock()
+	defer worker.health.mu.Unlock()
+
+	worker.health.reconnecting = false
+}
+
+// trackInFlight adds the task to in-flight tasks of the worker, the returned
+// function removes it
+func (worker *Worker) trackInFlight(signature *tasks.Signature) func() {
+	worker.health.mu.Lock()
+	defer worker.health.mu.Unlock()
+
+	if worker.health.inFlight == nil {
+		worker.health.inFlight = make(map[string]*InFlightTask)
+	}
+	worker.health.inFlight[signature.UUID] = &InFlightTask{
+		UUID:       signature.UUID,
+		Name:       signature.Name,
+		ReceivedAt: time.Now().UTC(),
+	}
+
+	return func() {
+		worker.health.mu.Lock()
+		defer worker.health.mu.Unlock()
+
+		delete(worker.health.inFlight, signature.UUID)
+	}
+}
+
+// inFlightTasks returns copies of in-flight tasks sorted by the time they
+// have been received
+func (worker *Worker) inFlightTasks() []*InFlightTask {
+	worker.health.mu.Lock()
+	defer worker.health.mu.Unlock()
+
+	inFlight := make([]*InFlightTask, 0, len(worker.health.inFlight))
+	for _, task := range worker.health.inFlight {
+		taskCopy := *task
+		inFlight = append(inFlight, &taskCopy)
+	}
+	sort.Slice(inFlight, func(i, j int) bool {
+		return inFlight[i].ReceivedAt.Before(inFlight[j].ReceivedAt)
+	})
+	return inFlight
+}
+
+func writeHealth(w http.ResponseWriter, ok bool) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("unavailable\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,161 @@
+package machinery
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/backends"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	idempotencySuffix = "_idempotency:"
+	// Idempotency keys expire after an hour unless configured otherwise
+	defaultIdempotencyWindow = 3600
+)
+
+// idempotencyStore remembers which task has been sent with an idempotency key
+type idempotencyStore interface {
+	// Claim assigns the task UUID to the key for the window. It returns false
+	// and UUID of the task the key is assigned to if it has been claimed
+	// already.
+	Claim(key, uuid string, window time.Duration) (string, bool, error)
+	// Release forgets the key so that a task can be sent with it again
+	Release(key, uuid string) error
+}
+
+// errIdempotencyNotSupported is returned for tasks sent with an idempotency
+// key when there is nowhere to keep the key
+var errIdempotencyNotSupported = errors.New("Idempotency keys require Redis broker or a result backend keeping them")
+
+// newIdempotencyStore creates the store of idempotency keys shared by all
+// publishers. Keys are kept in Redis when using Redis broker or Redis result
+// backend, otherwise by the result backend if it can keep them. Nil is
+// returned if neither can.
+func newIdempotencyStore(cnf *config.Config, broker brokers.Interface, backend backends.Interface) idempotencyStore {
+	if pool, ok := sharedRedisPool(broker, backend); ok {
+		return &redisIdempotencyStore{pool: pool, prefix: cnf.DefaultQueue + idempotencySuffix}
+	}
+	if claimer, ok := backend.(backends.KeyClaimer); ok {
+		return &backendIdempotencyStore{claimer: claimer, prefix: cnf.DefaultQueue + idempotencySuffix}
+	}
+	return nil
+}
+
+// idempotencyWindow returns how long a task sent with an idempotency key
+// prevents duplicates, by default as long as results are kept
+func idempotencyWindow(cnf *config.Config) time.Duration {
+	window := cnf.IdempotencyWindow
+	if window <= 0 {
+		window = cnf.ResultsExpireIn
+	}
+	if window <= 0 {
+		window = defaultIdempotencyWindow
+	}
+	return time.Duration(window) * time.Second
+}
+
+// redisIdempotencyStore keeps idempotency keys in Redis
+type redisIdempotencyStore struct {
+	pool   redisPool
+	prefix string
+}
+
+// releaseIdempotencyKeyScript deletes the key (KEYS[1]) only if it still holds
+// the task UUID (ARGV[1])
+var releaseIdempotencyKeyScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (store *redisIdempotencyStore) Claim(key, uuid string, window time.Duration) (string, bool, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	for {
+		_, err := redis.String(conn.Do("SET", store.prefix+key, uuid, "PX", int64(window/time.Millisecond), "NX"))
+		if err == nil {
+			return uuid, true, nil
+		}
+		if err != redis.ErrNil {
+			return "", false, err
+		}
+
+		existing, err := redis.String(conn.Do("GET", store.prefix+key))
+		// The key has expired in the meantime, try to claim it again
+		if err == redis.ErrNil {
+			continue
+		}
+		return existing, false, err
+	}
+}
+
+func (store *redisIdempotencyStore) Release(key, uuid string) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	_, err := releaseIdempotencyKeyScript.Do(conn, store.prefix+key, uuid)
+	return err
+}
+
+// backendIdempotencyStore keeps idempotency keys in the result backend
+type backendIdempotencyStore struct {
+	claimer backends.KeyClaimer
+	prefix  string
+}
+
+func (store *backendIdempotencyStore) Claim(key, uuid string, window time.Duration) (string, bool, error) {
+	return store.claimer.ClaimKey(store.prefix+key, uuid, window)
+}
+
+func (store *backendIdempotencyStore) Release(key, uuid string) error {
+	return store.claimer.ReleaseKey(store.prefix+key, uuid)
+}
+
+// claimIdempotencyKeys claims idempotency keys of the tasks which have one.
+// If any of them has been sent already, none of the keys is kept claimed and
+// an error is returned. The returned function releases the keys of the given
+// tasks so they can be sent with them again.
+func (server *Server) claimIdempotencyKeys(signatures []*tasks.Signature) (func(...*tasks.Signature), error) {
+	release := func(signatures ...*tasks.Signature) {
+		for _, signature := range signatures {
+			if signature.IdempotencyKey == "" {
+				continue
+			}
+			if err := server.idempotencyStore.Release(signature.IdempotencyKey, signature.UUID); err != nil {
+				log.ERROR.Printf("Failed to release idempotency key %s: %s", signature.IdempotencyKey, err)
+			}
+		}
+	}
+
+	var claimed []*tasks.Signature
+	for _, signature := range signatures {
+		if signature.IdempotencyKey == "" {
+			continue
+		}
+		if server.idempotencyStore == nil {
+			release(claimed...)
+			return nil, errIdempotencyNotSupported
+		}
+
+		existing, ok, err := server.idempotencyStore.Claim(signature.IdempotencyKey, signature.UUID, idempotencyWindow(server.config))
+		if err != nil {
+			release(claimed...)
+			return nil, fmt.Errorf("Claim idempotency key error: %s", err)
+		}
+		if !ok {
+			release(claimed...)
+			return nil, fmt.Errorf("Task with idempotency key %s has been sent already: %s", signature.IdempotencyKey, existing)
+		}
+		claimed = append(claimed, signature)
+	}
+
+	return release, nil
+}
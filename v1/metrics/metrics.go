@@ -0,0 +1,304 @@
+// Package metrics counts tasks and measures how long they wait in queues and
+// how long they take to execute. Metrics are served in the Prometheus text
+// format, so Prometheus scrapes them without a client library.
+package metrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+)
+
+const (
+	publishedTotal = "machinery_tasks_published_total"
+	receivedTotal  = "machinery_tasks_received_total"
+	succeededTotal = "machinery_tasks_succeeded_total"
+	failedTotal    = "machinery_tasks_failed_total"
+	retriedTotal   = "machinery_tasks_retried_total"
+	duration       = "machinery_task_duration_seconds"
+	queueWait      = "machinery_task_queue_wait_seconds"
+	pendingTasks   = "machinery_tasks_pending"
+	delayedTasks   = "machinery_tasks_delayed"
+)
+
+// DefaultBuckets are upper bounds of histogram buckets in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// Metrics of tasks published and processed by this process, labeled by task
+// name, and of tasks waiting in the queues of the broker
+type Metrics struct {
+	server     *machinery.Server
+	counters   map[string]*counter
+	histograms map[string]*histogram
+	mu         sync.Mutex
+}
+
+// counter is a counter per task name
+type counter struct {
+	help   string
+	values map[string]float64
+}
+
+// histogram is a histogram per task name
+type histogram struct {
+	help    string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	// counts of observations per bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// startCtxKey is the context key of the time the execution of a task started
+type startCtxKey struct{}
+
+// New creates Metrics instance, DefaultBuckets are used if buckets are empty.
+// Queue depths are read from the broker of the server when metrics are
+// served.
+func New(server *machinery.Server, buckets []float64) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	newCounter := func(help string) *counter {
+		return &counter{help: help, values: make(map[string]float64)}
+	}
+	newHistogram := func(help string) *histogram {
+		return &histogram{help: help, buckets: buckets, series: make(map[string]*histogramSeries)}
+	}
+
+	return &Metrics{
+		server: server,
+		counters: map[string]*counter{
+			publishedTotal: newCounter("Tasks published, including retry attempts and callbacks."),
+			receivedTotal:  newCounter("Tasks received by workers and about to be executed."),
+			succeededTotal: newCounter("Tasks executed successfully."),
+			failedTotal:    newCounter("Tasks failed without retry attempts left or revoked while running."),
+			retriedTotal:   newCounter("Failed tasks going to be retried."),
+		},
+		histograms: map[string]*histogram{
+			duration:  newHistogram("Time tasks take to execute."),
+			queueWait: newHistogram("Time tasks wait in queues from being published, or from their ETA, until they start."),
+		},
+	}
+}
+
+// Middleware returns a middleware collecting the metrics
+func (m *Metrics) Middleware() machinery.Middleware {
+	return machinery.Middleware{
+		BeforePublish: func(ctx context.Context, signature *tasks.Signature) error {
+			m.inc(publishedTotal, signature.Name)
+			return nil
+		},
+		BeforeExecute: func(ctx context.Context, signature *tasks.Signature) (context.Context, error) {
+			now := time.Now()
+			m.inc(receivedTotal, signature.Name)
+
+			// Delayed tasks are due at their ETA
+			if signature.PublishedAt != nil {
+				since := *signature.PublishedAt
+				if signature.ETA != nil && signature.ETA.After(since) {
+					since = *signature.ETA
+				}
+				wait := now.Sub(since)
+				if wait < 0 {
+					wait = 0
+				}
+				m.observe(queueWait, signature.Name, wait)
+			}
+
+			return context.WithValue(ctx, startCtxKey{}, now), nil
+		},
+		AfterSuccess: func(ctx context.Context, signature *tasks.Signature, results []*tasks.TaskResult) {
+			m.inc(succeededTotal, signature.Name)
+			m.observeDuration(ctx, signature)
+		},
+		AfterFailure: func(ctx context.Context, signature *tasks.Signature, err error) {
+			m.inc(failedTotal, signature.Name)
+			m.observeDuration(ctx, signature)
+		},
+		OnRetry: func(ctx context.Context, signature *tasks.Signature, err error, retryIn time.Duration) {
+			m.inc(retriedTotal, signature.Name)
+			m.observeDuration(ctx, signature)
+		},
+	}
+}
+
+func (m *Metrics) inc(name, taskName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.counters[name].values[taskName]++
+}
+
+func (m *Metrics) observe(name, taskName string, value time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	histogram := m.histograms[name]
+	series, ok := histogram.series[taskName]
+	if !ok {
+		series = &histogramSeries{counts: make([]uint64, len(histogram.buckets))}
+		histogram.series[taskName] = series
+	}
+
+	seconds := value.Seconds()
+	if i := sort.SearchFloat64s(histogram.buckets, seconds); i < len(histogram.buckets) {
+		series.counts[i]++
+	}
+	series.count++
+	series.sum += seconds
+}
+
+// observeDuration measures execution of the task started in BeforeExecute
+func (m *Metrics) observeDuration(ctx context.Context, signature *tasks.Signature) {
+	if start, ok := ctx.Value(startCtxKey{}).(time.Time); ok {
+		m.observe(duration, signature.Name, time.Since(start))
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	buf := bufio.NewWriter(w)
+	defer buf.Flush()
+
+	m.writeQueueDepths(buf)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, name := range sortedKeys(m.counters) {
+		counter := m.counters[name]
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", name, counter.help, name)
+		for _, taskName := range sortedKeys(counter.values) {
+			fmt.Fprintf(buf, "%s{task=%s} %s\n", name, quote(taskName), formatFloat(counter.values[taskName]))
+		}
+	}
+
+	for _, name := range sortedKeys(m.histograms) {
+		histogram := m.histograms[name]
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", name, histogram.help, name)
+		for _, taskName := range sortedKeys(histogram.series) {
+			series := histogram.series[taskName]
+			label := quote(taskName)
+
+			var cumulative uint64
+			for i, bound := range histogram.buckets {
+				cumulative += series.counts[i]
+				fmt.Fprintf(buf, "%s_bucket{task=%s,le=%q} %d\n", name, label, formatFloat(bound), cumulative)
+			}
+			fmt.Fprintf(buf, "%s_bucket{task=%s,le=\"+Inf\"} %d\n", name, label, series.count)
+			fmt.Fprintf(buf, "%s_sum{task=%s} %s\n", name, label, formatFloat(series.sum))
+			fmt.Fprintf(buf, "%s_count{task=%s} %d\n", name, label, series.count)
+		}
+	}
+}
+
+// writeQueueDepths writes numbers of tasks waiting in the queues of the
+// broker labeled by queue. Brokers which cannot inspect single queues report
+// totals of all queues without the label. A gauge is left out if the broker
+// cannot count the tasks.
+func (m *Metrics) writeQueueDepths(buf *bufio.Writer) {
+	broker := m.server.GetBroker()
+	inspector, ok := broker.(brokers.QueueInspector)
+
+	var queues []string
+	if ok {
+		var err error
+		if queues, err = inspector.Queues(); err != nil {
+			log.WARNING.Printf("Failed to list queues for queue depth metrics: %s", err)
+			return
+		}
+	}
+
+	for _, gauge := range []struct {
+		name       string
+		help       string
+		count      func() (int, error)
+		countQueue func(queue string) (int, error)
+	}{
+		{pendingTasks, "Tasks waiting in the queue of the broker.", broker.CountPendingTasks, nil},
+		{delayedTasks, "Delayed tasks waiting for their ETA.", broker.CountDelayedTasks, nil},
+	} {
+		if ok {
+			gauge.countQueue = inspector.CountQueuePendingTasks
+			if gauge.name == delayedTasks {
+				gauge.countQueue = inspector.CountQueueDelayedTasks
+			}
+		}
+
+		samples, err := queueDepthSamples(gauge.name, queues, gauge.count, gauge.countQueue)
+		if err == brokers.ErrNotSupported {
+			continue
+		}
+		if err != nil {
+			log.WARNING.Printf("Failed to count tasks for %s metric: %s", gauge.name, err)
+			continue
+		}
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n%s", gauge.name, gauge.help, gauge.name, samples)
+	}
+}
+
+// queueDepthSamples returns the samples of a queue depth gauge, one per queue
+// if the broker counts tasks of single queues
+func queueDepthSamples(name string, queues []string, count func() (int, error), countQueue func(string) (int, error)) (string, error) {
+	if countQueue == nil {
+		total, err := count()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %d\n", name, total), nil
+	}
+
+	var samples strings.Builder
+	for _, queue := range queues {
+		queueCount, err := countQueue(queue)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&samples, "%s{queue=%s} %d\n", name, quote(queue), queueCount)
+	}
+	return samples.String(), nil
+}
+
+// quote returns a label value escaped as the text format requires
+func quote(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `"`, `\"`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return `"` + value + `"`
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedKeys returns keys of a map with string keys in order
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
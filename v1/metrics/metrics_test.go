@@ -0,0 +1,128 @@
+package metrics_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/Guazi-inc/machinery/v1/metrics"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "eager",
+		DefaultQueue:  "machinery_tasks",
+		ResultBackend: "eager",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := metrics.New(server, []float64{0.01, 1})
+	server.Use(m.Middleware())
+
+	calls := 0
+	err = server.RegisterTasks(map[string]interface{}{
+		"fast": func() error { return nil },
+		"flaky": func() error {
+			calls++
+			if calls == 1 {
+				return tasks.NewErrRetryTaskLater("not yet", time.Millisecond)
+			}
+			return errors.New("broken")
+		},
+	})
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = server.SendTask(&tasks.Signature{Name: "fast"})
+		assert.NoError(t, err)
+	}
+	_, err = server.SendTask(&tasks.Signature{Name: "flaky"})
+	assert.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+
+	body, err := ioutil.ReadAll(recorder.Body)
+	assert.NoError(t, err)
+	lines := strings.Split(string(body), "\n")
+
+	for _, line := range []string{
+		"# TYPE machinery_tasks_pending gauge",
+		"machinery_tasks_pending 0",
+		"machinery_tasks_delayed 0",
+		"# TYPE machinery_tasks_published_total counter",
+		`machinery_tasks_published_total{task="fast"} 2`,
+		`machinery_tasks_published_total{task="flaky"} 2`,
+		`machinery_tasks_received_total{task="flaky"} 2`,
+		`machinery_tasks_succeeded_total{task="fast"} 2`,
+		`machinery_tasks_retried_total{task="flaky"} 1`,
+		`machinery_tasks_failed_total{task="flaky"} 1`,
+		"# TYPE machinery_task_duration_seconds histogram",
+		`machinery_task_duration_seconds_bucket{task="fast",le="1"} 2`,
+		`machinery_task_duration_seconds_bucket{task="fast",le="+Inf"} 2`,
+		`machinery_task_duration_seconds_count{task="flaky"} 2`,
+		`machinery_task_queue_wait_seconds_bucket{task="fast",le="1"} 2`,
+		`machinery_task_queue_wait_seconds_count{task="flaky"} 2`,
+	} {
+		assert.Contains(t, lines, line)
+	}
+	assert.NotContains(t, lines, `machinery_tasks_failed_total{task="fast"} 0`)
+}
+
+func TestMetricsQueueDepthsRedis(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		return
+	}
+
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "redis://" + redisURL,
+		DefaultQueue:  "test_metrics_queue",
+		ResultBackend: "redis://" + redisURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cleanup before the test
+	manager := server.GetBroker().(brokers.QueueManager)
+	_, err = manager.PurgePendingTasks("test_metrics_queue")
+	assert.NoError(t, err)
+	_, err = manager.PurgeDelayedTasks("test_metrics_queue")
+	assert.NoError(t, err)
+
+	eta := time.Now().Add(time.Hour)
+	for _, signature := range []*tasks.Signature{
+		{Name: "fast"},
+		{Name: "fast"},
+		{Name: "fast", ETA: &eta},
+	} {
+		_, err = server.SendTask(signature)
+		assert.NoError(t, err)
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.New(server, nil).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	lines := strings.Split(recorder.Body.String(), "\n")
+
+	assert.Contains(t, lines, `machinery_tasks_pending{queue="test_metrics_queue"} 2`)
+	assert.Contains(t, lines, `machinery_tasks_delayed{queue="test_metrics_queue"} 1`)
+	assert.NotContains(t, lines, "machinery_tasks_pending 2")
+
+	_, err = manager.PurgePendingTasks("test_metrics_queue")
+	assert.NoError(t, err)
+	_, err = manager.PurgeDelayedTasks("test_metrics_queue")
+	assert.NoError(t, err)
+}
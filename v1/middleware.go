@@ -0,0 +1,98 @@
+package machinery
+
+import (
+	"context"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/tasks"
+)
+
+// Middleware hooks into the lifecycle of tasks, e.g. to trace, authorize or
+// audit them. All hooks are optional. Before hooks of middlewares run in the
+// order the middlewares have been added in, after hooks in reverse order.
+type Middleware struct {
+	// BeforePublish is called before a task is published, including retry
+	// attempts and callbacks. It may modify the signature, an error aborts
+	// publishing.
+	BeforePublish func(ctx context.Context, signature *tasks.Signature) error
+	// BeforeExecute is called before the worker calls the task. It may
+	// modify the signature and return the context passed to the task and to
+	// the after hooks. An error short-circuits execution, the task is not
+	// called and the error is handled as if the task had returned it.
+	BeforeExecute func(ctx context.Context, signature *tasks.Signature) (context.Context, error)
+	// AfterSuccess is called once the task has returned its results
+	AfterSuccess func(ctx context.Context, signature *tasks.Signature, results []*tasks.TaskResult)
+	// AfterFailure is called once the task has failed without retry
+	// attempts left or has been revoked while running
+	AfterFailure func(ctx context.Context, signature *tasks.Signature, err error)
+	// OnRetry is called once the failed task is going to be retried
+	OnRetry func(ctx context.Context, signature *tasks.Signature, err error, retryIn time.Duration)
+}
+
+// Use adds middlewares to the server, it has to be called before workers
+// are launched and tasks are sent
+func (server *Server) Use(middlewares ...Middleware) {
+	server.middlewares = append(server.middlewares, middlewares...)
+}
+
+// beforePublish runs BeforePublish hooks, it stops at the first error
+func (server *Server) beforePublish(ctx context.Context, signature *tasks.Signature) error {
+	for _, middleware := range server.middlewares {
+		if middleware.BeforePublish == nil {
+			continue
+		}
+		if err := middleware.BeforePublish(ctx, signature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// executeHooks runs after hooks of middlewares whose BeforeExecute hook has
+// let the task through
+type executeHooks struct {
+	ctx         context.Context
+	middlewares []Middleware
+}
+
+// beforeExecute runs BeforeExecute hooks, it stops at the first error
+func (server *Server) beforeExecute(ctx context.Context, signature *tasks.Signature) (*executeHooks, error) {
+	hooks := &executeHooks{ctx: ctx}
+	for _, middleware := range server.middlewares {
+		if middleware.BeforeExecute != nil {
+			ctx, err := middleware.BeforeExecute(hooks.ctx, signature)
+			if err != nil {
+				return hooks, err
+			}
+			if ctx != nil {
+				hooks.ctx = ctx
+			}
+		}
+		hooks.middlewares = append(hooks.middlewares, middleware)
+	}
+	return hooks, nil
+}
+
+func (hooks *executeHooks) afterSuccess(signature *tasks.Signature, results []*tasks.TaskResult) {
+	for i := len(hooks.middlewares) - 1; i >= 0; i-- {
+		if hook := hooks.middlewares[i].AfterSuccess; hook != nil {
+			hook(hooks.ctx, signature, results)
+		}
+	}
+}
+
+func (hooks *executeHooks) afterFailure(signature *tasks.Signature, err error) {
+	for i := len(hooks.middlewares) - 1; i >= 0; i-- {
+		if hook := hooks.middlewares[i].AfterFailure; hook != nil {
+			hook(hooks.ctx, signature, err)
+		}
+	}
+}
+
+func (hooks *executeHooks) onRetry(signature *tasks.Signature, err error, retryIn time.Duration) {
+	for i := len(hooks.middlewares) - 1; i >= 0; i-- {
+		if hook := hooks.middlewares[i].OnRetry; hook != nil {
+			hook(hooks.ctx, signature, err, retryIn)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package machinery
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/backends"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/Guazi-inc/machinery/v1/ratelimit"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+)
+
+const rateLimitSuffix = "_rate_limit:"
+
+// errRateLimitNotSupported is returned when registering a task with a rate
+// limit if there is nowhere to keep token buckets shared by all workers
+var errRateLimitNotSupported = errors.New("Rate limits require Redis broker or Redis result backend")
+
+// newRateLimiter creates the limiter enforcing rate limits of registered
+// tasks. Token buckets are kept in Redis when using Redis broker or Redis
+// result backend so the limits apply to the whole worker fleet, eager broker
+// keeps them in memory. Nil is returned with other brokers and backends.
+func newRateLimiter(cnf *config.Config, broker brokers.Interface, backend backends.Interface) ratelimit.Limiter {
+	if pool, ok := sharedRedisPool(broker, backend); ok {
+		return ratelimit.NewRedisLimiter(pool, cnf.DefaultQueue+rateLimitSuffix)
+	}
+	if isEagerBroker(broker) {
+		return ratelimit.NewLocalLimiter()
+	}
+	return nil
+}
+
+// rateLimitDelay takes a token for the task if it has a rate limit, it
+// returns how long the task has to be delayed if the limit has been reached.
+// Tasks are not delayed if the limiter fails.
+func (worker *Worker) rateLimitDelay(signature *tasks.Signature) time.Duration {
+	limit := worker.server.GetRegisteredTaskOptions(signature.Name).RateLimit
+	if !limit.Enabled() {
+		return 0
+	}
+	if worker.server.rateLimiter == nil {
+		log.ERROR.Printf("Failed to take rate limit token for %s: %s", signature.UUID, errRateLimitNotSupported)
+		return 0
+	}
+
+	delay, err := worker.server.rateLimiter.Take(signature.Name, limit)
+	if err != nil {
+		log.ERROR.Printf("Failed to take rate limit token for %s: %s", signature.UUID, err)
+		return 0
+	}
+	return delay
+}
+
+// rateLimitJitter returns a random delay within a period of the rate limit of
+// the task, delayed tasks are spread over the period so they do not all come
+// due at once when the bucket refills
+func (worker *Worker) rateLimitJitter(signature *tasks.Signature) time.Duration {
+	per := worker.server.GetRegisteredTaskOptions(signature.Name).RateLimit.Per
+	if per <= 0 {
+		per = time.Second
+	}
+	return time.Duration(rand.Int63n(int64(per)))
+}
+
+// delayTask publishes the task again to be processed after the delay. It goes
+// straight to the broker, so the task keeps its state and retry attempts and
+// publish middlewares do not run again.
+func (worker *Worker) delayTask(signature *tasks.Signature, delay time.Duration) error {
+	eta := time.Now().UTC().Add(delay)
+	signature.ETA = &eta
+
+	log.INFO.Printf("Delaying task %s for %s", signature.UUID, delay)
+
+	return worker.server.GetBroker().Publish(signature)
+}
@@ -0,0 +1,170 @@
+// Package ratelimit implements token bucket rate limiters shared by workers,
+// either in memory of a single process or across processes in Redis.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Limit allows Rate events every Per period, with bursts of up to Burst
+// events. Zero Rate means no limit.
+type Limit struct {
+	Rate  int
+	Per   time.Duration
+	Burst int
+}
+
+// PerSecond allows rate events per second
+func PerSecond(rate int) Limit {
+	return Limit{Rate: rate, Per: time.Second}
+}
+
+// PerMinute allows rate events per minute
+func PerMinute(rate int) Limit {
+	return Limit{Rate: rate, Per: time.Minute}
+}
+
+// Enabled returns true if the limit restricts anything
+func (limit Limit) Enabled() bool {
+	return limit.Rate > 0
+}
+
+// interval returns time it takes to refill a single token
+func (limit Limit) interval() time.Duration {
+	per := limit.Per
+	if per <= 0 {
+		per = time.Second
+	}
+	return per / time.Duration(limit.Rate)
+}
+
+// burst returns capacity of the bucket, by default a period worth of tokens
+func (limit Limit) burst() int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	return limit.Rate
+}
+
+// Limiter keeps a token bucket for every key
+type Limiter interface {
+	// Take takes a token from the bucket of the key. If the bucket is empty,
+	// no token is taken and the time until a token is available is returned.
+	Take(key string, limit Limit) (time.Duration, error)
+}
+
+// bucket is the state of a local token bucket
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// localLimiter keeps token buckets in memory
+type localLimiter struct {
+	buckets map[string]*bucket
+	mu      sync.Mutex
+}
+
+// NewLocalLimiter creates a limiter keeping token buckets in memory, it only
+// limits events within the process
+func NewLocalLimiter() Limiter {
+	return &localLimiter{buckets: make(map[string]*bucket)}
+}
+
+func (limiter *localLimiter) Take(key string, limit Limit) (time.Duration, error) {
+	if !limit.Enabled() {
+		return 0, nil
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := time.Now()
+	interval := limit.interval()
+	burst := float64(limit.burst())
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = &bucket{tokens: burst, updated: now}
+		limiter.buckets[key] = b
+	}
+
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+float64(elapsed)/float64(interval))
+	}
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, nil
+	}
+	return time.Duration(math.Ceil((1 - b.tokens) * float64(interval))), nil
+}
+
+// Pool provides Redis connections
+type Pool interface {
+	Get() redis.Conn
+}
+
+// takeScript refills the token bucket (KEYS[1]) by ARGV[1] tokens per
+// millisecond up to ARGV[2] tokens as of ARGV[3] milliseconds and takes a
+// token. It returns 0 if a token has been taken, otherwise the number of
+// milliseconds until one is available.
+var takeScript = redis.NewScript(1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1])
+local updated = tonumber(bucket[2])
+if tokens == nil or updated == nil then
+	tokens = burst
+	updated = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+else
+	wait = math.ceil((1 - tokens) / rate)
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated', math.max(now, updated))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate) + 1000)
+return wait
+`)
+
+// redisLimiter keeps token buckets in Redis hashes
+type redisLimiter struct {
+	pool   Pool
+	prefix string
+}
+
+// NewRedisLimiter creates a limiter keeping token buckets in Redis under keys
+// starting with the prefix, it limits events across all processes sharing
+// the Redis server. Clocks of the processes should be in sync.
+func NewRedisLimiter(pool Pool, prefix string) Limiter {
+	return &redisLimiter{pool: pool, prefix: prefix}
+}
+
+func (limiter *redisLimiter) Take(key string, limit Limit) (time.Duration, error) {
+	if !limit.Enabled() {
+		return 0, nil
+	}
+
+	conn := limiter.pool.Get()
+	defer conn.Close()
+
+	// Tokens per millisecond
+	rate := float64(time.Millisecond) / float64(limit.interval())
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	wait, err := redis.Int64(takeScript.Do(conn, limiter.prefix+key, rate, limit.burst(), now))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(wait) * time.Millisecond, nil
+}
@@ -0,0 +1,78 @@
+package ratelimit_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/ratelimit"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalLimiter(t *testing.T) {
+	limiter := ratelimit.NewLocalLimiter()
+	limit := ratelimit.Limit{Rate: 10, Per: time.Second, Burst: 2}
+
+	testLimiter(t, limiter, "local", limit)
+
+	// Buckets of other keys are independent
+	delay, err := limiter.Take("other", limit)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+
+	// Zero limit does not limit anything
+	for i := 0; i < 100; i++ {
+		delay, err := limiter.Take("unlimited", ratelimit.Limit{})
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), delay)
+	}
+}
+
+func TestRedisLimiter(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		return
+	}
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", redisURL, redis.DialPassword(os.Getenv("REDIS_PASSWORD")))
+		},
+	}
+	defer pool.Close()
+
+	// Cleanup before the test
+	conn := pool.Get()
+	conn.Do("DEL", "test_rate_limit:redis")
+	conn.Close()
+
+	limiter := ratelimit.NewRedisLimiter(pool, "test_rate_limit:")
+	testLimiter(t, limiter, "redis", ratelimit.Limit{Rate: 10, Per: time.Second, Burst: 2})
+}
+
+func testLimiter(t *testing.T, limiter ratelimit.Limiter, key string, limit ratelimit.Limit) {
+	// Burst is allowed right away
+	for i := 0; i < 2; i++ {
+		delay, err := limiter.Take(key, limit)
+		assert.NoError(t, err)
+		assert.Equal(t, time.Duration(0), delay)
+	}
+
+	// Then a token is refilled every 100ms
+	delay, err := limiter.Take(key, limit)
+	assert.NoError(t, err)
+	assert.True(t, delay > 0 && delay <= 100*time.Millisecond, "unexpected delay %s", delay)
+
+	time.Sleep(delay)
+	delay, err = limiter.Take(key, limit)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), delay)
+}
+
+func TestLimitHelpers(t *testing.T) {
+	assert.Equal(t, ratelimit.Limit{Rate: 5, Per: time.Second}, ratelimit.PerSecond(5))
+	assert.Equal(t, ratelimit.Limit{Rate: 5, Per: time.Minute}, ratelimit.PerMinute(5))
+	assert.True(t, ratelimit.PerSecond(1).Enabled())
+	assert.False(t, ratelimit.Limit{}.Enabled())
+}
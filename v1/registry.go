@@ -0,0 +1,320 @@
+package machinery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/backends"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	workersSuffix = "_workers"
+	// How often a launched worker writes its heartbeat
+	workerHeartbeatInterval = 10 * time.Second
+	// Heartbeat of a worker which has not been renewed in time expires, so
+	// the worker is listed no more
+	workerHeartbeatExpiry = 3 * workerHeartbeatInterval
+)
+
+// errWorkerRegistryNotSupported is returned when listing workers if there is
+// nowhere to keep heartbeats written by the whole worker fleet
+var errWorkerRegistryNotSupported = errors.New("Worker heartbeats require Redis broker or Redis result backend")
+
+// WorkerInfo is the heartbeat of a launched worker, see Server.ListWorkers
+type WorkerInfo struct {
+	// ID identifies the worker across the fleet, it is made of the consumer
+	// tag, the host name and the PID
+	ID              string   `json:"id"`
+	ConsumerTag     string   `json:"consumer_tag"`
+	Hostname        string   `json:"hostname"`
+	PID             int      `json:"pid"`
+	Concurrency     int      `json:"concurrency"`
+	Paused          bool     `json:"paused"`
+	Queues          []string `json:"queues"`
+	RegisteredTasks []string `json:"registered_tasks"`
+	// UUIDs of tasks being processed when the heartbeat has been written
+	InFlightTasks []string  `json:"in_flight_tasks"`
+	LaunchedAt    time.Time `json:"launched_at"`
+	HeartbeatAt   time.Time `json:"heartbeat_at"`
+}
+
+// workerRegistry keeps heartbeats of launched workers
+type workerRegistry interface {
+	// Heartbeat stores the heartbeat until it expires
+	Heartbeat(info *WorkerInfo, expiry time.Duration) error
+	// Remove deletes the heartbeat of the worker which has quit
+	Remove(id string) error
+	// List returns heartbeats which have not expired
+	List() ([]*WorkerInfo, error)
+}
+
+// newWorkerRegistry creates the registry of workers. Heartbeats are kept in
+// Redis when using Redis broker or Redis result backend so the whole worker
+// fleet is listed, eager broker keeps them in memory. Nil is returned with
+// other brokers and backends.
+func newWorkerRegistry(cnf *config.Config, broker brokers.Interface, backend backends.Interface) workerRegistry {
+	if pool, ok := sharedRedisPool(broker, backend); ok {
+		return &redisWorkerRegistry{pool: pool, key: cnf.DefaultQueue + workersSuffix}
+	}
+	if isEagerBroker(broker) {
+		return &localWorkerRegistry{workers: make(map[string]*localWorker)}
+	}
+	return nil
+}
+
+// ListWorkers returns heartbeats of launched workers sorted by their IDs. It
+// requires Redis broker or Redis result backend, unless using eager broker.
+func (server *Server) ListWorkers() ([]*WorkerInfo, error) {
+	if server.workerRegistry == nil {
+		return nil, errWorkerRegistryNotSupported
+	}
+
+	workers, err := server.workerRegistry.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].ID < workers[j].ID
+	})
+	return workers, nil
+}
+
+// ID identifies the worker across the fleet
+func (worker *Worker) ID() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s@%s:%d", worker.ConsumerTag, hostname, os.Getpid())
+}
+
+// workerHeartbeat is the goroutine writing heartbeats of a launched worker
+type workerHeartbeat struct {
+	mu   sync.Mutex
+	quit chan struct{}
+	done chan struct{}
+}
+
+// startHeartbeat writes heartbeats of the worker until stopHeartbeat is
+// called, the worker is not listed if there is nowhere to keep them
+func (worker *Worker) startHeartbeat() {
+	registry := worker.server.workerRegistry
+	if registry == nil {
+		log.WARNING.Printf("Worker %s will not be listed: %s", worker.ID(), errWorkerRegistryNotSupported)
+		return
+	}
+
+	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	worker.heartbeat.mu.Lock()
+	worker.heartbeat.quit = quit
+	worker.heartbeat.done = done
+	worker.heartbeat.mu.Unlock()
+
+	launchedAt := time.Now().UTC()
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(workerHeartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			if err := worker.writeHeartbeat(registry, launchedAt); err != nil {
+				log.ERROR.Printf("Worker heartbeat error: %s", err)
+			}
+
+			select {
+			case <-quit:
+				if err := registry.Remove(worker.ID()); err != nil {
+					log.ERROR.Printf("Failed to remove worker heartbeat: %s", err)
+				}
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stopHeartbeat stops writing heartbeats and removes the heartbeat of the
+// worker, so the worker is listed no more. It may be called more than once,
+// every call waits until the heartbeat has been removed.
+func (worker *Worker) stopHeartbeat() {
+	worker.heartbeat.mu.Lock()
+	quit, done := worker.heartbeat.quit, worker.heartbeat.done
+	worker.heartbeat.quit = nil
+	worker.heartbeat.mu.Unlock()
+
+	if done == nil {
+		return
+	}
+	if quit != nil {
+		close(quit)
+	}
+	<-done
+}
+
+// writeHeartbeat writes the heartbeat of the worker to the registry
+func (worker *Worker) writeHeartbeat(registry workerRegistry, launchedAt time.Time) error {
+	hostname, _ := os.Hostname()
+	info := &WorkerInfo{
+		ID:              worker.ID(),
+		ConsumerTag:     worker.ConsumerTag,
+		Hostname:        hostname,
+		PID:             os.Getpid(),
+		Concurrency:     worker.concurrency(),
+		Paused:          worker.IsPaused(),
+		Queues:          worker.queueNames(),
+		RegisteredTasks: worker.server.GetRegisteredTaskNames(),
+		InFlightTasks:   []string{},
+		LaunchedAt:      launchedAt,
+		HeartbeatAt:     time.Now().UTC(),
+	}
+	sort.Strings(info.RegisteredTasks)
+	for _, task := range worker.inFlightTasks() {
+		info.InFlightTasks = append(info.InFlightTasks, task.UUID)
+	}
+
+	return registry.Heartbeat(info, workerHeartbeatExpiry)
+}
+
+// queueNames returns names of the queues the worker consumes from, the
+// default queue if none are set
+func (worker *Worker) queueNames() []string {
+	if len(worker.Queues) == 0 {
+		return []string{worker.server.GetConfig().DefaultQueue}
+	}
+	names := make([]string, 0, len(worker.Queues))
+	for _, queue := range worker.Queues {
+		names = append(names, queue.Name)
+	}
+	return names
+}
+
+// redisWorkerRegistry keeps each heartbeat in a key expiring with it, IDs of
+// workers are indexed by a sorted set scored by expiry of their heartbeats
+type redisWorkerRegistry struct {
+	pool redisPool
+	key  string
+}
+
+func (registry *redisWorkerRegistry) Heartbeat(info *WorkerInfo, expiry time.Duration) error {
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	conn := registry.pool.Get()
+	defer conn.Close()
+
+	expiresAt := time.Now().Add(expiry).UnixNano() / int64(time.Millisecond)
+	conn.Send("MULTI")
+	conn.Send("SET", registry.key+":"+info.ID, encoded, "PX", int64(expiry/time.Millisecond))
+	conn.Send("ZADD", registry.key, expiresAt, info.ID)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (registry *redisWorkerRegistry) Remove(id string) error {
+	conn := registry.pool.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("DEL", registry.key+":"+id)
+	conn.Send("ZREM", registry.key, id)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (registry *redisWorkerRegistry) List() ([]*WorkerInfo, error) {
+	conn := registry.pool.Get()
+	defer conn.Close()
+
+	// Drop IDs of workers whose heartbeats have expired
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if _, err := conn.Do("ZREMRANGEBYSCORE", registry.key, "-inf", now); err != nil {
+		return nil, err
+	}
+
+	ids, err := redis.Strings(conn.Do("ZRANGE", registry.key, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return []*WorkerInfo{}, nil
+	}
+
+	keys := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, registry.key+":"+id)
+	}
+	items, err := redis.ByteSlices(conn.Do("MGET", keys...))
+	if err != nil {
+		return nil, err
+	}
+
+	workers := make([]*WorkerInfo, 0, len(items))
+	for _, item := range items {
+		// The heartbeat has expired in the meantime
+		if item == nil {
+			continue
+		}
+		info := new(WorkerInfo)
+		if err := json.Unmarshal(item, info); err != nil {
+			return nil, err
+		}
+		workers = append(workers, info)
+	}
+	return workers, nil
+}
+
+// localWorker is a heartbeat of a worker kept in memory
+type localWorker struct {
+	info      WorkerInfo
+	expiresAt time.Time
+}
+
+// localWorkerRegistry keeps heartbeats in memory
+type localWorkerRegistry struct {
+	workers map[string]*localWorker
+	mu      sync.Mutex
+}
+
+func (registry *localWorkerRegistry) Heartbeat(info *WorkerInfo, expiry time.Duration) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	registry.workers[info.ID] = &localWorker{info: *info, expiresAt: time.Now().Add(expiry)}
+	return nil
+}
+
+func (registry *localWorkerRegistry) Remove(id string) error {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	delete(registry.workers, id)
+	return nil
+}
+
+func (registry *localWorkerRegistry) List() ([]*WorkerInfo, error) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	now := time.Now()
+	workers := make([]*WorkerInfo, 0, len(registry.workers))
+	for id, worker := range registry.workers {
+		if !worker.expiresAt.After(now) {
+			delete(registry.workers, id)
+			continue
+		}
+		info := worker.info
+		workers = append(workers, &info)
+	}
+	return workers, nil
+}
@@ -0,0 +1,84 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Policy computes delays between retry attempts of a failed task
+type Policy interface {
+	// Delay returns how long to wait before the retry attempt, attempts are
+	// counted from 1
+	Delay(attempt int) time.Duration
+}
+
+// PolicyFunc is an adapter to use ordinary functions as retry policies
+type PolicyFunc func(attempt int) time.Duration
+
+// Delay calls f(attempt)
+func (f PolicyFunc) Delay(attempt int) time.Duration {
+	return f(attempt)
+}
+
+// Fixed waits the same delay before every attempt
+func Fixed(delay time.Duration) Policy {
+	return PolicyFunc(func(attempt int) time.Duration {
+		return delay
+	})
+}
+
+// Linear increases the delay by the same amount after every attempt, i.e.
+// waits delay, 2*delay, 3*delay and so on
+func Linear(delay time.Duration) Policy {
+	return PolicyFunc(func(attempt int) time.Duration {
+		return multiply(delay, float64(attempt))
+	})
+}
+
+// Exponential multiplies the delay by multiplier after every attempt. Jitter
+// between 0 and 1 randomly shortens delays by up to that fraction so retries
+// of tasks which failed at the same time are spread out.
+func Exponential(delay time.Duration, multiplier, jitter float64) Policy {
+	return PolicyFunc(func(attempt int) time.Duration {
+		factor := math.Pow(multiplier, float64(attempt-1))
+		if jitter > 0 {
+			factor *= 1 - rand.Float64()*math.Min(jitter, 1)
+		}
+		return multiply(delay, factor)
+	})
+}
+
+// FibonacciBackoff waits unit times successive Fibonacci numbers, i.e.
+// unit, 2*unit, 3*unit, 5*unit and so on
+func FibonacciBackoff(unit time.Duration) Policy {
+	return PolicyFunc(func(attempt int) time.Duration {
+		fib := Fibonacci()
+		fib()
+		n := fib()
+		for i := 1; i < attempt; i++ {
+			n = fib()
+		}
+		return multiply(unit, float64(n))
+	})
+}
+
+// WithMaxDelay caps delays of the policy
+func WithMaxDelay(policy Policy, maxDelay time.Duration) Policy {
+	return PolicyFunc(func(attempt int) time.Duration {
+		delay := policy.Delay(attempt)
+		if delay > maxDelay {
+			return maxDelay
+		}
+		return delay
+	})
+}
+
+// multiply scales the duration without overflowing
+func multiply(duration time.Duration, factor float64) time.Duration {
+	scaled := float64(duration) * factor
+	if scaled >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(scaled)
+}
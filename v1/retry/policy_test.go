@@ -0,0 +1,71 @@
+package retry_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/retry"
+	"github.com/stretchr/testify/assert"
+)
+
+func delays(policy retry.Policy, attempts int) []time.Duration {
+	result := make([]time.Duration, attempts)
+	for i := range result {
+		result[i] = policy.Delay(i + 1)
+	}
+	return result
+}
+
+func TestFixed(t *testing.T) {
+	policy := retry.Fixed(500 * time.Millisecond)
+	assert.Equal(t, []time.Duration{500 * time.Millisecond, 500 * time.Millisecond}, delays(policy, 2))
+}
+
+func TestLinear(t *testing.T) {
+	policy := retry.Linear(time.Second)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, delays(policy, 3))
+}
+
+func TestExponential(t *testing.T) {
+	policy := retry.Exponential(100*time.Millisecond, 2, 0)
+	assert.Equal(t, []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+	}, delays(policy, 4))
+
+	// Huge attempts do not overflow
+	assert.True(t, policy.Delay(1000) > 0)
+}
+
+func TestExponentialJitter(t *testing.T) {
+	policy := retry.Exponential(time.Second, 2, 0.5)
+	for i := 0; i < 100; i++ {
+		delay := policy.Delay(3)
+		assert.True(t, delay > 2*time.Second && delay <= 4*time.Second, "delay %v out of range", delay)
+	}
+}
+
+func TestFibonacciBackoff(t *testing.T) {
+	policy := retry.FibonacciBackoff(time.Second)
+	assert.Equal(t, []time.Duration{
+		1 * time.Second,
+		2 * time.Second,
+		3 * time.Second,
+		5 * time.Second,
+		8 * time.Second,
+	}, delays(policy, 5))
+}
+
+func TestWithMaxDelay(t *testing.T) {
+	policy := retry.WithMaxDelay(retry.Linear(time.Second), 2*time.Second)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 2 * time.Second}, delays(policy, 3))
+}
+
+func TestPolicyFunc(t *testing.T) {
+	policy := retry.PolicyFunc(func(attempt int) time.Duration {
+		return time.Duration(attempt) * time.Millisecond
+	})
+	assert.Equal(t, 3*time.Millisecond, policy.Delay(3))
+}
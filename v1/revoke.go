@@ -0,0 +1,138 @@
+package machinery
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/backends"
+	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+)
+
+// revokedPollInterval is how often the worker checks whether its running
+// tasks have been revoked
+const revokedPollInterval = time.Second
+
+// revokedWatcher cancels tasks revoked while running in a worker. A single
+// goroutine polls the result backend for all running tasks of the worker
+// and it is only running while there are tasks to watch.
+type revokedWatcher struct {
+	mu      sync.Mutex
+	tasks   map[*watchedTask]struct{}
+	polling bool
+}
+
+// watchedTask is a task running in the worker
+type watchedTask struct {
+	uuid    string
+	cancel  context.CancelFunc
+	revoked int32
+}
+
+// isRevoked returns true if the task has been revoked, the task is processed
+// if the backend cannot tell
+func (worker *Worker) isRevoked(signature *tasks.Signature) bool {
+	revoked, err := worker.server.GetBackend().IsRevoked(signature.UUID)
+	if err != nil {
+		log.WARNING.Printf("Is revoked error: %s", err)
+		return false
+	}
+	return revoked
+}
+
+// watchRevoked calls cancel once the task gets revoked until stop is called.
+// The returned revoked function reports whether it has done so.
+func (worker *Worker) watchRevoked(signature *tasks.Signature, cancel context.CancelFunc) (revoked func() bool, stop func()) {
+	w := &worker.revoked
+	task := &watchedTask{uuid: signature.UUID, cancel: cancel}
+
+	w.mu.Lock()
+	if w.tasks == nil {
+		w.tasks = make(map[*watchedTask]struct{})
+	}
+	w.tasks[task] = struct{}{}
+	if !w.polling {
+		w.polling = true
+		go w.poll(worker.server.GetBackend())
+	}
+	w.mu.Unlock()
+
+	revoked = func() bool {
+		return atomic.LoadInt32(&task.revoked) == 1
+	}
+	stop = func() {
+		w.mu.Lock()
+		delete(w.tasks, task)
+		w.mu.Unlock()
+	}
+	return revoked, stop
+}
+
+// poll checks the watched tasks until there are none left
+func (w *revokedWatcher) poll(backend backends.Interface) {
+	ticker := time.NewTicker(revokedPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		w.mu.Lock()
+		if len(w.tasks) == 0 {
+			w.polling = false
+			w.mu.Unlock()
+			return
+		}
+		watched := make([]*watchedTask, 0, len(w.tasks))
+		for task := range w.tasks {
+			watched = append(watched, task)
+		}
+		w.mu.Unlock()
+
+		for _, task := range revokedTasks(backend, watched) {
+			atomic.StoreInt32(&task.revoked, 1)
+			task.cancel()
+		}
+	}
+}
+
+// revokedTasks returns the watched tasks which have been revoked, backends
+// implementing RevokedChecker check all of them with a single call
+func revokedTasks(backend backends.Interface, watched []*watchedTask) []*watchedTask {
+	var revoked []*watchedTask
+
+	checker, ok := backend.(backends.RevokedChecker)
+	if !ok {
+		for _, task := range watched {
+			isRevoked, err := backend.IsRevoked(task.uuid)
+			if err != nil {
+				log.WARNING.Printf("Is revoked error: %s", err)
+				continue
+			}
+			if isRevoked {
+				revoked = append(revoked, task)
+			}
+		}
+		return revoked
+	}
+
+	taskUUIDs := make([]string, 0, len(watched))
+	for _, task := range watched {
+		taskUUIDs = append(taskUUIDs, task.uuid)
+	}
+	revokedUUIDs, err := checker.RevokedTasks(taskUUIDs)
+	if err != nil {
+		log.WARNING.Printf("Revoked tasks error: %s", err)
+		return nil
+	}
+
+	isRevoked := make(map[string]bool, len(revokedUUIDs))
+	for _, taskUUID := range revokedUUIDs {
+		isRevoked[taskUUID] = true
+	}
+	for _, task := range watched {
+		if isRevoked[task.uuid] {
+			revoked = append(revoked, task)
+		}
+	}
+	return revoked
+}
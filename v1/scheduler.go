@@ -0,0 +1,398 @@
+package machinery
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/cron"
+	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/garyburd/redigo/redis"
+	redsync "gopkg.in/redsync.v1"
+)
+
+const (
+	schedulerSuffix = "_scheduler"
+	// Lock is held only while a periodic task is being sent
+	schedulerLockExpiry = 10 * time.Second
+	// Delay before sending a periodic task again after a failure
+	schedulerRetryDelay = time.Second
+)
+
+// Scheduler sends periodic tasks, either on a cron schedule or at fixed
+// intervals. Several schedulers can run against the same Redis broker or
+// result backend, last run times are kept in Redis and only one of them sends
+// a task at each tick.
+type Scheduler struct {
+	server  *Server
+	store   schedulerStore
+	clock   schedulerClock
+	entries []*schedulerEntry
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+// schedulerClock tells the time and waits until periodic tasks are due
+type schedulerClock interface {
+	Now() time.Time
+	// Timer returns a channel receiving the time once d has elapsed and
+	// a function stopping the timer
+	Timer(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+// systemClock is schedulerClock using the system time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Timer(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// schedulerEntry is a single periodic task
+type schedulerEntry struct {
+	name      string
+	schedule  cron.Schedule
+	signature *tasks.Signature
+	next      time.Time
+}
+
+// schedulerStore keeps last run times of periodic tasks and makes sure only
+// one scheduler sends a periodic task at a time
+type schedulerStore interface {
+	LastRun(name string) (time.Time, error)
+	SetLastRun(name string, lastRun time.Time) error
+	// Lock returns false if the lock is held by another scheduler
+	Lock(name string) (unlock func(), ok bool)
+}
+
+// errSchedulerNotSupported is returned when creating a scheduler if there is
+// nowhere to keep last run times shared by all schedulers
+var errSchedulerNotSupported = errors.New("Scheduler requires Redis broker or Redis result backend")
+
+// NewScheduler creates Scheduler instance. Last run times are kept in Redis
+// when using Redis broker or Redis result backend so several schedulers can
+// run at once, eager broker keeps them in memory. An error is returned with
+// other brokers and backends.
+func (server *Server) NewScheduler() (*Scheduler, error) {
+	var store schedulerStore
+	if pool, ok := sharedRedisPool(server.broker, server.backend); ok {
+		store = newRedisSchedulerStore(pool, server.config.DefaultQueue+schedulerSuffix)
+	} else if isEagerBroker(server.broker) {
+		store = newLocalSchedulerStore()
+	} else {
+		return nil, errSchedulerNotSupported
+	}
+
+	return &Scheduler{
+		server: server,
+		store:  store,
+		clock:  systemClock{},
+	}, nil
+}
+
+// AddCron schedules the task using a cron expression, see cron.Parse.
+// The name identifies the periodic task across schedulers.
+func (scheduler *Scheduler) AddCron(name, spec string, signature *tasks.Signature) error {
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return err
+	}
+	return scheduler.Add(name, schedule, signature)
+}
+
+// AddInterval schedules the task to be sent at fixed intervals.
+// The name identifies the periodic task across schedulers.
+func (scheduler *Scheduler) AddInterval(name string, interval time.Duration, signature *tasks.Signature) error {
+	schedule, err := cron.Every(interval)
+	if err != nil {
+		return err
+	}
+	return scheduler.Add(name, schedule, signature)
+}
+
+// Add schedules the task. Every run sends a copy of the signature with a new
+// UUID. Periodic tasks must be added before the scheduler is launched.
+func (scheduler *Scheduler) Add(name string, schedule cron.Schedule, signature *tasks.Signature) error {
+	if name == "" {
+		return errors.New("Periodic task name is required")
+	}
+	for _, entry := range scheduler.entries {
+		if entry.name == name {
+			return fmt.Errorf("Periodic task %s already exists", name)
+		}
+	}
+
+	scheduler.entries = append(scheduler.entries, &schedulerEntry{
+		name:      name,
+		schedule:  schedule,
+		signature: signature,
+	})
+	return nil
+}
+
+// Launch starts the scheduler and blocks until it quits
+func (scheduler *Scheduler) Launch() error {
+	errorsChan := make(chan error)
+
+	scheduler.LaunchAsync(errorsChan)
+
+	return <-errorsChan
+}
+
+// LaunchAsync is a non blocking version of Launch
+func (scheduler *Scheduler) LaunchAsync(errorsChan chan<- error) {
+	log.INFO.Printf("Launching a scheduler with %d periodic tasks", len(scheduler.entries))
+
+	scheduler.quit = make(chan struct{})
+	scheduler.done = make(chan struct{})
+
+	go scheduler.run()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	// Goroutine Handle SIGINT and SIGTERM signals
+	go func() {
+		select {
+		case s := <-sig:
+			log.WARNING.Printf("Signal received: %v", s)
+			scheduler.Quit()
+			errorsChan <- errors.New("Scheduler quit gracefully")
+		case <-scheduler.done:
+			signal.Stop(sig)
+			errorsChan <- errors.New("Scheduler quit")
+		}
+	}()
+}
+
+// Quit stops the scheduler, it waits for a periodic task being sent
+func (scheduler *Scheduler) Quit() {
+	if scheduler.quit == nil {
+		return
+	}
+
+	select {
+	case <-scheduler.quit:
+	default:
+		close(scheduler.quit)
+	}
+	<-scheduler.done
+}
+
+// run sends periodic tasks when they are due until the scheduler quits
+func (scheduler *Scheduler) run() {
+	defer close(scheduler.done)
+
+	now := scheduler.clock.Now()
+	for _, entry := range scheduler.entries {
+		scheduler.scheduleNext(entry, now)
+	}
+
+	for {
+		due := scheduler.dueEntries()
+		if len(due) == 0 {
+			<-scheduler.quit
+			return
+		}
+
+		timer, stopTimer := scheduler.clock.Timer(due[0].next.Sub(scheduler.clock.Now()))
+		select {
+		case <-scheduler.quit:
+			stopTimer()
+			return
+		case now = <-timer:
+		}
+
+		for _, entry := range due {
+			if entry.next.After(now) {
+				continue
+			}
+			scheduler.fire(entry, now)
+			scheduler.scheduleNext(entry, now)
+
+			// The task is still due if sending it failed or another scheduler
+			// is sending it right now, try again a bit later
+			if !entry.next.IsZero() && !entry.next.After(now) {
+				entry.next = now.Add(schedulerRetryDelay)
+			}
+		}
+	}
+}
+
+// dueEntries returns entries which have a next run sorted by the next run
+func (scheduler *Scheduler) dueEntries() []*schedulerEntry {
+	due := make([]*schedulerEntry, 0, len(scheduler.entries))
+	for _, entry := range scheduler.entries {
+		if !entry.next.IsZero() {
+			due = append(due, entry)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].next.Before(due[j].next)
+	})
+	return due
+}
+
+// scheduleNext computes the next run of the entry from its last run
+func (scheduler *Scheduler) scheduleNext(entry *schedulerEntry, now time.Time) {
+	lastRun, err := scheduler.store.LastRun(entry.name)
+	if err != nil {
+		log.ERROR.Printf("Failed to get last run of periodic task %s: %s", entry.name, err)
+		entry.next = now.Add(schedulerRetryDelay)
+		return
+	}
+
+	// Periodic task which has never run starts one period from now
+	if lastRun.IsZero() {
+		lastRun = now
+	}
+
+	entry.next = entry.schedule.Next(lastRun)
+
+	// Runs missed while no scheduler was running are made up for only once
+	if !entry.next.IsZero() && !entry.next.After(now) {
+		entry.next = now
+	}
+}
+
+// fire sends the periodic task unless another scheduler has already done so
+func (scheduler *Scheduler) fire(entry *schedulerEntry, now time.Time) {
+	unlock, ok := scheduler.store.Lock(entry.name)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// Check the last run again while holding the lock
+	lastRun, err := scheduler.store.LastRun(entry.name)
+	if err != nil {
+		log.ERROR.Printf("Failed to get last run of periodic task %s: %s", entry.name, err)
+		return
+	}
+	if !lastRun.IsZero() && entry.schedule.Next(lastRun).After(now) {
+		return
+	}
+
+	signature, err := copySignature(entry.signature)
+	if err != nil {
+		log.ERROR.Printf("Failed to copy signature of periodic task %s: %s", entry.name, err)
+		return
+	}
+
+	if _, err := scheduler.server.SendTask(signature); err != nil {
+		log.ERROR.Printf("Failed to send periodic task %s: %s", entry.name, err)
+		return
+	}
+
+	// The due time rather than now is stored so intervals do not drift
+	if err := scheduler.store.SetLastRun(entry.name, entry.next); err != nil {
+		log.ERROR.Printf("Failed to set last run of periodic task %s: %s", entry.name, err)
+	}
+
+	log.INFO.Printf("Sent periodic task %s: %s", entry.name, signature.UUID)
+}
+
+// copySignature returns a deep copy of the signature without UUID
+func copySignature(signature *tasks.Signature) (*tasks.Signature, error) {
+	encoded, err := json.Marshal(signature)
+	if err != nil {
+		return nil, err
+	}
+
+	signatureCopy := new(tasks.Signature)
+	if err := json.Unmarshal(encoded, signatureCopy); err != nil {
+		return nil, err
+	}
+	signatureCopy.UUID = ""
+
+	return signatureCopy, nil
+}
+
+// redisSchedulerStore keeps last run times in a Redis hash
+type redisSchedulerStore struct {
+	pool    redisPool
+	key     string
+	redsync *redsync.Redsync
+}
+
+func newRedisSchedulerStore(pool redisPool, key string) *redisSchedulerStore {
+	return &redisSchedulerStore{
+		pool:    pool,
+		key:     key,
+		redsync: redsync.New([]redsync.Pool{pool}),
+	}
+}
+
+func (store *redisSchedulerStore) LastRun(name string) (time.Time, error) {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	lastRun, err := redis.Int64(conn.Do("HGET", store.key, name))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, lastRun*int64(time.Millisecond)), nil
+}
+
+func (store *redisSchedulerStore) SetLastRun(name string, lastRun time.Time) error {
+	conn := store.pool.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HSET", store.key, name, lastRun.UnixNano()/int64(time.Millisecond))
+	return err
+}
+
+func (store *redisSchedulerStore) Lock(name string) (func(), bool) {
+	mutex := store.redsync.NewMutex(
+		store.key+":"+name,
+		redsync.SetExpiry(schedulerLockExpiry),
+		redsync.SetTries(1),
+	)
+	if err := mutex.Lock(); err != nil {
+		return nil, false
+	}
+	return func() { mutex.Unlock() }, true
+}
+
+// localSchedulerStore keeps last run times in memory
+type localSchedulerStore struct {
+	lastRuns map[string]time.Time
+	mu       sync.Mutex
+}
+
+func newLocalSchedulerStore() *localSchedulerStore {
+	return &localSchedulerStore{lastRuns: make(map[string]time.Time)}
+}
+
+func (store *localSchedulerStore) LastRun(name string) (time.Time, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	return store.lastRuns[name], nil
+}
+
+func (store *localSchedulerStore) SetLastRun(name string, lastRun time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.lastRuns[name] = lastRun
+	return nil
+}
+
+func (store *localSchedulerStore) Lock(name string) (func(), bool) {
+	return func() {}, true
+}
@@ -0,0 +1,127 @@
+package machinery_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchedulerAdd(t *testing.T) {
+	scheduler, err := getEagerServer(t).NewScheduler()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, scheduler.AddCron("hourly", "@hourly", &tasks.Signature{Name: "test_task"}))
+	assert.Error(t, scheduler.AddCron("hourly", "@hourly", &tasks.Signature{Name: "test_task"}))
+	assert.Error(t, scheduler.AddCron("invalid", "* * *", &tasks.Signature{Name: "test_task"}))
+	assert.Error(t, scheduler.AddInterval("zero", 0, &tasks.Signature{Name: "test_task"}))
+	assert.Error(t, scheduler.AddInterval("", time.Second, &tasks.Signature{Name: "test_task"}))
+}
+
+// testClock is a clock for the scheduler which only moves when told to,
+// waiting receives a value every time the scheduler starts waiting
+type testClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  map[chan time.Time]time.Time
+	waiting chan struct{}
+}
+
+func newTestClock() *testClock {
+	return &testClock{
+		now:     time.Unix(1500000000, 0),
+		timers:  make(map[chan time.Time]time.Time),
+		waiting: make(chan struct{}, 100),
+	}
+}
+
+func (clock *testClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	return clock.now
+}
+
+func (clock *testClock) Timer(d time.Duration) (<-chan time.Time, func() bool) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	timer := make(chan time.Time, 1)
+	if d <= 0 {
+		timer <- clock.now
+	} else {
+		clock.timers[timer] = clock.now.Add(d)
+	}
+	clock.waiting <- struct{}{}
+
+	return timer, func() bool {
+		clock.mu.Lock()
+		defer clock.mu.Unlock()
+
+		_, ok := clock.timers[timer]
+		delete(clock.timers, timer)
+		return ok
+	}
+}
+
+// Advance moves the time forward and fires timers which are due
+func (clock *testClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	clock.now = clock.now.Add(d)
+	for timer, at := range clock.timers {
+		if !at.After(clock.now) {
+			timer <- clock.now
+			delete(clock.timers, timer)
+		}
+	}
+}
+
+func TestSchedulerInterval(t *testing.T) {
+	server := getEagerServer(t)
+
+	var calls int32
+	err := server.RegisterTask("periodic_task", func(n int64) error {
+		atomic.AddInt32(&calls, int32(n))
+		return nil
+	})
+	assert.NoError(t, err)
+
+	clock := newTestClock()
+	scheduler, err := server.NewScheduler()
+	if !assert.NoError(t, err) {
+		return
+	}
+	scheduler.SetClock(clock)
+	err = scheduler.AddInterval("every_50ms", 50*time.Millisecond, &tasks.Signature{
+		Name: "periodic_task",
+		Args: []tasks.Arg{{Type: "int64", Value: 1}},
+	})
+	assert.NoError(t, err)
+
+	errorsChan := make(chan error, 1)
+	scheduler.LaunchAsync(errorsChan)
+
+	// Eager broker processes the task in place, it has run by the time the
+	// scheduler waits for the next run
+	<-clock.waiting
+	clock.Advance(30 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+	for i := 1; i <= 5; i++ {
+		clock.Advance(20 * time.Millisecond)
+		<-clock.waiting
+		clock.Advance(30 * time.Millisecond)
+
+		// Every run sends a fresh copy of the signature
+		assert.Equal(t, int32(i), atomic.LoadInt32(&calls))
+	}
+
+	scheduler.Quit()
+	assert.Error(t, <-errorsChan)
+}
@@ -0,0 +1,159 @@
+// Package semaphore implements counting semaphores limiting how many tasks
+// run at once, either within a single process or across processes in Redis.
+package semaphore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/garyburd/redigo/redis"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Semaphore keeps a counting semaphore for every key
+type Semaphore interface {
+	// Acquire takes one of limit slots of the key. It returns false if all
+	// slots are taken, otherwise the slot is held until release is called.
+	Acquire(key string, limit int) (release func(), ok bool, err error)
+}
+
+// localSemaphore counts taken slots in memory
+type localSemaphore struct {
+	taken map[string]int
+	mu    sync.Mutex
+}
+
+// NewLocalSemaphore creates a semaphore counting slots in memory, it only
+// limits tasks within the process
+func NewLocalSemaphore() Semaphore {
+	return &localSemaphore{taken: make(map[string]int)}
+}
+
+func (semaphore *localSemaphore) Acquire(key string, limit int) (func(), bool, error) {
+	semaphore.mu.Lock()
+	defer semaphore.mu.Unlock()
+
+	if semaphore.taken[key] >= limit {
+		return nil, false, nil
+	}
+	semaphore.taken[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			semaphore.mu.Lock()
+			defer semaphore.mu.Unlock()
+
+			semaphore.taken[key]--
+			if semaphore.taken[key] <= 0 {
+				delete(semaphore.taken, key)
+			}
+		})
+	}, true, nil
+}
+
+// Pool provides Redis connections
+type Pool interface {
+	Get() redis.Conn
+}
+
+const (
+	// Slot of a process which stopped refreshing it is freed after this time
+	defaultSlotExpiry = time.Minute
+)
+
+// acquireScript removes slots of the sorted set (KEYS[1]) which expired by
+// ARGV[1] milliseconds and adds the slot ARGV[4] expiring at ARGV[2] if fewer
+// than ARGV[3] slots are taken. It returns 1 if the slot has been added.
+var acquireScript = redis.NewScript(1, `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[4])
+redis.call('PEXPIRE', KEYS[1], tonumber(ARGV[2]) - tonumber(ARGV[1]))
+return 1
+`)
+
+// redisSemaphore keeps taken slots in Redis sorted sets scored by the time
+// they expire, held slots are refreshed periodically
+type redisSemaphore struct {
+	pool   Pool
+	prefix string
+	expiry time.Duration
+}
+
+// NewRedisSemaphore creates a semaphore keeping slots in Redis under keys
+// starting with the prefix, it limits tasks across all processes sharing the
+// Redis server. Slots of processes which died are freed after a minute.
+func NewRedisSemaphore(pool Pool, prefix string) Semaphore {
+	return &redisSemaphore{pool: pool, prefix: prefix, expiry: defaultSlotExpiry}
+}
+
+func (semaphore *redisSemaphore) Acquire(key string, limit int) (func(), bool, error) {
+	key = semaphore.prefix + key
+	slot := fmt.Sprintf("%v", uuid.NewV4())
+
+	conn := semaphore.pool.Get()
+	defer conn.Close()
+
+	now := time.Now()
+	acquired, err := redis.Bool(acquireScript.Do(conn, key, milliseconds(now), milliseconds(now.Add(semaphore.expiry)), limit, slot))
+	if err != nil || !acquired {
+		return nil, false, err
+	}
+
+	// Keep the slot from expiring while it is held
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(semaphore.expiry / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case now := <-ticker.C:
+				semaphore.refresh(key, slot, now)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+			semaphore.release(key, slot)
+		})
+	}, true, nil
+}
+
+// refresh extends expiry of the slot unless it has been freed already
+func (semaphore *redisSemaphore) refresh(key, slot string, now time.Time) {
+	conn := semaphore.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("ZADD", key, "XX", milliseconds(now.Add(semaphore.expiry)), slot); err != nil {
+		log.ERROR.Printf("Refresh semaphore slot %s error: %s", key, err)
+	}
+}
+
+// release frees the slot
+func (semaphore *redisSemaphore) release(key, slot string) {
+	conn := semaphore.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("ZREM", key, slot); err != nil {
+		log.ERROR.Printf("Release semaphore slot %s error: %s", key, err)
+	}
+}
+
+func milliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
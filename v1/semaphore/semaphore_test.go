@@ -0,0 +1,71 @@
+package semaphore_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/Guazi-inc/machinery/v1/semaphore"
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalSemaphore(t *testing.T) {
+	testSemaphore(t, semaphore.NewLocalSemaphore(), "local")
+}
+
+func TestRedisSemaphore(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		return
+	}
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", redisURL, redis.DialPassword(os.Getenv("REDIS_PASSWORD")))
+		},
+	}
+	defer pool.Close()
+
+	// Cleanup before the test
+	conn := pool.Get()
+	conn.Do("DEL", "test_concurrency:redis", "test_concurrency:other")
+	conn.Close()
+
+	testSemaphore(t, semaphore.NewRedisSemaphore(pool, "test_concurrency:"), "redis")
+}
+
+func testSemaphore(t *testing.T, sem semaphore.Semaphore, key string) {
+	release1, ok, err := sem.Acquire(key, 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	release2, ok, err := sem.Acquire(key, 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// All slots are taken
+	_, ok, err = sem.Acquire(key, 2)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Slots of other keys are independent
+	releaseOther, ok, err := sem.Acquire("other", 1)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	releaseOther()
+
+	// Releasing twice frees a single slot
+	release1()
+	release1()
+
+	release3, ok, err := sem.Acquire(key, 2)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	_, ok, err = sem.Acquire(key, 2)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	release2()
+	release3()
+}
@@ -1,15 +1,19 @@
 package machinery
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/Guazi-inc/machinery/v1/backends"
 	"github.com/Guazi-inc/machinery/v1/brokers"
 	"github.com/Guazi-inc/machinery/v1/config"
 	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/Guazi-inc/machinery/v1/ratelimit"
+	"github.com/Guazi-inc/machinery/v1/semaphore"
 	"github.com/Guazi-inc/machinery/v1/tasks"
 	uuid "github.com/satori/go.uuid"
 )
@@ -17,10 +21,18 @@ import (
 // Server is the main Machinery object and stores all configuration
 // All the tasks workers process are registered against the server
 type Server struct {
-	config          *config.Config
-	registeredTasks map[string]interface{}
-	broker          brokers.Interface
-	backend         backends.Interface
+	config                *config.Config
+	registeredTasks       map[string]interface{}
+	registeredTaskOptions map[string]TaskOptions
+	broker                brokers.Interface
+	backend               backends.Interface
+	rateLimiter           ratelimit.Limiter
+	semaphore             semaphore.Semaphore
+	idempotencyStore      idempotencyStore
+	uniqueLocker          uniqueLocker
+	workerRegistry        workerRegistry
+	controlChannel        controlChannel
+	middlewares           []Middleware
 }
 
 // NewServer creates Server instance
@@ -33,11 +45,13 @@ func NewServer(cnf *config.Config) (*Server, error) {
 	// Backend is optional so we ignore the error
 	backend, _ := BackendFactory(cnf)
 	srv := &Server{
-		config:          cnf,
-		registeredTasks: make(map[string]interface{}),
-		broker:          broker,
-		backend:         backend,
+		config:                cnf,
+		registeredTasks:       make(map[string]interface{}),
+		registeredTaskOptions: make(map[string]TaskOptions),
+		broker:                broker,
+		backend:               backend,
 	}
+	srv.initSharedState()
 
 	// init for eager-mode
 	eager, ok := broker.(brokers.EagerMode)
@@ -50,12 +64,17 @@ func NewServer(cnf *config.Config) (*Server, error) {
 	return srv, nil
 }
 
-// NewWorker creates Worker instance
+// NewWorker creates Worker instance consuming from queues set in the config
+// (or from the default queue if there are none)
 func (server *Server) NewWorker(consumerTag string, concurrency int) *Worker {
+	queues := make([]config.QueueConfig, len(server.config.Queues))
+	copy(queues, server.config.Queues)
+
 	return &Worker{
 		server:      server,
 		ConsumerTag: consumerTag,
 		Concurrency: concurrency,
+		Queues:      queues,
 	}
 }
 
@@ -67,6 +86,7 @@ func (server *Server) GetBroker() brokers.Interface {
 // SetBroker sets broker
 func (server *Server) SetBroker(broker brokers.Interface) {
 	server.broker = broker
+	server.initSharedState()
 }
 
 // GetBackend returns backend
@@ -77,6 +97,18 @@ func (server *Server) GetBackend() backends.Interface {
 // SetBackend sets backend
 func (server *Server) SetBackend(backend backends.Interface) {
 	server.backend = backend
+	server.initSharedState()
+}
+
+// initSharedState creates the stores of state shared by all workers and
+// publishers, they are kept by the broker or the result backend
+func (server *Server) initSharedState() {
+	server.rateLimiter = newRateLimiter(server.config, server.broker, server.backend)
+	server.semaphore = newSemaphore(server.config, server.broker, server.backend)
+	server.idempotencyStore = newIdempotencyStore(server.config, server.broker, server.backend)
+	server.uniqueLocker = newUniqueLocker(server.config, server.broker, server.backend)
+	server.workerRegistry = newWorkerRegistry(server.config, server.broker, server.backend)
+	server.controlChannel = newControlChannel(server.config, server.broker)
 }
 
 // GetConfig returns connection object
@@ -98,6 +130,8 @@ func (server *Server) RegisterTasks(namedTaskFuncs map[string]interface{}) error
 		log.DEBUG.Printf("registered task: %s", name)
 	}
 	server.registeredTasks = namedTaskFuncs
+	// Options of tasks registered before are dropped with them
+	server.registeredTaskOptions = make(map[string]TaskOptions)
 	server.broker.SetRegisteredTaskNames(server.GetRegisteredTaskNames())
 	return nil
 }
@@ -108,10 +142,34 @@ func (server *Server) RegisterTask(name string, taskFunc interface{}) error {
 		return err
 	}
 	server.registeredTasks[name] = taskFunc
+	// The task registered again without options has none
+	delete(server.registeredTaskOptions, name)
 	server.broker.SetRegisteredTaskNames(server.GetRegisteredTaskNames())
 	return nil
 }
 
+// RegisterTaskWithOptions registers a single task together with options
+// workers apply when processing it
+func (server *Server) RegisterTaskWithOptions(name string, taskFunc interface{}, options TaskOptions) error {
+	if options.RateLimit.Enabled() && server.rateLimiter == nil {
+		return errRateLimitNotSupported
+	}
+	if options.GlobalConcurrency > 0 && server.semaphore == nil {
+		return errGlobalConcurrencyNotSupported
+	}
+	if err := server.RegisterTask(name, taskFunc); err != nil {
+		return err
+	}
+	server.registeredTaskOptions[name] = options
+	return nil
+}
+
+// GetRegisteredTaskOptions returns options of a registered task, zero value
+// options are returned for tasks registered without them
+func (server *Server) GetRegisteredTaskOptions(name string) TaskOptions {
+	return server.registeredTaskOptions[name]
+}
+
 // IsTaskRegistered returns true if the task name is registered with this broker
 func (server *Server) IsTaskRegistered(name string) bool {
 	_, ok := server.registeredTasks[name]
@@ -129,6 +187,55 @@ func (server *Server) GetRegisteredTask(name string) (interface{}, error) {
 
 // SendTask publishes a task to the default queue
 func (server *Server) SendTask(signature *tasks.Signature) (*backends.AsyncResult, error) {
+	return server.SendTaskWithContext(context.Background(), signature)
+}
+
+// SendTaskWithContext publishes a task to the default queue, it gives up
+// once the context is done
+func (server *Server) SendTaskWithContext(ctx context.Context, signature *tasks.Signature) (*backends.AsyncResult, error) {
+	if signature.IdempotencyKey == "" {
+		return server.sendTask(ctx, signature)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if server.idempotencyStore == nil {
+		return nil, errIdempotencyNotSupported
+	}
+
+	// Auto generate a UUID if not set already
+	if signature.UUID == "" {
+		signature.UUID = fmt.Sprintf("task_%v", uuid.NewV4())
+	}
+
+	// A task sent with the same idempotency key within the window is not
+	// sent again, the result of the task sent first is returned instead
+	existing, claimed, err := server.idempotencyStore.Claim(signature.IdempotencyKey, signature.UUID, idempotencyWindow(server.config))
+	if err != nil {
+		return nil, fmt.Errorf("Claim idempotency key error: %s", err)
+	}
+	if !claimed {
+		log.INFO.Printf("Task with idempotency key %s has been sent already: %s", signature.IdempotencyKey, existing)
+		duplicate := *signature
+		duplicate.UUID = existing
+		return backends.NewAsyncResult(&duplicate, server.backend), nil
+	}
+
+	asyncResult, err := server.sendTask(ctx, signature)
+	if err != nil {
+		// Let the task be sent again with the key
+		if err := server.idempotencyStore.Release(signature.IdempotencyKey, signature.UUID); err != nil {
+			log.ERROR.Printf("Failed to release idempotency key %s: %s", signature.IdempotencyKey, err)
+		}
+	}
+	return asyncResult, err
+}
+
+// sendTask publishes the task without checking its idempotency key, it is
+// used to send the same task again, e.g. for a retry attempt
+func (server *Server) sendTask(ctx context.Context, signature *tasks.Signature) (*backends.AsyncResult, error) {
 	// Make sure result backend is defined
 	if server.backend == nil {
 		return nil, errors.New("Result backend required")
@@ -139,23 +246,39 @@ func (server *Server) SendTask(signature *tasks.Signature) (*backends.AsyncResul
 		signature.UUID = fmt.Sprintf("task_%v", uuid.NewV4())
 	}
 
-	for idx, arg := range signature.Args {
-		if _, ok := tasks.TypesMap[arg.Type]; !ok {
-			return nil, tasks.NewErrUnsupportedType(arg.Type)
-		}
-		bytes, err := json.Marshal(arg.Value)
-		if err != nil {
-			return nil, err
-		}
-		signature.Args[idx].ValueBytes = bytes
+	// Retried tasks keep the time and retry count they were first sent with
+	if signature.CreatedAt == nil {
+		now := time.Now().UTC()
+		signature.CreatedAt = &now
+		signature.InitialRetryCount = signature.RetryCount
+	}
+	publishedAt := time.Now().UTC()
+	signature.PublishedAt = &publishedAt
+
+	if err := server.beforePublish(ctx, signature); err != nil {
+		return nil, err
+	}
+
+	if err := server.prepareSignature(signature); err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	// Set initial task state to PENDING
-	if err := server.backend.SetStatePending(signature); err != nil {
+	if err := withContext(ctx, func() error { return server.backend.SetStatePending(signature) }); err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("Set state pending error: %s", err)
 	}
 
-	if err := server.broker.Publish(signature); err != nil {
+	if err := server.broker.PublishWithContext(ctx, signature); err != nil {
+		if ctx.Err() != nil {
+			return nil, err
+		}
 		return nil, fmt.Errorf("Publish message error: %s", err)
 	}
 	log.INFO.Printf("Publish Message: %s", log.Truncate(log.ToString(signature)))
@@ -163,9 +286,47 @@ func (server *Server) SendTask(signature *tasks.Signature) (*backends.AsyncResul
 	return backends.NewAsyncResult(signature, server.backend), nil
 }
 
+// prepareSignature makes sure the task can be processed by a worker before it
+// is published and encodes its arguments
+func (server *Server) prepareSignature(signature *tasks.Signature) error {
+	// Make sure the retry policy is valid before it reaches a worker
+	if signature.RetryPolicy != nil {
+		if _, err := signature.RetryPolicy.Policy(); err != nil {
+			return err
+		}
+	}
+
+	if signature.Unique != nil {
+		if server.uniqueLocker == nil {
+			return errUniqueNotSupported
+		}
+		if err := signature.Unique.Validate(signature); err != nil {
+			return err
+		}
+	}
+
+	for idx, arg := range signature.Args {
+		if _, err := tasks.ReflectType(arg.Type); err != nil {
+			return err
+		}
+		bytes, err := json.Marshal(arg.Value)
+		if err != nil {
+			return err
+		}
+		signature.Args[idx].ValueBytes = bytes
+	}
+	return nil
+}
+
 // SendChain triggers a chain of tasks
 func (server *Server) SendChain(chain *tasks.Chain) (*backends.ChainAsyncResult, error) {
-	_, err := server.SendTask(chain.Tasks[0])
+	return server.SendChainWithContext(context.Background(), chain)
+}
+
+// SendChainWithContext triggers a chain of tasks, it gives up once the
+// context is done
+func (server *Server) SendChainWithContext(ctx context.Context, chain *tasks.Chain) (*backends.ChainAsyncResult, error) {
+	_, err := server.SendTaskWithContext(ctx, chain.Tasks[0])
 	if err != nil {
 		return nil, err
 	}
@@ -175,23 +336,67 @@ func (server *Server) SendChain(chain *tasks.Chain) (*backends.ChainAsyncResult,
 
 // SendGroup triggers a group of parallel tasks
 func (server *Server) SendGroup(group *tasks.Group, sendConcurrency int) ([]*backends.AsyncResult, error) {
+	return server.SendGroupWithContext(context.Background(), group, sendConcurrency)
+}
+
+// SendGroupWithContext triggers a group of parallel tasks, it gives up once
+// the context is done. Tasks published by then are not withdrawn.
+func (server *Server) SendGroupWithContext(ctx context.Context, group *tasks.Group, sendConcurrency int) ([]*backends.AsyncResult, error) {
 	// Make sure result backend is defined
 	if server.backend == nil {
 		return nil, errors.New("Result backend required")
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Every task is checked before any of them is published, so an invalid
+	// task does not leave the group sent in part
+	now := time.Now().UTC()
+	for _, signature := range group.Tasks {
+		if signature.CreatedAt == nil {
+			signature.CreatedAt = &now
+			signature.InitialRetryCount = signature.RetryCount
+		}
+		signature.PublishedAt = &now
+
+		if err := server.beforePublish(ctx, signature); err != nil {
+			return nil, err
+		}
+		if err := server.prepareSignature(signature); err != nil {
+			return nil, err
+		}
+	}
+
+	// Tasks sent with an idempotency key already are not sent again, the
+	// group is rejected as a whole instead
+	releaseKeys, err := server.claimIdempotencyKeys(group.Tasks)
+	if err != nil {
+		return nil, err
+	}
+
 	asyncResults := make([]*backends.AsyncResult, len(group.Tasks))
 
 	var wg sync.WaitGroup
-	wg.Add(len(group.Tasks))
 	errorsChan := make(chan error, len(group.Tasks)*2)
 
 	// Init group
-	server.backend.InitGroup(group.GroupUUID, group.GetUUIDs())
+	if err := withContext(ctx, func() error { return server.backend.InitGroup(group.GroupUUID, group.GetUUIDs()) }); err != nil {
+		releaseKeys(group.Tasks...)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("Init group error: %s", err)
+	}
 
 	// Init the tasks Pending state first
 	for _, signature := range group.Tasks {
-		if err := server.backend.SetStatePending(signature); err != nil {
+		if err := withContext(ctx, func() error { return server.backend.SetStatePending(signature) }); err != nil {
+			if ctx.Err() != nil {
+				releaseKeys(group.Tasks...)
+				return nil, err
+			}
 			errorsChan <- err
 			continue
 		}
@@ -207,21 +412,35 @@ func (server *Server) SendGroup(group *tasks.Group, sendConcurrency int) ([]*bac
 	for i, signature := range group.Tasks {
 
 		if sendConcurrency > 0 {
-			<-pool
+			select {
+			case <-pool:
+			case <-ctx.Done():
+				// Tasks being published release their own keys if they fail
+				releaseKeys(group.Tasks[i:]...)
+				return asyncResults, ctx.Err()
+			}
 		}
 
+		wg.Add(1)
 		go func(s *tasks.Signature, index int) {
 			defer wg.Done()
 
 			// Publish task
 
-			err := server.broker.Publish(s)
+			err := server.broker.PublishWithContext(ctx, s)
 
 			if sendConcurrency > 0 {
 				pool <- struct{}{}
 			}
 
 			if err != nil {
+				// Let the task be sent again with its key, keys of the
+				// published tasks are kept
+				releaseKeys(s)
+				if ctx.Err() != nil {
+					errorsChan <- err
+					return
+				}
 				errorsChan <- fmt.Errorf("Publish message error: %s", err)
 				return
 			}
@@ -230,10 +449,11 @@ func (server *Server) SendGroup(group *tasks.Group, sendConcurrency int) ([]*bac
 		}(signature, i)
 	}
 
-	done := make(chan int)
+	// Closed rather than sent to, nobody receives once an error is returned
+	done := make(chan struct{})
 	go func() {
 		wg.Wait()
-		done <- 1
+		close(done)
 	}()
 
 	select {
@@ -246,7 +466,13 @@ func (server *Server) SendGroup(group *tasks.Group, sendConcurrency int) ([]*bac
 
 // SendChord triggers a group of parallel tasks with a callback
 func (server *Server) SendChord(chord *tasks.Chord, sendConcurrency int) (*backends.ChordAsyncResult, error) {
-	_, err := server.SendGroup(chord.Group, sendConcurrency)
+	return server.SendChordWithContext(context.Background(), chord, sendConcurrency)
+}
+
+// SendChordWithContext triggers a group of parallel tasks with a callback,
+// it gives up once the context is done
+func (server *Server) SendChordWithContext(ctx context.Context, chord *tasks.Chord, sendConcurrency int) (*backends.ChordAsyncResult, error) {
+	_, err := server.SendGroupWithContext(ctx, chord.Group, sendConcurrency)
 	if err != nil {
 		return nil, err
 	}
@@ -269,6 +495,99 @@ func (server *Server) GetRegisteredTaskNames() []string {
 	return taskNames
 }
 
+// RevokeTask revokes a task. Workers skip the task if it is still waiting
+// in a queue and cancel context of the task if it is already running.
+// Tasks which have completed already are left intact.
+func (server *Server) RevokeTask(uuid string) error {
+	// Make sure result backend is defined
+	if server.backend == nil {
+		return errors.New("Result backend required")
+	}
+
+	// Reading state of a task consumes it when using AMQP backend
+	if !backends.IsAMQP(server.backend) {
+		taskState, err := server.backend.GetState(uuid)
+		if err == nil && taskState.IsCompleted() {
+			return nil
+		}
+	}
+
+	if err := server.backend.SetStateRevoked(&tasks.Signature{UUID: uuid}); err != nil {
+		return fmt.Errorf("Set state revoked error: %s", err)
+	}
+
+	// Delayed tasks can be removed right away if the broker supports it,
+	// otherwise they are skipped once they are due
+	if err := server.broker.CancelDelayTask(uuid); err != nil {
+		return fmt.Errorf("Cancel delay task error: %s", err)
+	}
+
+	log.INFO.Printf("Revoked task %s", uuid)
+
+	return nil
+}
+
+// GetDeadLetters returns dead letters of the queue, oldest first. Indexes are
+// inclusive and may be negative to count from the last dead letter.
+// The default queue is used if queue is empty.
+func (server *Server) GetDeadLetters(queue string, indexStart, indexEnd int) ([]*tasks.DeadLetter, error) {
+	return server.broker.GetDeadLetters(queue, indexStart, indexEnd)
+}
+
+// GetDeadLetter returns a dead letter of the queue by task UUID, nil if
+// there is none
+func (server *Server) GetDeadLetter(queue, uuid string) (*tasks.DeadLetter, error) {
+	return server.broker.GetDeadLetter(queue, uuid)
+}
+
+// RequeueDeadLetter sends the failed task again with the same UUID and its
+// original retry attempts, and removes it from dead letters of the queue
+func (server *Server) RequeueDeadLetter(queue, uuid string) (*backends.AsyncResult, error) {
+	deadLetter, err := server.broker.GetDeadLetter(queue, uuid)
+	if err != nil {
+		return nil, fmt.Errorf("Get dead letter error: %s", err)
+	}
+	if deadLetter == nil {
+		return nil, fmt.Errorf("Dead letter %s not found", uuid)
+	}
+
+	// Removed first, the task may fail again and become a new dead letter
+	if err := server.broker.DeleteDeadLetter(queue, uuid); err != nil {
+		return nil, fmt.Errorf("Delete dead letter error: %s", err)
+	}
+
+	// The task gets its original retry attempts again
+	signature := deadLetter.Signature
+	signature.ETA = nil
+	signature.RetryCount = signature.InitialRetryCount
+	signature.RetryAttempt = 0
+	signature.RetryLaterAttempt = 0
+	signature.RetryTimeout = 0
+
+	asyncResult, err := server.sendTask(context.Background(), signature)
+	if err != nil {
+		// Keep the dead letter so requeueing can be tried again
+		if err := server.broker.PublishDeadLetter(deadLetter); err != nil {
+			log.ERROR.Printf("Failed to publish dead letter %s: %s", uuid, err)
+		}
+		return nil, err
+	}
+
+	log.INFO.Printf("Requeued dead letter %s", uuid)
+
+	return asyncResult, nil
+}
+
+// CountDeadLetters returns the number of dead letters of the queue
+func (server *Server) CountDeadLetters(queue string) (int, error) {
+	return server.broker.CountDeadLetters(queue)
+}
+
+// PurgeDeadLetters removes all dead letters of the queue
+func (server *Server) PurgeDeadLetters(queue string) error {
+	return server.broker.PurgeDeadLetters(queue)
+}
+
 //CancelDelayTask _
 func (server *Server) CancelDelayTask(uuid string) error {
 	return server.broker.CancelDelayTask(uuid)
@@ -278,3 +597,24 @@ func (server *Server) CancelDelayTask(uuid string) error {
 func (server *Server) GetDelayTask(uuid string) (*tasks.Signature, error) {
 	return server.broker.GetDelayTask(uuid)
 }
+
+// withContext returns once the call returns or the context is done, so a
+// backend call which does not take a context cannot outlive its deadline. The
+// call keeps running in the background in the latter case.
+func withContext(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- call()
+	}()
+
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,38 @@
+package machinery
+
+import (
+	"github.com/Guazi-inc/machinery/v1/backends"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/garyburd/redigo/redis"
+)
+
+// redisPool lets state shared by all workers and publishers, e.g. rate limits
+// or locks of unique tasks, be kept in the Redis server of the broker or the
+// result backend
+type redisPool struct {
+	getConn func() redis.Conn
+}
+
+func (pool redisPool) Get() redis.Conn {
+	return pool.getConn()
+}
+
+// sharedRedisPool returns a pool of connections to the Redis server of the
+// broker, or else of the result backend. It returns false if neither of them
+// is Redis.
+func sharedRedisPool(broker brokers.Interface, backend backends.Interface) (redisPool, bool) {
+	if redisBroker, ok := broker.(*brokers.RedisBroker); ok {
+		return redisPool{redisBroker.GetConn}, true
+	}
+	if redisBackend, ok := backend.(*backends.RedisBackend); ok {
+		return redisPool{redisBackend.GetConn}, true
+	}
+	return redisPool{}, false
+}
+
+// isEagerBroker returns true for the eager broker, it processes all tasks in
+// the process sending them so state kept in memory is shared by all of them
+func isEagerBroker(broker brokers.Interface) bool {
+	_, ok := broker.(brokers.EagerMode)
+	return ok
+}
@@ -0,0 +1,69 @@
+package machinery
+
+import (
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/ratelimit"
+	"github.com/Guazi-inc/machinery/v1/retry"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+)
+
+// DefaultMaxRetryLater is the number of times a task returning
+// tasks.ErrRetryTaskLater is retried before it fails, unless
+// TaskOptions.MaxRetryLater is set
+const DefaultMaxRetryLater = 100
+
+// TaskOptions holds settings workers apply to every invocation of a
+// registered task
+type TaskOptions struct {
+	// Timeout limits execution time of the task, it is used when the
+	// signature does not set its own timeout. Zero means no timeout.
+	Timeout time.Duration
+	// RetryPolicy spaces out retry attempts of the task, it is used when the
+	// signature does not set its own retry policy. Fibonacci sequence of
+	// seconds is used if neither is set.
+	RetryPolicy retry.Policy
+	// RateLimit limits how often the task is started across all workers
+	// sharing the Redis broker or result backend, tasks over the limit are
+	// delayed until they are allowed to run
+	RateLimit ratelimit.Limit
+	// Concurrency limits how many instances of the task a worker runs at
+	// once, so a slow task cannot take up the whole worker. Zero means no
+	// limit other than concurrency of the worker.
+	Concurrency int
+	// GlobalConcurrency limits how many instances of the task run at once
+	// across all workers sharing the Redis broker or result backend. Zero
+	// means no limit.
+	GlobalConcurrency int
+	// MaxRetryLater limits how many times the task is retried after
+	// returning tasks.ErrRetryTaskLater, the task fails when it asks to be
+	// retried once more. DefaultMaxRetryLater is used if zero.
+	MaxRetryLater int
+}
+
+// timeout returns execution timeout of the signature, falling back to the
+// default timeout of the registered task
+func (options TaskOptions) timeout(signature *tasks.Signature) time.Duration {
+	if signature.Timeout > 0 {
+		return time.Duration(signature.Timeout) * time.Second
+	}
+	return options.Timeout
+}
+
+// retryPolicy returns retry policy of the signature, falling back to the
+// default retry policy of the registered task. Nil is returned if neither
+// is set.
+func (options TaskOptions) retryPolicy(signature *tasks.Signature) (retry.Policy, error) {
+	if signature.RetryPolicy != nil {
+		return signature.RetryPolicy.Policy()
+	}
+	return options.RetryPolicy, nil
+}
+
+// maxRetryLater returns how many times a task may be retried later
+func (options TaskOptions) maxRetryLater() int {
+	if options.MaxRetryLater > 0 {
+		return options.MaxRetryLater
+	}
+	return DefaultMaxRetryLater
+}
@@ -0,0 +1,157 @@
+package tasks
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// signatureCtxKey is the context key of the signature of a running task
+type signatureCtxKey struct{}
+
+// WithSignature returns a copy of the context carrying a deep copy of the
+// signature, the worker passes it to tasks accepting a context
+func WithSignature(ctx context.Context, signature *Signature) context.Context {
+	return context.WithValue(ctx, signatureCtxKey{}, copySignature(signature))
+}
+
+// SignatureFromContext returns the signature of the running task, nil if
+// the context does not carry any. It is a deep copy of the signature the
+// worker has received, so modifying it does not change what the worker
+// retries or publishes.
+func SignatureFromContext(ctx context.Context) *Signature {
+	signature, _ := ctx.Value(signatureCtxKey{}).(*Signature)
+	return signature
+}
+
+// TaskUUIDFromContext returns UUID of the running task, empty if the
+// context does not carry a signature
+func TaskUUIDFromContext(ctx context.Context) string {
+	if signature := SignatureFromContext(ctx); signature != nil {
+		return signature.UUID
+	}
+	return ""
+}
+
+// copySignature returns a deep copy of the signature including its args,
+// headers and callbacks
+func copySignature(signature *Signature) *Signature {
+	if signature == nil {
+		return nil
+	}
+
+	signatureCopy := *signature
+	signatureCopy.ETA = copyTime(signature.ETA)
+	signatureCopy.CreatedAt = copyTime(signature.CreatedAt)
+	signatureCopy.PublishedAt = copyTime(signature.PublishedAt)
+
+	if signature.Args != nil {
+		signatureCopy.Args = make([]Arg, len(signature.Args))
+		for i, arg := range signature.Args {
+			signatureCopy.Args[i] = Arg{
+				Type:       arg.Type,
+				Value:      copyValue(arg.Value),
+				ValueBytes: append([]byte(nil), arg.ValueBytes...),
+			}
+		}
+	}
+	if signature.Headers != nil {
+		signatureCopy.Headers = make(Headers, len(signature.Headers))
+		for key, value := range signature.Headers {
+			signatureCopy.Headers[key] = copyValue(value)
+		}
+	}
+	if signature.RetryPolicy != nil {
+		retryPolicy := *signature.RetryPolicy
+		signatureCopy.RetryPolicy = &retryPolicy
+	}
+	if signature.Unique != nil {
+		unique := *signature.Unique
+		unique.Args = append([]int(nil), signature.Unique.Args...)
+		signatureCopy.Unique = &unique
+	}
+
+	signatureCopy.OnSuccess = copySignatures(signature.OnSuccess)
+	signatureCopy.OnError = copySignatures(signature.OnError)
+	signatureCopy.ChordCallback = copySignature(signature.ChordCallback)
+
+	return &signatureCopy
+}
+
+func copySignatures(signatures []*Signature) []*Signature {
+	if signatures == nil {
+		return nil
+	}
+	signaturesCopy := make([]*Signature, len(signatures))
+	for i, signature := range signatures {
+		signaturesCopy[i] = copySignature(signature)
+	}
+	return signaturesCopy
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	tCopy := *t
+	return &tCopy
+}
+
+// copyValue returns a deep copy of an arg or header value, values of slices,
+// maps, pointers and exported struct fields are copied as well
+func copyValue(value interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	return copyReflectValue(reflect.ValueOf(value)).Interface()
+}
+
+func copyReflectValue(value reflect.Value) reflect.Value {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			return value
+		}
+		valueCopy := reflect.New(value.Elem().Type())
+		valueCopy.Elem().Set(copyReflectValue(value.Elem()))
+		return valueCopy
+	case reflect.Interface:
+		if value.IsNil() {
+			return value
+		}
+		valueCopy := reflect.New(value.Type()).Elem()
+		valueCopy.Set(copyReflectValue(value.Elem()))
+		return valueCopy
+	case reflect.Slice:
+		if value.IsNil() {
+			return value
+		}
+		valueCopy := reflect.MakeSlice(value.Type(), value.Len(), value.Len())
+		for i := 0; i < value.Len(); i++ {
+			valueCopy.Index(i).Set(copyReflectValue(value.Index(i)))
+		}
+		return valueCopy
+	case reflect.Map:
+		if value.IsNil() {
+			return value
+		}
+		valueCopy := reflect.MakeMapWithSize(value.Type(), value.Len())
+		for _, key := range value.MapKeys() {
+			valueCopy.SetMapIndex(key, copyReflectValue(value.MapIndex(key)))
+		}
+		return valueCopy
+	case reflect.Struct:
+		// Unexported fields are copied as they are, e.g. location of
+		// time.Time
+		valueCopy := reflect.New(value.Type()).Elem()
+		valueCopy.Set(value)
+		for i := 0; i < value.NumField(); i++ {
+			if field := valueCopy.Field(i); field.CanSet() {
+				field.Set(copyReflectValue(value.Field(i)))
+			}
+		}
+		return valueCopy
+	default:
+		return value
+	}
+}
@@ -0,0 +1,48 @@
+package tasks_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignatureFromContext(t *testing.T) {
+	assert.Nil(t, tasks.SignatureFromContext(context.Background()))
+	assert.Equal(t, "", tasks.TaskUUIDFromContext(context.Background()))
+
+	eta := time.Now().UTC()
+	signature := &tasks.Signature{
+		UUID:       "testTaskUUID",
+		Name:       "add",
+		RetryCount: 2,
+		ETA:        &eta,
+		Args:       []tasks.Arg{{Type: "[]int64", Value: []int64{1, 2}}},
+		Headers:    tasks.Headers{"trace": map[string]interface{}{"id": "1"}},
+		OnSuccess:  []*tasks.Signature{{Name: "log", Headers: tasks.Headers{"level": "info"}}},
+	}
+	ctx := tasks.WithSignature(context.Background(), signature)
+
+	fromContext := tasks.SignatureFromContext(ctx)
+	if !assert.NotNil(t, fromContext) {
+		return
+	}
+	assert.Equal(t, *signature, *fromContext)
+	assert.Equal(t, "testTaskUUID", tasks.TaskUUIDFromContext(ctx))
+
+	// The worker's signature is not affected by the task
+	fromContext.RetryCount = 0
+	*fromContext.ETA = eta.Add(time.Hour)
+	fromContext.Args[0].Value.([]int64)[0] = 5
+	fromContext.Headers["trace"].(map[string]interface{})["id"] = "2"
+	fromContext.Headers["new"] = true
+	fromContext.OnSuccess[0].Headers["level"] = "debug"
+
+	assert.Equal(t, 2, signature.RetryCount)
+	assert.Equal(t, eta, *signature.ETA)
+	assert.Equal(t, []int64{1, 2}, signature.Args[0].Value)
+	assert.Equal(t, tasks.Headers{"trace": map[string]interface{}{"id": "1"}}, signature.Headers)
+	assert.Equal(t, "info", signature.OnSuccess[0].Headers["level"])
+}
@@ -0,0 +1,29 @@
+package tasks
+
+import (
+	"time"
+)
+
+// DeadLetter keeps a task which failed after exhausting its retry attempts,
+// so it can be inspected and requeued later
+type DeadLetter struct {
+	Signature *Signature
+	// Error returned by the last attempt
+	Error string
+	// Number of times the task has been attempted
+	Attempts int
+	// When the task was first sent, nil if unknown
+	CreatedAt *time.Time
+	FailedAt  time.Time
+}
+
+// NewDeadLetter creates DeadLetter instance for the failed task
+func NewDeadLetter(signature *Signature, err string) *DeadLetter {
+	return &DeadLetter{
+		Signature: signature,
+		Error:     err,
+		Attempts:  signature.RetryAttempt + signature.RetryLaterAttempt + 1,
+		CreatedAt: signature.CreatedAt,
+		FailedAt:  time.Now().UTC(),
+	}
+}
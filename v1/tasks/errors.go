@@ -0,0 +1,85 @@
+package tasks
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrRetryTaskLater is returned by a task to have it retried after a given
+// delay. The task is retried even if it has no retry attempts left, the retry
+// counts as an attempt though and a task which keeps asking to be retried
+// eventually fails, see TaskOptions.MaxRetryLater of machinery.Server.
+// Retries later are counted apart from ordinary retries in
+// Signature.RetryLaterAttempt.
+type ErrRetryTaskLater struct {
+	msg     string
+	retryIn time.Duration
+}
+
+// NewErrRetryTaskLater returns new ErrRetryTaskLater instance
+func NewErrRetryTaskLater(msg string, retryIn time.Duration) ErrRetryTaskLater {
+	return ErrRetryTaskLater{msg: msg, retryIn: retryIn}
+}
+
+// RetryIn returns how long to wait before retrying the task
+func (e ErrRetryTaskLater) RetryIn() time.Duration {
+	return e.retryIn
+}
+
+// Error implements the error interface
+func (e ErrRetryTaskLater) Error() string {
+	return fmt.Sprintf("Task error: %s Will retry in: %s", e.msg, e.retryIn)
+}
+
+// ErrNonRetryable is returned by a task to report a permanent failure, the
+// task fails right away even if it has retry attempts left
+type ErrNonRetryable struct {
+	err error
+}
+
+// NewErrNonRetryable wraps err in ErrNonRetryable
+func NewErrNonRetryable(err error) ErrNonRetryable {
+	return ErrNonRetryable{err: err}
+}
+
+// Err returns the wrapped error
+func (e ErrNonRetryable) Err() error {
+	return e.err
+}
+
+// Error implements the error interface
+func (e ErrNonRetryable) Error() string {
+	if e.err == nil {
+		return "Non-retryable task error"
+	}
+	return e.err.Error()
+}
+
+// AsRetryTaskLater finds ErrRetryTaskLater in the chain of err, returned
+// either as a value or as a pointer
+func AsRetryTaskLater(err error) (ErrRetryTaskLater, bool) {
+	var retryLater ErrRetryTaskLater
+	if errors.As(err, &retryLater) {
+		return retryLater, true
+	}
+	var retryLaterPtr *ErrRetryTaskLater
+	if errors.As(err, &retryLaterPtr) && retryLaterPtr != nil {
+		return *retryLaterPtr, true
+	}
+	return ErrRetryTaskLater{}, false
+}
+
+// AsNonRetryable finds ErrNonRetryable in the chain of err, returned either
+// as a value or as a pointer
+func AsNonRetryable(err error) (ErrNonRetryable, bool) {
+	var nonRetryable ErrNonRetryable
+	if errors.As(err, &nonRetryable) {
+		return nonRetryable, true
+	}
+	var nonRetryablePtr *ErrNonRetryable
+	if errors.As(err, &nonRetryablePtr) && nonRetryablePtr != nil {
+		return *nonRetryablePtr, true
+	}
+	return ErrNonRetryable{}, false
+}
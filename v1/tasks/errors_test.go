@@ -0,0 +1,63 @@
+package tasks_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrRetryTaskLater(t *testing.T) {
+	err := tasks.NewErrRetryTaskLater("rate limited", 30*time.Second)
+	assert.Equal(t, 30*time.Second, err.RetryIn())
+	assert.Equal(t, "Task error: rate limited Will retry in: 30s", err.Error())
+}
+
+func TestErrNonRetryable(t *testing.T) {
+	cause := errors.New("invalid input")
+	err := tasks.NewErrNonRetryable(cause)
+	assert.Equal(t, cause, err.Err())
+	assert.Equal(t, "invalid input", err.Error())
+}
+
+func TestAsRetryTaskLater(t *testing.T) {
+	retryLater := tasks.NewErrRetryTaskLater("rate limited", time.Second)
+	var retryLaterPtr error = &retryLater
+
+	for _, err := range []error{
+		retryLater,
+		retryLaterPtr,
+		fmt.Errorf("wrapped: %w", retryLater),
+		fmt.Errorf("wrapped: %w", retryLaterPtr),
+	} {
+		found, ok := tasks.AsRetryTaskLater(err)
+		assert.True(t, ok, err.Error())
+		assert.Equal(t, time.Second, found.RetryIn())
+	}
+
+	_, ok := tasks.AsRetryTaskLater(errors.New("other"))
+	assert.False(t, ok)
+}
+
+func TestAsNonRetryable(t *testing.T) {
+	cause := errors.New("invalid input")
+	nonRetryable := tasks.NewErrNonRetryable(cause)
+	var nonRetryablePtr error = &nonRetryable
+
+	for _, err := range []error{
+		nonRetryable,
+		nonRetryablePtr,
+		fmt.Errorf("wrapped: %w", nonRetryable),
+		fmt.Errorf("wrapped: %w", nonRetryablePtr),
+	} {
+		found, ok := tasks.AsNonRetryable(err)
+		assert.True(t, ok, err.Error())
+		assert.Equal(t, cause, found.Err())
+	}
+
+	_, ok := tasks.AsNonRetryable(cause)
+	assert.False(t, ok)
+}
@@ -0,0 +1,49 @@
+package tasks
+
+import (
+	"context"
+	"fmt"
+)
+
+// Progress is reported by a running task, it is kept with the PROGRESS
+// state of the task until the task completes
+type Progress struct {
+	// Percent is between 0 and 100
+	Percent  float64                `json:"percent" bson:"percent"`
+	Metadata map[string]interface{} `json:"metadata,omitempty" bson:"metadata,omitempty"`
+}
+
+// ProgressReporter stores progress of the running task
+type ProgressReporter func(progress *Progress) error
+
+// progressReporterCtxKey is the context key of the progress reporter of
+// a running task
+type progressReporterCtxKey struct{}
+
+// WithProgressReporter returns a copy of the context carrying the progress
+// reporter, the worker passes it to tasks accepting a context
+func WithProgressReporter(ctx context.Context, reporter ProgressReporter) context.Context {
+	return context.WithValue(ctx, progressReporterCtxKey{}, reporter)
+}
+
+// ReportProgress sets the task state to PROGRESS with the percent done and
+// optional metadata. It does nothing if the context does not come from
+// a worker, e.g. when the task is called directly in a test.
+func ReportProgress(ctx context.Context, percent float64, metadata map[string]interface{}) error {
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("Progress percent must be between 0 and 100, got %v", percent)
+	}
+
+	reporter, ok := ctx.Value(progressReporterCtxKey{}).(ProgressReporter)
+	if !ok {
+		return nil
+	}
+
+	// Progress reported late must not overwrite the state of a task which
+	// has timed out or has been revoked
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return reporter(&Progress{Percent: percent, Metadata: metadata})
+}
@@ -0,0 +1,34 @@
+package tasks_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportProgress(t *testing.T) {
+	// Nothing to report to outside of a worker
+	assert.NoError(t, tasks.ReportProgress(context.Background(), 50, nil))
+
+	var reported []*tasks.Progress
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = tasks.WithProgressReporter(ctx, func(progress *tasks.Progress) error {
+		reported = append(reported, progress)
+		return nil
+	})
+
+	assert.NoError(t, tasks.ReportProgress(ctx, 50, map[string]interface{}{"stage": "upload"}))
+	assert.Error(t, tasks.ReportProgress(ctx, 101, nil))
+	assert.Error(t, tasks.ReportProgress(ctx, -1, nil))
+
+	// Task context is done, e.g. the task has timed out
+	cancel()
+	assert.Equal(t, context.Canceled, tasks.ReportProgress(ctx, 100, nil))
+
+	if assert.Len(t, reported, 1) {
+		assert.Equal(t, float64(50), reported[0].Percent)
+		assert.Equal(t, "upload", reported[0].Metadata["stage"])
+	}
+}
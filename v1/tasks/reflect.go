@@ -3,9 +3,17 @@ package tasks
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	slicePrefix     = "[]"
+	stringMapPrefix = "map[string]"
 )
 
 var (
@@ -26,7 +34,18 @@ var (
 		"string":  reflect.TypeOf(string("")),
 	}
 
-	ctxType = reflect.TypeOf((*context.Context)(nil)).Elem()
+	ctxType   = reflect.TypeOf((*context.Context)(nil)).Elem()
+	bytesType = reflect.TypeOf([]byte(nil))
+
+	// Types registered by name, values of these types are converted
+	// through their JSON representation
+	registeredTypes = map[string]reflect.Type{
+		"time.Time": reflect.TypeOf(time.Time{}),
+	}
+	registeredTypeNames = map[reflect.Type]string{
+		reflect.TypeOf(time.Time{}): "time.Time",
+	}
+	registeredTypesMu sync.RWMutex
 
 	typeConversionError = func(argValue interface{}, argTypeStr string) error {
 		return fmt.Errorf("%v is not %v", argValue, argTypeStr)
@@ -48,11 +67,107 @@ func (e ErrUnsupportedType) Error() string {
 	return fmt.Sprintf("%v is not one of supported types", e.valueType)
 }
 
+// RegisterType makes values of a JSON serialisable type (e.g. a struct)
+// usable as task arguments and results. Args refer to the type by name,
+// slices and maps of the type are supported as well. The value may also be a
+// pointer to the type, e.g. (*T)(nil).
+func RegisterType(name string, value interface{}) error {
+	if name == "" || value == nil {
+		return errors.New("Type name and value are required")
+	}
+	if _, ok := TypesMap[name]; ok {
+		return fmt.Errorf("%v is a built-in type", name)
+	}
+
+	// A pointer, even a nil one, registers the type it points to
+	theType := reflect.TypeOf(value)
+	if theType.Kind() == reflect.Ptr {
+		theType = theType.Elem()
+	}
+
+	registeredTypesMu.Lock()
+	defer registeredTypesMu.Unlock()
+
+	if registeredType, ok := registeredTypes[name]; ok && registeredType != theType {
+		return fmt.Errorf("%v is already registered as %v", name, registeredType)
+	}
+	registeredTypes[name] = theType
+	registeredTypeNames[theType] = name
+	return nil
+}
+
+// ReflectType returns reflect.Type for string type. Besides the scalar types
+// in TypesMap, []byte, time.Time, registered types and []T and map[string]T
+// of any of them are supported.
+func ReflectType(valueType string) (reflect.Type, error) {
+	if theType, ok := TypesMap[valueType]; ok {
+		return theType, nil
+	}
+
+	if valueType == "[]byte" {
+		return bytesType, nil
+	}
+
+	if strings.HasPrefix(valueType, slicePrefix) {
+		elemType, err := ReflectType(strings.TrimPrefix(valueType, slicePrefix))
+		if err != nil {
+			return nil, NewErrUnsupportedType(valueType)
+		}
+		return reflect.SliceOf(elemType), nil
+	}
+
+	if strings.HasPrefix(valueType, stringMapPrefix) {
+		elemType, err := ReflectType(strings.TrimPrefix(valueType, stringMapPrefix))
+		if err != nil {
+			return nil, NewErrUnsupportedType(valueType)
+		}
+		return reflect.MapOf(TypesMap["string"], elemType), nil
+	}
+
+	registeredTypesMu.RLock()
+	defer registeredTypesMu.RUnlock()
+
+	if theType, ok := registeredTypes[valueType]; ok {
+		return theType, nil
+	}
+
+	return nil, NewErrUnsupportedType(valueType)
+}
+
+// TypeName returns string type for reflect.Type, it is the inverse of
+// ReflectType so registered types are named as they were registered
+func TypeName(theType reflect.Type) string {
+	registeredTypesMu.RLock()
+	name, ok := registeredTypeNames[theType]
+	registeredTypesMu.RUnlock()
+	if ok {
+		return name
+	}
+
+	switch {
+	case theType == bytesType:
+		return "[]byte"
+	case theType.Name() != "":
+		return theType.String()
+	case theType.Kind() == reflect.Slice:
+		return slicePrefix + TypeName(theType.Elem())
+	case theType.Kind() == reflect.Map && theType.Key() == TypesMap["string"]:
+		return stringMapPrefix + TypeName(theType.Elem())
+	}
+
+	return theType.String()
+}
+
 // ReflectValue converts interface{} to reflect.Value based on string type
 func ReflectValue(valueType string, value interface{}) (reflect.Value, error) {
 	theType, ok := TypesMap[valueType]
 	if !ok {
-		return reflect.Value{}, NewErrUnsupportedType(valueType)
+		// Slices, maps and registered types are converted through JSON
+		theType, err := ReflectType(valueType)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflectJSONValue(theType, value)
 	}
 	theValue := reflect.New(theType)
 
@@ -116,9 +231,9 @@ func ReflectValue(valueType string, value interface{}) (reflect.Value, error) {
 
 // ReflectValueBytes unmarshal bytes to reflect.Value based on string type
 func ReflectValueBytes(valueType string, valueBytes []byte) (reflect.Value, error) {
-	theType, ok := TypesMap[valueType]
-	if !ok {
-		return reflect.Value{}, NewErrUnsupportedType(valueType)
+	theType, err := ReflectType(valueType)
+	if err != nil {
+		return reflect.Value{}, err
 	}
 	theValue := reflect.New(theType)
 
@@ -128,6 +243,25 @@ func ReflectValueBytes(valueType string, valueBytes []byte) (reflect.Value, erro
 	return theValue.Elem(), nil
 }
 
+// reflectJSONValue converts value to theType by encoding it to JSON and back,
+// values decoded from JSON come as []interface{}, map[string]interface{} etc.
+func reflectJSONValue(theType reflect.Type, value interface{}) (reflect.Value, error) {
+	if value != nil && reflect.TypeOf(value) == theType {
+		return reflect.ValueOf(value), nil
+	}
+
+	valueBytes, err := json.Marshal(value)
+	if err != nil {
+		return reflect.Value{}, typeConversionError(value, theType.String())
+	}
+
+	theValue := reflect.New(theType)
+	if err := json.Unmarshal(valueBytes, theValue.Interface()); err != nil {
+		return reflect.Value{}, typeConversionError(value, theType.String())
+	}
+	return theValue.Elem(), nil
+}
+
 func getIntValue(theType string, value interface{}) (int64, error) {
 	if strings.HasPrefix(fmt.Sprintf("%T", value), "float") {
 		// Any numbers from unmarshalled JSON will be float64 by default
@@ -1,11 +1,20 @@
 package tasks_test
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
 )
 
+type testOrder struct {
+	ID    int64    `json:"id"`
+	Items []string `json:"items"`
+}
+
 func TestReflectValue(t *testing.T) {
 	value, err := tasks.ReflectValue("bool", interface{}(false))
 	if err != nil {
@@ -119,3 +128,95 @@ func TestReflectValue(t *testing.T) {
 		t.Errorf("type is %v, want string", value.Type().String())
 	}
 }
+
+func TestReflectValueComposite(t *testing.T) {
+	assert.NoError(t, tasks.RegisterType("testOrder", testOrder{}))
+
+	// Values decoded from JSON, e.g. task results read from a backend
+	var decoded interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`[1, 2, 3]`), &decoded))
+	value, err := tasks.ReflectValue("[]int64", decoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []int64{1, 2, 3}, value.Interface())
+	}
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"a": ["x"], "b": []}`), &decoded))
+	value, err = tasks.ReflectValue("map[string][]string", decoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string][]string{"a": {"x"}, "b": {}}, value.Interface())
+	}
+
+	assert.NoError(t, json.Unmarshal([]byte(`{"id": 1, "items": ["x"]}`), &decoded))
+	value, err = tasks.ReflectValue("testOrder", decoded)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testOrder{ID: 1, Items: []string{"x"}}, value.Interface())
+	}
+
+	now := time.Now().UTC()
+	value, err = tasks.ReflectValue("time.Time", now.Format(time.RFC3339Nano))
+	if assert.NoError(t, err) {
+		assert.True(t, now.Equal(value.Interface().(time.Time)))
+	}
+
+	// Values of the right type are used as they are
+	value, err = tasks.ReflectValue("[]byte", []byte("abc"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("abc"), value.Interface())
+	}
+
+	_, err = tasks.ReflectValue("[]int64", "abc")
+	assert.Error(t, err)
+
+	_, err = tasks.ReflectValue("map[int]string", decoded)
+	assert.Equal(t, tasks.NewErrUnsupportedType("map[int]string"), err)
+}
+
+func TestReflectValueBytesComposite(t *testing.T) {
+	assert.NoError(t, tasks.RegisterType("testOrder", &testOrder{}))
+
+	orders := []testOrder{{ID: 1}, {ID: 2, Items: []string{"x"}}}
+	valueBytes, err := json.Marshal(orders)
+	assert.NoError(t, err)
+
+	value, err := tasks.ReflectValueBytes("[]testOrder", valueBytes)
+	if assert.NoError(t, err) {
+		assert.Equal(t, orders, value.Interface())
+	}
+
+	valueBytes, err = json.Marshal([]byte("abc"))
+	assert.NoError(t, err)
+
+	value, err = tasks.ReflectValueBytes("[]byte", valueBytes)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []byte("abc"), value.Interface())
+	}
+}
+
+func TestRegisterType(t *testing.T) {
+	assert.Error(t, tasks.RegisterType("", testOrder{}))
+	assert.Error(t, tasks.RegisterType("int", testOrder{}))
+
+	assert.NoError(t, tasks.RegisterType("testOrder", testOrder{}))
+	assert.Error(t, tasks.RegisterType("testOrder", struct{}{}))
+
+	// A nil pointer registers the type it points to
+	assert.NoError(t, tasks.RegisterType("testOrder", (*testOrder)(nil)))
+	assert.Error(t, tasks.RegisterType("testOrder", (*struct{})(nil)))
+}
+
+func TestTypeName(t *testing.T) {
+	assert.NoError(t, tasks.RegisterType("testOrder", testOrder{}))
+
+	assert.Equal(t, "int64", tasks.TypeName(reflect.TypeOf(int64(1))))
+	assert.Equal(t, "[]byte", tasks.TypeName(reflect.TypeOf([]byte{})))
+	assert.Equal(t, "time.Time", tasks.TypeName(reflect.TypeOf(time.Time{})))
+	assert.Equal(t, "testOrder", tasks.TypeName(reflect.TypeOf(testOrder{})))
+	assert.Equal(t, "map[string][]testOrder", tasks.TypeName(reflect.TypeOf(map[string][]testOrder{})))
+
+	for _, typeName := range []string{"[]int", "map[string]float64", "[][]byte", "map[string]testOrder"} {
+		theType, err := tasks.ReflectType(typeName)
+		if assert.NoError(t, err) {
+			assert.Equal(t, typeName, tasks.TypeName(theType))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package tasks
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/retry"
+)
+
+const (
+	// RetryPolicyFixed - wait the same delay before every retry attempt
+	RetryPolicyFixed = "fixed"
+	// RetryPolicyLinear - wait delay, 2*delay, 3*delay and so on
+	RetryPolicyLinear = "linear"
+	// RetryPolicyExponential - multiply the delay after every retry attempt
+	RetryPolicyExponential = "exponential"
+	// RetryPolicyFibonacci - wait delay times successive Fibonacci numbers
+	RetryPolicyFibonacci = "fibonacci"
+)
+
+// RetryPolicy describes how retry attempts of a task are spaced out, unlike
+// retry.Policy it can be sent across the wire as a part of a signature
+type RetryPolicy struct {
+	// One of RetryPolicyFixed, RetryPolicyLinear, RetryPolicyExponential
+	// and RetryPolicyFibonacci
+	Type string
+	// Delay before the first retry attempt, defaults to 1 second
+	Delay time.Duration
+	// Upper bound of delays, zero means no bound
+	MaxDelay time.Duration
+	// Factor of exponential policy, defaults to 2
+	Multiplier float64
+	// Fraction of up to which exponential policy randomly shortens delays
+	Jitter float64
+}
+
+// Policy returns retry.Policy described by the retry policy
+func (retryPolicy *RetryPolicy) Policy() (retry.Policy, error) {
+	delay := retryPolicy.Delay
+	if delay <= 0 {
+		delay = time.Second
+	}
+
+	var policy retry.Policy
+	switch retryPolicy.Type {
+	case RetryPolicyFixed:
+		policy = retry.Fixed(delay)
+	case RetryPolicyLinear:
+		policy = retry.Linear(delay)
+	case RetryPolicyExponential:
+		multiplier := retryPolicy.Multiplier
+		if multiplier <= 0 {
+			multiplier = 2
+		}
+		policy = retry.Exponential(delay, multiplier, retryPolicy.Jitter)
+	case RetryPolicyFibonacci:
+		policy = retry.FibonacciBackoff(delay)
+	default:
+		return nil, fmt.Errorf("Unknown retry policy type: %s", retryPolicy.Type)
+	}
+
+	if retryPolicy.MaxDelay > 0 {
+		policy = retry.WithMaxDelay(policy, retryPolicy.MaxDelay)
+	}
+
+	return policy, nil
+}
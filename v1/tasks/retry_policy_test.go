@@ -0,0 +1,49 @@
+package tasks_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	testCases := []struct {
+		retryPolicy *tasks.RetryPolicy
+		expected    []time.Duration
+	}{
+		{
+			&tasks.RetryPolicy{Type: tasks.RetryPolicyFixed, Delay: 100 * time.Millisecond},
+			[]time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond},
+		},
+		{
+			&tasks.RetryPolicy{Type: tasks.RetryPolicyLinear},
+			[]time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			&tasks.RetryPolicy{Type: tasks.RetryPolicyExponential, Delay: time.Second, MaxDelay: 3 * time.Second},
+			[]time.Duration{time.Second, 2 * time.Second, 3 * time.Second},
+		},
+		{
+			&tasks.RetryPolicy{Type: tasks.RetryPolicyExponential, Delay: time.Second, Multiplier: 3},
+			[]time.Duration{time.Second, 3 * time.Second, 9 * time.Second},
+		},
+		{
+			&tasks.RetryPolicy{Type: tasks.RetryPolicyFibonacci, Delay: 10 * time.Millisecond},
+			[]time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond},
+		},
+	}
+
+	for _, testCase := range testCases {
+		policy, err := testCase.retryPolicy.Policy()
+		if assert.NoError(t, err) {
+			for i, expected := range testCase.expected {
+				assert.Equal(t, expected, policy.Delay(i+1), testCase.retryPolicy.Type)
+			}
+		}
+	}
+
+	_, err := (&tasks.RetryPolicy{Type: "unknown"}).Policy()
+	assert.Error(t, err)
+}
@@ -19,20 +19,30 @@ type Headers map[string]interface{}
 
 // Signature represents a single task invocation
 type Signature struct {
-	UUID           string
-	Name           string
-	RoutingKey     string
-	ETA            *time.Time
-	GroupUUID      string
-	GroupTaskCount int
-	Args           []Arg
-	Headers        Headers
-	Immutable      bool
-	RetryCount     int
-	RetryTimeout   int
-	OnSuccess      []*Signature
-	OnError        []*Signature
-	ChordCallback  *Signature
+	UUID              string
+	Name              string
+	RoutingKey        string
+	ETA               *time.Time
+	CreatedAt         *time.Time
+	PublishedAt       *time.Time
+	Priority          uint8
+	IdempotencyKey    string
+	GroupUUID         string
+	GroupTaskCount    int
+	Args              []Arg
+	Headers           Headers
+	Immutable         bool
+	RetryCount        int
+	RetryTimeout      int
+	RetryAttempt      int
+	RetryLaterAttempt int
+	InitialRetryCount int
+	RetryPolicy       *RetryPolicy
+	Timeout           int
+	Unique            *Unique
+	OnSuccess         []*Signature
+	OnError           []*Signature
+	ChordCallback     *Signature
 }
 
 // NewSignature creates a new task signature
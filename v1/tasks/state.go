@@ -7,12 +7,16 @@ const (
 	StateReceived = "RECEIVED"
 	// StateStarted - when the worker starts processing the task
 	StateStarted = "STARTED"
+	// StateProgress - when the running task reports its progress
+	StateProgress = "PROGRESS"
 	// StateRetry - when failed task has been scheduled for retry
 	StateRetry = "RETRY"
 	// StateSuccess - when the task is processed successfully
 	StateSuccess = "SUCCESS"
 	// StateFailure - when processing of the task fails
 	StateFailure = "FAILURE"
+	// StateRevoked - when the task is revoked before it finished processing
+	StateRevoked = "REVOKED"
 )
 
 // TaskState represents a state of a task
@@ -21,6 +25,7 @@ type TaskState struct {
 	State    string        `bson:"state"`
 	Results  []*TaskResult `bson:"results"`
 	Error    string        `bson:"error"`
+	Progress *Progress     `bson:"progress,omitempty"`
 }
 
 // GroupMeta stores useful metadata about tasks within the same group
@@ -57,6 +62,15 @@ func NewStartedTaskState(signature *Signature) *TaskState {
 	}
 }
 
+// NewProgressTaskState ...
+func NewProgressTaskState(signature *Signature, progress *Progress) *TaskState {
+	return &TaskState{
+		TaskUUID: signature.UUID,
+		State:    StateProgress,
+		Progress: progress,
+	}
+}
+
 // NewSuccessTaskState ...
 func NewSuccessTaskState(signature *Signature, results []*TaskResult) *TaskState {
 	return &TaskState{
@@ -83,10 +97,24 @@ func NewRetryTaskState(signature *Signature) *TaskState {
 	}
 }
 
-// IsCompleted returns true if state is SUCCESS or FAILURE,
-// i.e. the task has finished processing and either succeeded or failed.
+// NewRevokedTaskState ...
+func NewRevokedTaskState(signature *Signature) *TaskState {
+	return &TaskState{
+		TaskUUID: signature.UUID,
+		State:    StateRevoked,
+	}
+}
+
+// IsCompleted returns true if state is SUCCESS, FAILURE or REVOKED,
+// i.e. the task has finished processing and either succeeded or failed,
+// or it will never be processed because it has been revoked.
 func (taskState *TaskState) IsCompleted() bool {
-	return taskState.IsSuccess() || taskState.IsFailure()
+	return taskState.IsSuccess() || taskState.IsFailure() || taskState.IsRevoked()
+}
+
+// IsProgress returns true if state is PROGRESS
+func (taskState *TaskState) IsProgress() bool {
+	return taskState.State == StateProgress
 }
 
 // IsSuccess returns true if state is SUCCESS
@@ -98,3 +126,8 @@ func (taskState *TaskState) IsSuccess() bool {
 func (taskState *TaskState) IsFailure() bool {
 	return taskState.State == StateFailure
 }
+
+// IsRevoked returns true if state is REVOKED
+func (taskState *TaskState) IsRevoked() bool {
+	return taskState.State == StateRevoked
+}
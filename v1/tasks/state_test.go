@@ -26,4 +26,8 @@ func TestTaskStateIsCompleted(t *testing.T) {
 
 	taskState.State = tasks.StateFailure
 	assert.True(t, taskState.IsCompleted())
+
+	taskState.State = tasks.StateRevoked
+	assert.True(t, taskState.IsCompleted())
+	assert.True(t, taskState.IsRevoked())
 }
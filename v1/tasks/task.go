@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"reflect"
 	"runtime/debug"
+	"time"
 
 	"context"
 
@@ -14,12 +15,20 @@ import (
 // ErrTaskPanicked ...
 var ErrTaskPanicked = errors.New("Invoking task caused a panic")
 
+// ErrTaskTimedOut is returned when a task does not finish before its deadline
+var ErrTaskTimedOut = errors.New("Task execution timed out")
+
+// ErrTaskRevoked is returned for tasks which have been revoked
+var ErrTaskRevoked = errors.New("Task has been revoked")
+
 // Task wraps a signature and methods used to reflect task arguments and
 // return values after invoking the task
 type Task struct {
 	TaskFunc   reflect.Value
 	UseContext bool
+	Context    context.Context
 	Args       []reflect.Value
+	done       chan struct{}
 }
 
 // New tries to use reflection to convert the function and arguments
@@ -27,6 +36,7 @@ type Task struct {
 func New(taskFunc interface{}, args []Arg) (*Task, error) {
 	task := &Task{
 		TaskFunc: reflect.ValueOf(taskFunc),
+		Context:  context.Background(),
 	}
 
 	taskFuncType := reflect.TypeOf(taskFunc)
@@ -46,11 +56,78 @@ func New(taskFunc interface{}, args []Arg) (*Task, error) {
 
 // Call attempts to call the task with the supplied arguments.
 //
-// `err` is set in the return value in two cases:
+// `err` is set in the return value in three cases:
 // 1. The reflected function invocation panics (e.g. due to a mismatched
 //    argument list).
 // 2. The task func itself returns a non-nil error.
+// 3. The task context is done before the task returns, ErrTaskTimedOut is
+//    returned when its deadline was exceeded.
+//
+// Tasks must honour their context, a task ignoring it keeps running after
+// Call has returned, see Done.
 func (t *Task) Call() (taskResults []*TaskResult, err error) {
+	t.done = make(chan struct{})
+
+	// Task context can never be done, no need to watch it
+	if t.Context.Done() == nil {
+		defer close(t.done)
+		return t.call()
+	}
+
+	type callResult struct {
+		taskResults []*TaskResult
+		err         error
+	}
+
+	// Buffered so the goroutine of a task ignoring its context can exit
+	// once the task returns, even when nobody waits for it anymore
+	resultChan := make(chan callResult, 1)
+	go func() {
+		defer close(t.done)
+		taskResults, err := t.call()
+		resultChan <- callResult{taskResults: taskResults, err: err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		// A task honouring its context returns the context error, which has
+		// to be reported the same way as when the context wins the select
+		if result.err != nil && result.err == t.Context.Err() {
+			return nil, t.contextErr()
+		}
+		return result.taskResults, result.err
+	case <-t.Context.Done():
+		return nil, t.contextErr()
+	}
+}
+
+// contextErr returns the error for the task context being done. The deadline
+// is checked first as the context of a task which has timed out may report
+// context.Canceled when a parent context has been cancelled at the same time.
+func (t *Task) contextErr() error {
+	if deadline, ok := t.Context.Deadline(); ok && !time.Now().Before(deadline) {
+		return ErrTaskTimedOut
+	}
+	if t.Context.Err() == context.DeadlineExceeded {
+		return ErrTaskTimedOut
+	}
+	return t.Context.Err()
+}
+
+// Done returns a channel which is closed once the task func called by Call
+// has returned. It is closed when Call returns unless the task has ignored
+// its context being done.
+func (t *Task) Done() <-chan struct{} {
+	if t.done == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return t.done
+}
+
+// call invokes the task func and converts its return values
+func (t *Task) call() (taskResults []*TaskResult, err error) {
 	defer func() {
 		// Recover from panic and set err.
 		if e := recover(); e != nil {
@@ -70,8 +147,7 @@ func (t *Task) Call() (taskResults []*TaskResult, err error) {
 	args := t.Args
 
 	if t.UseContext {
-		ctx := context.Background()
-		ctxValue := reflect.ValueOf(ctx)
+		ctxValue := reflect.ValueOf(t.Context)
 		args = append([]reflect.Value{ctxValue}, args...)
 	}
 
@@ -102,7 +178,7 @@ func (t *Task) Call() (taskResults []*TaskResult, err error) {
 	taskResults = make([]*TaskResult, len(results)-1)
 	for i := 0; i < len(results)-1; i++ {
 		taskResults[i] = &TaskResult{
-			Type:  reflect.TypeOf(results[i].Interface()).String(),
+			Type:  TypeName(reflect.TypeOf(results[i].Interface())),
 			Value: results[i].Interface(),
 		}
 	}
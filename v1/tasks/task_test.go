@@ -4,6 +4,7 @@ import (
 	"context"
 	"math"
 	"testing"
+	"time"
 
 	"github.com/Guazi-inc/machinery/v1/tasks"
 	"github.com/stretchr/testify/assert"
@@ -40,6 +41,21 @@ func TestInterfaceValuedResult(t *testing.T) {
 	assert.Equal(t, math.Pi, taskResults[0].Value)
 }
 
+func TestCompositeValuedResult(t *testing.T) {
+	f := func() (map[string][]int, error) { return map[string][]int{"a": {1}}, nil }
+
+	task, err := tasks.New(f, []tasks.Arg{})
+	assert.NoError(t, err)
+
+	taskResults, err := task.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, "map[string][]int", taskResults[0].Type)
+
+	results, err := tasks.ReflectTaskResults(taskResults)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]int{"a": {1}}, results[0].Interface())
+}
+
 func TestTaskHasContext(t *testing.T) {
 	f := func(c context.Context) (interface{}, error) {
 		assert.NotNil(t, c)
@@ -52,3 +68,107 @@ func TestTaskHasContext(t *testing.T) {
 	assert.Equal(t, "float64", taskResults[0].Type)
 	assert.Equal(t, math.Pi, taskResults[0].Value)
 }
+
+func TestTaskCallTimeout(t *testing.T) {
+	f := func(c context.Context) error {
+		<-c.Done()
+		return c.Err()
+	}
+	task, err := tasks.New(f, []tasks.Arg{})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	task.Context = ctx
+
+	taskResults, err := task.Call()
+	assert.Equal(t, tasks.ErrTaskTimedOut, err)
+	assert.Nil(t, taskResults)
+}
+
+func TestTaskCallTimeoutIgnoringContext(t *testing.T) {
+	f := func() error {
+		time.Sleep(time.Second)
+		return nil
+	}
+	task, err := tasks.New(f, []tasks.Arg{})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	task.Context = ctx
+
+	start := time.Now()
+	_, err = task.Call()
+	assert.Equal(t, tasks.ErrTaskTimedOut, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// The task is still running until the task func returns
+	select {
+	case <-task.Done():
+		t.Error("Task should still be running")
+	default:
+	}
+	<-task.Done()
+	assert.True(t, time.Since(start) >= time.Second)
+}
+
+// deadlineContext reports a deadline on a context which may have been
+// cancelled for another reason
+type deadlineContext struct {
+	context.Context
+	deadline time.Time
+}
+
+func (c deadlineContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func TestTaskCallTimeoutWithCancelledParent(t *testing.T) {
+	f := func(c context.Context) error {
+		<-c.Done()
+		return c.Err()
+	}
+	task, err := tasks.New(f, []tasks.Arg{})
+	assert.NoError(t, err)
+
+	// The deadline has passed but the context reports the cancellation of
+	// its parent, as when both happen at the same time
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	task.Context = deadlineContext{Context: ctx, deadline: time.Now()}
+
+	taskResults, err := task.Call()
+	assert.Equal(t, tasks.ErrTaskTimedOut, err)
+	assert.Nil(t, taskResults)
+}
+
+func TestTaskCallCancelled(t *testing.T) {
+	f := func(c context.Context) error {
+		<-c.Done()
+		return c.Err()
+	}
+	task, err := tasks.New(f, []tasks.Arg{})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	task.Context = ctx
+	cancel()
+
+	_, err = task.Call()
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestTaskCallWithinTimeout(t *testing.T) {
+	f := func() (interface{}, error) { return math.Pi, nil }
+	task, err := tasks.New(f, []tasks.Arg{})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	task.Context = ctx
+
+	taskResults, err := task.Call()
+	assert.NoError(t, err)
+	assert.Equal(t, math.Pi, taskResults[0].Value)
+}
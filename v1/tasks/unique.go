@@ -0,0 +1,81 @@
+package tasks
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// What happens to a duplicate of a unique task which is already running
+const (
+	// UniqueSkip drops the duplicate, it is marked REVOKED without running or
+	// triggering its callbacks
+	UniqueSkip = "skip"
+	// UniqueDelay sends the duplicate back to the queue to run later
+	UniqueDelay = "delay"
+	// UniqueFail fails the duplicate with ErrTaskLocked
+	UniqueFail = "fail"
+)
+
+// ErrTaskLocked is the error of a unique task failed because a duplicate
+// of it is already running
+var ErrTaskLocked = errors.New("Task is locked by a running duplicate")
+
+// Unique makes sure only one instance of a task runs at a time for the same
+// key, which is made of the task name and chosen args
+type Unique struct {
+	// Indexes of args making up the key, all args are used if empty
+	Args []int
+	// Mode is UniqueSkip, UniqueDelay or UniqueFail, defaults to UniqueSkip
+	Mode string
+	// Delay in seconds before a delayed duplicate is tried again, defaults to 1
+	Delay int
+	// Expiry in seconds of the lock held by a worker which died, defaults to
+	// the task timeout or a minute. Running tasks keep extending the lock.
+	Expiry int
+}
+
+// Validate checks the mode and arg indexes of the signature
+func (unique *Unique) Validate(signature *Signature) error {
+	switch unique.Mode {
+	case "", UniqueSkip, UniqueDelay, UniqueFail:
+	default:
+		return fmt.Errorf("Unknown unique mode: %s", unique.Mode)
+	}
+
+	for _, index := range unique.Args {
+		if index < 0 || index >= len(signature.Args) {
+			return fmt.Errorf("Unique arg index %d out of range", index)
+		}
+	}
+	return nil
+}
+
+// Key returns the lock key of the signature
+func (unique *Unique) Key(signature *Signature) (string, error) {
+	if err := unique.Validate(signature); err != nil {
+		return "", err
+	}
+
+	args := signature.Args
+	if len(unique.Args) > 0 {
+		args = make([]Arg, 0, len(unique.Args))
+		for _, index := range unique.Args {
+			args = append(args, signature.Args[index])
+		}
+	}
+
+	values := make([]interface{}, 0, len(args))
+	for _, arg := range args {
+		values = append(values, arg.Value)
+	}
+	encoded, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha1.Sum(encoded)
+	return signature.Name + ":" + hex.EncodeToString(hash[:]), nil
+}
@@ -0,0 +1,51 @@
+package tasks_test
+
+import (
+	"testing"
+
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUniqueKey(t *testing.T) {
+	signature := func(index string, shard int) *tasks.Signature {
+		return &tasks.Signature{
+			Name: "rebuild_index",
+			Args: []tasks.Arg{
+				{Type: "string", Value: index},
+				{Type: "int", Value: shard},
+			},
+		}
+	}
+
+	// All args make up the key by default
+	unique := &tasks.Unique{}
+	key1, err := unique.Key(signature("users", 1))
+	assert.NoError(t, err)
+	key2, err := unique.Key(signature("users", 2))
+	assert.NoError(t, err)
+	assert.NotEqual(t, key1, key2)
+	assert.Contains(t, key1, "rebuild_index:")
+
+	// Only chosen args make up the key
+	unique = &tasks.Unique{Args: []int{0}}
+	key1, err = unique.Key(signature("users", 1))
+	assert.NoError(t, err)
+	key2, err = unique.Key(signature("users", 2))
+	assert.NoError(t, err)
+	assert.Equal(t, key1, key2)
+	key3, err := unique.Key(signature("orders", 1))
+	assert.NoError(t, err)
+	assert.NotEqual(t, key1, key3)
+}
+
+func TestUniqueValidate(t *testing.T) {
+	signature := &tasks.Signature{Args: []tasks.Arg{{Type: "int", Value: 1}}}
+
+	for _, mode := range []string{"", tasks.UniqueSkip, tasks.UniqueDelay, tasks.UniqueFail} {
+		assert.NoError(t, (&tasks.Unique{Mode: mode}).Validate(signature))
+	}
+	assert.Error(t, (&tasks.Unique{Mode: "queue"}).Validate(signature))
+	assert.Error(t, (&tasks.Unique{Args: []int{1}}).Validate(signature))
+	assert.Error(t, (&tasks.Unique{Args: []int{-1}}).Validate(signature))
+}
@@ -0,0 +1,192 @@
+// Package tracing traces tasks from the code sending them, e.g. an HTTP
+// handler, to the workers executing them and on to their callbacks. Trace
+// context is carried in headers of task signatures.
+//
+// The package does not depend on a tracing library, Tracer is implemented on
+// top of one, e.g. OpenTelemetry with its W3C trace context propagator.
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+)
+
+// PublishedAtHeader keeps the time the task has been published at, the
+// span of the time the task waits in the queue starts then. It is only read
+// for tasks whose signature does not carry PublishedAt.
+const PublishedAtHeader = "machinery_published_at"
+
+// SpanKind tells the role of a span in a trace
+type SpanKind int
+
+const (
+	// SpanKindInternal - the time a task waits in the queue
+	SpanKindInternal SpanKind = iota
+	// SpanKindProducer - publishing of a task
+	SpanKindProducer
+	// SpanKindConsumer - execution of a task
+	SpanKindConsumer
+)
+
+// StartOptions configure a new span
+type StartOptions struct {
+	Kind SpanKind
+	// StartTime is now if zero
+	StartTime  time.Time
+	Attributes map[string]interface{}
+}
+
+// Span is a traced operation
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// Tracer creates spans and propagates trace context through headers
+type Tracer interface {
+	// Start starts a span, it is a child of the span in the context if any
+	Start(ctx context.Context, name string, options StartOptions) (context.Context, Span)
+	// Inject writes trace context of the span in the context to the headers,
+	// it returns false if there is no span in the context
+	Inject(ctx context.Context, headers map[string]string) bool
+	// Extract returns a copy of the context carrying trace context read from
+	// the headers
+	Extract(ctx context.Context, headers map[string]string) context.Context
+}
+
+// spanCtxKey is the context key of the span of a task being executed
+type spanCtxKey struct{}
+
+// Middleware returns a middleware tracing tasks. Publishing of a task is
+// a child span of the span in the context the task is sent with. Time the
+// task waits in the queue and its execution are child spans of the publish
+// span. Callbacks of chains and chords are published within the execution
+// span of the task triggering them.
+func Middleware(tracer Tracer) machinery.Middleware {
+	return machinery.Middleware{
+		BeforePublish: func(ctx context.Context, signature *tasks.Signature) error {
+			tracePublish(tracer, ctx, signature)
+			return nil
+		},
+		BeforeExecute: func(ctx context.Context, signature *tasks.Signature) (context.Context, error) {
+			return startExecution(tracer, ctx, signature), nil
+		},
+		AfterSuccess: func(ctx context.Context, signature *tasks.Signature, results []*tasks.TaskResult) {
+			endExecution(ctx, nil)
+		},
+		AfterFailure: func(ctx context.Context, signature *tasks.Signature, err error) {
+			endExecution(ctx, err)
+		},
+		OnRetry: func(ctx context.Context, signature *tasks.Signature, err error, retryIn time.Duration) {
+			if span, ok := ctx.Value(spanCtxKey{}).(Span); ok {
+				span.SetAttribute("machinery.retry_in", retryIn.String())
+			}
+			endExecution(ctx, err)
+		},
+	}
+}
+
+// tracePublish records the publish span and injects its trace context into
+// headers of the task
+func tracePublish(tracer Tracer, ctx context.Context, signature *tasks.Signature) {
+	// Tasks sent again without a span in the context, e.g. delayed by their
+	// rate limit, stay in the trace they have been sent in first
+	if !tracer.Inject(ctx, make(map[string]string)) {
+		ctx = tracer.Extract(ctx, headers(signature))
+	}
+
+	ctx, span := tracer.Start(ctx, signature.Name+" publish", StartOptions{
+		Kind:       SpanKindProducer,
+		Attributes: attributes(signature),
+	})
+	defer span.End()
+
+	carrier := make(map[string]string)
+	tracer.Inject(ctx, carrier)
+
+	if signature.Headers == nil {
+		signature.Headers = make(tasks.Headers)
+	}
+	for key, value := range carrier {
+		signature.Headers[key] = value
+	}
+	signature.Headers[PublishedAtHeader] = time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// startExecution records the queue span and starts the execution span
+func startExecution(tracer Tracer, ctx context.Context, signature *tasks.Signature) context.Context {
+	ctx = tracer.Extract(ctx, headers(signature))
+
+	if publishedAt, ok := publishedAt(signature); ok {
+		_, span := tracer.Start(ctx, signature.Name+" queue", StartOptions{
+			Kind:       SpanKindInternal,
+			StartTime:  publishedAt,
+			Attributes: attributes(signature),
+		})
+		span.End()
+	}
+
+	ctx, span := tracer.Start(ctx, signature.Name+" process", StartOptions{
+		Kind:       SpanKindConsumer,
+		Attributes: attributes(signature),
+	})
+	return context.WithValue(ctx, spanCtxKey{}, span)
+}
+
+// endExecution ends the execution span, recording the error if any
+func endExecution(ctx context.Context, err error) {
+	span, ok := ctx.Value(spanCtxKey{}).(Span)
+	if !ok {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
+// publishedAt returns the time the task has been published at, tasks sent by
+// older publishers only carry it in PublishedAtHeader
+func publishedAt(signature *tasks.Signature) (time.Time, bool) {
+	if signature.PublishedAt != nil {
+		return *signature.PublishedAt, true
+	}
+	if header, ok := signature.Headers[PublishedAtHeader].(string); ok {
+		if publishedAt, err := time.Parse(time.RFC3339Nano, header); err == nil {
+			return publishedAt, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// headers returns string headers of the task which may carry trace context
+func headers(signature *tasks.Signature) map[string]string {
+	carrier := make(map[string]string, len(signature.Headers))
+	for key, value := range signature.Headers {
+		if value, ok := value.(string); ok {
+			carrier[key] = value
+		}
+	}
+	return carrier
+}
+
+// attributes describe the task a span belongs to
+func attributes(signature *tasks.Signature) map[string]interface{} {
+	attributes := map[string]interface{}{
+		"messaging.system":        "machinery",
+		"messaging.message_id":    signature.UUID,
+		"machinery.task_name":     signature.Name,
+		"machinery.retry_attempt": signature.RetryAttempt,
+	}
+	if signature.RoutingKey != "" {
+		attributes["messaging.destination"] = signature.RoutingKey
+	}
+	if signature.GroupUUID != "" {
+		attributes["machinery.group_uuid"] = signature.GroupUUID
+	}
+	return attributes
+}
@@ -0,0 +1,154 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1"
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/Guazi-inc/machinery/v1/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+const traceHeader = "test_parent_span"
+
+type testSpan struct {
+	name   string
+	parent string
+	kind   tracing.SpanKind
+	err    error
+	ended  bool
+}
+
+func (span *testSpan) SetAttribute(key string, value interface{}) {}
+func (span *testSpan) RecordError(err error)                      { span.err = err }
+func (span *testSpan) End()                                       { span.ended = true }
+
+type testSpanCtxKey struct{}
+
+// testTracer records spans, spans are identified by their names
+type testTracer struct {
+	spans map[string]*testSpan
+	mu    sync.Mutex
+}
+
+func (tracer *testTracer) Start(ctx context.Context, name string, options tracing.StartOptions) (context.Context, tracing.Span) {
+	span := &testSpan{name: name, kind: options.Kind}
+	if parent, ok := ctx.Value(testSpanCtxKey{}).(string); ok {
+		span.parent = parent
+	}
+
+	tracer.mu.Lock()
+	tracer.spans[name] = span
+	tracer.mu.Unlock()
+
+	return context.WithValue(ctx, testSpanCtxKey{}, name), span
+}
+
+func (tracer *testTracer) Inject(ctx context.Context, headers map[string]string) bool {
+	parent, ok := ctx.Value(testSpanCtxKey{}).(string)
+	if ok {
+		headers[traceHeader] = parent
+	}
+	return ok
+}
+
+func (tracer *testTracer) Extract(ctx context.Context, headers map[string]string) context.Context {
+	if parent, ok := headers[traceHeader]; ok {
+		return context.WithValue(ctx, testSpanCtxKey{}, parent)
+	}
+	return ctx
+}
+
+func TestMiddleware(t *testing.T) {
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "eager",
+		DefaultQueue:  "machinery_tasks",
+		ResultBackend: "eager",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracer := &testTracer{spans: make(map[string]*testSpan)}
+	server.Use(tracing.Middleware(tracer))
+
+	err = server.RegisterTasks(map[string]interface{}{
+		"first":  func() error { return nil },
+		"second": func() error { return nil },
+		"broken": func() error { return errors.New("broken") },
+	})
+	assert.NoError(t, err)
+
+	ctx, request := tracer.Start(context.Background(), "request", tracing.StartOptions{})
+	chain := tasks.NewChain(&tasks.Signature{Name: "first"}, &tasks.Signature{Name: "second"})
+	_, err = server.SendChainWithContext(ctx, chain)
+	assert.NoError(t, err)
+	request.End()
+
+	// The chain is followed from the request to its last task
+	for _, span := range []struct {
+		name   string
+		parent string
+		kind   tracing.SpanKind
+	}{
+		{"first publish", "request", tracing.SpanKindProducer},
+		{"first queue", "first publish", tracing.SpanKindInternal},
+		{"first process", "first publish", tracing.SpanKindConsumer},
+		{"second publish", "first process", tracing.SpanKindProducer},
+		{"second queue", "second publish", tracing.SpanKindInternal},
+		{"second process", "second publish", tracing.SpanKindConsumer},
+	} {
+		if assert.Contains(t, tracer.spans, span.name) {
+			assert.Equal(t, span.parent, tracer.spans[span.name].parent, span.name)
+			assert.Equal(t, span.kind, tracer.spans[span.name].kind, span.name)
+			assert.True(t, tracer.spans[span.name].ended, span.name)
+		}
+	}
+
+	// Tasks sent without a trace start a new one
+	_, err = server.SendTask(&tasks.Signature{Name: "broken"})
+	assert.NoError(t, err)
+
+	if assert.Contains(t, tracer.spans, "broken process") {
+		assert.Equal(t, "", tracer.spans["broken publish"].parent)
+		assert.Equal(t, "broken publish", tracer.spans["broken process"].parent)
+		assert.EqualError(t, tracer.spans["broken process"].err, "broken")
+		assert.True(t, tracer.spans["broken process"].ended)
+	}
+}
+
+func TestMiddlewareRepublish(t *testing.T) {
+	tracer := &testTracer{spans: make(map[string]*testSpan)}
+	middleware := tracing.Middleware(tracer)
+
+	signature := &tasks.Signature{Name: "task"}
+	assert.NoError(t, middleware.BeforePublish(context.Background(), signature))
+	assert.Equal(t, "", tracer.spans["task publish"].parent)
+
+	publishedAt, err := time.Parse(time.RFC3339Nano, signature.Headers[tracing.PublishedAtHeader].(string))
+	if assert.NoError(t, err) {
+		assert.WithinDuration(t, time.Now(), publishedAt, time.Second)
+	}
+
+	// Task sent again without a span in the context stays in its trace
+	assert.NoError(t, middleware.BeforePublish(context.Background(), signature))
+	assert.Equal(t, "task publish", tracer.spans["task publish"].parent)
+}
+
+func TestMiddlewarePublishedAtHeader(t *testing.T) {
+	tracer := &testTracer{spans: make(map[string]*testSpan)}
+	middleware := tracing.Middleware(tracer)
+
+	// Tasks sent by older publishers only carry the header
+	signature := &tasks.Signature{Name: "task", Headers: tasks.Headers{
+		tracing.PublishedAtHeader: time.Now().UTC().Format(time.RFC3339Nano),
+	}}
+	_, err := middleware.BeforeExecute(context.Background(), signature)
+	assert.NoError(t, err)
+	assert.Contains(t, tracer.spans, "task queue")
+}
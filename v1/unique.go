@@ -0,0 +1,188 @@
+package machinery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1/backends"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/Guazi-inc/machinery/v1/log"
+	"github.com/Guazi-inc/machinery/v1/semaphore"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	redsync "gopkg.in/redsync.v1"
+)
+
+const (
+	uniqueSuffix = "_unique:"
+	// Lock of a unique task expires after a minute unless the task has a
+	// timeout or the lock sets its own expiry
+	defaultUniqueLockExpiry = time.Minute
+	// Delayed duplicate of a unique task is tried again after a second
+	defaultUniqueDelay = time.Second
+	// How often a duplicate of a unique task checks whether the lock is free
+	// when it waits in place with eager broker
+	uniquePollInterval = 10 * time.Millisecond
+)
+
+// uniqueLocker takes locks of unique tasks
+type uniqueLocker interface {
+	// Lock returns false if the lock is held already, otherwise the lock is
+	// held until unlock is called. An error is returned if it cannot tell
+	// whether the lock is held.
+	Lock(key string, expiry time.Duration) (unlock func(), ok bool, err error)
+}
+
+// errUniqueNotSupported is returned for unique tasks if there is nowhere to
+// keep locks shared by all workers
+var errUniqueNotSupported = errors.New("Unique tasks require Redis broker or Redis result backend")
+
+// newUniqueLocker creates the locker of unique tasks. Locks are kept in Redis
+// when using Redis broker or Redis result backend so they apply to the whole
+// worker fleet, eager broker keeps them in memory. Nil is returned with other
+// brokers and backends.
+func newUniqueLocker(cnf *config.Config, broker brokers.Interface, backend backends.Interface) uniqueLocker {
+	if pool, ok := sharedRedisPool(broker, backend); ok {
+		return &redisUniqueLocker{
+			pool:    pool,
+			prefix:  cnf.DefaultQueue + uniqueSuffix,
+			redsync: redsync.New([]redsync.Pool{pool}),
+		}
+	}
+	if isEagerBroker(broker) {
+		return &localUniqueLocker{semaphore: semaphore.NewLocalSemaphore()}
+	}
+	return nil
+}
+
+// redisUniqueLocker takes locks in Redis, held locks are extended
+// periodically until they are unlocked
+type redisUniqueLocker struct {
+	pool    redisPool
+	prefix  string
+	redsync *redsync.Redsync
+}
+
+func (locker *redisUniqueLocker) Lock(key string, expiry time.Duration) (func(), bool, error) {
+	mutex := locker.redsync.NewMutex(
+		locker.prefix+key,
+		redsync.SetExpiry(expiry),
+		redsync.SetTries(1),
+	)
+	if err := mutex.Lock(); err != nil {
+		if err != redsync.ErrFailed {
+			return nil, false, err
+		}
+		// Redsync fails the same way whether the lock is held or Redis
+		// cannot be reached, tell them apart
+		conn := locker.pool.Get()
+		defer conn.Close()
+		if _, err := conn.Do("EXISTS", locker.prefix+key); err != nil {
+			return nil, false, err
+		}
+		return nil, false, nil
+	}
+
+	// Keep the lock from expiring while the task is running
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(expiry / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if !mutex.Extend() {
+					log.WARNING.Printf("Failed to extend lock of unique task %s", key)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		mutex.Unlock()
+	}, true, nil
+}
+
+// localUniqueLocker takes locks in memory
+type localUniqueLocker struct {
+	semaphore semaphore.Semaphore
+}
+
+func (locker *localUniqueLocker) Lock(key string, expiry time.Duration) (func(), bool, error) {
+	return locker.semaphore.Acquire(key, 1)
+}
+
+// uniqueLock returns the key and expiry of the lock of a unique task, an
+// error means the task can never take its lock
+func (worker *Worker) uniqueLock(signature *tasks.Signature) (string, time.Duration, error) {
+	if worker.server.uniqueLocker == nil {
+		return "", 0, errUniqueNotSupported
+	}
+
+	key, err := signature.Unique.Key(signature)
+	if err != nil {
+		return "", 0, err
+	}
+
+	expiry := defaultUniqueLockExpiry
+	if signature.Unique.Expiry > 0 {
+		expiry = time.Duration(signature.Unique.Expiry) * time.Second
+	} else if timeout := worker.server.GetRegisteredTaskOptions(signature.Name).timeout(signature); timeout > 0 {
+		expiry = timeout
+	}
+
+	return key, expiry, nil
+}
+
+// lockUnique takes the lock of a unique task, it returns false if a duplicate
+// of the task holds the lock
+func (worker *Worker) lockUnique(key string, expiry time.Duration) (func(), bool, error) {
+	return worker.server.uniqueLocker.Lock(key, expiry)
+}
+
+// uniqueLockFailed handles a unique task which could not tell whether its
+// lock is held, e.g. when Redis cannot be reached. The task is tried again
+// later the same as a delayed duplicate.
+func (worker *Worker) uniqueLockFailed(signature *tasks.Signature, err error) error {
+	log.ERROR.Printf("Failed to lock unique task %s: %s", signature.UUID, err)
+	if worker.isEager() {
+		return fmt.Errorf("Lock unique task error: %s", err)
+	}
+	return worker.delayTask(signature, uniqueDelay(signature))
+}
+
+// uniqueDelay returns how long a delayed duplicate of a unique task waits
+// before it is tried again
+func uniqueDelay(signature *tasks.Signature) time.Duration {
+	if signature.Unique.Delay > 0 {
+		return time.Duration(signature.Unique.Delay) * time.Second
+	}
+	return defaultUniqueDelay
+}
+
+// uniqueDuplicate handles a duplicate of a unique task according to the mode
+// of its lock
+func (worker *Worker) uniqueDuplicate(signature *tasks.Signature) error {
+	switch signature.Unique.Mode {
+	case tasks.UniqueDelay:
+		log.INFO.Printf("Task %s is locked by a running duplicate", signature.UUID)
+		return worker.delayTask(signature, uniqueDelay(signature))
+	case tasks.UniqueFail:
+		return worker.taskFailed(context.Background(), signature, tasks.ErrTaskLocked)
+	default:
+		// The skipped task never runs, so it is revoked rather than
+		// succeeded, its callbacks are not triggered
+		log.WARNING.Printf("Task %s is locked by a running duplicate, skipping", signature.UUID)
+		return worker.taskRevoked(signature)
+	}
+}
@@ -1,6 +1,7 @@
 package machinery
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -9,6 +10,8 @@ import (
 	"time"
 
 	"github.com/Guazi-inc/machinery/v1/backends"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/config"
 	"github.com/Guazi-inc/machinery/v1/log"
 	"github.com/Guazi-inc/machinery/v1/retry"
 	"github.com/Guazi-inc/machinery/v1/tasks"
@@ -19,6 +22,18 @@ type Worker struct {
 	server      *Server
 	ConsumerTag string
 	Concurrency int
+	// Queues to consume from, the default queue is used if empty
+	Queues []config.QueueConfig
+	// Slots of tasks with concurrency limits running in this worker
+	slots taskSlots
+	// Health of the worker, see HealthHandler
+	health workerHealth
+	// Heartbeats of the worker, see Server.ListWorkers
+	heartbeat workerHeartbeat
+	// State changed by control commands, see Server.Control
+	control workerControl
+	// Tasks running in this worker which are cancelled once revoked
+	revoked revokedWatcher
 }
 
 // Launch starts a new worker process. The worker subscribes
@@ -34,12 +49,14 @@ func (worker *Worker) Launch() error {
 // LaunchAsync is a non blocking version of Launch
 func (worker *Worker) LaunchAsync(errorsChan chan<- error) {
 	cnf := worker.server.GetConfig()
-	broker := worker.server.GetBroker()
 
 	// Log some useful information about woorker configuration
 	log.INFO.Printf("Launching a worker with the following settings:")
 	log.INFO.Printf("- Broker: %s", cnf.Broker)
 	log.INFO.Printf("- DefaultQueue: %s", cnf.DefaultQueue)
+	for _, queue := range worker.Queues {
+		log.INFO.Printf("- Queue: %s (weight %d)", queue.Name, queue.Weight)
+	}
 	log.INFO.Printf("- ResultBackend: %s", cnf.ResultBackend)
 	if cnf.AMQP != nil {
 		log.INFO.Printf("- AMQP: %s", cnf.AMQP.Exchange)
@@ -49,19 +66,18 @@ func (worker *Worker) LaunchAsync(errorsChan chan<- error) {
 		log.INFO.Printf("  - PrefetchCount: %d", cnf.AMQP.PrefetchCount)
 	}
 
-	// Goroutine to start broker consumption and handle retries when broker connection dies
-	go func() {
-		for {
-			retry, err := broker.StartConsuming(worker.ConsumerTag, worker.Concurrency, worker)
+	if cnf.HealthAddr != "" {
+		worker.serveHealth(cnf.HealthAddr)
+	}
 
-			if retry {
-				log.WARNING.Printf("Start consuming error: %s", err)
-			} else {
-				errorsChan <- err // stop the goroutine
-				return
-			}
-		}
-	}()
+	// Let the worker be listed by Server.ListWorkers and receive control
+	// commands while it is running
+	worker.startHeartbeat()
+	worker.startControl()
+
+	// Goroutine to start broker consumption and handle retries when broker connection dies
+	worker.setConsuming(true)
+	go worker.consume(errorsChan)
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
@@ -93,7 +109,18 @@ func (worker *Worker) LaunchAsync(errorsChan chan<- error) {
 
 // Quit tears down the running worker process
 func (worker *Worker) Quit() {
-	worker.server.GetBroker().StopConsuming()
+	// Paused worker is not consuming, it only stops waiting to be resumed
+	if worker.quitting() {
+		worker.server.GetBroker().StopConsuming()
+	}
+	worker.stopHeartbeat()
+	worker.stopControl()
+	worker.stopHealth()
+}
+
+// ConsumingQueues returns queues the worker consumes from
+func (worker *Worker) ConsumingQueues() []config.QueueConfig {
+	return worker.Queues
 }
 
 // Process handles received tasks and triggers success/error callbacks
@@ -109,66 +136,250 @@ func (worker *Worker) Process(signature *tasks.Signature) error {
 		return nil
 	}
 
+	// Keep track of the task for the status page of the worker
+	defer worker.trackInFlight(signature)()
+
+	// Slots and the unique lock the task holds are released before it is
+	// retried or its callbacks are sent, eager broker processes those in
+	// place and would wait for them forever
+	var held []func()
+	releaseHeld := func() {
+		for len(held) > 0 {
+			held[len(held)-1]()
+			held = held[:len(held)-1]
+		}
+	}
+	defer releaseHeld()
+
+	// Skip tasks revoked while waiting in the queue, the state is set again
+	// in case the task was sent after it had been revoked
+	if worker.isRevoked(signature) {
+		log.WARNING.Printf("Task %s has been revoked, skipping", signature.UUID)
+		return worker.taskRevoked(signature)
+	}
+
+	// Only one instance of a unique task runs at a time, eager broker
+	// processes tasks in place so a delayed duplicate waits there instead
+	if signature.Unique != nil {
+		key, expiry, err := worker.uniqueLock(signature)
+		if err != nil {
+			return worker.taskFailed(context.Background(), signature, err)
+		}
+		unlock, ok, err := worker.lockUnique(key, expiry)
+		for ; err == nil && !ok; unlock, ok, err = worker.lockUnique(key, expiry) {
+			if signature.Unique.Mode != tasks.UniqueDelay || !worker.isEager() {
+				return worker.uniqueDuplicate(signature)
+			}
+			time.Sleep(uniquePollInterval)
+		}
+		if err != nil {
+			return worker.uniqueLockFailed(signature, err)
+		}
+		held = append(held, unlock)
+	}
+
+	// Concurrency limits have been enforced by the broker, see TaskLimiter.
+	// Eager broker processes tasks in place so the task waits for its slots
+	// here.
+	if worker.isEager() {
+		held = append(held, worker.acquireTask(signature.Name))
+	}
+
+	// Delay the task while it is over its rate limit, eager broker processes
+	// tasks in place so the task waits there instead.
+	for delay := worker.rateLimitDelay(signature); delay > 0; delay = worker.rateLimitDelay(signature) {
+		if !worker.isEager() {
+			log.INFO.Printf("Task %s has reached its rate limit", signature.UUID)
+			return worker.delayTask(signature, delay+worker.rateLimitJitter(signature))
+		}
+		time.Sleep(delay)
+	}
+
 	// Update task state to RECEIVED
 	if err = worker.server.GetBackend().SetStateReceived(signature); err != nil {
 		return fmt.Errorf("Set state received error: %s", err)
 	}
 
+	// Middlewares may modify the signature or keep the task from running
+	hooks, err := worker.server.beforeExecute(context.Background(), signature)
+	if err != nil {
+		releaseHeld()
+		return worker.taskErrored(hooks, signature, err)
+	}
+
 	// Prepare task for processing
 	task, err := tasks.New(taskFunc, signature.Args)
 	// if this failed, it means the task is malformed, probably has invalid
-	// signature, go directly to task failed without checking whether to retry
+	// signature, go directly to task failed without checking whether to retry.
+	// The error is non-retryable so brokers do not deliver the task again.
 	if err != nil {
-		worker.taskFailed(signature, err)
-		return err
+		hooks.afterFailure(signature, err)
+		releaseHeld()
+		worker.taskFailed(hooks.ctx, signature, err)
+		return tasks.NewErrNonRetryable(err)
 	}
 
-	// Update task state to STARTED
+	// Let the task read its own signature, e.g. to log its UUID, and
+	// report its progress
+	task.Context = tasks.WithSignature(hooks.ctx, signature)
+	task.Context = tasks.WithProgressReporter(task.Context, func(progress *tasks.Progress) error {
+		return worker.server.GetBackend().SetStateProgress(signature, progress)
+	})
+
+	// Update task state to STARTED, middlewares have started executing the
+	// task so they are told it has not run
 	if err = worker.server.GetBackend().SetStateStarted(signature); err != nil {
-		return fmt.Errorf("Set state started error: %s", err)
+		err = fmt.Errorf("Set state started error: %s", err)
+		hooks.afterFailure(signature, err)
+		return err
+	}
+
+	// The task may have been revoked since it was received, in that case
+	// STARTED has just overwritten its REVOKED state
+	if worker.isRevoked(signature) {
+		log.WARNING.Printf("Task %s has been revoked, skipping", signature.UUID)
+		hooks.afterFailure(signature, tasks.ErrTaskRevoked)
+		return worker.taskRevoked(signature)
+	}
+
+	// Cancel the task context if the task gets revoked while running
+	ctx, cancel := context.WithCancel(task.Context)
+	defer cancel()
+	task.Context = ctx
+	revoked, stopWatching := worker.watchRevoked(signature, cancel)
+	defer stopWatching()
+
+	// Bound execution time of the task, the task context is cancelled
+	// when the timeout expires
+	if timeout := worker.server.GetRegisteredTaskOptions(signature.Name).timeout(signature); timeout > 0 {
+		var cancel context.CancelFunc
+		task.Context, cancel = context.WithTimeout(task.Context, timeout)
+		defer cancel()
 	}
 
-	// Call the task
+	// Call the task, a task ignoring its context keeps running after it has
+	// timed out. It is waited for before it is retried or its callbacks are
+	// sent, so the retry does not run next to it and the task holds its slot
+	// until it returns, no more than Concurrency tasks run at once.
 	results, err := task.Call()
+	waitTask(task, signature)
+	releaseHeld()
 	if err != nil {
-		// Let's retry the task
-		if signature.RetryCount > 0 {
-			return worker.taskRetry(signature)
+		// Revoked task is not retried, progress reported before the task
+		// got cancelled may have overwritten its REVOKED state
+		if revoked() {
+			log.WARNING.Printf("Task %s has been revoked while running", signature.UUID)
+			hooks.afterFailure(signature, tasks.ErrTaskRevoked)
+			return worker.taskRevoked(signature)
 		}
 
-		return worker.taskFailed(signature, err)
+		return worker.taskErrored(hooks, signature, err)
 	}
 
-	return worker.taskSucceeded(signature, results)
+	hooks.afterSuccess(signature, results)
+	return worker.taskSucceeded(hooks.ctx, signature, results)
 }
 
-// retryTask decrements RetryCount counter and republishes the task to the queue
-func (worker *Worker) taskRetry(signature *tasks.Signature) error {
-	// Update task state to RETRY
-	if err := worker.server.GetBackend().SetStateRetry(signature); err != nil {
-		return fmt.Errorf("Set state retry error: %s", err)
+// taskErrored retries the task which has returned an error or fails it
+func (worker *Worker) taskErrored(hooks *executeHooks, signature *tasks.Signature, err error) error {
+	// The task may decide itself when to retry or not to retry at all
+	if retryLater, ok := tasks.AsRetryTaskLater(err); ok {
+		// Retries later are counted apart and do not use up RetryCount
+		if signature.RetryLaterAttempt+1 <= worker.server.GetRegisteredTaskOptions(signature.Name).maxRetryLater() {
+			signature.RetryLaterAttempt++
+			hooks.onRetry(signature, err, retryLater.RetryIn())
+			return worker.retryTaskIn(hooks.ctx, signature, retryLater.RetryIn())
+		}
+		log.WARNING.Printf("Task %s has been retried later too many times", signature.UUID)
+		hooks.afterFailure(signature, err)
+		return worker.taskFailed(hooks.ctx, signature, err)
+	}
+	if _, ok := tasks.AsNonRetryable(err); ok {
+		hooks.afterFailure(signature, err)
+		return worker.taskFailed(hooks.ctx, signature, err)
+	}
+
+	// Let's retry the task
+	if signature.RetryCount > 0 {
+		return worker.taskRetry(hooks, signature, err)
+	}
+
+	hooks.afterFailure(signature, err)
+	return worker.taskFailed(hooks.ctx, signature, err)
+}
+
+// waitTask blocks until the task func has returned
+func waitTask(task *tasks.Task, signature *tasks.Signature) {
+	select {
+	case <-task.Done():
+		return
+	default:
 	}
 
+	log.WARNING.Printf("Task %s ignores its context, waiting for it to return", signature.UUID)
+	<-task.Done()
+}
+
+// taskRevoked sets the state of the revoked task to REVOKED again
+func (worker *Worker) taskRevoked(signature *tasks.Signature) error {
+	if err := worker.server.GetBackend().SetStateRevoked(signature); err != nil {
+		return fmt.Errorf("Set state revoked error: %s", err)
+	}
+	return nil
+}
+
+// retryTask decrements RetryCount counter and republishes the task to the queue
+func (worker *Worker) taskRetry(hooks *executeHooks, signature *tasks.Signature, err error) error {
 	// Decrement the retry counter, when it reaches 0, we won't retry again
 	signature.RetryCount--
+	signature.RetryAttempt++
 
-	// Increase retry timeout
-	signature.RetryTimeout = retry.FibonacciNext(signature.RetryTimeout)
+	retryIn := worker.retryDelay(signature)
+	hooks.onRetry(signature, err, retryIn)
+
+	return worker.retryTaskIn(hooks.ctx, signature, retryIn)
+}
+
+// retryTaskIn republishes the task to the queue delayed by retryIn, ctx is
+// the context the task has been executed with
+func (worker *Worker) retryTaskIn(ctx context.Context, signature *tasks.Signature, retryIn time.Duration) error {
+	// Update task state to RETRY
+	if err := worker.server.GetBackend().SetStateRetry(signature); err != nil {
+		return fmt.Errorf("Set state retry error: %s", err)
+	}
 
-	// Delay task by signature.RetryTimeout seconds
-	eta := time.Now().UTC().Add(time.Second * time.Duration(signature.RetryTimeout))
+	// Delay task by retryIn
+	eta := time.Now().UTC().Add(retryIn)
 	signature.ETA = &eta
 
-	log.WARNING.Printf("Task %s failed. Going to retry in %ds.", signature.UUID, signature.RetryTimeout)
+	log.WARNING.Printf("Task %s failed. Going to retry in %v.", signature.UUID, retryIn)
 
 	// Send the task back to the queue
-	_, err := worker.server.SendTask(signature)
+	_, err := worker.server.sendTask(ctx, signature)
 	return err
 }
 
+// retryDelay returns how long to wait before the next retry attempt, by
+// default retry timeout follows Fibonacci sequence of seconds
+func (worker *Worker) retryDelay(signature *tasks.Signature) time.Duration {
+	policy, err := worker.server.GetRegisteredTaskOptions(signature.Name).retryPolicy(signature)
+	if err != nil {
+		log.WARNING.Printf("Retry policy error: %s", err)
+	}
+
+	if policy != nil {
+		return policy.Delay(signature.RetryAttempt)
+	}
+
+	// Increase retry timeout
+	signature.RetryTimeout = retry.FibonacciNext(signature.RetryTimeout)
+	return time.Second * time.Duration(signature.RetryTimeout)
+}
+
 // taskSucceeded updates the task state and triggers success callbacks or a
-// chord callback if this was the last task of a group with a chord callback
-func (worker *Worker) taskSucceeded(signature *tasks.Signature, taskResults []*tasks.TaskResult) error {
+// chord callback if this was the last task of a group with a chord callback,
+// ctx is the context the task has been executed with
+func (worker *Worker) taskSucceeded(ctx context.Context, signature *tasks.Signature, taskResults []*tasks.TaskResult) error {
 	// Update task state to SUCCESS
 	if err := worker.server.GetBackend().SetStateSuccess(signature, taskResults); err != nil {
 		return fmt.Errorf("Set state success error: %s", err)
@@ -197,7 +408,7 @@ func (worker *Worker) taskSucceeded(signature *tasks.Signature, taskResults []*t
 			}
 		}
 
-		worker.server.SendTask(successTask)
+		worker.server.SendTaskWithContext(ctx, successTask)
 	}
 
 	// If the task was not part of a group, just return
@@ -267,7 +478,7 @@ func (worker *Worker) taskSucceeded(signature *tasks.Signature, taskResults []*t
 	}
 
 	// Send the chord task
-	_, err = worker.server.SendTask(signature.ChordCallback)
+	_, err = worker.server.SendTaskWithContext(ctx, signature.ChordCallback)
 	if err != nil {
 		return err
 	}
@@ -276,7 +487,7 @@ func (worker *Worker) taskSucceeded(signature *tasks.Signature, taskResults []*t
 }
 
 // taskFailed updates the task state and triggers error callbacks
-func (worker *Worker) taskFailed(signature *tasks.Signature, taskErr error) error {
+func (worker *Worker) taskFailed(ctx context.Context, signature *tasks.Signature, taskErr error) error {
 	// Update task state to FAILURE
 	if err := worker.server.GetBackend().SetStateFailure(signature, taskErr.Error()); err != nil {
 		return fmt.Errorf("Set state failure error: %s", err)
@@ -284,6 +495,12 @@ func (worker *Worker) taskFailed(signature *tasks.Signature, taskErr error) erro
 
 	log.ERROR.Printf("Failed processing %s. Error = %v", signature.UUID, taskErr)
 
+	// Keep the failed task as a dead letter so it can be requeued later
+	deadLetter := tasks.NewDeadLetter(signature, taskErr.Error())
+	if err := worker.server.GetBroker().PublishDeadLetter(deadLetter); err != nil {
+		log.ERROR.Printf("Failed to publish dead letter %s: %s", signature.UUID, err)
+	}
+
 	// Trigger error callbacks
 	for _, errorTask := range signature.OnError {
 		// Pass error as a first argument to error callbacks
@@ -292,12 +509,18 @@ func (worker *Worker) taskFailed(signature *tasks.Signature, taskErr error) erro
 			Value: taskErr.Error(),
 		}}, errorTask.Args...)
 		errorTask.Args = args
-		worker.server.SendTask(errorTask)
+		worker.server.SendTaskWithContext(ctx, errorTask)
 	}
 
 	return nil
 }
 
+// Returns true if the worker uses eager broker
+func (worker *Worker) isEager() bool {
+	_, ok := worker.server.GetBroker().(brokers.EagerMode)
+	return ok
+}
+
 // Returns true if the worker uses AMQP backend
 func (worker *Worker) hasAMQPBackend() bool {
 	_, ok := worker.server.GetBackend().(*backends.AMQPBackend)
@@ -0,0 +1,1195 @@
+package machinery_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Guazi-inc/machinery/v1"
+	"github.com/Guazi-inc/machinery/v1/backends"
+	"github.com/Guazi-inc/machinery/v1/brokers"
+	"github.com/Guazi-inc/machinery/v1/config"
+	"github.com/Guazi-inc/machinery/v1/ratelimit"
+	"github.com/Guazi-inc/machinery/v1/retry"
+	"github.com/Guazi-inc/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProcessTimeout(t *testing.T) {
+	server := getEagerServer(t)
+	err := server.RegisterTaskWithOptions("slow_task", func() error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}, machinery.TaskOptions{Timeout: 10 * time.Millisecond})
+	assert.NoError(t, err)
+
+	// Eager broker processes the task in place, the task ignoring its
+	// context holds the worker until it returns
+	start := time.Now()
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "slow_task"})
+	assert.NoError(t, err)
+	assert.True(t, time.Since(start) >= 100*time.Millisecond)
+
+	state := asyncResult.GetState()
+	assert.Equal(t, tasks.StateFailure, state.State)
+	assert.Equal(t, tasks.ErrTaskTimedOut.Error(), state.Error)
+}
+
+func TestProcessTimeoutRetry(t *testing.T) {
+	server := getEagerServer(t)
+
+	var running, maxRunning, calls int32
+	err := server.RegisterTaskWithOptions("slow_task", func() error {
+		if current := atomic.AddInt32(&running, 1); current > atomic.LoadInt32(&maxRunning) {
+			atomic.StoreInt32(&maxRunning, current)
+		}
+		defer atomic.AddInt32(&running, -1)
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return nil
+	}, machinery.TaskOptions{Timeout: 10 * time.Millisecond})
+	assert.NoError(t, err)
+
+	// The retry is sent only once the timed out task ignoring its context
+	// has returned
+	retryPolicy := &tasks.RetryPolicy{Type: tasks.RetryPolicyFixed, Delay: time.Millisecond}
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "slow_task", RetryCount: 1, RetryPolicy: retryPolicy})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxRunning))
+	assert.Equal(t, tasks.StateSuccess, asyncResult.GetState().State)
+}
+
+func TestProcessSignatureTimeout(t *testing.T) {
+	server := getEagerServer(t)
+	err := server.RegisterTaskWithOptions("slow_task", func() error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}, machinery.TaskOptions{Timeout: 10 * time.Millisecond})
+	assert.NoError(t, err)
+
+	// Signature timeout takes precedence over the registered default
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "slow_task", Timeout: 1})
+	assert.NoError(t, err)
+
+	state := asyncResult.GetState()
+	assert.Equal(t, tasks.StateSuccess, state.State)
+}
+
+func TestProcessRevokedPending(t *testing.T) {
+	server := getEagerServer(t)
+	called := false
+	err := server.RegisterTask("test_task", func() error {
+		called = true
+		return nil
+	})
+	assert.NoError(t, err)
+
+	assert.NoError(t, server.RevokeTask("revoked_task"))
+
+	asyncResult, err := server.SendTask(&tasks.Signature{UUID: "revoked_task", Name: "test_task"})
+	assert.NoError(t, err)
+
+	assert.False(t, called)
+	assert.Equal(t, tasks.StateRevoked, asyncResult.GetState().State)
+
+	_, err = asyncResult.Touch()
+	assert.Equal(t, tasks.ErrTaskRevoked, err)
+}
+
+func TestProcessRevokedRunning(t *testing.T) {
+	server := getEagerServer(t)
+	started := make(chan struct{})
+	err := server.RegisterTask("blocking_task", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.NoError(t, err)
+
+	sent := make(chan error)
+	go func() {
+		_, err := server.SendTask(&tasks.Signature{UUID: "running_task", Name: "blocking_task", RetryCount: 3})
+		sent <- err
+	}()
+
+	<-started
+	assert.NoError(t, server.RevokeTask("running_task"))
+
+	select {
+	case err := <-sent:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Revoked task has not been cancelled")
+	}
+
+	state, err := server.GetBackend().GetState("running_task")
+	if assert.NoError(t, err) {
+		assert.Equal(t, tasks.StateRevoked, state.State)
+	}
+}
+
+func TestProcessRevokedRunningMany(t *testing.T) {
+	server := getEagerServer(t)
+	started := make(chan struct{}, 2)
+	err := server.RegisterTask("blocking_task", func(ctx context.Context, d int) error {
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(d) * time.Millisecond):
+			return nil
+		}
+	})
+	assert.NoError(t, err)
+
+	// Only the revoked one of the tasks running at once gets cancelled
+	sent := make(chan error, 2)
+	for _, uuid := range []string{"revoked_task", "running_task"} {
+		go func(uuid string) {
+			_, err := server.SendTask(&tasks.Signature{
+				UUID: uuid,
+				Name: "blocking_task",
+				Args: []tasks.Arg{{Type: "int", Value: 2500}},
+			})
+			sent <- err
+		}(uuid)
+	}
+
+	<-started
+	<-started
+	assert.NoError(t, server.RevokeTask("revoked_task"))
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-sent:
+			assert.NoError(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Tasks have not returned")
+		}
+	}
+
+	state, err := server.GetBackend().GetState("revoked_task")
+	if assert.NoError(t, err) {
+		assert.Equal(t, tasks.StateRevoked, state.State)
+	}
+	state, err = server.GetBackend().GetState("running_task")
+	if assert.NoError(t, err) {
+		assert.Equal(t, tasks.StateSuccess, state.State)
+	}
+}
+
+type testPayload struct {
+	Name  string
+	Sizes map[string]int
+}
+
+func TestProcessCompositeArgs(t *testing.T) {
+	server := getEagerServer(t)
+	assert.NoError(t, tasks.RegisterType("machinery_test.testPayload", testPayload{}))
+
+	err := server.RegisterTask("composite_task", func(payloads []testPayload, data []byte) ([]string, error) {
+		names := make([]string, 0, len(payloads))
+		for _, payload := range payloads {
+			names = append(names, payload.Name+":"+string(data))
+		}
+		return names, nil
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Name: "composite_task",
+		Args: []tasks.Arg{
+			{Type: "[]machinery_test.testPayload", Value: []testPayload{{Name: "a"}, {Name: "b", Sizes: map[string]int{"x": 1}}}},
+			{Type: "[]byte", Value: []byte("data")},
+		},
+	})
+	assert.NoError(t, err)
+
+	results, err := asyncResult.Touch()
+	if assert.NoError(t, err) && assert.Len(t, results, 1) {
+		assert.Equal(t, []string{"a:data", "b:data"}, results[0].Interface())
+	}
+
+	_, err = server.SendTask(&tasks.Signature{
+		Name: "composite_task",
+		Args: []tasks.Arg{{Type: "[]unknown", Value: nil}},
+	})
+	assert.Equal(t, tasks.NewErrUnsupportedType("[]unknown"), err)
+}
+
+func TestProcessSignatureInContext(t *testing.T) {
+	server := getEagerServer(t)
+
+	var received []*tasks.Signature
+	err := server.RegisterTask("context_task", func(ctx context.Context) error {
+		signature := tasks.SignatureFromContext(ctx)
+		received = append(received, signature)
+		if signature.RetryAttempt == 0 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Name:       "context_task",
+		RetryCount: 1,
+		Headers:    tasks.Headers{"correlation_id": "42"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, tasks.StateSuccess, asyncResult.GetState().State)
+
+	// The retry attempt sees its own retry count
+	if assert.Len(t, received, 2) {
+		for i, signature := range received {
+			assert.Equal(t, asyncResult.Signature.UUID, signature.UUID)
+			assert.Equal(t, "42", signature.Headers["correlation_id"])
+			assert.Equal(t, i, signature.RetryAttempt)
+		}
+	}
+}
+
+func TestProcessProgress(t *testing.T) {
+	server := getEagerServer(t)
+
+	var progress *tasks.Progress
+	err := server.RegisterTask("progress_task", func(ctx context.Context) error {
+		if err := tasks.ReportProgress(ctx, 40, map[string]interface{}{"stage": "upload"}); err != nil {
+			return err
+		}
+		signature := tasks.SignatureFromContext(ctx)
+		progress = backends.NewAsyncResult(signature, server.GetBackend()).GetProgress()
+		return nil
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "progress_task"})
+	assert.NoError(t, err)
+
+	if assert.NotNil(t, progress) {
+		assert.Equal(t, float64(40), progress.Percent)
+		assert.Equal(t, "upload", progress.Metadata["stage"])
+	}
+
+	// Progress is gone once the task completes
+	assert.Equal(t, tasks.StateSuccess, asyncResult.GetState().State)
+	assert.Nil(t, asyncResult.GetProgress())
+}
+
+func TestProcessRetryPolicy(t *testing.T) {
+	server := getEagerServer(t)
+
+	calls := 0
+	err := server.RegisterTaskWithOptions("failing_task", func() error {
+		calls++
+		return errors.New("failed")
+	}, machinery.TaskOptions{
+		RetryPolicy: retry.PolicyFunc(func(attempt int) time.Duration {
+			return time.Duration(attempt) * time.Millisecond
+		}),
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "failing_task", RetryCount: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	assert.Equal(t, tasks.StateFailure, asyncResult.GetState().State)
+
+	// Signature retry policy must be valid
+	_, err = server.SendTask(&tasks.Signature{
+		Name:        "failing_task",
+		RetryCount:  1,
+		RetryPolicy: &tasks.RetryPolicy{Type: "unknown"},
+	})
+	assert.Error(t, err)
+}
+
+func TestProcessNonRetryable(t *testing.T) {
+	server := getEagerServer(t)
+
+	calls := 0
+	err := server.RegisterTask("permanent_task", func() error {
+		calls++
+		return tasks.NewErrNonRetryable(errors.New("invalid input"))
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "permanent_task", RetryCount: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, calls)
+
+	state := asyncResult.GetState()
+	assert.Equal(t, tasks.StateFailure, state.State)
+	assert.Equal(t, "invalid input", state.Error)
+}
+
+func TestProcessRetryTaskLater(t *testing.T) {
+	server := getEagerServer(t)
+
+	calls := 0
+	err := server.RegisterTask("later_task", func() error {
+		calls++
+		if calls == 1 {
+			return tasks.NewErrRetryTaskLater("not yet", time.Millisecond)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// Retried even without retry attempts
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "later_task"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, tasks.StateSuccess, asyncResult.GetState().State)
+}
+
+func TestProcessRetryTaskLaterLimit(t *testing.T) {
+	server := getEagerServer(t)
+
+	calls := 0
+	err := server.RegisterTaskWithOptions("later_task", func() error {
+		calls++
+		return tasks.NewErrRetryTaskLater("not yet", time.Millisecond)
+	}, machinery.TaskOptions{MaxRetryLater: 3})
+	assert.NoError(t, err)
+
+	// Task which keeps asking to be retried fails after the last retry
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "later_task"})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, calls)
+	assert.Equal(t, tasks.StateFailure, asyncResult.GetState().State)
+}
+
+func TestProcessRetryTaskLaterWrapped(t *testing.T) {
+	server := getEagerServer(t)
+
+	calls := 0
+	err := server.RegisterTask("later_task", func() error {
+		calls++
+		if calls == 1 {
+			retryLater := tasks.NewErrRetryTaskLater("not yet", time.Millisecond)
+			var err error = &retryLater
+			return fmt.Errorf("throttled: %w", err)
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "later_task"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, tasks.StateSuccess, asyncResult.GetState().State)
+}
+
+func TestProcessRetryTaskLaterKeepsRetries(t *testing.T) {
+	server := getEagerServer(t)
+
+	var retryAttempts, retryLaterAttempts []int
+	err := server.RegisterTask("later_task", func(ctx context.Context) error {
+		signature := tasks.SignatureFromContext(ctx)
+		retryAttempts = append(retryAttempts, signature.RetryAttempt)
+		retryLaterAttempts = append(retryLaterAttempts, signature.RetryLaterAttempt)
+		if len(retryAttempts) <= 2 {
+			return tasks.NewErrRetryTaskLater("not yet", time.Millisecond)
+		}
+		return errors.New("broken")
+	})
+	assert.NoError(t, err)
+
+	// Retries later neither use up RetryCount nor count as ordinary retries
+	retryPolicy := &tasks.RetryPolicy{Type: tasks.RetryPolicyFixed, Delay: time.Millisecond}
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "later_task", RetryCount: 1, RetryPolicy: retryPolicy})
+	assert.NoError(t, err)
+	assert.Equal(t, []int{0, 0, 0, 1}, retryAttempts)
+	assert.Equal(t, []int{0, 1, 2, 2}, retryLaterAttempts)
+	assert.Equal(t, tasks.StateFailure, asyncResult.GetState().State)
+}
+
+func TestProcessDeadLetter(t *testing.T) {
+	server := getEagerServer(t)
+
+	fail, calls := true, 0
+	err := server.RegisterTask("flaky_task", func() error {
+		calls++
+		if fail {
+			return errors.New("still broken")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	retryPolicy := &tasks.RetryPolicy{Type: tasks.RetryPolicyFixed, Delay: time.Millisecond}
+	asyncResult, err := server.SendTask(&tasks.Signature{Name: "flaky_task", RetryCount: 2, RetryPolicy: retryPolicy})
+	assert.NoError(t, err)
+	assert.Equal(t, tasks.StateFailure, asyncResult.GetState().State)
+
+	deadLetters, err := server.GetDeadLetters("", 0, -1)
+	assert.NoError(t, err)
+	if assert.Len(t, deadLetters, 1) {
+		deadLetter := deadLetters[0]
+		assert.Equal(t, asyncResult.Signature.UUID, deadLetter.Signature.UUID)
+		assert.Equal(t, "still broken", deadLetter.Error)
+		assert.Equal(t, 3, deadLetter.Attempts)
+		assert.NotNil(t, deadLetter.CreatedAt)
+		assert.False(t, deadLetter.FailedAt.IsZero())
+	}
+
+	// Requeued task gets its retry attempts again
+	calls = 0
+	_, err = server.RequeueDeadLetter("", asyncResult.Signature.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+	deadLetters, err = server.GetDeadLetters("", 0, -1)
+	assert.NoError(t, err)
+	if assert.Len(t, deadLetters, 1) {
+		assert.Equal(t, 3, deadLetters[0].Attempts)
+	}
+
+	// Requeued task runs again with the same UUID
+	fail = false
+	requeued, err := server.RequeueDeadLetter("", asyncResult.Signature.UUID)
+	assert.NoError(t, err)
+	assert.Equal(t, asyncResult.Signature.UUID, requeued.Signature.UUID)
+	assert.Equal(t, tasks.StateSuccess, requeued.GetState().State)
+
+	deadLetter, err := server.GetDeadLetter("", asyncResult.Signature.UUID)
+	assert.NoError(t, err)
+	assert.Nil(t, deadLetter)
+
+	_, err = server.RequeueDeadLetter("", asyncResult.Signature.UUID)
+	assert.Error(t, err)
+}
+
+func TestProcessRateLimit(t *testing.T) {
+	server := getEagerServer(t)
+
+	calls := 0
+	err := server.RegisterTaskWithOptions("limited_task", func() error {
+		calls++
+		return nil
+	}, machinery.TaskOptions{RateLimit: ratelimit.Limit{Rate: 20, Per: time.Second, Burst: 1}})
+	assert.NoError(t, err)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		asyncResult, err := server.SendTask(&tasks.Signature{Name: "limited_task"})
+		assert.NoError(t, err)
+		assert.Equal(t, tasks.StateSuccess, asyncResult.GetState().State)
+	}
+
+	// Tasks over the limit waited for their turn instead of failing
+	assert.Equal(t, 3, calls)
+	assert.True(t, time.Since(start) >= 90*time.Millisecond)
+}
+
+func TestProcessConcurrencyLimit(t *testing.T) {
+	server := getEagerServer(t)
+
+	var running, maxRunning int32
+	err := server.RegisterTaskWithOptions("exclusive_task", func() error {
+		current := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if current <= max || atomic.CompareAndSwapInt32(&maxRunning, max, current) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		return nil
+	}, machinery.TaskOptions{Concurrency: 1, GlobalConcurrency: 2})
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			asyncResult, err := server.SendTask(&tasks.Signature{Name: "exclusive_task"})
+			assert.NoError(t, err)
+			assert.Equal(t, tasks.StateSuccess, asyncResult.GetState().State)
+		}()
+	}
+	wg.Wait()
+
+	// Tasks over the limit waited for a free slot
+	assert.Equal(t, int32(1), maxRunning)
+}
+
+func TestProcessConcurrencyLimitRetry(t *testing.T) {
+	server := getEagerServer(t)
+
+	calls := 0
+	err := server.RegisterTaskWithOptions("exclusive_task", func() error {
+		calls++
+		if calls == 1 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	}, machinery.TaskOptions{Concurrency: 1})
+	assert.NoError(t, err)
+
+	// Eager broker processes the retry and the callback in place, the task
+	// has released its slot by then
+	signature := &tasks.Signature{
+		Name:        "exclusive_task",
+		RetryCount:  1,
+		RetryPolicy: &tasks.RetryPolicy{Type: tasks.RetryPolicyFixed, Delay: time.Millisecond},
+		OnSuccess:   []*tasks.Signature{{Name: "exclusive_task", Immutable: true}},
+	}
+	sent := make(chan error)
+	go func() {
+		_, err := server.SendTask(signature)
+		sent <- err
+	}()
+
+	select {
+	case err := <-sent:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Retried task waits for its own slot")
+	}
+	assert.Equal(t, 3, calls)
+}
+
+func TestProcessUnique(t *testing.T) {
+	server := getEagerServer(t)
+
+	started := make(chan struct{}, 1)
+	finish := make(chan struct{})
+	calls := int32(0)
+	err := server.RegisterTask("rebuild_index", func(index string, block bool) error {
+		atomic.AddInt32(&calls, 1)
+		if block {
+			started <- struct{}{}
+			<-finish
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	signature := func(index string, block bool, mode string) *tasks.Signature {
+		return &tasks.Signature{
+			Name: "rebuild_index",
+			Args: []tasks.Arg{
+				{Type: "string", Value: index},
+				{Type: "bool", Value: block},
+			},
+			Unique: &tasks.Unique{Args: []int{0}, Mode: mode},
+		}
+	}
+
+	// Keep the first task running
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := server.SendTask(signature("users", true, ""))
+		assert.NoError(t, err)
+	}()
+	<-started
+
+	// Skipped duplicate is revoked without running or triggering its
+	// callbacks
+	skipped := signature("users", false, tasks.UniqueSkip)
+	skipped.OnSuccess = []*tasks.Signature{signature("orders", false, "")}
+	asyncResult, err := server.SendTask(skipped)
+	assert.NoError(t, err)
+	assert.Equal(t, tasks.StateRevoked, asyncResult.GetState().State)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// Failed duplicate fails without running
+	asyncResult, err = server.SendTask(signature("users", false, tasks.UniqueFail))
+	assert.NoError(t, err)
+	assert.Equal(t, tasks.StateFailure, asyncResult.GetState().State)
+	assert.Equal(t, tasks.ErrTaskLocked.Error(), asyncResult.GetState().Error)
+
+	// Tasks with other keys are not locked
+	asyncResult, err = server.SendTask(signature("orders", false, tasks.UniqueFail))
+	assert.NoError(t, err)
+	assert.Equal(t, tasks.StateSuccess, asyncResult.GetState().State)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// Delayed duplicate runs once the first task has finished
+	delayed := make(chan struct{})
+	go func() {
+		defer close(delayed)
+		asyncResult, err := server.SendTask(signature("users", false, tasks.UniqueDelay))
+		assert.NoError(t, err)
+		assert.Equal(t, tasks.StateSuccess, asyncResult.GetState().State)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	close(finish)
+	<-done
+	<-delayed
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// Invalid arg indexes are refused when sending
+	invalid := signature("users", false, "")
+	invalid.Unique.Args = []int{5}
+	_, err = server.SendTask(invalid)
+	assert.Error(t, err)
+}
+
+func TestProcessUniqueRetry(t *testing.T) {
+	server := getEagerServer(t)
+
+	calls := 0
+	err := server.RegisterTask("rebuild_index", func() error {
+		calls++
+		if calls == 1 {
+			return errors.New("temporary failure")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// Eager broker processes the retry in place, the task has released its
+	// lock by then so the retry is not taken for a duplicate
+	signature := &tasks.Signature{
+		Name:        "rebuild_index",
+		RetryCount:  1,
+		RetryPolicy: &tasks.RetryPolicy{Type: tasks.RetryPolicyFixed, Delay: time.Millisecond},
+		Unique:      &tasks.Unique{Mode: tasks.UniqueDelay},
+	}
+	sent := make(chan error)
+	go func() {
+		_, err := server.SendTask(signature)
+		sent <- err
+	}()
+
+	select {
+	case err := <-sent:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Retried task waits for its own lock")
+	}
+	assert.Equal(t, 2, calls)
+	taskState, err := server.GetBackend().GetState(signature.UUID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tasks.StateSuccess, taskState.State)
+	}
+}
+
+func TestProcessUniqueLockError(t *testing.T) {
+	// Nothing listens on the port, the lock cannot be taken
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "redis://127.0.0.1:1",
+		DefaultQueue:  "machinery_tasks",
+		ResultBackend: "eager",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	calls := 0
+	err = server.RegisterTask("rebuild_index", func() error {
+		calls++
+		return nil
+	})
+	assert.NoError(t, err)
+
+	signature := &tasks.Signature{UUID: "rebuild_users", Name: "rebuild_index", Unique: &tasks.Unique{}}
+	assert.NoError(t, server.GetBackend().SetStatePending(signature))
+
+	// The task is neither run nor skipped, the error is returned so that
+	// the task is tried again
+	assert.Error(t, server.NewWorker("test_worker", 0).Process(signature))
+	assert.Equal(t, 0, calls)
+	taskState, err := server.GetBackend().GetState(signature.UUID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tasks.StatePending, taskState.State)
+	}
+}
+
+func getEagerServer(t *testing.T) *machinery.Server {
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "eager",
+		DefaultQueue:  "machinery_tasks",
+		ResultBackend: "eager",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+type middlewareCtxKey struct{}
+
+func TestProcessMiddleware(t *testing.T) {
+	server := getEagerServer(t)
+
+	var calls []string
+	logMiddleware := func(name string) machinery.Middleware {
+		return machinery.Middleware{
+			BeforePublish: func(ctx context.Context, signature *tasks.Signature) error {
+				calls = append(calls, name+" publish")
+				return nil
+			},
+			BeforeExecute: func(ctx context.Context, signature *tasks.Signature) (context.Context, error) {
+				calls = append(calls, name+" before")
+				return context.WithValue(ctx, middlewareCtxKey{}, name), nil
+			},
+			AfterSuccess: func(ctx context.Context, signature *tasks.Signature, results []*tasks.TaskResult) {
+				calls = append(calls, name+" success "+ctx.Value(middlewareCtxKey{}).(string))
+			},
+			AfterFailure: func(ctx context.Context, signature *tasks.Signature, err error) {
+				calls = append(calls, name+" failure "+err.Error())
+			},
+			OnRetry: func(ctx context.Context, signature *tasks.Signature, err error, retryIn time.Duration) {
+				calls = append(calls, name+" retry "+err.Error())
+			},
+		}
+	}
+	server.Use(logMiddleware("first"), logMiddleware("second"))
+
+	// Middlewares may modify the signature and short-circuit execution
+	server.Use(machinery.Middleware{
+		BeforePublish: func(ctx context.Context, signature *tasks.Signature) error {
+			if signature.Headers["token"] == nil {
+				return errors.New("unauthorized")
+			}
+			return nil
+		},
+		BeforeExecute: func(ctx context.Context, signature *tasks.Signature) (context.Context, error) {
+			if signature.Headers["token"] != "secret" {
+				return nil, tasks.NewErrNonRetryable(errors.New("forbidden"))
+			}
+			// Retry attempts are sent with the modified signature
+			if len(signature.Args) == 0 {
+				signature.Args = append(signature.Args, tasks.Arg{Type: "string", Value: "checked"})
+			}
+			return nil, nil
+		},
+	})
+
+	attempts := 0
+	err := server.RegisterTask("middleware_task", func(ctx context.Context, arg string) (string, error) {
+		calls = append(calls, "task "+ctx.Value(middlewareCtxKey{}).(string))
+		attempts++
+		if attempts == 1 {
+			return "", errors.New("failed")
+		}
+		return arg, nil
+	})
+	assert.NoError(t, err)
+
+	_, err = server.SendTask(&tasks.Signature{Name: "middleware_task"})
+	assert.EqualError(t, err, "unauthorized")
+	assert.Equal(t, []string{"first publish", "second publish"}, calls)
+
+	calls = nil
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Name:       "middleware_task",
+		Headers:    tasks.Headers{"token": "secret"},
+		RetryCount: 1,
+	})
+	assert.NoError(t, err)
+	results, err := asyncResult.Get(time.Millisecond)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "checked", results[0].String())
+	}
+	assert.Equal(t, []string{
+		"first publish", "second publish",
+		"first before", "second before", "task second",
+		"second retry failed", "first retry failed",
+		"first publish", "second publish",
+		"first before", "second before", "task second",
+		"second success second", "first success second",
+	}, calls)
+
+	// Only middlewares which have let the task through observe its failure
+	calls = nil
+	asyncResult, err = server.SendTask(&tasks.Signature{
+		Name:    "middleware_task",
+		Headers: tasks.Headers{"token": "wrong"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, tasks.StateFailure, asyncResult.GetState().State)
+	assert.Equal(t, []string{
+		"first publish", "second publish",
+		"first before", "second before",
+		"second failure forbidden", "first failure forbidden",
+	}, calls)
+}
+
+// startedErrorBackend fails to set the STARTED state
+type startedErrorBackend struct {
+	backends.Interface
+}
+
+func (backend startedErrorBackend) SetStateStarted(signature *tasks.Signature) error {
+	return errors.New("backend unavailable")
+}
+
+func TestProcessMiddlewareSetStateStartedError(t *testing.T) {
+	server := getEagerServer(t)
+	server.SetBackend(startedErrorBackend{server.GetBackend()})
+
+	calls := 0
+	err := server.RegisterTask("task", func() error {
+		calls++
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// After hooks are called for a task whose execution has been started
+	// by the middleware, e.g. to end its span
+	var failure error
+	server.Use(machinery.Middleware{
+		AfterFailure: func(ctx context.Context, signature *tasks.Signature, err error) {
+			failure = err
+		},
+	})
+
+	_, err = server.SendTask(&tasks.Signature{Name: "task"})
+	assert.Error(t, err)
+	assert.Equal(t, 0, calls)
+	assert.Error(t, failure)
+}
+
+func TestHealthHandler(t *testing.T) {
+	server := getEagerServer(t)
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	err := server.RegisterTask("blocking_task", func() error {
+		close(started)
+		<-finish
+		return nil
+	})
+	assert.NoError(t, err)
+
+	worker := server.NewWorker("health_worker", 1)
+	handler := httptest.NewServer(worker.HealthHandler())
+	defer handler.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- worker.Process(&tasks.Signature{UUID: "health_task", Name: "blocking_task"})
+	}()
+	<-started
+
+	// The worker has not been launched so it is neither alive nor ready
+	resp, err := http.Get(handler.URL + "/healthz")
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	resp, err = http.Get(handler.URL + "/status")
+	assert.NoError(t, err)
+	status := new(machinery.WorkerStatus)
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(status))
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	assert.Equal(t, "health_worker", status.ConsumerTag)
+	assert.False(t, status.Alive)
+	assert.False(t, status.Ready)
+	assert.Empty(t, status.BrokerError)
+	assert.Equal(t, []string{"machinery_tasks"}, status.Queues)
+	assert.Equal(t, []string{"blocking_task"}, status.RegisteredTasks)
+	if assert.Len(t, status.InFlightTasks, 1) {
+		assert.Equal(t, "health_task", status.InFlightTasks[0].UUID)
+		assert.Equal(t, "blocking_task", status.InFlightTasks[0].Name)
+	}
+
+	close(finish)
+	assert.NoError(t, <-done)
+	assert.Empty(t, worker.Status().InFlightTasks)
+}
+
+// consumingBroker blocks in StartConsuming until StopConsuming is called, so
+// a worker can be launched in tests. Concurrency is passed to started.
+type consumingBroker struct {
+	brokers.Interface
+	started chan int
+	stop    chan struct{}
+}
+
+func newConsumingBroker(server *machinery.Server) *consumingBroker {
+	return &consumingBroker{
+		Interface: server.GetBroker(),
+		started:   make(chan int, 10),
+		stop:      make(chan struct{}),
+	}
+}
+
+func (b *consumingBroker) StartConsuming(consumerTag string, concurrency int, p brokers.TaskProcessor) (bool, error) {
+	b.started <- concurrency
+	<-b.stop
+	return false, nil
+}
+
+func (b *consumingBroker) StopConsuming() {
+	b.stop <- struct{}{}
+}
+
+// AssignWorker keeps the wrapped eager broker in eager mode, so state shared
+// by workers is kept in memory
+func (b *consumingBroker) AssignWorker(p brokers.TaskProcessor) {
+	b.Interface.(brokers.EagerMode).AssignWorker(p)
+}
+
+// reconnectingBroker fails StartConsuming with errors sent to fail and tells
+// the consumer is connected while it is consuming
+type reconnectingBroker struct {
+	*consumingBroker
+	fail      chan error
+	connected int32
+}
+
+func (b *reconnectingBroker) StartConsuming(consumerTag string, concurrency int, p brokers.TaskProcessor) (bool, error) {
+	if err := <-b.fail; err != nil {
+		return true, err
+	}
+	atomic.StoreInt32(&b.connected, 1)
+	defer atomic.StoreInt32(&b.connected, 0)
+	return b.consumingBroker.StartConsuming(consumerTag, concurrency, p)
+}
+
+func (b *reconnectingBroker) IsConsumerConnected() bool {
+	return atomic.LoadInt32(&b.connected) == 1
+}
+
+func TestHealthReconnecting(t *testing.T) {
+	server := getEagerServer(t)
+	broker := &reconnectingBroker{consumingBroker: newConsumingBroker(server), fail: make(chan error)}
+	server.SetBroker(broker)
+
+	worker := server.NewWorker("reconnecting_worker", 1)
+	errorsChan := make(chan error, 1)
+	worker.LaunchAsync(errorsChan)
+
+	// Neither alive nor ready while reconnecting after consuming has failed
+	broker.fail <- errors.New("connection refused")
+	status := worker.Status()
+	for i := 0; i < 100 && status.LastConsumeError == ""; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = worker.Status()
+	}
+	assert.Equal(t, "connection refused", status.LastConsumeError)
+	assert.False(t, status.Alive)
+	assert.False(t, status.Ready)
+	assert.NotEmpty(t, status.BrokerError)
+
+	// Alive and ready again once the consumer has connected
+	broker.fail <- nil
+	assert.Equal(t, 1, <-broker.started)
+	status = worker.Status()
+	assert.True(t, status.Alive)
+	assert.True(t, status.Ready)
+	assert.Empty(t, status.BrokerError)
+
+	worker.Quit()
+	assert.NoError(t, <-errorsChan)
+}
+
+func TestListWorkers(t *testing.T) {
+	server := getEagerServer(t)
+	server.SetBroker(newConsumingBroker(server))
+	err := server.RegisterTask("test_task", func() error { return nil })
+	assert.NoError(t, err)
+
+	workers, err := server.ListWorkers()
+	assert.NoError(t, err)
+	assert.Empty(t, workers)
+
+	worker := server.NewWorker("listed_worker", 2)
+	errorsChan := make(chan error, 1)
+	worker.LaunchAsync(errorsChan)
+
+	// The first heartbeat is written right after launching
+	for i := 0; i < 100 && len(workers) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+		workers, err = server.ListWorkers()
+		assert.NoError(t, err)
+	}
+	if assert.Len(t, workers, 1) {
+		assert.Equal(t, worker.ID(), workers[0].ID)
+		assert.Equal(t, "listed_worker", workers[0].ConsumerTag)
+		assert.Equal(t, os.Getpid(), workers[0].PID)
+		assert.Equal(t, 2, workers[0].Concurrency)
+		assert.Equal(t, []string{"machinery_tasks"}, workers[0].Queues)
+		assert.Equal(t, []string{"test_task"}, workers[0].RegisteredTasks)
+		assert.Empty(t, workers[0].InFlightTasks)
+	}
+
+	// The worker is listed no more once it has quit
+	worker.Quit()
+	assert.NoError(t, <-errorsChan)
+
+	workers, err = server.ListWorkers()
+	assert.NoError(t, err)
+	assert.Empty(t, workers)
+}
+
+func TestControlWorkers(t *testing.T) {
+	server := getEagerServer(t)
+	broker := newConsumingBroker(server)
+	server.SetBroker(broker)
+
+	worker := server.NewWorker("controlled_worker", 2)
+	errorsChan := make(chan error, 1)
+	worker.LaunchAsync(errorsChan)
+	assert.Equal(t, 2, <-broker.started)
+
+	// Wait for the worker to be listed so replies are not waited for longer
+	// than necessary
+	for i := 0; i < 100; i++ {
+		if workers, _ := server.ListWorkers(); len(workers) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	replies, err := server.PingWorkers(time.Second)
+	assert.NoError(t, err)
+	if assert.Len(t, replies, 1) {
+		assert.Equal(t, worker.ID(), replies[0].WorkerID)
+		assert.Empty(t, replies[0].Error)
+	}
+
+	// Commands for other workers are ignored
+	replies, err = server.PauseWorkers(50*time.Millisecond, "other_worker")
+	assert.NoError(t, err)
+	assert.Empty(t, replies)
+	assert.False(t, worker.IsPaused())
+
+	replies, err = server.PauseWorkers(time.Second, worker.ID())
+	assert.NoError(t, err)
+	assert.Len(t, replies, 1)
+	assert.True(t, worker.IsPaused())
+	assert.True(t, worker.Status().Paused)
+
+	// Paused worker starts consuming with the new concurrency once resumed
+	replies, err = server.SetWorkersConcurrency(5, time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, replies, 1)
+
+	replies, err = server.ResumeWorkers(time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, replies, 1)
+	assert.False(t, worker.IsPaused())
+	assert.Equal(t, 5, <-broker.started)
+
+	// Running worker is restarted with the new concurrency
+	replies, err = server.SetWorkersConcurrency(3, time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, replies, 1)
+	assert.Equal(t, 3, <-broker.started)
+
+	replies, err = server.Control(&machinery.ControlCommand{Name: "unknown"}, time.Second)
+	assert.NoError(t, err)
+	if assert.Len(t, replies, 1) {
+		assert.Equal(t, "Unknown control command unknown", replies[0].Error)
+	}
+
+	replies, err = server.ShutdownWorkers(time.Second)
+	assert.NoError(t, err)
+	assert.Len(t, replies, 1)
+	assert.NoError(t, <-errorsChan)
+
+	workers, err := server.ListWorkers()
+	assert.NoError(t, err)
+	assert.Empty(t, workers)
+}
+
+func TestControlWorkersRedis(t *testing.T) {
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		return
+	}
+
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "redis://" + redisURL,
+		DefaultQueue:  "test_control_queue",
+		ResultBackend: "redis://" + redisURL,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	testControlWorkers(t, server)
+}
+
+func TestControlWorkersAMQP(t *testing.T) {
+	amqpURL := os.Getenv("AMQP_URL")
+	if amqpURL == "" {
+		return
+	}
+
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        amqpURL,
+		DefaultQueue:  "test_control_queue",
+		ResultBackend: amqpURL,
+		AMQP: &config.AMQPConfig{
+			Exchange:      "test_control_exchange",
+			ExchangeType:  "direct",
+			BindingKey:    "test_control_task",
+			PrefetchCount: 1,
+		},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	testControlWorkers(t, server)
+}
+
+// testControlWorkers pauses, resumes and shuts down a worker consuming from
+// the broker of the server
+func testControlWorkers(t *testing.T, server *machinery.Server) {
+	worker := server.NewWorker("remote_worker", 1)
+	errorsChan := make(chan error, 1)
+	worker.LaunchAsync(errorsChan)
+
+	// Commands broadcast before the worker has subscribed are missed
+	var replies []*machinery.ControlReply
+	for i := 0; i < 50 && len(replies) == 0; i++ {
+		var err error
+		replies, err = server.PingWorkers(100*time.Millisecond, worker.ID())
+		assert.NoError(t, err)
+	}
+	assert.Len(t, replies, 1)
+
+	replies, err := server.PauseWorkers(5*time.Second, worker.ID())
+	assert.NoError(t, err)
+	assert.Len(t, replies, 1)
+	assert.True(t, worker.IsPaused())
+
+	// The broker is used by the paused worker while it is not consuming
+	replies, err = server.ResumeWorkers(5*time.Second, worker.ID())
+	assert.NoError(t, err)
+	assert.Len(t, replies, 1)
+	assert.False(t, worker.IsPaused())
+
+	replies, err = server.ShutdownWorkers(5*time.Second, worker.ID())
+	assert.NoError(t, err)
+	assert.Len(t, replies, 1)
+	assert.NoError(t, <-errorsChan)
+}
+
+func TestQuitPausedWorker(t *testing.T) {
+	server := getEagerServer(t)
+	broker := newConsumingBroker(server)
+	server.SetBroker(broker)
+
+	worker := server.NewWorker("paused_worker", 1)
+	errorsChan := make(chan error, 1)
+	worker.LaunchAsync(errorsChan)
+	<-broker.started
+
+	assert.NoError(t, worker.Pause())
+	worker.Quit()
+	assert.NoError(t, <-errorsChan)
+	assert.Error(t, worker.Pause())
+}